@@ -98,12 +98,12 @@ func SockRead(con net.Conn, buf []byte) (n int, e error) {
 }
 
 
-// Send all the bytes, but respect the upload limit (force delays)
-func SockWrite(con net.Conn, buf []byte) (n int, e error) {
+// Send all the bytes, but respect the upload limit (force delays), unless nolimit is set
+func SockWrite(con net.Conn, buf []byte, nolimit bool) (n int, e error) {
 	var tosend int
 	bw_mutex.Lock()
 	TickSent()
-	if UploadLimit==0 {
+	if UploadLimit==0 || nolimit {
 		tosend = len(buf)
 	} else {
 		tosend = int(UploadLimit) - ul_bytes_so_far
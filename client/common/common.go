@@ -13,12 +13,28 @@ import (
 const (
 	ConfigFile = "gocoin.conf"
 
-	Version = uint32(70012)
+	Version = uint32(70016)
 	DefaultUserAgent = "/Gocoin:"+lib.Version+"/"
-	Services = uint64(0x00000001)
+
+	SERVICE_NETWORK = uint64(0x00000001)
+	SERVICE_BLOOM = uint64(0x00000004)
+	SERVICE_COMPACT_FILTERS = uint64(0x00000040)
+	SERVICE_P2P_V2 = uint64(0x00000800)
+	SERVICE_DANDELION = uint64(0x01000000) // we relay MSG_DANDELION_TX (bits 24-31 are for experiments)
+
+	// Permissions of whitelisted peers (Net.Whitelist)
+	PERM_NOBAN = 1<<0 // never ban nor drop the peer
+	PERM_FORCERELAY = 1<<1 // route its txs, even if they do not meet TXRoute policy
+	PERM_RELAY = 1<<2 // accept its txs, even if TXPool is disabled
+	PERM_DOWNLOAD = 1<<3 // not subject to the upload limit
+	PERM_BYPASS = 1<<4 // accept its connection, even if we have MaxInCons already
+	PERM_MEMPOOL = 1<<5 // answer its "mempool" requests (BIP35)
+	PERM_ALL = PERM_NOBAN|PERM_FORCERELAY|PERM_RELAY|PERM_DOWNLOAD|PERM_BYPASS|PERM_MEMPOOL
 )
 
 var (
+	Services uint64 = SERVICE_NETWORK // what we advertise in version and addr messages
+
 	BlockChain *chain.Chain
 	GenesisBlock *btc.Uint256
 	Magic [4]byte
@@ -2,16 +2,18 @@ package common
 
 import (
 	"os"
-	"fmt"
 	"flag"
 	"sync"
 	"time"
+	"net"
 	"strings"
 	"io/ioutil"
 	"sync/atomic"
 	"runtime/debug"
 	"encoding/json"
+	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
 
 var (
@@ -48,9 +50,21 @@ var (
 			TCPPort uint16
 			MaxOutCons uint32
 			MaxInCons uint32
+			MaxBlockOnlyCons uint32 // Outgoing connections that only relay blocks (not txs nor addresses)
 			MaxUpKBps uint
 			MaxDownKBps uint
 			MaxBlockAtOnce uint32
+			CompactBlocks bool // Use BIP152 compact blocks for relaying new blocks
+			BloomFilters bool // Serve bloom filtered txs and blocks to SPV clients (BIP37)
+			BlockFilters bool // Build compact block filters index and serve it to peers (BIP157/158)
+			V2Transport bool // Use BIP324 encrypted transport with peers that support it
+			Proxy string // SOCKS5 proxy (e.g. Tor at "127.0.0.1:9050") for outgoing connections
+			ProxyOnlyOnion bool // Use the proxy only for .onion peers and connect to the others directly
+			ProxyIsolate bool // Use random credentials for each connection (stream isolation in Tor)
+			ASMap string // Text file mapping IP ranges to AS numbers (one outgoing connection per AS)
+			BanTimeHours uint // How long misbehaving peers stay banned
+			AddNode string // Comma separated list of peers to always stay connected to
+			Whitelist string // Space separated list of "perm1,perm2@IP/bits" - see PermNames
 		}
 		TXPool struct {
 			Enabled bool // Global on/off swicth
@@ -62,12 +76,16 @@ var (
 			// Otherwise expiration time will be proportionally different.
 			TxExpireMinPerKB uint
 			TxExpireMaxHours uint
+			MaxOrphans uint // How many txs can be waiting for their inputs
+			MaxOrphansPerPeer uint // ... of which this many from a single peer
+			OrphanExpireMin uint // Txs waiting for inputs expire after this many minutes
 		}
 		TXRoute struct {
 			Enabled bool // Global on/off swicth
 			FeePerByte uint64
 			MaxTxSize uint32
 			MinVoutValue uint64
+			Dandelion bool // Send own txs (and relay stem txs of other peers) with Dandelion++
 		}
 		Memory struct {
 			GCPercTrshold int
@@ -82,27 +100,49 @@ var (
 		HashrateHours uint
 		MiningStatHours uint
 		AverageFeeBlocks uint
+		EstimateFeeBlocks uint // default confirmation target for the fee estimator
 		AverageBlockSizeBlocks uint
 		UserAgent string
+		VerifyThreads uint // goroutines verifying scripts of a block (0 - as many as GOMAXPROCS)
 	}
 
 	mutex_cfg sync.Mutex
 )
 
 
-type oneAllowedAddr struct {
-	Addr, Mask uint32
+var WebUIAllowed []*net.IPNet
+
+type WhitelistEntry struct {
+	Net *net.IPNet
+	Perms uint32
+}
+
+var Whitelist []WhitelistEntry
+
+var PermNames = map[string]uint32 {
+	"noban" : PERM_NOBAN,
+	"forcerelay" : PERM_FORCERELAY,
+	"relay" : PERM_RELAY,
+	"download" : PERM_DOWNLOAD,
+	"bypass" : PERM_BYPASS,
+	"mempool" : PERM_MEMPOOL,
+	"all" : PERM_ALL,
 }
 
-var WebUIAllowed []oneAllowedAddr
+var asmap_loaded string
 
 
 func InitConfig() {
 	// Fill in default values
 	CFG.Net.ListenTCP = true
 	CFG.Net.MaxOutCons = 9
+	CFG.Net.MaxBlockOnlyCons = 2
 	CFG.Net.MaxInCons = 10
 	CFG.Net.MaxBlockAtOnce = 3
+	CFG.Net.V2Transport = true
+	CFG.Net.CompactBlocks = true
+	CFG.Net.ProxyIsolate = true
+	CFG.Net.BanTimeHours = 24
 
 	CFG.TextUI.Enabled = true
 
@@ -123,11 +163,15 @@ func InitConfig() {
 	CFG.TXPool.MinVoutValue = 0
 	CFG.TXPool.TxExpireMinPerKB = 180
 	CFG.TXPool.TxExpireMaxHours = 12
+	CFG.TXPool.MaxOrphans = 1000
+	CFG.TXPool.MaxOrphansPerPeer = 100
+	CFG.TXPool.OrphanExpireMin = 20
 
 	CFG.TXRoute.Enabled = true
 	CFG.TXRoute.FeePerByte = 25
 	CFG.TXRoute.MaxTxSize = 100e3
 	CFG.TXRoute.MinVoutValue = 0
+	CFG.TXRoute.Dandelion = false
 
 	CFG.Memory.GCPercTrshold = 100 // 100%
 	CFG.Memory.MaxCachedBlocks = 500
@@ -135,8 +179,10 @@ func InitConfig() {
 	CFG.HashrateHours = 12
 	CFG.MiningStatHours = 48
 	CFG.AverageFeeBlocks = 4*6 /*last 4 hours*/
+	CFG.EstimateFeeBlocks = 6 /*about an hour*/
 	CFG.AverageBlockSizeBlocks = 12*6 /*half a day*/
 	CFG.UserAgent = DefaultUserAgent
+	CFG.VerifyThreads = 0
 
 	cfgfilecontent, e := ioutil.ReadFile(ConfigFile)
 	if e==nil && len(cfgfilecontent)>0 {
@@ -207,6 +253,28 @@ func Reset() {
 	UploadLimit = CFG.Net.MaxUpKBps << 10
 	DownloadLimit = CFG.Net.MaxDownKBps << 10
 	debug.SetGCPercent(CFG.Memory.GCPercTrshold)
+	chain.ScriptThreads = int(CFG.VerifyThreads)
+	if CFG.Net.BloomFilters {
+		Services |= SERVICE_BLOOM
+	} else {
+		Services &^= SERVICE_BLOOM
+	}
+	if CFG.Net.BlockFilters {
+		Services |= SERVICE_COMPACT_FILTERS
+	} else {
+		Services &^= SERVICE_COMPACT_FILTERS
+	}
+	if CFG.Net.V2Transport {
+		Services |= SERVICE_P2P_V2
+	} else {
+		Services &^= SERVICE_P2P_V2
+	}
+	if CFG.TXRoute.Dandelion {
+		Services |= SERVICE_DANDELION
+	} else {
+		Services &^= SERVICE_DANDELION
+	}
+	peersdb.BanTime = time.Duration(CFG.Net.BanTimeHours) * time.Hour
 	MaxExpireTime = time.Duration(CFG.TXPool.TxExpireMaxHours) * time.Hour
 	ExpirePerKB = time.Duration(CFG.TXPool.TxExpireMinPerKB) * time.Minute
 	if CFG.Net.TCPPort != 0 {
@@ -224,7 +292,7 @@ func Reset() {
 	for i := range ips {
 		oaa := str2oaa(ips[i])
 		if oaa!=nil {
-			WebUIAllowed = append(WebUIAllowed, *oaa)
+			WebUIAllowed = append(WebUIAllowed, oaa)
 		} else {
 			println("ERROR: Incorrect AllowedIP:", ips[i])
 		}
@@ -232,6 +300,26 @@ func Reset() {
 	if len(WebUIAllowed)==0 {
 		println("WARNING: No IP is currently allowed at WebUI")
 	}
+
+	Whitelist = nil
+	for _, s := range strings.Fields(CFG.Net.Whitelist) {
+		if we := str2whitelist(s); we != nil {
+			Whitelist = append(Whitelist, *we)
+		} else {
+			println("ERROR: Incorrect Whitelist entry:", s)
+		}
+	}
+
+	if CFG.Net.ASMap != asmap_loaded {
+		if cnt, e := peersdb.LoadASMap(CFG.Net.ASMap); e != nil {
+			println("ERROR: ASMap:", e.Error())
+		} else {
+			asmap_loaded = CFG.Net.ASMap
+			if cnt > 0 {
+				println(cnt, "AS prefixes loaded from", CFG.Net.ASMap)
+			}
+		}
+	}
 	SetListenTCP(CFG.Net.ListenTCP, false)
 	ReloadMiners()
 }
@@ -249,28 +337,69 @@ func RPCPort() uint32 {
 }
 
 
-// Converts an IP range to addr/mask
-func str2oaa(ip string) (res *oneAllowedAddr) {
-	var a,b,c,d,x uint32
-	n, _ := fmt.Sscanf(ip, "%d.%d.%d.%d/%d", &a, &b, &c, &d, &x)
-	if n<4 {
-		return
+// Converts an IP range (IPv4 or IPv6, with optional /bits) to addr/mask
+func str2oaa(ip string) (res *net.IPNet) {
+	ip = strings.TrimSpace(ip)
+	if strings.Index(ip, "/") == -1 {
+		a := net.ParseIP(ip)
+		if a == nil {
+			return
+		}
+		if a.To4() != nil {
+			ip += "/32"
+		} else {
+			ip += "/128"
+		}
+	}
+	_, res, _ = net.ParseCIDR(ip)
+	return
+}
+
+
+// Parses "perm1,perm2@IP/bits" (if no permissions are given, they are "noban,relay,download")
+func str2whitelist(s string) (res *WhitelistEntry) {
+	perms := uint32(PERM_NOBAN|PERM_RELAY|PERM_DOWNLOAD|PERM_MEMPOOL)
+	if i := strings.Index(s, "@"); i != -1 {
+		perms = 0
+		for _, p := range strings.Split(s[:i], ",") {
+			v, ok := PermNames[p]
+			if !ok {
+				return
+			}
+			perms |= v
+		}
+		s = s[i+1:]
 	}
-	if (a|b|c|d)>255 || n==5 && (x<1 || x>32) {
-		return
+	if oaa := str2oaa(s); oaa != nil {
+		res = &WhitelistEntry{Net:oaa, Perms:perms}
 	}
-	res = new(oneAllowedAddr)
-	res.Addr = (a<<24) | (b<<16) | (c<<8) | d
-	if n==4 || x==32 {
-		res.Mask = 0xffffffff
-	} else {
-		res.Mask = uint32(( uint64(1) << (32-x) ) - 1)  ^ 0xffffffff
+	return
+}
+
+
+// Returns comma separated names of the permissions
+func PermsString(perms uint32) string {
+	var ss []string
+	for _, n := range []string{"noban", "forcerelay", "relay", "download", "bypass", "mempool"} {
+		if (perms&PermNames[n])!=0 {
+			ss = append(ss, n)
+		}
+	}
+	return strings.Join(ss, ",")
+}
+
+
+// Returns permissions of the peer with the given IP
+func PeerPermissions(ip net.IP) (perms uint32) {
+	for _, we := range Whitelist {
+		if we.Net.Contains(ip) {
+			perms |= we.Perms
+		}
 	}
-	res.Addr &= res.Mask
-	//fmt.Printf(" %s -> %08x / %08x\n", ip, res.Addr, res.Mask)
 	return
 }
 
+
 func LockCfg() {
 	mutex_cfg.Lock()
 }
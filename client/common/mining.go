@@ -113,7 +113,7 @@ func GetAverageFee() (float64) {
 			return 0
 		}
 
-		cbasetx, cbasetxlen := btc.NewTx(bl[block.TxOffset:])
+		cbasetx, cbasetxlen, _ := btc.NewTx(bl[block.TxOffset:])
 		for o := range cbasetx.TxOut {
 			AverageFeeTotal += cbasetx.TxOut[o].Value
 		}
@@ -100,8 +100,10 @@ func host_init() {
 
 	ext := &chain.NewChanOpts{NotifyTxAdd: wallet.TxNotifyAdd,
 		NotifyTxDel: wallet.TxNotifyDel, LoadWalk: wallet.NewUTXO,
+		BlockUndone: network.BlockUndone,
 		UTXOVolatileMode : common.FLAG.VolatileUTXO,
 		UndoBlocks : common.FLAG.UndoBlocks,
+		BlockFilters : common.CFG.Net.BlockFilters,
 		SetBlocksDBCacheSize:true, BlocksDBCacheSize:int(common.CFG.Memory.MaxCachedBlocks)}
 
 	sta := time.Now().UnixNano()
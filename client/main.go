@@ -11,6 +11,7 @@ import (
 	"runtime/debug"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib"
+	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/others/sys"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/wallet"
@@ -25,6 +26,8 @@ import (
 
 var killchan chan os.Signal = make(chan os.Signal)
 var retryCachedBlocks bool
+var blockIOFailed bool // a block could not be applied because of a local I/O error - try it again later
+var moveIOFailed *chain.BlockTreeNode // a chain reorg to this block stopped because of a local I/O error
 
 
 func LocalAcceptBlock(newbl *network.BlockRcvd) (e error) {
@@ -38,9 +41,7 @@ func LocalAcceptBlock(newbl *network.BlockRcvd) (e error) {
 
 		common.RecalcAverageBlockSize(false)
 
-		for i:=1; i<len(bl.Txs); i++ {
-			network.TxMined(bl.Txs[i])
-		}
+		network.BlockMined(bl)
 
 		if int64(bl.BlockTime()) > time.Now().Add(-10*time.Minute).Unix() {
 			// Freshly mined block - do the inv and beeps...
@@ -64,21 +65,53 @@ func LocalAcceptBlock(newbl *network.BlockRcvd) (e error) {
 		}
 	} else {
 		fmt.Println("Warning: AcceptBlock failed. If the block was valid, you may need to rebuild the unspent DB (-r)")
-		common.Last.Mutex.Lock()
-		common.Last.Block = common.BlockChain.BlockTreeEnd
-		common.Last.Mutex.Unlock()
-		// update network.LastCommitedHeader
-		network.MutexRcv.Lock()
-		if network.LastCommitedHeader != common.BlockChain.BlockTreeEnd {
-			network.LastCommitedHeader = common.BlockChain.BlockTreeEnd
-			println("LastCommitedHeader moved to", network.LastCommitedHeader.Height)
-		}
-		network.MutexRcv.Unlock()
+		chain_head_moved()
 	}
 	return
 }
 
 
+// Call it after the chain's head has moved, other than by accepting a new block
+func chain_head_moved() {
+	common.Last.Mutex.Lock()
+	common.Last.Block = common.BlockChain.BlockTreeEnd
+	common.Last.Mutex.Unlock()
+	// update network.LastCommitedHeader
+	network.MutexRcv.Lock()
+	if network.LastCommitedHeader != common.BlockChain.BlockTreeEnd {
+		network.LastCommitedHeader = common.BlockChain.BlockTreeEnd
+		println("LastCommitedHeader moved to", network.LastCommitedHeader.Height)
+	}
+	network.MutexRcv.Unlock()
+	network.ReaddUndoneTxs() // some blocks might have been undone
+}
+
+
+// Continues the chain reorg, that has been stopped by a local I/O error
+func retry_move_to_block() {
+	dst := moveIOFailed
+	moveIOFailed = nil
+	common.CountSafe("RedoMoveToBlock")
+	common.BlockChain.BlockIndexAccess.Lock()
+	known := common.BlockChain.BlockIndex[dst.BlockHash.BIdx()] == dst
+	common.BlockChain.BlockIndexAccess.Unlock()
+	if !known || dst.Height <= common.BlockChain.BlockTreeEnd.Height {
+		return // the branch has been dropped or another one took over
+	}
+	common.Busy("MoveToBlock "+dst.BlockHash.String())
+	e := common.BlockChain.MoveToBlock(dst)
+	if e != nil {
+		fmt.Println("MoveToBlock:", e.Error())
+		if _, ok := e.(*chain.LocalIOError); ok {
+			common.CountSafe("BlockLocalIOError")
+			moveIOFailed = dst
+			blockIOFailed = true
+		}
+	}
+	chain_head_moved()
+}
+
+
 func retry_cached_blocks() bool {
 	var idx int
 	common.CountSafe("RedoCachedBlks")
@@ -87,9 +120,8 @@ func retry_cached_blocks() bool {
 		if newbl.Block.Height==common.BlockChain.BlockTreeEnd.Height+1 {
 			common.Busy("Cache.LocalAcceptBlock "+newbl.Block.Hash.String())
 			e := LocalAcceptBlock(newbl)
-			if e != nil {
-				fmt.Println("AcceptBlock:", e.Error())
-				newbl.Conn.DoS("LocalAcceptBl")
+			if e != nil && block_not_accepted(newbl, e) {
+				return false // leave it in the cache
 			}
 			if usif.Exit_now {
 				return false
@@ -105,6 +137,27 @@ func retry_cached_blocks() bool {
 }
 
 
+// Called when LocalAcceptBlock failed. Returns true if the block shall be kept for later.
+func block_not_accepted(newbl *network.BlockRcvd, e error) bool {
+	fmt.Println("AcceptBlock:", e.Error())
+	if _, ok := e.(*chain.LocalIOError); ok {
+		// Not the peer's fault
+		common.CountSafe("BlockLocalIOError")
+		blockIOFailed = true
+		if common.BlockChain.Blocks.BlockStored(newbl.Hash) {
+			// Only a reorg stores the block before applying it, so it must have stopped half way.
+			// It will be continued with MoveToBlock, as the chain may not get back to the block's parent.
+			moveIOFailed = newbl.BlockTreeNode
+			return false
+		}
+		return true
+	}
+	newbl.Conn.SendBlockReject(newbl.Hash, e)
+	newbl.Conn.DoS("LocalAcceptBl")
+	return false
+}
+
+
 // Called from the blockchain thread
 func HandleNetBlock(newbl *network.BlockRcvd) {
 	if int(newbl.Block.Height)-int(common.BlockChain.BlockTreeEnd.Height) > 1 {
@@ -119,8 +172,9 @@ func HandleNetBlock(newbl *network.BlockRcvd) {
 	common.Busy("LocalAcceptBlock "+newbl.Hash.String())
 	e := LocalAcceptBlock(newbl)
 	if e != nil {
-		fmt.Println("AcceptBlock:", e.Error())
-		newbl.Conn.DoS("LocalAcceptBl")
+		if block_not_accepted(newbl, e) {
+			network.CachedBlocks = append(network.CachedBlocks, newbl)
+		}
 	} else {
 		//println("block", newbl.Block.Height, "accepted")
 		retryCachedBlocks = retry_cached_blocks()
@@ -183,6 +237,7 @@ func HandleRpcBlock(msg *rpcapi.BlockSubmited) {
 	}
 	if e != nil {
 		common.CountSafe("RPCBlockError")
+		network.ReaddUndoneTxs()
 		msg.Error = e.Error()
 		msg.Done.Done()
 		return
@@ -190,9 +245,7 @@ func HandleRpcBlock(msg *rpcapi.BlockSubmited) {
 
 	common.RecalcAverageBlockSize(false)
 
-	for i:=1; i<len(msg.Block.Txs); i++ {
-		network.TxMined(msg.Block.Txs[i])
-	}
+	network.BlockMined(msg.Block)
 
 	common.CountSafe("RPCBlockOK")
 	println("New mined block", msg.Block.Height, "accepted OK")
@@ -281,6 +334,8 @@ func main() {
 			network.ReceivedBlocks[k] = &network.OneReceivedBlock{Time: time.Unix(int64(v.Timestamp()), 0)}
 		}
 		network.LastCommitedHeader = common.Last.Block
+		network.FeeEstLoad(common.GocoinHomeDir)
+		network.AnchorsLoad(common.GocoinHomeDir)
 
 		if common.CFG.TextUI.Enabled {
 			go textui.MainThread()
@@ -343,6 +398,7 @@ func main() {
 					common.Busy("UI command")
 					cmd.Handler(cmd.Param)
 					cmd.Done.Done()
+					network.ReaddUndoneTxs() // in case the command has undone some blocks
 					continue
 
 				case <-peersTick:
@@ -355,6 +411,14 @@ func main() {
 
 				case <-time.After(time.Second/2):
 					common.CountSafe("MainThreadTouts")
+					if blockIOFailed {
+						blockIOFailed = false
+						if moveIOFailed != nil {
+							retry_move_to_block()
+						}
+						retryCachedBlocks = true
+						continue
+					}
 					if !retryCachedBlocks {
 						if usif.DefragUTXO {
 							usif.Exit_now = true
@@ -369,7 +433,9 @@ func main() {
 			}
 		}
 
+		network.AnchorsSave(common.GocoinHomeDir)
 		network.NetCloseAll()
+		network.FeeEstSave(common.GocoinHomeDir)
 	}
 
 	if usif.DefragUTXO {
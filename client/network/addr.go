@@ -3,18 +3,16 @@ package network
 import (
 	"time"
 	"sync"
-	"bytes"
 	"encoding/binary"
-	"github.com/piotrnar/gocoin/lib/qdb"
 	"github.com/piotrnar/gocoin/lib/btc"
-	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
 
 
 var (
-	ExternalIp4 map[uint32][2]uint = make(map[uint32][2]uint) // [0]-count, [1]-timestamp
+	ExternalIp map[[16]byte][2]uint = make(map[[16]byte][2]uint) // [0]-count, [1]-timestamp
 	ExternalIpMutex sync.Mutex
 	ExternalIpExpireTicker int
 )
@@ -22,25 +20,25 @@ var (
 
 func ExternalAddrLen() (res int) {
 	ExternalIpMutex.Lock()
-	res = len(ExternalIp4)
+	res = len(ExternalIp)
 	ExternalIpMutex.Unlock()
 	return
 }
 
 
 func BestExternalAddr() []byte {
-	var best_ip, worst_ip uint32
+	var best_ip, worst_ip [16]byte
 	var worst_tim, best_tim uint
 
 	ExternalIpMutex.Lock()
 
-	if len(ExternalIp4) > 0 {
-		for ip, rec := range ExternalIp4 {
+	if len(ExternalIp) > 0 {
+		for ip, rec := range ExternalIp {
 			if worst_tim == 0 {
 				worst_tim = rec[1]
 				worst_ip = ip
 			}
-			if best_ip==0 || (rec[1]>best_tim && rec[0]>3) {
+			if best_ip==[16]byte{} || (rec[1]>best_tim && rec[0]>3) {
 				/*If newer timestamp and more than 3 counts */
 				best_ip = ip
 				best_tim = rec[1]
@@ -51,82 +49,120 @@ func BestExternalAddr() []byte {
 		}
 
 		// Expire any extra IP if it has been stale for more than an hour
-		if len(ExternalIp4) > 1 && uint(time.Now().Unix())-worst_tim > 3600 {
+		if len(ExternalIp) > 1 && uint(time.Now().Unix())-worst_tim > 3600 {
 			common.CountSafe("ExternalIPExpire")
-			delete(ExternalIp4, worst_ip)
+			delete(ExternalIp, worst_ip)
 		}
 	}
 
 	ExternalIpMutex.Unlock()
 	res := make([]byte, 26)
 	binary.LittleEndian.PutUint64(res[0:8], common.Services)
-	// leave ip6 filled with zeros, except for the last 2 bytes:
-	res[18], res[19] = 0xff, 0xff
-	binary.BigEndian.PutUint32(res[20:24], best_ip)
+	copy(res[8:24], best_ip[:])
 	binary.BigEndian.PutUint16(res[24:26], common.DefaultTcpPort)
 	return res
 }
 
 
-func (c *OneConnection) SendAddr() {
-	pers := peersdb.GetBestPeers(MaxAddrsPerMessage, nil)
-	if len(pers)>0 {
-		buf := new(bytes.Buffer)
-		btc.WriteVlen(buf, uint64(len(pers)))
-		for i := range pers {
-			binary.Write(buf, binary.LittleEndian, pers[i].Time)
-			buf.Write(pers[i].NetAddr.Bytes())
+// Sends "addrv2" if the peer asked for it, or "addr" otherwise (skipping non-IP addresses then)
+func (c *OneConnection) sendAddrList(pers []*peersdb.PeerAddr) {
+	c.Mutex.Lock()
+	v2 := c.Node.SendAddrV2
+	c.Mutex.Unlock()
+
+	addrs := make([]*wire.Addr, 0, len(pers))
+	for i := range pers {
+		if v2 || pers[i].IsIP() {
+			addrs = append(addrs, &wire.Addr{Time:pers[i].Time, NetAddr:pers[i].NetAddr})
+		}
+	}
+	if len(addrs)>0 {
+		if v2 {
+			c.SendRawMsg("addrv2", wire.EncodeAddr(addrs, true))
+		} else {
+			c.SendRawMsg("addr", wire.EncodeAddr(addrs, false))
 		}
-		c.SendRawMsg("addr", buf.Bytes())
 	}
 }
 
 
+func (c *OneConnection) SendAddr() {
+	c.sendAddrList(peersdb.GetBestPeers(MaxAddrsPerMessage, nil))
+}
+
+
 func (c *OneConnection) SendOwnAddr() {
 	if ExternalAddrLen()>0 {
-		buf := new(bytes.Buffer)
-		btc.WriteVlen(buf, uint64(1))
-		binary.Write(buf, binary.LittleEndian, uint32(time.Now().Unix()))
-		buf.Write(BestExternalAddr())
-		c.SendRawMsg("addr", buf.Bytes())
+		p := peersdb.NewPeer(append([]byte{0,0,0,0}, BestExternalAddr()...))
+		p.Time = uint32(time.Now().Unix())
+		c.sendAddrList([]*peersdb.PeerAddr{p})
 	}
 }
 
+
+// Stores an address received from the peer. Returns true if the peer got banned.
+func (c *OneConnection) addrReceived(a *peersdb.PeerAddr) bool {
+	if !a.Routable() {
+		//print(c.PeerAddr.Ip(), " ", c.Node.Agent, " ", c.Node.Version, " addr local ", a.String(), "\n> ")
+		return c.Misbehave("AddrLocal", 1)
+	}
+	if !time.Unix(int64(a.Time), 0).Before(time.Now().Add(time.Minute)) {
+		return c.Misbehave("AddrFuture", 50)
+	}
+	if time.Now().Before(time.Unix(int64(a.Time), 0).Add(peersdb.ExpirePeerAfter)) {
+		if !peersdb.AddrReceived(a, c.PeerAddr) {
+			common.CountSafe("AddrNoRoom")
+		}
+	} else {
+		common.CountSafe("AddrStale")
+	}
+	return false
+}
+
+
 // Parese network's "addr" message
 func (c *OneConnection) ParseAddr(pl []byte) {
-	b := bytes.NewBuffer(pl)
-	cnt, _ := btc.ReadVLen(b)
-	for i := 0; i < int(cnt); i++ {
-		var buf [30]byte
-		n, e := b.Read(buf[:])
-		if n!=len(buf) || e!=nil {
-			common.CountSafe("AddrError")
-			c.DoS("AddrError")
-			//println("ParseAddr:", n, e)
+	addrs, e := wire.ParseAddr(pl)
+	if e != nil {
+		common.CountSafe("AddrError")
+		c.DoS("AddrError")
+		//println("ParseAddr:", e.Error())
+		return
+	}
+	for _, ad := range addrs {
+		a := peersdb.NewEmptyPeer()
+		a.NetAddr = ad.NetAddr
+		a.Time = ad.Time
+		if c.addrReceived(a) {
 			break
 		}
-		a := peersdb.NewPeer(buf[:])
-		if !sys.ValidIp4(a.Ip4[:]) {
-			//common.CountSafe("AddrLocal")
-			if c.Misbehave("AddrLocal", 1) {
-				break
-			}
-			//print(c.PeerAddr.Ip(), " ", c.Node.Agent, " ", c.Node.Version, " addr local ", a.String(), "\n> ")
-		} else if time.Unix(int64(a.Time), 0).Before(time.Now().Add(time.Minute)) {
-			if time.Now().Before(time.Unix(int64(a.Time), 0).Add(peersdb.ExpirePeerAfter)) {
-				k := qdb.KeyType(a.UniqID())
-				v := peersdb.PeerDB.Get(k)
-				if v != nil {
-					a.Banned = peersdb.NewPeer(v[:]).Banned
-				}
-				peersdb.PeerDB.Put(k, a.Bytes())
-			} else {
-				common.CountSafe("AddrStale")
-			}
+	}
+}
+
+
+// Parese network's "addrv2" message (BIP155)
+func (c *OneConnection) ParseAddrV2(pl []byte) {
+	addrs, e := wire.ParseAddrV2(pl)
+	if e != nil {
+		if e == wire.ErrTooMany {
+			c.DoS("AddrV2TooMany")
 		} else {
-			if c.Misbehave("AddrFuture", 50) {
-				break
-			}
+			common.CountSafe("AddrV2Error")
+			c.DoS("AddrV2Error")
+		}
+		return
+	}
+	for _, ad := range addrs {
+		switch ad.Network() {
+			case btc.NET_IPV4, btc.NET_IPV6, btc.NET_TORV3, btc.NET_I2P:
+				a := peersdb.NewEmptyPeer()
+				a.NetAddr = ad.NetAddr
+				a.Time = ad.Time
+				if c.addrReceived(a) {
+					return
+				}
+			default:
+				common.CountSafe("AddrV2Unknown") // networks we do not support are just ignored
 		}
 	}
 }
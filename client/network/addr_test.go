@@ -0,0 +1,65 @@
+package network
+
+import (
+	"net"
+	"time"
+	"bytes"
+	"testing"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
+)
+
+// Builds one "addrv2" entry with services set to 1
+func testAddrV2(tim uint32, netid byte, addr []byte) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, tim)
+	b.Write(testPl(0, 1, []byte{netid}, len(addr), addr))
+	binary.Write(b, binary.BigEndian, uint16(8333))
+	return b.Bytes()
+}
+
+func TestParseAddrV2(t *testing.T) {
+	peersdb.OpenPeerDB(t.TempDir() + "/") // no seeding
+	defer peersdb.ClosePeerDB()
+
+	now := uint32(time.Now().Unix())
+	ip4 := net.ParseIP("8.8.8.8").To4()
+	ip6 := net.ParseIP("2001:4860::8888")
+	tor := bytes.Repeat([]byte{7}, 32)
+	entry := testAddrV2(now, btc.NET_IPV4, ip4)
+	entry2 := testAddrV2(now, btc.NET_IPV4, net.ParseIP("8.8.4.4").To4())
+	entry3 := testAddrV2(now, btc.NET_IPV4, net.ParseIP("1.1.1.1").To4())
+	var tv = []struct {
+		pl []byte
+		ban bool
+		misbehave int
+		stored int // new addresses (the DB is shared by all the cases)
+	} {
+		{testPl(0, 1, entry), false, 0, 1},
+		{testPl(0, 3, entry2, testAddrV2(now, btc.NET_IPV6, ip6), testAddrV2(now, btc.NET_TORV3, tor)), false, 0, 3},
+		{testPl(0, 1, testAddrV2(now, 9, make([]byte, 10))), false, 0, 0},
+		{testPl(0, 0), false, 0, 0},
+		{testPl(0, 1, testAddrV2(now, btc.NET_IPV4, net.ParseIP("10.0.0.1").To4())), false, 1, 0},
+		{testPl(0, 1, testAddrV2(now+3600, btc.NET_IPV4, ip4)), false, 50, 0},
+		{testPl(0, 1, testAddrV2(now, btc.NET_IPV4, ip6)), true, 0, 0},
+		{testPl(0, 1, testAddrV2(now, btc.NET_IPV6, ip4)), true, 0, 0},
+		{testPl(0, 1, testAddrV2(now, btc.NET_TORV3, tor[:31])), true, 0, 0},
+		{testPl(0, 1, testAddrV2(now, 9, make([]byte, btc.MAX_ADDRV2_SIZE+1))), true, 0, 0},
+		{testPl(0, 2, entry), true, 0, 0},
+		{testPl(0, 1, entry[:len(entry)-1]), true, 0, 0},
+		{testPl(0, 1000+1, bytes.Repeat(entry, 1000+1)), true, 0, 0},
+		{testPl(0, uint64(0xffffffffffffffff)), true, 0, 0},
+		{testPl(0, 1, entry[:4], []byte{0xfd, 1, 0}, entry[5:]), true, 0, 0},
+		{testPl(0, 1, entry3[:4], uint64(0xffffffffffffffff), entry3[5:]), false, 0, 1},
+		{testPl(0, 1, entry[:6], uint64(0xffffffffffffffff), ip4, entry[11:]), true, 0, 0},
+	}
+	for i := range tv {
+		cnt := peersdb.PeerDB.Count()
+		c := testConn()
+		c.ParseAddrV2(tv[i].pl)
+		if !testPunished(c, tv[i].ban, tv[i].misbehave) || peersdb.PeerDB.Count()-cnt != tv[i].stored {
+			t.Error(i, "Unexpected result", c.banit, c.X.Misbehave, peersdb.PeerDB.Count()-cnt)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package network
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"strings"
+	"io/ioutil"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
+)
+
+// Anchors are the block-relay-only peers we were connected to at shutdown, to reconnect to them after restart.
+// AddNode peers (from the config) we always try to stay connected to.
+
+const (
+	AnchorsFileName = "anchors.txt"
+	MaxAnchors = 2
+)
+
+type addNodeRec struct {
+	id uint64 // UniqID of the peer, while connecting or connected
+	retry time.Duration
+	next time.Time
+}
+
+var (
+	anchors []*peersdb.PeerAddr // only accessed from NetworkTick()
+
+	addNodes map[string]*addNodeRec = make(map[string]*addNodeRec)
+	addNodesCfg string // value of Net.AddNode that addNodes were made of
+	addNodesMutex sync.Mutex
+)
+
+
+// Saves the addresses of the block-relay-only peers we have been connected to for the longest time.
+// Call it before NetCloseAll()
+func AnchorsSave(dir string) {
+	var cs []*OneConnection
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if v.X.BlockOnly && v.X.VerackReceived {
+			cs = append(cs, v)
+		}
+	}
+	Mutex_net.Unlock()
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[i].X.ConnectedAt.Before(cs[j].X.ConnectedAt)
+	})
+
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(cs) && i < MaxAnchors; i++ {
+		fmt.Fprintln(buf, cs[i].PeerAddr.Ip())
+	}
+	ioutil.WriteFile(dir+AnchorsFileName, buf.Bytes(), 0600)
+}
+
+
+// Loads the anchors saved by AnchorsSave and removes the file (so we do not use them twice)
+func AnchorsLoad(dir string) {
+	d, e := ioutil.ReadFile(dir+AnchorsFileName)
+	if e != nil {
+		return
+	}
+	os.Remove(dir+AnchorsFileName)
+	if common.CFG.ConnectOnly != "" {
+		return
+	}
+	for _, s := range strings.Split(string(d), "\n") {
+		if s = strings.TrimSpace(s); s != "" {
+			if ad, e := peersdb.NewPeerFromString(s, false); e == nil {
+				anchors = append(anchors, ad)
+			} else {
+				println("Anchor", s, e.Error())
+			}
+		}
+	}
+}
+
+
+// Connects to the AddNode peers we are not connected to, unless we are waiting to retry
+func tickAddNodes() {
+	var todo []*peersdb.PeerAddr
+
+	common.LockCfg()
+	cfg := common.CFG.Net.AddNode
+	common.UnlockCfg()
+
+	addNodesMutex.Lock()
+	if cfg != addNodesCfg {
+		nodes := make(map[string]*addNodeRec)
+		for _, s := range strings.Split(cfg, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				if rec, ok := addNodes[s]; ok {
+					nodes[s] = rec
+				} else {
+					nodes[s] = &addNodeRec{retry:AddNodeMinRetry}
+				}
+			}
+		}
+		addNodes = nodes
+		addNodesCfg = cfg
+	}
+
+	now := time.Now()
+	for s, rec := range addNodes {
+		if rec.id != 0 || now.Before(rec.next) {
+			continue
+		}
+		ad, e := peersdb.NewPeerFromString(s, false)
+		if e != nil {
+			println("AddNode", s, e.Error())
+			rec.next = now.Add(AddNodeMaxRetry)
+			continue
+		}
+		if ConnectionActive(ad) {
+			continue // i.e. it has connected to us
+		}
+		rec.id = ad.UniqID()
+		todo = append(todo, ad)
+	}
+	addNodesMutex.Unlock()
+
+	for _, ad := range todo {
+		common.CountSafe("AddNodeConnect")
+		if !doConnect(ad, OUT_ADDNODE) {
+			addNodeDone(ad, true)
+		}
+	}
+}
+
+
+// Called when the connection to AddNode peer is closed (handshake tells if it was successful)
+func addNodeDone(ad *peersdb.PeerAddr, handshake bool) {
+	addNodesMutex.Lock()
+	for _, rec := range addNodes {
+		if rec.id == ad.UniqID() {
+			rec.id = 0
+			if handshake {
+				rec.retry = AddNodeMinRetry
+			} else if rec.retry *= 2; rec.retry > AddNodeMaxRetry {
+				rec.retry = AddNodeMaxRetry
+			}
+			rec.next = time.Now().Add(rec.retry)
+		}
+	}
+	addNodesMutex.Unlock()
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// Serving SPV clients (BIP37)
+
+// Handles "filterload", "filteradd" and "filterclear"
+func (c *OneConnection) HandleFilterMsg(cmd string, pl []byte) {
+	if !common.CFG.Net.BloomFilters {
+		// we do not advertise NODE_BLOOM, so the peer should not be sending it
+		c.DoS("BloomDisabled")
+		return
+	}
+
+	switch cmd {
+		case "filterload":
+			bf, e := btc.NewBloomFilterFromMsg(pl)
+			if e != nil {
+				println(c.PeerAddr.Ip(), e.Error())
+				c.DoS("BadFilterLoad")
+				return
+			}
+			c.bloom = bf
+			c.Mutex.Lock()
+			c.Node.DoNotRelayTxs = false
+			c.Mutex.Unlock()
+			common.CountSafe("BloomFilterLoad")
+
+		case "filteradd":
+			b := bytes.NewReader(pl)
+			le, e := btc.ReadVLen(b)
+			if e != nil || le > btc.MAX_SCRIPT_ELEMENT_SIZE || int(le) != b.Len() {
+				c.DoS("BadFilterAdd")
+				return
+			}
+			if c.bloom == nil {
+				c.Misbehave("FilterAddNoFilter", 100)
+				return
+			}
+			c.bloom.Add(pl[len(pl)-int(le):])
+			common.CountSafe("BloomFilterAdd")
+
+		case "filterclear":
+			c.bloom = nil
+			c.Mutex.Lock()
+			c.Node.DoNotRelayTxs = false
+			c.Mutex.Unlock()
+			common.CountSafe("BloomFilterClear")
+	}
+}
+
+
+// Sends "merkleblock" followed by all the matching txs.
+// Returns false if the block could not be found.
+func (c *OneConnection) SendMerkleBlock(hash *btc.Uint256) bool {
+	raw, _, er := common.BlockChain.Blocks.BlockGet(hash)
+	if er != nil {
+		return false
+	}
+	bl, er := btc.NewBlock(raw)
+	if er != nil || bl.BuildTxList() != nil {
+		return false
+	}
+
+	txids := make([][]byte, len(bl.Txs))
+	matches := make([]bool, len(bl.Txs))
+	var matched [][]byte
+	offs := bl.TxOffset
+	for i, tx := range bl.Txs {
+		txids[i] = tx.Hash.Hash[:]
+		if c.bloom.MatchTx(tx) {
+			matches[i] = true
+			matched = append(matched, raw[offs:offs+int(tx.Size)])
+		}
+		offs += int(tx.Size)
+	}
+
+	hashes, flags := btc.PartialMerkleTree(txids, matches)
+	msg := new(bytes.Buffer)
+	msg.Write(raw[:80])
+	binary.Write(msg, binary.LittleEndian, uint32(len(bl.Txs)))
+	btc.WriteVlen(msg, uint64(len(hashes)))
+	for _, h := range hashes {
+		msg.Write(h)
+	}
+	btc.WriteVlen(msg, uint64(len(flags)))
+	msg.Write(flags)
+	c.SendRawMsg("merkleblock", msg.Bytes())
+
+	for _, tx := range matched {
+		c.SendRawMsg("tx", tx)
+	}
+	common.CountSafe("MerkleBlockSent")
+	return true
+}
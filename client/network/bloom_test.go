@@ -0,0 +1,92 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
+)
+
+// Builds "filterload" payload with a filter of the given size
+func testFilterLoad(size int, funcs byte) []byte {
+	return testPl(0, size, make([]byte, size), []byte{funcs, 0, 0, 0, 1, 2, 3, 4, 0})
+}
+
+func testConn() (c *OneConnection) {
+	c = new(OneConnection)
+	c.PeerAddr = peersdb.NewEmptyPeer()
+	c.counters = make(map[string]uint64)
+	return
+}
+
+// Returns true if the peer has been banned as expected, or not banned and given the expected misbehave score
+func testPunished(c *OneConnection, ban bool, misbehave int) bool {
+	if c.banit {
+		return ban
+	}
+	return !ban && c.X.Misbehave == misbehave
+}
+
+func TestHandleFilterMsg(t *testing.T) {
+	common.CFG.Net.BloomFilters = true
+	defer func() {
+		common.CFG.Net.BloomFilters = false
+	}()
+
+	elem := bytes.Repeat([]byte{0xab}, 20)
+	var tv = []struct {
+		cmd string
+		pl []byte
+		loaded bool // filterload sent before
+		ban bool
+		misbehave int
+		bloom bool // the peer has a filter afterwards
+	} {
+		{"filterload", testFilterLoad(10, 5), false, false, 0, true},
+		{"filterload", testFilterLoad(btc.MAX_BLOOM_FILTER_SIZE, btc.MAX_BLOOM_HASH_FUNCS), false, false, 0, true},
+		{"filterload", testFilterLoad(btc.MAX_BLOOM_FILTER_SIZE+1, 5), false, true, 0, false},
+		{"filterload", testFilterLoad(10, btc.MAX_BLOOM_HASH_FUNCS+1), false, true, 0, false},
+		{"filterload", testFilterLoad(10, 5)[1:], false, true, 0, false},
+		{"filterload", testPl(0, 10, make([]byte, 9+9)), false, true, 0, false},
+		{"filterload", testPl(0), false, true, 0, false},
+		{"filterload", testPl(0, uint64(0xffffffffffffffff), make([]byte, 9)), false, true, 0, false},
+		{"filterload", testPl(0, uint64(0xfffffff7), make([]byte, 9)), false, true, 0, false},
+		{"filteradd", testPl(0, 20, elem), true, false, 0, true},
+		{"filteradd", testPl(0, btc.MAX_SCRIPT_ELEMENT_SIZE, make([]byte, btc.MAX_SCRIPT_ELEMENT_SIZE)), true, false, 0, true},
+		{"filteradd", testPl(0, btc.MAX_SCRIPT_ELEMENT_SIZE+1, make([]byte, btc.MAX_SCRIPT_ELEMENT_SIZE+1)), true, true, 0, true},
+		{"filteradd", testPl(0, 20, elem[:19]), true, true, 0, true},
+		{"filteradd", testPl(0, 20, elem, []byte{0}), true, true, 0, true},
+		{"filteradd", testPl(0, uint64(0xffffffffffffffff), elem), true, true, 0, true},
+		{"filteradd", testPl(0), true, true, 0, true},
+		{"filteradd", testPl(0, 20, elem), false, false, 100, false},
+		{"filterclear", nil, true, false, 0, false},
+	}
+	for i := range tv {
+		c := testConn()
+		if tv[i].loaded {
+			c.HandleFilterMsg("filterload", testFilterLoad(100, 10))
+		}
+		c.HandleFilterMsg(tv[i].cmd, tv[i].pl)
+		if !testPunished(c, tv[i].ban, tv[i].misbehave) || (c.bloom != nil) != tv[i].bloom {
+			t.Error(i, "Unexpected result", c.banit, c.X.Misbehave, c.bloom != nil)
+		}
+	}
+
+	c := testConn()
+	c.HandleFilterMsg("filterload", testFilterLoad(100, 10))
+	if c.bloom.Contains(elem) {
+		t.Error("Empty filter matches")
+	}
+	c.HandleFilterMsg("filteradd", testPl(0, 20, elem))
+	if !c.bloom.Contains(elem) {
+		t.Error("Added element not matched")
+	}
+
+	common.CFG.Net.BloomFilters = false
+	c = testConn()
+	c.HandleFilterMsg("filterload", testFilterLoad(10, 5))
+	if !c.banit || c.bloom != nil {
+		t.Error("filterload accepted with BloomFilters disabled")
+	}
+}
@@ -0,0 +1,152 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// Serving compact block filters (BIP157)
+
+const (
+	MAX_GETCFILTERS_SIZE = 1000
+	MAX_GETCFHEADERS_SIZE = 2000
+	CFCHECKPT_INTERVAL = 1000
+)
+
+
+// Returns the chain of blocks from start_height up to stop_hash (both inclusive)
+func cfilterNodes(start_height uint32, stop_hash []byte, max uint32) (nodes []*chain.BlockTreeNode, ok bool) {
+	common.BlockChain.BlockIndexAccess.Lock()
+	defer common.BlockChain.BlockIndexAccess.Unlock()
+	stop := common.BlockChain.BlockIndex[btc.NewUint256(stop_hash).BIdx()]
+	if stop == nil || start_height > stop.Height || stop.Height-start_height >= max {
+		return
+	}
+	nodes = make([]*chain.BlockTreeNode, stop.Height-start_height+1)
+	for n := stop; n != nil && n.Height >= start_height; n = n.Parent {
+		nodes[n.Height-start_height] = n
+	}
+	ok = true
+	return
+}
+
+
+// Parses "getcfilters" or "getcfheaders". Returns nil if the request should be ignored.
+func (c *OneConnection) cfilterRequest(pl []byte, max uint32) []*chain.BlockTreeNode {
+	if common.BlockChain.Filters == nil {
+		common.CountSafe("CFilterDisabled")
+		return nil
+	}
+	if len(pl) != 37 || pl[0] != btc.BASIC_FILTER {
+		c.DoS("BadCFilterReq")
+		return nil
+	}
+	nodes, ok := cfilterNodes(binary.LittleEndian.Uint32(pl[1:5]), pl[5:37], max)
+	if !ok {
+		c.Misbehave("BadCFilterRange", 100)
+		return nil
+	}
+	return nodes
+}
+
+
+// Handles "getcfilters"
+func (c *OneConnection) ProcessGetCFilters(pl []byte) {
+	nodes := c.cfilterRequest(pl, MAX_GETCFILTERS_SIZE)
+	for _, n := range nodes {
+		f, e := common.BlockChain.Filters.Get(n.BlockHash)
+		if e != nil {
+			common.CountSafe("CFilterMissing")
+			return
+		}
+		msg := new(bytes.Buffer)
+		msg.WriteByte(btc.BASIC_FILTER)
+		msg.Write(n.BlockHash.Hash[:])
+		btc.WriteVlen(msg, uint64(len(f)))
+		msg.Write(f)
+		c.SendRawMsg("cfilter", msg.Bytes())
+	}
+	common.CountSafeAdd("CFilterSent", uint64(len(nodes)))
+}
+
+
+// Handles "getcfheaders"
+func (c *OneConnection) ProcessGetCFHeaders(pl []byte) {
+	var prev [32]byte
+	nodes := c.cfilterRequest(pl, MAX_GETCFHEADERS_SIZE)
+	if len(nodes) == 0 {
+		return
+	}
+	if nodes[0].Parent != nil {
+		var ok bool
+		if prev, ok = common.BlockChain.Filters.Header(nodes[0].Parent.BlockHash); !ok {
+			common.CountSafe("CFilterMissing")
+			return
+		}
+	}
+
+	msg := new(bytes.Buffer)
+	msg.WriteByte(btc.BASIC_FILTER)
+	msg.Write(pl[5:37])
+	msg.Write(prev[:])
+	btc.WriteVlen(msg, uint64(len(nodes)))
+	for _, n := range nodes {
+		f, e := common.BlockChain.Filters.Get(n.BlockHash)
+		if e != nil {
+			common.CountSafe("CFilterMissing")
+			return
+		}
+		fh := btc.Sha2Sum(f)
+		msg.Write(fh[:])
+	}
+	c.SendRawMsg("cfheaders", msg.Bytes())
+	common.CountSafe("CFHeadersSent")
+}
+
+
+// Handles "getcfcheckpt"
+func (c *OneConnection) ProcessGetCFCheckpt(pl []byte) {
+	if common.BlockChain.Filters == nil {
+		common.CountSafe("CFilterDisabled")
+		return
+	}
+	if len(pl) != 33 || pl[0] != btc.BASIC_FILTER {
+		c.DoS("BadCFilterReq")
+		return
+	}
+
+	var hashes []*btc.Uint256
+	common.BlockChain.BlockIndexAccess.Lock()
+	stop := common.BlockChain.BlockIndex[btc.NewUint256(pl[1:33]).BIdx()]
+	if stop != nil {
+		hashes = make([]*btc.Uint256, stop.Height/CFCHECKPT_INTERVAL)
+		for n := stop; n != nil && n.Height >= CFCHECKPT_INTERVAL; n = n.Parent {
+			if n.Height%CFCHECKPT_INTERVAL == 0 {
+				hashes[n.Height/CFCHECKPT_INTERVAL-1] = n.BlockHash
+			}
+		}
+	}
+	common.BlockChain.BlockIndexAccess.Unlock()
+	if stop == nil {
+		common.CountSafe("CFCheckptUnknown")
+		return
+	}
+
+	msg := new(bytes.Buffer)
+	msg.WriteByte(btc.BASIC_FILTER)
+	msg.Write(pl[1:33])
+	btc.WriteVlen(msg, uint64(len(hashes)))
+	for _, h := range hashes {
+		hdr, ok := common.BlockChain.Filters.Header(h)
+		if !ok {
+			common.CountSafe("CFilterMissing")
+			return
+		}
+		msg.Write(hdr[:])
+	}
+	c.SendRawMsg("cfcheckpt", msg.Bytes())
+	common.CountSafe("CFCheckptSent")
+}
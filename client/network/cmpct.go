@@ -0,0 +1,543 @@
+package network
+
+import (
+	"time"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/others/siphash"
+)
+
+/*
+  Compact block relay (BIP152), version 1
+*/
+
+const (
+	CmpctHighBandwidthPeers = 3 // Ask this many peers to send us new blocks in the high-bandwidth mode
+	CmpctMaxDepth = 10 // Do not send cmpctblock for blocks that are deeper than this
+	CmpctMaxTxs = uint64(btc.MAX_BLOCK_SIZE)/60 // No block can have more txs than this
+)
+
+// Compact block that we are reconstructing, while waiting for the missing txs (blocktxn)
+type cmpctBlockPending struct {
+	hash *btc.Uint256
+	header []byte
+	txs [][]byte // raw txs; nil for the ones that we still miss
+	missing []int // indexes of the missing txs
+	start time.Time
+}
+
+var (
+	// ConnIDs of the peers that we asked to announce new blocks in the high-bandwidth mode
+	cmpctHBPeers []uint32
+)
+
+
+// Returns the keys for the short tx IDs, calculated from the given header and nonce
+func cmpctKeys(header, nonce []byte) (k0, k1 uint64) {
+	sha := sha256.New()
+	sha.Write(header[:80])
+	sha.Write(nonce[:8])
+	k := sha.Sum(nil)
+	k0 = binary.LittleEndian.Uint64(k[0:8])
+	k1 = binary.LittleEndian.Uint64(k[8:16])
+	return
+}
+
+
+// Returns the 6 bytes short ID of a tx
+func cmpctShortID(k0, k1 uint64, txid *btc.Uint256) uint64 {
+	return siphash.Hash(k0, k1, txid.Hash[:]) & 0xffffffffffff
+}
+
+
+// Sends "sendcmpct" to the peer
+func (c *OneConnection) SendCmpct(announce bool) {
+	var pl [9]byte
+	if announce {
+		pl[0] = 1
+	}
+	binary.LittleEndian.PutUint64(pl[1:], 1)
+	c.SendRawMsg("sendcmpct", pl[:])
+}
+
+
+// Handles incoming "sendcmpct"
+func (c *OneConnection) HandleSendCmpct(pl []byte) {
+	if len(pl) != 9 {
+		c.DoS("SendCmpctErr")
+		return
+	}
+	if binary.LittleEndian.Uint64(pl[1:9]) != 1 {
+		common.CountSafe("SendCmpctVerUnkn")
+		return
+	}
+	c.Mutex.Lock()
+	c.Node.SendCmpctVer = 1
+	c.Node.HighBandwidth = pl[0]==1
+	c.Mutex.Unlock()
+}
+
+
+// Called when the peer has delivered us a new block.
+// Makes sure that it is among the high-bandwidth peers.
+func (c *OneConnection) cmpctBlockDelivered() {
+	if !common.CFG.Net.CompactBlocks || c.Node.SendCmpctVer != 1 {
+		return
+	}
+
+	Mutex_net.Lock()
+	defer Mutex_net.Unlock()
+	for _, id := range cmpctHBPeers {
+		if id == c.ConnID {
+			return
+		}
+	}
+
+	if len(cmpctHBPeers) >= CmpctHighBandwidthPeers {
+		// Switch the oldest one back to the low-bandwidth mode
+		for _, v := range OpenCons {
+			if v.ConnID == cmpctHBPeers[0] {
+				v.SendCmpct(false)
+				break
+			}
+		}
+		cmpctHBPeers = cmpctHBPeers[1:]
+	}
+	cmpctHBPeers = append(cmpctHBPeers, c.ConnID)
+	c.SendCmpct(true)
+	common.CountSafe("CmpctHBPeerNew")
+}
+
+
+// Returns serialized "cmpctblock" message for the given raw block
+func cmpctBlockMsg(raw []byte) []byte {
+	bl, er := btc.NewBlock(raw)
+	if er != nil {
+		return nil
+	}
+	if bl.BuildTxList() != nil {
+		return nil
+	}
+
+	var nonce [8]byte
+	binary.LittleEndian.PutUint64(nonce[:], uint64(time.Now().UnixNano()))
+	k0, k1 := cmpctKeys(raw[:80], nonce[:])
+
+	msg := new(bytes.Buffer)
+	msg.Write(raw[:80])
+	msg.Write(nonce[:])
+	btc.WriteVlen(msg, uint64(len(bl.Txs)-1))
+	var sid [8]byte
+	for i:=1; i<len(bl.Txs); i++ {
+		binary.LittleEndian.PutUint64(sid[:], cmpctShortID(k0, k1, bl.Txs[i].Hash))
+		msg.Write(sid[:6])
+	}
+	// We always prefill only the coinbase
+	btc.WriteVlen(msg, 1)
+	btc.WriteVlen(msg, 0)
+	msg.Write(raw[bl.TxOffset:bl.TxOffset+int(bl.Txs[0].Size)])
+	return msg.Bytes()
+}
+
+
+// Sends "cmpctblock" to the peer (or "block" if the requested one is too deep)
+func (c *OneConnection) SendCmpctBlock(hash *btc.Uint256) bool {
+	raw, _, er := common.BlockChain.Blocks.BlockGet(hash)
+	if er != nil {
+		return false
+	}
+
+	common.BlockChain.BlockIndexAccess.Lock()
+	node := common.BlockChain.BlockIndex[hash.BIdx()]
+	common.BlockChain.BlockIndexAccess.Unlock()
+	common.Last.Mutex.Lock()
+	top := common.Last.Block.Height
+	common.Last.Mutex.Unlock()
+
+	if node==nil || node.Height+CmpctMaxDepth < top {
+		common.CountSafe("CmpctBlockTooDeep")
+		c.SendRawMsg("block", raw)
+		return true
+	}
+
+	if msg := cmpctBlockMsg(raw); msg != nil {
+		c.SendRawMsg("cmpctblock", msg)
+		return true
+	}
+	return false
+}
+
+
+// Parses "getblocktxn" payload. Returns the block hash and absolute indexes of the txs.
+// On error, returns the name of the offence.
+func parseGetBlockTxn(pl []byte) (hash *btc.Uint256, idxs []uint64, why string) {
+	if len(pl) < 34 {
+		why = "GetBlkTxnErr1"
+		return
+	}
+	hash = btc.NewUint256(pl[:32])
+	b := bytes.NewReader(pl[32:])
+	cnt, er := btc.ReadVLen(b)
+	if er != nil || cnt > CmpctMaxTxs || cnt > uint64(b.Len()) {
+		why = "GetBlkTxnErr2"
+		return
+	}
+	idxs = make([]uint64, cnt)
+	var idx uint64
+	for i := range idxs {
+		diff, er := btc.ReadVLen(b)
+		if er != nil {
+			why = "GetBlkTxnErr3"
+			return
+		}
+		if i > 0 {
+			idx++
+		}
+		idx += diff
+		if diff >= CmpctMaxTxs || idx >= CmpctMaxTxs {
+			why = "GetBlkTxnErr4"
+			return
+		}
+		idxs[i] = idx
+	}
+	return
+}
+
+
+// Handles incoming "getblocktxn"
+func (c *OneConnection) ProcessGetBlockTxn(pl []byte) {
+	hash, idxs, why := parseGetBlockTxn(pl)
+	if why != "" {
+		c.Misbehave(why, MisbehaveMalformed)
+		return
+	}
+
+	raw, _, er := common.BlockChain.Blocks.BlockGet(hash)
+	if er != nil {
+		common.CountSafe("GetBlkTxnUnknown")
+		return
+	}
+	bl, er := btc.NewBlock(raw)
+	if er != nil || bl.BuildTxList() != nil {
+		return
+	}
+
+	// Offsets of the txs inside the raw block
+	offs := make([]int, len(bl.Txs)+1)
+	offs[0] = bl.TxOffset
+	for i := range bl.Txs {
+		offs[i+1] = offs[i] + int(bl.Txs[i].Size)
+	}
+
+	msg := new(bytes.Buffer)
+	msg.Write(hash.Hash[:])
+	btc.WriteVlen(msg, uint64(len(idxs)))
+	for _, idx := range idxs {
+		if idx >= uint64(len(bl.Txs)) {
+			c.DoS("GetBlkTxnErr4")
+			return
+		}
+		msg.Write(raw[offs[idx]:offs[idx+1]])
+	}
+	c.SendRawMsg("blocktxn", msg.Bytes())
+}
+
+
+// Makes sure that the block is expected from this peer.
+// Accepts its header, if it has not been seen before.
+// Returns false if we should ignore the compact block.
+func (c *OneConnection) cmpctBlockExpected(hdr []byte, hash *btc.Uint256) bool {
+	idx := hash.BIdx()
+
+	c.Mutex.Lock()
+	_, asked := c.GetBlockInProgress[idx]
+	c.Mutex.Unlock()
+	if !asked && !c.isCmpctHBPeer() {
+		// We only take unsolicited compact blocks from the high-bandwidth peers
+		common.CountSafe("CmpctBlockUnsolicited")
+		return false
+	}
+
+	MutexRcv.Lock()
+	defer MutexRcv.Unlock()
+
+	if _, got := ReceivedBlocks[idx]; got {
+		common.CountSafe("CmpctBlockOld")
+		return false
+	}
+
+	b2g := BlocksToGet[idx]
+	if b2g == nil {
+		// New block announced in the high-bandwidth mode
+		bl, er := btc.NewBlock(append(append([]byte{}, hdr[:80]...), 0))
+		if er != nil {
+			return false
+		}
+		common.BlockChain.BlockIndexAccess.Lock()
+		er, dos, _ := common.BlockChain.PreCheckBlock(bl)
+		if er != nil {
+			common.BlockChain.BlockIndexAccess.Unlock()
+			common.CountSafe("CmpctBlockHdrFail")
+			if dos {
+				c.DoS("BadCmpctHeader")
+			} else {
+				c.X.AllHeadersReceived = false // maybe we miss its parent
+			}
+			return false
+		}
+		node := common.BlockChain.AcceptHeader(bl)
+		LastCommitedHeader = node
+		common.BlockChain.BlockIndexAccess.Unlock()
+		if node.Height > c.Node.Height {
+			c.Node.Height = node.Height
+		}
+		b2g = &OneBlockToGet{Block:bl, BlockTreeNode:node, InProgress:0}
+		BlocksToGet[idx] = b2g
+		common.CountSafe("CmpctBlockNew")
+	}
+
+	c.Mutex.Lock()
+	if _, ok := c.GetBlockInProgress[idx]; !ok {
+		c.GetBlockInProgress[idx] = c.newBlockDl(hash, common.GetAverageBlockSize())
+		b2g.InProgress++
+	}
+	c.Mutex.Unlock()
+	return true
+}
+
+
+// Returns true if we asked the peer to send us new blocks in the high-bandwidth mode
+func (c *OneConnection) isCmpctHBPeer() bool {
+	Mutex_net.Lock()
+	defer Mutex_net.Unlock()
+	for _, id := range cmpctHBPeers {
+		if id == c.ConnID {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Parses "cmpctblock" payload. Returns the short IDs and all the txs of the block,
+// with only the prefilled ones set. On error, returns the name of the offence.
+func parseCmpctBlock(pl []byte) (shortids []uint64, txs [][]byte, why string) {
+	if len(pl) < 90 {
+		why = "CmpctBlkErr1"
+		return
+	}
+
+	b := bytes.NewReader(pl[88:])
+	cnt, er := btc.ReadVLen(b)
+	if er != nil || cnt > CmpctMaxTxs || cnt > uint64(b.Len())/6 {
+		why = "CmpctBlkErr2"
+		return
+	}
+	shortids = make([]uint64, cnt)
+	var sid [8]byte
+	for i := range shortids {
+		b.Read(sid[:6])
+		shortids[i] = binary.LittleEndian.Uint64(sid[:])
+	}
+
+	pcnt, er := btc.ReadVLen(b)
+	if er != nil || pcnt > CmpctMaxTxs-cnt || pcnt > uint64(b.Len())/11 || cnt+pcnt == 0 {
+		shortids = nil
+		why = "CmpctBlkErr3"
+		return
+	}
+	txs = make([][]byte, cnt+pcnt)
+	idx := -1
+	for i:=uint64(0); i<pcnt; i++ {
+		diff, er := btc.ReadVLen(b)
+		if er != nil {
+			why = "CmpctBlkErr4"
+			break
+		}
+		if diff >= uint64(len(txs)) || idx+int(diff)+1 >= len(txs) {
+			why = "CmpctBlkErr5"
+			break
+		}
+		idx += int(diff) + 1
+		rest := pl[len(pl)-b.Len():]
+		_, n, e := btc.NewTx(rest)
+		if e != nil {
+			why = "CmpctBlkErr6"
+			break
+		}
+		txs[idx] = rest[:n]
+		b.Seek(int64(n), 1)
+	}
+	if why != "" {
+		shortids, txs = nil, nil
+	}
+	return
+}
+
+
+// Handles incoming "cmpctblock"
+func (c *OneConnection) ProcessCmpctBlock(pl []byte) {
+	shortids, txs, why := parseCmpctBlock(pl)
+	if why != "" {
+		c.Misbehave(why, MisbehaveMalformed)
+		return
+	}
+
+	hash := btc.NewSha2Hash(pl[:80])
+	if !c.cmpctBlockExpected(pl[:80], hash) {
+		return
+	}
+
+	// Match the short IDs with the txs in our mempool
+	k0, k1 := cmpctKeys(pl[:80], pl[80:88])
+	mempool := make(map[uint64] []byte, len(TransactionsToSend))
+	TxMutex.Lock()
+	for _, v := range TransactionsToSend {
+		id := cmpctShortID(k0, k1, v.Tx.Hash)
+		if _, ok := mempool[id]; ok {
+			mempool[id] = nil // collision - we will need to ask for it
+		} else {
+			mempool[id] = v.Data
+		}
+	}
+	TxMutex.Unlock()
+
+	pend := &cmpctBlockPending{hash:hash, header:pl[:80], txs:txs, start:time.Now()}
+	var sidx int
+	for i := range txs {
+		if txs[i] != nil {
+			continue
+		}
+		if raw := mempool[shortids[sidx]]; raw != nil {
+			txs[i] = raw
+		} else {
+			pend.missing = append(pend.missing, i)
+		}
+		sidx++
+	}
+
+	if len(pend.missing)==0 {
+		common.CountSafe("CmpctBlockFull")
+		c.cmpctBlockComplete(pend)
+		return
+	}
+
+	common.CountSafe("CmpctBlockPartial")
+	c.Mutex.Lock()
+	c.cmpct = pend
+	c.Mutex.Unlock()
+
+	msg := new(bytes.Buffer)
+	msg.Write(hash.Hash[:])
+	btc.WriteVlen(msg, uint64(len(pend.missing)))
+	for i, v := range pend.missing {
+		if i==0 {
+			btc.WriteVlen(msg, uint64(v))
+		} else {
+			btc.WriteVlen(msg, uint64(v-pend.missing[i-1]-1))
+		}
+	}
+	c.SendRawMsg("getblocktxn", msg.Bytes())
+}
+
+
+// Handles incoming "blocktxn"
+func (c *OneConnection) ProcessBlockTxn(pl []byte) {
+	if len(pl) < 33 {
+		c.Misbehave("BlkTxnErr1", MisbehaveMalformed)
+		return
+	}
+
+	c.Mutex.Lock()
+	pend := c.cmpct
+	if pend==nil || !bytes.Equal(pend.hash.Hash[:], pl[:32]) {
+		c.Mutex.Unlock()
+		common.CountSafe("BlkTxnUnexpected")
+		return
+	}
+	c.cmpct = nil
+	c.Mutex.Unlock()
+
+	txs, why := parseBlockTxn(pl, len(pend.missing))
+	if why != "" {
+		c.Misbehave(why, MisbehaveMalformed)
+		return
+	}
+	for i, idx := range pend.missing {
+		pend.txs[idx] = txs[i]
+	}
+	c.cmpctBlockComplete(pend)
+}
+
+
+// Parses "blocktxn" payload, that is expected to carry cnt txs.
+// On error, returns the name of the offence.
+func parseBlockTxn(pl []byte, cnt int) (txs [][]byte, why string) {
+	b := bytes.NewReader(pl[32:])
+	le, er := btc.ReadVLen(b)
+	if er != nil || le != uint64(cnt) {
+		why = "BlkTxnErr2"
+		return
+	}
+	txs = make([][]byte, cnt)
+	for i := range txs {
+		rest := pl[len(pl)-b.Len():]
+		_, n, e := btc.NewTx(rest)
+		if e != nil {
+			return nil, "BlkTxnErr3"
+		}
+		txs[i] = rest[:n]
+		b.Seek(int64(n), 1)
+	}
+	return
+}
+
+
+// Builds the raw block and passes it on as if we had received it in a "block" message
+func (c *OneConnection) cmpctBlockComplete(pend *cmpctBlockPending) {
+	mtr := make([][]byte, len(pend.txs))
+	raw := new(bytes.Buffer)
+	raw.Write(pend.header)
+	btc.WriteVlen(raw, uint64(len(pend.txs)))
+	for i := range pend.txs {
+		raw.Write(pend.txs[i])
+		mtr[i] = btc.NewSha2Hash(pend.txs[i]).Hash[:]
+	}
+
+	if merkle, _ := btc.CalcMerkel(mtr); !bytes.Equal(merkle, pend.header[36:68]) {
+		// Most likely a short ID collision - get the full block then
+		common.CountSafe("CmpctBlockBadMerkle")
+		c.getFullBlock(pend.hash)
+		return
+	}
+
+	netBlockReceived(c, raw.Bytes())
+	c.cmpctBlockDelivered()
+}
+
+
+// Asks the peer for the full block
+func (c *OneConnection) getFullBlock(hash *btc.Uint256) {
+	c.SendRawMsg("getdata", wire.EncodeInv([]wire.InvVect{{Type:wire.MSG_BLOCK, Hash:hash.Hash}}))
+}
+
+
+// Called from Tick() - if the peer does not send us the missing txs in time, get the full block
+func (c *OneConnection) cmpctCheckTimeout() {
+	c.Mutex.Lock()
+	pend := c.cmpct
+	if pend!=nil && time.Now().Sub(pend.start) > GetBlockTimeout {
+		c.cmpct = nil
+	} else {
+		pend = nil
+	}
+	c.Mutex.Unlock()
+	if pend != nil && !blockReceived(pend.hash) {
+		common.CountSafe("BlkTxnTimeout")
+		c.getFullBlock(pend.hash)
+	}
+}
@@ -0,0 +1,128 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// The genesis block coinbase
+var testTx, _ = hex.DecodeString("01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000")
+
+// Builds a payload made of the given prefix followed by var_ints and raw data
+func testPl(prefix int, items ...interface{}) []byte {
+	b := bytes.NewBuffer(make([]byte, prefix))
+	for _, v := range items {
+		switch v := v.(type) {
+			case int:
+				btc.WriteVlen(b, uint64(v))
+			case uint64:
+				btc.WriteVlen(b, v)
+			case []byte:
+				b.Write(v)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestParseCmpctBlock(t *testing.T) {
+	sids := make([]byte, 12)
+	sids[0], sids[6] = 1, 2
+	var tv = []struct {
+		pl []byte
+		why string
+		sids, txs int
+	} {
+		{testPl(88, 2, sids, 1, 0, testTx), "", 2, 3},
+		{testPl(88, 0, 1, 0, testTx), "", 0, 1},
+		{testPl(88, 0, 2, 0, testTx, 0, testTx), "", 0, 2},
+		{testPl(80), "CmpctBlkErr1", 0, 0},
+		{testPl(88, 0, 0), "CmpctBlkErr3", 0, 0},
+		{testPl(88, 3, sids), "CmpctBlkErr2", 0, 0},
+		{testPl(88, uint64(0x2AAAAAAAAAAAAAAB), sids), "CmpctBlkErr2", 0, 0},
+		{testPl(88, CmpctMaxTxs+1, make([]byte, 6*(CmpctMaxTxs+1))), "CmpctBlkErr2", 0, 0},
+		{testPl(88, 2, sids, uint64(0xffffffffffffffff), 0, testTx), "CmpctBlkErr3", 0, 0},
+		{testPl(88, 2, sids, 100, 0, testTx), "CmpctBlkErr3", 0, 0},
+		{testPl(88, 2, sids, 1, 3, testTx), "CmpctBlkErr5", 0, 0},
+		{testPl(88, 2, sids, 1, uint64(btc.MaxVLen), testTx), "CmpctBlkErr5", 0, 0},
+		{testPl(88, 2, sids, 1, uint64(btc.MaxVLen+1), testTx), "CmpctBlkErr4", 0, 0},
+		{testPl(88, 2, sids, 1, []byte{0xfd, 0, 0}, testTx), "CmpctBlkErr4", 0, 0},
+		{testPl(88, 0, 2, 0, testTx, 1, testTx), "CmpctBlkErr5", 0, 0},
+		{testPl(88, 2, sids, 1, 0, testTx[:100]), "CmpctBlkErr6", 0, 0},
+	}
+	for i := range tv {
+		shortids, txs, why := parseCmpctBlock(tv[i].pl)
+		if why != tv[i].why || len(shortids) != tv[i].sids || len(txs) != tv[i].txs {
+			t.Error(i, "Unexpected result", why, len(shortids), len(txs))
+		}
+	}
+
+	shortids, txs, _ := parseCmpctBlock(tv[0].pl)
+	if shortids[0] != 1 || shortids[1] != 2 {
+		t.Error("Bad short IDs", shortids)
+	}
+	if !bytes.Equal(txs[0], testTx) || txs[1] != nil || txs[2] != nil {
+		t.Error("Bad prefilled txs")
+	}
+}
+
+func TestParseGetBlockTxn(t *testing.T) {
+	var tv = []struct {
+		pl []byte
+		why string
+		idxs []uint64
+	} {
+		{testPl(32, 3, 0, 0, 5), "", []uint64{0, 1, 7}},
+		{testPl(32, 0, 0), "", []uint64{}},
+		{testPl(31), "GetBlkTxnErr1", nil},
+		{testPl(32, 3, 0, 0), "GetBlkTxnErr2", nil},
+		{testPl(32, uint64(0xffffffffffffffff), 0), "GetBlkTxnErr2", nil},
+		{testPl(32, CmpctMaxTxs+1, make([]byte, CmpctMaxTxs+1)), "GetBlkTxnErr2", nil},
+		{testPl(32, 2, 0, []byte{0xfd}), "GetBlkTxnErr3", nil},
+		{testPl(32, 2, 1, uint64(btc.MaxVLen)), "GetBlkTxnErr4", nil},
+		{testPl(32, 2, 1, uint64(0xffffffffffffffff)), "GetBlkTxnErr3", nil},
+		{testPl(32, 2, CmpctMaxTxs-1, 0), "GetBlkTxnErr4", nil},
+	}
+	for i := range tv {
+		_, idxs, why := parseGetBlockTxn(tv[i].pl)
+		if why != tv[i].why {
+			t.Error(i, "Unexpected result", why)
+			continue
+		}
+		if why == "" {
+			if len(idxs) != len(tv[i].idxs) {
+				t.Error(i, "Bad indexes", idxs)
+				continue
+			}
+			for j := range idxs {
+				if idxs[j] != tv[i].idxs[j] {
+					t.Error(i, "Bad indexes", idxs)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestParseBlockTxn(t *testing.T) {
+	var tv = []struct {
+		pl []byte
+		cnt int
+		why string
+	} {
+		{testPl(32, 2, testTx, testTx), 2, ""},
+		{testPl(32, 0), 0, ""},
+		{testPl(32, 2, testTx, testTx), 3, "BlkTxnErr2"},
+		{testPl(32, uint64(0xffffffffffffffff)), 2, "BlkTxnErr2"},
+		{testPl(32, 2, testTx, testTx[:50]), 2, "BlkTxnErr3"},
+	}
+	for i := range tv {
+		txs, why := parseBlockTxn(tv[i].pl, tv[i].cnt)
+		if why != tv[i].why {
+			t.Error(i, "Unexpected result", why)
+		} else if why == "" && len(txs) != tv[i].cnt {
+			t.Error(i, "Bad number of txs", len(txs))
+		}
+	}
+}
@@ -5,13 +5,12 @@ import (
 	"net"
 	"time"
 	"sync"
-	"bytes"
 	"errors"
-	"strings"
+	"encoding/hex"
 	"sync/atomic"
 	"crypto/rand"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	//"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
@@ -37,6 +36,12 @@ const (
 	PingAssumedIfUnsupported = 999 // ms
 
 	DropSlowestEvery = 10*time.Minute // Look for the slowest peer and drop it
+	MisbehaveBanScore = 1000 // Ban the peer when its misbehavior score reaches this value
+	MisbehaveMalformed = 250 // Weight of sending us a message that cannot be parsed
+
+	AddNodeMinRetry = 30*time.Second // Reconnect to AddNode peers after this time, doubling it on each failure
+	AddNodeMaxRetry = 30*time.Minute
+	FeelerEvery = 2*time.Minute // Connect to a random "new" address, to check if it is good
 
 	MIN_PROTO_VERSION = 209
 
@@ -53,12 +58,21 @@ var (
 	Mutex_net sync.Mutex
 	OpenCons map[uint64]*OneConnection = make(map[uint64]*OneConnection)
 	InConsActive, OutConsActive uint32
+	BlockOnlyActive uint32
 	LastConnId uint32
 	nonce [8]byte
 
-	// Hammering protection (peers that keep re-connecting) map IPv4 => UnixTime
+	// Hammering protection (peers that keep re-connecting) map IP => UnixTime
 	HammeringMutex sync.Mutex
-	RecentlyDisconencted map[[4]byte] time.Time = make(map[[4]byte] time.Time)
+	RecentlyDisconencted map[[16]byte] time.Time = make(map[[16]byte] time.Time)
+)
+
+// Kinds of outgoing connections
+const (
+	OUT_FULL = iota // regular one, counted in OutConsActive
+	OUT_FEELER
+	OUT_ADDNODE
+	OUT_BLOCKONLY // counted in BlockOnlyActive
 )
 
 type NetworkNodeStruct struct {
@@ -68,12 +82,19 @@ type NetworkNodeStruct struct {
 	Height uint32
 	Agent string
 	DoNotRelayTxs bool
-	ReportedIp4 uint32
+	ReportedIp net.IP
 	SendHeaders bool
+	SendCmpctVer uint64 // version of compact blocks that the peer wants (0 - none)
+	HighBandwidth bool // the peer wants new blocks announced with cmpctblock
+	SendAddrV2 bool // the peer wants addresses in addrv2 messages (BIP155)
+	FeeFilter uint64 // the peer does not want invs of txs paying less (satoshis per 1000 bytes) - BIP133
 }
 
 type ConnectionStatus struct {
 	Incomming bool
+	Feeler bool // short-lived connection, only to see if the peer is alive
+	AddNode bool // connection to one of the peers from Net.AddNode
+	BlockOnly bool // block-relay-only connection: we do not exchange txs nor addresses over it
 	ConnectedAt time.Time
 	VerackReceived bool
 	LastBtsRcvd, LastBtsSent uint32
@@ -85,6 +106,9 @@ type ConnectionStatus struct {
 	GetHeadersInProgress bool
 	GetBlocksDataNow bool
 	LastFetchTried time.Time
+	BlockDlSpeed uint64 // measured block download speed in bytes per second (see stall.go)
+	BlockStalls uint // number of block download stalls in a row
+	BlocksStalled uint64 // total number of blocks that the peer did not deliver in time
 
 	LastSent time.Time
 	MaxSentBufSize int
@@ -95,6 +119,14 @@ type ConnectionStatus struct {
 
 	BytesReceived, BytesSent uint64
 	Counters map[string]uint64
+
+	Misbehave int // Sum of weights of the offences - see MisbehaveBanScore
+	LastOffence string
+	Perms uint32 // PERM_* flags from Net.Whitelist
+	Encrypted bool // BIP324 v2 transport
+	FeeFilterSent uint64 // our "feefilter" value, last sent to the peer
+	MempoolAsked bool // we have sent "mempool" to the peer
+	NextTxInvs, NextOwnTxInvs time.Time // when to flush the tx invs queues
 }
 
 type ConnInfo struct {
@@ -108,6 +140,9 @@ type ConnInfo struct {
 	BlocksInProgress int
 	InvsToSend int
 	AveragePing int
+	Permissions string
+	SessionID string // of the encrypted transport
+	Rejects []RejectInfo // recently received "reject" messages
 }
 
 type OneConnection struct {
@@ -119,7 +154,6 @@ type OneConnection struct {
 
 	broken bool // flag that the conenction has been broken / shall be disconnected
 	banit bool // Ban this client after disconnecting
-	misbehave int // When it reaches 1000, ban it
 
 	net.Conn
 
@@ -130,34 +164,48 @@ type OneConnection struct {
 
 	// Messages reception state machine:
 	recv struct {
-		hdr [24]byte
+		hdr [wire.HeaderLen]byte
 		hdr_len int
+		msg *wire.Header
 		pl_len uint32 // length taken from the message header
 		cmd string
 		dat []byte
 		datlen uint32
 	}
 
+	v2 *btc.V2Cipher // set if BIP324 encrypted transport is used
+
+	rejects []*RejectInfo // recently received "reject" messages
+
 	// Message sending state machine:
 	sendBuf [SendBufSize]byte
 	SendBufProd, SendBufCons int
 
 	// Statistics:
-	PendingInvs []*[36]byte // List of pending INV to send and the mutex protecting access to it
+	PendingInvs []*wire.InvVect // List of pending INV to send and the mutex protecting access to it
+	txInvs, ownTxInvs []*wire.InvVect // tx invs waiting for the Poisson-timed flush (see trickle.go)
+	stemAsked map[[btc.Uint256IdxLen]byte] bool // txs requested with MSG_DANDELION_TX
 
 	GetBlockInProgress map[[btc.Uint256IdxLen]byte] *oneBlockDl
+	stalledBlocks map[[btc.Uint256IdxLen]byte] *oneBlockDl // taken back from GetBlockInProgress after the deadline
+	lastBlockRcvd time.Time
 
 	// Ping stats
 	NextPing time.Time
 	LastPingSent time.Time
-	PingInProgress []byte
+	PingInProgress *uint64 // nonce of the ping that we wait the pong for
 
 	counters map[string] uint64
+
+	cmpct *cmpctBlockPending // compact block waiting for the missing txs
+
+	bloom *btc.BloomFilter // set by the peer's filterload (only accessed from the peer's thread)
 }
 
 type oneBlockDl struct {
 	hash *btc.Uint256
 	start time.Time
+	deadline time.Time // after this time we consider the peer stalling
 }
 
 
@@ -202,8 +250,17 @@ func (v *OneConnection) GetStats(res *ConnInfo) {
 	res.ConnectionStatus = v.X
 	res.BytesToSend = v.BytesToSent()
 	res.BlocksInProgress = len(v.GetBlockInProgress)
-	res.InvsToSend = len(v.PendingInvs)
+	res.InvsToSend = len(v.PendingInvs) + len(v.txInvs) + len(v.ownTxInvs)
 	res.AveragePing = v.GetAveragePing()
+	res.Permissions = common.PermsString(v.X.Perms)
+	if v.v2 != nil {
+		res.SessionID = hex.EncodeToString(v.v2.SessionID[:])
+	}
+
+	res.Rejects = make([]RejectInfo, len(v.rejects))
+	for i := range v.rejects {
+		res.Rejects[i] = *v.rejects[i]
+	}
 
 	res.Counters = make(map[string]uint64, len(v.counters))
 	for k, v := range v.counters {
@@ -221,11 +278,16 @@ func (c *OneConnection) SendRawMsg(cmd string, pl []byte) (e error) {
 		return
 	}
 
+	msg_len := len(pl)+wire.HeaderLen
+	if c.v2 != nil {
+		msg_len = len(pl)+13+btc.V2_OVERHEAD
+	}
+
 	// we never allow the buffer to be totally full because then producer would be equal consumer
-	if bytes_left:=SendBufSize-c.BytesToSent(); bytes_left<=len(pl)+24 {
+	if bytes_left:=SendBufSize-c.BytesToSent(); bytes_left<=msg_len {
 		c.Mutex.Unlock()
 		/*println(c.PeerAddr.Ip(), c.Node.Version, c.Node.Agent, "Peer Send Buffer Overflow @",
-			cmd, bytes_left, len(pl)+24, c.SendBufProd, c.SendBufCons, c.BytesToSent())*/
+			cmd, bytes_left, msg_len, c.SendBufProd, c.SendBufCons, c.BytesToSent())*/
 		c.Disconnect()
 		common.CountSafe("PeerSendOverflow")
 		return errors.New("Send buffer overflow")
@@ -236,20 +298,20 @@ func (c *OneConnection) SendRawMsg(cmd string, pl []byte) (e error) {
 
 	common.CountSafe("sent_"+cmd)
 	common.CountSafeAdd("sbts_"+cmd, uint64(len(pl)))
-	var sbuf [24]byte
 
 	c.X.LastCmdSent = cmd
 	c.X.LastBtsSent = uint32(len(pl))
 
-	binary.LittleEndian.PutUint32(sbuf[0:4], common.Version)
-	copy(sbuf[0:4], common.Magic[:])
-	copy(sbuf[4:16], cmd)
-	binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
-
-	sh := btc.Sha2Sum(pl[:])
-	copy(sbuf[20:24], sh[:4])
+	if c.v2 != nil {
+		c.append_to_send_buffer(c.v2.Encrypt(btc.V2EncodeMsg(cmd, pl), nil, false))
+		if x:=c.BytesToSent(); x>c.X.MaxSentBufSize {
+			c.X.MaxSentBufSize = x
+		}
+		c.Mutex.Unlock()
+		return
+	}
 
-	c.append_to_send_buffer(sbuf[:])
+	c.append_to_send_buffer(wire.MsgHeader(common.Magic, cmd, pl))
 	c.append_to_send_buffer(pl)
 
 	if x:=c.BytesToSent(); x>c.X.MaxSentBufSize {
@@ -296,9 +358,20 @@ func (c *OneConnection) IsBroken() (res bool) {
 }
 
 
+// Disconnects and bans the peer immediately, unless it has PERM_NOBAN
 func (c *OneConnection) DoS(why string) {
-	common.CountSafe("Ban"+why)
 	c.Mutex.Lock()
+	if (c.X.Perms&common.PERM_NOBAN)!=0 {
+		// only count the offence, like Misbehave does
+		common.CountSafe("NoBan"+why)
+		c.X.Misbehave += MisbehaveBanScore
+		c.X.LastOffence = why
+		c.Mutex.Unlock()
+		return
+	}
+	common.CountSafe("Ban"+why)
+	c.X.Misbehave = MisbehaveBanScore
+	c.X.LastOffence = why
 	c.banit = true
 	c.broken = true
 	if common.DebugLevel!=0 {
@@ -308,12 +381,14 @@ func (c *OneConnection) DoS(why string) {
 }
 
 
+// Adds weight of the offence to the peer's score. Returns true if the peer is being banned now.
 func (c *OneConnection) Misbehave(why string, how_much int) (res bool) {
 	c.Mutex.Lock()
 	if !c.banit {
 		common.CountSafe("Bad"+why)
-		c.misbehave += how_much
-		if c.misbehave >= 1000 {
+		c.X.Misbehave += how_much
+		c.X.LastOffence = why
+		if c.X.Misbehave >= MisbehaveBanScore && (c.X.Perms&common.PERM_NOBAN)==0 {
 			common.CountSafe("BanMisbehave")
 			res = true
 			c.banit = true
@@ -345,8 +420,12 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 	var e error
 	var n int
 
-	for c.recv.hdr_len < 24 {
-		n, e = common.SockRead(c.Conn, c.recv.hdr[c.recv.hdr_len:24])
+	if c.v2 != nil {
+		return c.fetchMessageV2()
+	}
+
+	for c.recv.hdr_len < wire.HeaderLen {
+		n, e = common.SockRead(c.Conn, c.recv.hdr[c.recv.hdr_len:wire.HeaderLen])
 		c.Mutex.Lock()
 		c.recv.hdr_len += n
 		if e != nil {
@@ -354,33 +433,34 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 			c.HandleError(e)
 			return nil
 		}
-		if c.recv.hdr_len>=4 && !bytes.Equal(c.recv.hdr[:4], common.Magic[:]) {
-			c.Mutex.Unlock()
-			if common.DebugLevel >0 {
-				println("FetchMessage: Proto out of sync")
-			}
-			common.CountSafe("NetBadMagic")
-			c.Disconnect()
-			return nil
-		}
 		if c.broken {
 			c.Mutex.Unlock()
 			return nil
 		}
-		if c.recv.hdr_len >= 24 {
-			c.recv.pl_len = binary.LittleEndian.Uint32(c.recv.hdr[16:20])
-			c.recv.cmd = strings.TrimRight(string(c.recv.hdr[4:16]), "\000")
+		if c.recv.hdr_len >= wire.HeaderLen {
+			c.recv.msg, e = wire.ParseHeader(common.Magic, c.recv.hdr[:])
+			if e == wire.ErrBadMagic {
+				c.Mutex.Unlock()
+				if common.DebugLevel >0 {
+					println("FetchMessage: Proto out of sync")
+				}
+				common.CountSafe("NetBadMagic")
+				c.Disconnect()
+				return nil
+			}
+			if e == wire.ErrTooBig {
+				c.Mutex.Unlock()
+				c.DoS("Big-"+c.recv.msg.Cmd)
+				return nil
+			}
+			c.recv.pl_len = c.recv.msg.Len
+			c.recv.cmd = c.recv.msg.Cmd
 		}
 		c.Mutex.Unlock()
 	}
 
 	if c.recv.pl_len > 0 {
 		if c.recv.dat == nil {
-			msi := maxmsgsize(c.recv.cmd)
-			if c.recv.pl_len > msi {
-				c.DoS("Big-"+c.recv.cmd)
-				return nil
-			}
 			c.Mutex.Lock()
 			c.recv.dat = make([]byte, c.recv.pl_len)
 			c.recv.datlen = 0
@@ -408,8 +488,7 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 		}
 	}
 
-	sh := btc.Sha2Sum(c.recv.dat)
-	if !bytes.Equal(c.recv.hdr[20:24], sh[:4]) {
+	if c.recv.msg.Verify(c.recv.dat) != nil {
 		//println(c.PeerAddr.Ip(), "Msg checksum error")
 		c.DoS("MsgBadChksum")
 		return nil
@@ -422,7 +501,7 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 	c.Mutex.Lock()
 	c.recv.dat = nil
 	c.recv.hdr_len = 0
-	c.X.BytesReceived += uint64(24+len(ret.pl))
+	c.X.BytesReceived += uint64(wire.HeaderLen+len(ret.pl))
 	c.Mutex.Unlock()
 
 	return ret
@@ -437,19 +516,18 @@ func ConnectionActive(ad *peersdb.PeerAddr) (yes bool) {
 }
 
 
-// Returns maximum accepted payload size of a given type of message
-func maxmsgsize(cmd string) uint32 {
-	switch cmd {
-		case "inv": return 3+50000*36 // the spec says "max 50000 entries"
-		case "tx": return 100e3 // max tx size 100KB
-		case "addr": return 3+1000*30 // max 1000 addrs
-		case "block": return 1e6 // max block size 1MB
-		case "getblocks": return 4+3+500*32+32 // we allow up to 500 locator hashes
-		case "getdata": return 3+50000*36 // the spec says "max 50000 entries"
-		case "headers": return 3+50000*36 // the spec says "max 50000 entries"
-		case "getheaders": return 4+3+500*32+32 // we allow up to 500 locator hashes
-		default: return 1024 // Any other type of block: 1KB payload limit
+// Returns true if we have an outgoing connection to the same network group (or AS) already
+func OutGroupConnected(ad *peersdb.PeerAddr) (yes bool) {
+	grp := string(ad.Group())
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if !v.X.Incomming && !v.X.Feeler && !v.X.AddNode && string(v.PeerAddr.Group())==grp {
+			yes = true
+			break
+		}
 	}
+	Mutex_net.Unlock()
+	return
 }
 
 
@@ -461,15 +539,13 @@ func NetCloseAll() {
 	common.SetListenTCP(false, false)
 	common.UnlockCfg()
 	Mutex_net.Lock()
-	if InConsActive > 0 || OutConsActive > 0 {
-		for _, v := range OpenCons {
-			v.Disconnect()
-		}
+	for _, v := range OpenCons {
+		v.Disconnect()
 	}
 	Mutex_net.Unlock()
 	for {
 		Mutex_net.Lock()
-		all_done := InConsActive == 0 && OutConsActive == 0
+		all_done := len(OpenCons) == 0
 		Mutex_net.Unlock()
 		if all_done {
 			return
@@ -493,6 +569,20 @@ func DropPeer(conid uint32) {
 }
 
 
+// Disconnects from all the peers that are banned now (i.e. after their subnet got banned)
+func DropBannedPeers() (cnt int) {
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if v.PeerAddr.IsBanned() {
+			v.Disconnect()
+			cnt++
+		}
+	}
+	Mutex_net.Unlock()
+	return
+}
+
+
 func init() {
 	rand.Read(nonce[:])
 }
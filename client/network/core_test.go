@@ -0,0 +1,37 @@
+package network
+
+import (
+	"testing"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+func TestPermNoBan(t *testing.T) {
+	var tv = []struct {
+		perms uint32
+		dos bool // DoS, otherwise Misbehave
+		ban bool
+	} {
+		{0, true, true},
+		{0, false, true},
+		{common.PERM_NOBAN, true, false},
+		{common.PERM_NOBAN, false, false},
+		{common.PERM_ALL&^common.PERM_NOBAN, true, true},
+	}
+	for i := range tv {
+		c := testConn()
+		c.X.Perms = tv[i].perms
+		for j := 0; j < 2; j++ {
+			if tv[i].dos {
+				c.DoS("Test")
+			} else {
+				c.Misbehave("Test", MisbehaveBanScore)
+			}
+		}
+		if c.banit != tv[i].ban || c.IsBroken() != tv[i].ban {
+			t.Error(i, "Unexpected result", c.banit, c.IsBroken())
+		}
+		if c.X.Misbehave < MisbehaveBanScore || c.X.LastOffence != "Test" {
+			t.Error(i, "Offence not recorded", c.X.Misbehave, c.X.LastOffence)
+		}
+	}
+}
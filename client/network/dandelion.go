@@ -0,0 +1,250 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"math/rand"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+/*
+  Dandelion++ (BIP156)
+
+  In the stem phase a tx is passed (with MSG_DANDELION_TX inv) to a single
+  outgoing peer, which either does the same or "fluffs" it - broadcasts it
+  the usual way. If the tx does not get back to us within the embargo time,
+  we fluff it ourselves.
+
+  Only the peers that advertise SERVICE_DANDELION are used as stem peers.
+  Lock order: dandMutex, Mutex_net, OneConnection.Mutex - so the stem peer
+  must be picked before TxMutex gets locked (see dandelionPickStem).
+*/
+
+const (
+	DandelionEpoch = 10*time.Minute // how often to choose new stem peers and the node's role
+	DandelionStemPeers = 2
+	DandelionFluffPerc = 10 // probability (in percent) of being a diffuser in an epoch
+	DandelionEmbargoMin = 10*time.Second
+	DandelionEmbargoAvg = 20*time.Second // the random part, added to DandelionEmbargoMin
+)
+
+var (
+	dandMutex sync.Mutex
+	dandEpochEnd time.Time
+	dandDiffuser bool // in this epoch we fluff all the stem txs that we receive
+	dandStems []uint32 // ConnIDs of our stem peers
+	dandRoutes map[uint32]uint32 // ConnID of the peer we got the stem tx from -> ConnID of the stem peer
+
+	// Txs in the stem phase - protected by TxMutex
+	stemTxs map[[btc.Uint256IdxLen]byte] *OneTxToSend = make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
+)
+
+
+// Returns the connection if it can be used as a stem peer
+func dandelionPeer(id uint32) (c *OneConnection) {
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if v.ConnID==id {
+			c = v
+			break
+		}
+	}
+	Mutex_net.Unlock()
+	return
+}
+
+
+// Chooses new stem peers - call it with dandMutex locked
+func dandelionNewEpoch() {
+	var cands []uint32
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		v.Mutex.Lock()
+		if !v.X.Incomming && !v.X.Feeler && !v.X.BlockOnly && !v.Node.DoNotRelayTxs && v.X.VerackReceived &&
+			(v.Node.Services&common.SERVICE_DANDELION)!=0 {
+			cands = append(cands, v.ConnID)
+		}
+		v.Mutex.Unlock()
+	}
+	Mutex_net.Unlock()
+
+	rand.Shuffle(len(cands), func(i, j int) {
+		cands[i], cands[j] = cands[j], cands[i]
+	})
+	if len(cands) > DandelionStemPeers {
+		cands = cands[:DandelionStemPeers]
+	}
+	dandStems = cands
+	dandRoutes = make(map[uint32]uint32)
+	dandDiffuser = rand.Intn(100) < DandelionFluffPerc
+	dandEpochEnd = time.Now().Add(DandelionEpoch)
+	common.CountSafe("DandelionEpoch")
+}
+
+
+// Returns the stem peer for txs coming from the given connection (0 for own txs)
+func dandelionStemPeer(from uint32) *OneConnection {
+	dandMutex.Lock()
+	defer dandMutex.Unlock()
+
+	if time.Now().After(dandEpochEnd) {
+		dandelionNewEpoch()
+	}
+
+	if id, ok := dandRoutes[from]; ok {
+		if c := dandelionPeer(id); c != nil {
+			return c
+		}
+		delete(dandRoutes, from) // the stem peer has disconnected
+	}
+
+	for len(dandStems) > 0 {
+		idx := rand.Intn(len(dandStems))
+		if c := dandelionPeer(dandStems[idx]); c != nil {
+			dandRoutes[from] = dandStems[idx]
+			return c
+		}
+		dandStems = append(dandStems[:idx], dandStems[idx+1:]...)
+	}
+	return nil
+}
+
+
+// Returns the peer to pass a stem tx to, or nil if it should be fluffed instead.
+// Do not call it with TxMutex locked.
+func dandelionPickStem(from *OneConnection) (to *OneConnection) {
+	var from_id uint32
+	if from != nil {
+		from_id = from.ConnID
+		dandMutex.Lock()
+		fluff := dandDiffuser
+		dandMutex.Unlock()
+		if fluff {
+			common.CountSafe("DandelionFluff")
+			return
+		}
+	}
+
+	if to = dandelionStemPeer(from_id); to == nil {
+		common.CountSafe("DandelionNoStem")
+	}
+	return
+}
+
+
+// Passes the tx to the stem peer (from dandelionPickStem). Returns false if it should be fluffed instead.
+// Call it with TxMutex locked.
+func dandelionStem(rec *OneTxToSend, to *OneConnection) bool {
+	if to == nil {
+		return false
+	}
+
+	rec.StemTo = to.ConnID
+	if rec.Stem.IsZero() {
+		rec.Stem = time.Now().Add(DandelionEmbargoMin + poissonDelay(DandelionEmbargoAvg))
+	}
+	stemTxs[rec.Hash.BIdx()] = rec
+	to.SendRawMsg("inv", wire.EncodeInv([]wire.InvVect{{Type:wire.MSG_DANDELION_TX, Hash:rec.Hash.Hash}}))
+	common.CountSafe("DandelionStem")
+	return true
+}
+
+
+// Ends the stem phase of the tx - call it with TxMutex locked
+func dandelionEnd(rec *OneTxToSend) {
+	rec.Stem = time.Time{}
+	rec.StemTo = 0
+	delete(stemTxs, rec.Hash.BIdx())
+}
+
+
+// DandelionSend sends own tx from the pool into the stem phase.
+// Returns false if Dandelion is disabled or there is no peer to use as the stem.
+func DandelionSend(h *btc.Uint256) bool {
+	if !common.CFG.TXRoute.Dandelion {
+		return false
+	}
+	to := dandelionPickStem(nil)
+	TxMutex.Lock()
+	defer TxMutex.Unlock()
+	if rec, ok := TransactionsToSend[h.BIdx()]; ok && rec.Blocked==0 && dandelionStem(rec, to) {
+		rec.Invsentcnt++
+		return true
+	}
+	return false
+}
+
+
+// Handles MSG_DANDELION_TX inv - asks for the tx, if we relay stem txs
+func (c *OneConnection) stemInvNotify(hash []byte) {
+	if !common.CFG.TXRoute.Dandelion || !c.X.Incomming && (c.X.Perms&common.PERM_RELAY)==0 {
+		common.CountSafe("InvStemIgnored")
+		return
+	}
+	id := btc.NewUint256(hash)
+	if NeedThisTx(id, nil) {
+		c.Mutex.Lock()
+		if c.stemAsked == nil {
+			c.stemAsked = make(map[[btc.Uint256IdxLen]byte] bool)
+		}
+		c.stemAsked[id.BIdx()] = true
+		c.Mutex.Unlock()
+		inv := wire.InvVect{Type:wire.MSG_DANDELION_TX}
+		copy(inv.Hash[:], hash)
+		c.SendRawMsg("getdata", wire.EncodeInv([]wire.InvVect{inv}))
+	}
+}
+
+
+// Returns true if the tx has been requested from the peer as a stem one
+func (c *OneConnection) stemRequested(id *btc.Uint256) (res bool) {
+	c.Mutex.Lock()
+	if res = c.stemAsked[id.BIdx()]; res {
+		delete(c.stemAsked, id.BIdx())
+	}
+	c.Mutex.Unlock()
+	return
+}
+
+
+// Someone has announced a tx that we keep in the stem phase - so it has been fluffed
+func dandelionSeen(id *btc.Uint256) {
+	TxMutex.Lock()
+	rec, ok := stemTxs[id.BIdx()]
+	if ok {
+		dandelionEnd(rec)
+	}
+	TxMutex.Unlock()
+	if ok {
+		common.CountSafe("DandelionSeen")
+		rec.Invsentcnt += NetRouteInv(wire.MSG_TX, rec.Hash, nil)
+	}
+}
+
+
+// Fluffs the txs whose embargo has expired - called from NetworkTick()
+func dandelionTick() {
+	var fluff []*OneTxToSend
+	now := time.Now()
+	TxMutex.Lock()
+	for k, rec := range stemTxs {
+		if TransactionsToSend[k] != rec {
+			delete(stemTxs, k) // mined or expired
+		} else if now.After(rec.Stem) {
+			dandelionEnd(rec)
+			fluff = append(fluff, rec)
+		}
+	}
+	TxMutex.Unlock()
+
+	for _, rec := range fluff {
+		common.CountSafe("DandelionEmbargo")
+		if common.DebugLevel > 0 {
+			fmt.Println("Dandelion embargo expired for", rec.Hash.String())
+		}
+		rec.Invsentcnt += NetRouteInv(wire.MSG_TX, rec.Hash, nil)
+	}
+}
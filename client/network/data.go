@@ -3,73 +3,80 @@ package network
 import (
 	"fmt"
 	"time"
-	"bytes"
 	//"encoding/hex"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/client/common"
 )
 
 
 func (c *OneConnection) ProcessGetData(pl []byte) {
-	var notfound []byte
+	var notfound []wire.InvVect
 
 	//println(c.PeerAddr.Ip(), "getdata")
-	b := bytes.NewReader(pl)
-	cnt, e := btc.ReadVLen(b)
+	invs, e := wire.ParseInv(pl)
 	if e != nil {
 		println("ProcessGetData:", e.Error(), c.PeerAddr.Ip())
 		return
 	}
-	for i:=0; i<int(cnt); i++ {
-		var typ uint32
-		var h [36]byte
-
-		n, _ := b.Read(h[:])
-		if n!=36 {
-			println("ProcessGetData: pl too short", c.PeerAddr.Ip())
-			return
-		}
-
-		typ = binary.LittleEndian.Uint32(h[:4])
-
+	for _, h := range invs {
+		typ := h.Type
 		common.CountSafe(fmt.Sprint("GetdataType",typ))
-		if typ == 2 {
-			uh := btc.NewUint256(h[4:])
+		if typ == wire.MSG_BLOCK {
+			uh := btc.NewUint256(h.Hash[:])
 			bl, _, er := common.BlockChain.Blocks.BlockGet(uh)
 			if er == nil {
 				c.SendRawMsg("block", bl)
 			} else {
-				notfound = append(notfound, h[:]...)
+				notfound = append(notfound, h)
 			}
-		} else if typ == 1 {
+		} else if typ == wire.MSG_CMPCT_BLOCK {
+			if !c.SendCmpctBlock(btc.NewUint256(h.Hash[:])) {
+				h.Type = wire.MSG_BLOCK // reply notfound as for a regular block
+				notfound = append(notfound, h)
+			}
+		} else if typ == wire.MSG_FILTERED_BLOCK && c.bloom != nil {
+			if !c.SendMerkleBlock(btc.NewUint256(h.Hash[:])) {
+				notfound = append(notfound, h)
+			}
+		} else if typ == wire.MSG_TX {
 			// transaction
-			uh := btc.NewUint256(h[4:])
+			uh := btc.NewUint256(h.Hash[:])
+			TxMutex.Lock()
+			if tx, ok := TransactionsToSend[uh.BIdx()]; ok && tx.Blocked==0 && tx.Stem.IsZero() {
+				tx.SentCnt++
+				tx.Lastsent = time.Now()
+				TxMutex.Unlock()
+				c.SendRawMsg("tx", tx.Data)
+			} else {
+				TxMutex.Unlock()
+				notfound = append(notfound, h)
+			}
+		} else if typ == wire.MSG_DANDELION_TX {
+			// stem transaction - only for the peer we have passed it to
+			uh := btc.NewUint256(h.Hash[:])
 			TxMutex.Lock()
-			if tx, ok := TransactionsToSend[uh.BIdx()]; ok && tx.Blocked==0 {
+			if tx, ok := TransactionsToSend[uh.BIdx()]; ok && !tx.Stem.IsZero() && tx.StemTo==c.ConnID {
 				tx.SentCnt++
 				tx.Lastsent = time.Now()
 				TxMutex.Unlock()
 				c.SendRawMsg("tx", tx.Data)
 			} else {
 				TxMutex.Unlock()
-				notfound = append(notfound, h[:]...)
+				notfound = append(notfound, h)
 			}
 		} else {
 			if common.DebugLevel>0 {
 				println("getdata for type", typ, "not supported yet")
 			}
-			if typ>0 && typ<=3 /*3 is a filtered block(we dont support it)*/ {
-				notfound = append(notfound, h[:]...)
+			if typ>0 && typ<=wire.MSG_FILTERED_BLOCK /*only served after filterload*/ {
+				notfound = append(notfound, h)
 			}
 		}
 	}
 
 	if len(notfound)>0 {
-		buf := new(bytes.Buffer)
-		btc.WriteVlen(buf, uint64(len(notfound)/36))
-		buf.Write(notfound)
-		c.SendRawMsg("notfound", buf.Bytes())
+		c.SendRawMsg("notfound", wire.EncodeInv(notfound))
 	}
 }
 
@@ -96,6 +103,7 @@ func netBlockReceived(conn *OneConnection, b []byte) {
 		common.CountSafe("BlockSameRcvd")
 		conn.Mutex.Lock()
 		delete(conn.GetBlockInProgress, idx)
+		delete(conn.stalledBlocks, idx)
 		conn.Mutex.Unlock()
 		return
 	}
@@ -121,22 +129,31 @@ func netBlockReceived(conn *OneConnection, b []byte) {
 		return
 	}
 
-	//println("block", rec.BlockTreeNode.Height," len", len(b), " got from", conn.PeerAddr.Ip(), rec.InProgress)
-	rec.InProgress--
+	conn.Mutex.Lock()
+	bip := conn.GetBlockInProgress[idx]
+	if bip!=nil {
+		//println("block", rec.BlockTreeNode.Height," len", len(b), " got from", conn.PeerAddr.Ip(), rec.InProgress)
+		rec.InProgress--
+	} else if bip = conn.stalledBlocks[idx]; bip!=nil {
+		common.CountSafe("BlockRcvdAfterStall") // InProgress has already been decreased
+	}
+	conn.Mutex.Unlock()
 	rec.Block.Raw = b
 
 	er := common.BlockChain.PostCheckBlock(rec.Block)
 	if er!=nil {
 		MutexRcv.Unlock()
 		println("Corrupt block received from", conn.PeerAddr.Ip())
-		conn.DoS("BadBlock")
+		conn.SendBlockReject(hash, er)
+		if btc.IsParseError(er) {
+			conn.Misbehave("BlockMalformed", MisbehaveMalformed)
+		} else {
+			conn.DoS("BadBlock")
+		}
 		return
 	}
 
-	conn.Mutex.Lock()
-	bip := conn.GetBlockInProgress[idx]
 	if bip==nil {
-		conn.Mutex.Unlock()
 		MutexRcv.Unlock()
 		println("unexpected block received from", conn.PeerAddr.Ip())
 		common.CountSafe("UnxpectedBlockRcvd")
@@ -144,8 +161,11 @@ func netBlockReceived(conn *OneConnection, b []byte) {
 		return
 	}
 
+	conn.Mutex.Lock()
 	orb := &OneReceivedBlock{Time:bip.start, TmDownload:now.Sub(bip.start)}
 	delete(conn.GetBlockInProgress, idx)
+	delete(conn.stalledBlocks, idx)
+	conn.blockDlDone(bip, len(b), now)
 	conn.Mutex.Unlock()
 
 	ReceivedBlocks[idx] = orb
@@ -157,47 +177,6 @@ func netBlockReceived(conn *OneConnection, b []byte) {
 }
 
 
-// Read VLen followed by the number of locators
-// parse the payload of getblocks and getheaders messages
-func parseLocatorsPayload(pl []byte) (h2get []*btc.Uint256, hashstop *btc.Uint256, er error) {
-	var cnt uint64
-	var h [32]byte
-	var ver uint32
-
-	b := bytes.NewReader(pl)
-
-	// version
-	if er = binary.Read(b, binary.LittleEndian, &ver); er != nil {
-		return
-	}
-
-	// hash count
-	cnt, er = btc.ReadVLen(b)
-	if er != nil {
-		return
-	}
-
-	// block locator hashes
-	if cnt>0 {
-		h2get = make([]*btc.Uint256, cnt)
-		for i:=0; i<int(cnt); i++ {
-			if _, er = b.Read(h[:]); er!=nil {
-				return
-			}
-			h2get[i] = btc.NewUint256(h[:])
-		}
-	}
-
-	// hash_stop
-	if _, er = b.Read(h[:]); er!=nil {
-		return
-	}
-	hashstop = btc.NewUint256(h[:])
-
-	return
-}
-
-
 // Call it with locked MutexRcv
 func getBlockToFetch(max_height uint32, cnt_in_progress, avg_block_size uint) (lowest_found *OneBlockToGet) {
 	for _, v := range BlocksToGet {
@@ -215,19 +194,21 @@ func (c *OneConnection) GetBlockData() (yes bool) {
 
 	// Need to send getdata...?
 	MutexRcv.Lock()
-	if len(BlocksToGet)>0 && uint(len(c.GetBlockInProgress)+1)*avg_block_size <= MAX_GETDATA_FORWARD {
+	window := c.blockDlWindow(avg_block_size)
+	if len(BlocksToGet)>0 && uint(len(c.GetBlockInProgress)+1)*avg_block_size <= window {
 		//uint32(len(c.GetBlockInProgress)) < atomic.LoadUint32(&common.CFG.Net.MaxBlockAtOnce)
 		// We can issue getdata for this peer
 		// Let's look for the lowest height block in BlocksToGet that isn't being downloaded yet
 
 		common.Last.Mutex.Lock()
-		max_height := common.Last.Block.Height + MAX_BLOCKS_FORWARD
+		top_height := common.Last.Block.Height
 		common.Last.Mutex.Unlock()
+		max_height := top_height + MAX_BLOCKS_FORWARD
 		if max_height > c.Node.Height {
 			max_height = c.Node.Height
 		}
 
-		invs := new(bytes.Buffer)
+		var invs []wire.InvVect
 		var cnt uint64
 		var cnt_in_progress uint
 
@@ -240,8 +221,11 @@ func (c *OneConnection) GetBlockData() (yes bool) {
 				if v.InProgress==cnt_in_progress && v.Block.Height <= max_height &&
 					(lowest_found==nil || v.Block.Height < lowest_found.Block.Height) {
 						c.Mutex.Lock()
+						// do not ask again for the blocks it has stalled - let the others fetch them
 						if _, ok := c.GetBlockInProgress[v.BlockHash.BIdx()]; !ok {
-							lowest_found = v
+							if _, ok = c.stalledBlocks[v.BlockHash.BIdx()]; !ok {
+								lowest_found = v
+							}
 						}
 						c.Mutex.Unlock()
 				}
@@ -255,27 +239,29 @@ func (c *OneConnection) GetBlockData() (yes bool) {
 				continue
 			}
 
-			binary.Write(invs, binary.LittleEndian, uint32(2))
-			invs.Write(lowest_found.BlockHash.Hash[:])
+			if c.Node.SendCmpctVer==1 && common.CFG.Net.CompactBlocks &&
+				lowest_found.Block.Height==top_height+1 {
+				// For the next block on top of our chain, try the compact version
+				invs = append(invs, wire.InvVect{Type:wire.MSG_CMPCT_BLOCK, Hash:lowest_found.BlockHash.Hash})
+			} else {
+				invs = append(invs, wire.InvVect{Type:wire.MSG_BLOCK, Hash:lowest_found.BlockHash.Hash})
+			}
 			lowest_found.InProgress++
 			cnt++
 
 			c.Mutex.Lock()
 			c.GetBlockInProgress[lowest_found.BlockHash.BIdx()] =
-				&oneBlockDl{hash:lowest_found.BlockHash, start:time.Now()}
+				c.newBlockDl(lowest_found.BlockHash, avg_block_size)
 			c.Mutex.Unlock()
 
-			if len(c.GetBlockInProgress)*int(avg_block_size) >= MAX_GETDATA_FORWARD || cnt==2000 {
+			if uint(len(c.GetBlockInProgress))*avg_block_size >= window || cnt==2000 {
 				break
 			}
 		}
 
 		if cnt > 0 {
-			bu := new(bytes.Buffer)
-			btc.WriteVlen(bu, uint64(cnt))
-			pl := append(bu.Bytes(), invs.Bytes()...)
-			//println("fetching", cnt, "blocks from", c.PeerAddr.Ip(), len(invs.Bytes()), "...")
-			c.SendRawMsg("getdata", pl)
+			//println("fetching", cnt, "blocks from", c.PeerAddr.Ip(), len(invs), "...")
+			c.SendRawMsg("getdata", wire.EncodeInv(invs))
 			yes = true
 		} else {
 			//println("fetch nothing from", c.PeerAddr.Ip())
@@ -0,0 +1,254 @@
+package network
+
+import (
+	"os"
+	"sync"
+	"bytes"
+	"io/ioutil"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+/*
+  Fee estimator, based on how long it took for the txs from our mempool to get mined.
+
+  Each tx that enters the mempool gets recorded along with the block height at
+  which we first saw it. When it gets mined, we note how many blocks it took
+  and put it into a bucket of its fee rate (SPB). Historical data is decayed
+  with each new block, so the most recent blocks have the biggest impact.
+*/
+
+const (
+	FeeEstMaxTarget = 25 // We estimate fees for confirmation within up to this many blocks
+	FeeEstMinSPB = 1.0
+	FeeEstMaxSPB = 10000.0
+	FeeEstBucketStep = 1.1 // Each next bucket is for a fee rate this many times higher
+	FeeEstDecay = 0.998 // With each new block, weight of the historical data gets multipled by this
+	FeeEstSuccessPct = 0.85 // At least this part of the txs must have been mined within the target
+	FeeEstSufficientTxs = 1.0 // Average number of txs per block (in a bucket range) that we need to trust the data
+
+	FeeEstFileName = "feeest.dat"
+)
+
+type feeEstBucket struct {
+	MaxSPB float64 // Upper limit of the fee rate for this bucket
+	TxCnt float64 // (decayed) number of mined txs from this bucket
+	SPBSum float64 // (decayed) sum of the fee rates of the mined txs
+	Conf [FeeEstMaxTarget]float64 // [i] - (decayed) number of txs mined within i+1 blocks
+	Failed [FeeEstMaxTarget]float64 // [i] - (decayed) number of txs that left the pool unmined after more than i blocks
+}
+
+type feeEstTx struct {
+	Height uint32 // Height of the chain when we saw the tx for the first time
+	SPB float64
+	Bucket int
+}
+
+var (
+	FeeEstMutex sync.Mutex
+	feeEstBuckets []*feeEstBucket
+	feeEstTxs map[[btc.Uint256IdxLen]byte] *feeEstTx = make(map[[btc.Uint256IdxLen]byte] *feeEstTx)
+	feeEstHeight uint32 // Height of the last processed block
+)
+
+
+// Returns index of the bucket for the given fee rate
+func feeEstBucketIdx(spb float64) int {
+	for i := range feeEstBuckets {
+		if spb <= feeEstBuckets[i].MaxSPB {
+			return i
+		}
+	}
+	return len(feeEstBuckets)-1
+}
+
+
+// Call it for each tx that has just been accepted to the mempool
+func feeEstTxAdded(rec *OneTxToSend) {
+	if rec.Own!=0 || rec.MemInputs || len(rec.Data)==0 {
+		return // Own txs and txs with unconfirmed inputs do not tell us anything about the market
+	}
+
+	common.Last.Mutex.Lock()
+	height := common.Last.Block.Height
+	common.Last.Mutex.Unlock()
+
+	MutexRcv.Lock()
+	pending_blocks := len(BlocksToGet) + len(CachedBlocks) + len(NetBlocks)
+	MutexRcv.Unlock()
+	if pending_blocks > 0 {
+		common.CountSafe("FeeEstNotSynced") // we do not know how long it has been waiting for
+		return
+	}
+
+	spb := float64(rec.Fee)/float64(len(rec.Data))
+	FeeEstMutex.Lock()
+	if height > feeEstHeight {
+		feeEstHeight = height
+	}
+	feeEstTxs[rec.Tx.Hash.BIdx()] = &feeEstTx{Height:height, SPB:spb, Bucket:feeEstBucketIdx(spb)}
+	FeeEstMutex.Unlock()
+}
+
+
+// Call it for each tx that is being removed from the mempool.
+// Set failed if the tx has not made it into a block (i.e. it expired).
+func feeEstTxRemoved(rec *OneTxToSend, failed bool) {
+	FeeEstMutex.Lock()
+	if t, ok := feeEstTxs[rec.Tx.Hash.BIdx()]; ok {
+		delete(feeEstTxs, rec.Tx.Hash.BIdx())
+		if failed {
+			b := feeEstBuckets[t.Bucket]
+			for i:=0; i<FeeEstMaxTarget && t.Height+uint32(i)<feeEstHeight; i++ {
+				b.Failed[i]++
+			}
+		}
+	}
+	FeeEstMutex.Unlock()
+}
+
+
+// Call it for each new block, before its txs get removed from the mempool
+func feeEstBlockMined(bl *btc.Block) {
+	FeeEstMutex.Lock()
+	defer FeeEstMutex.Unlock()
+
+	if bl.Height <= feeEstHeight {
+		common.CountSafe("FeeEstBlockOld") // a chain reorg - just ignore it
+		return
+	}
+	feeEstHeight = bl.Height
+
+	for _, b := range feeEstBuckets {
+		b.TxCnt *= FeeEstDecay
+		b.SPBSum *= FeeEstDecay
+		for i := range b.Conf {
+			b.Conf[i] *= FeeEstDecay
+			b.Failed[i] *= FeeEstDecay
+		}
+	}
+
+	for i:=1; i<len(bl.Txs); i++ {
+		t, ok := feeEstTxs[bl.Txs[i].Hash.BIdx()]
+		if !ok {
+			continue
+		}
+		delete(feeEstTxs, bl.Txs[i].Hash.BIdx())
+		if t.Height >= bl.Height {
+			continue // it shall not happen, but...
+		}
+		b := feeEstBuckets[t.Bucket]
+		b.TxCnt++
+		b.SPBSum += t.SPB
+		for blks := int(bl.Height-t.Height)-1; blks<FeeEstMaxTarget; blks++ {
+			b.Conf[blks]++
+		}
+		common.CountSafe("FeeEstTxMined")
+	}
+}
+
+
+// Returns fee rate (in SPB) for a tx to get mined within the given number of blocks.
+// If there is not enough data for the given target, a higher target is tried.
+// Returns zero if we cannot tell.
+func EstimateFee(target uint) (spb float64, blocks uint) {
+	if target<1 {
+		target = 1
+	}
+	FeeEstMutex.Lock()
+	defer FeeEstMutex.Unlock()
+	for blocks=target; blocks<=FeeEstMaxTarget; blocks++ {
+		if spb = feeEstForTarget(blocks); spb>0 {
+			return
+		}
+	}
+	blocks = 0
+	return
+}
+
+
+// Make sure to call it with locked FeeEstMutex
+func feeEstForTarget(target uint) (spb float64) {
+	// Txs still in the pool and waiting longer then the target count as failed
+	unconf := make([]float64, len(feeEstBuckets))
+	for _, t := range feeEstTxs {
+		if feeEstHeight >= t.Height+uint32(target) {
+			unconf[t.Bucket]++
+		}
+	}
+
+	sufficient := FeeEstSufficientTxs / (1-FeeEstDecay)
+	var conf, total, txcnt, spbsum float64
+	for i:=len(feeEstBuckets)-1; i>=0; i-- {
+		b := feeEstBuckets[i]
+		conf += b.Conf[target-1]
+		total += b.TxCnt + b.Failed[target-1] + unconf[i]
+		txcnt += b.TxCnt
+		spbsum += b.SPBSum
+		if total < sufficient {
+			continue // not enough data in this range yet - take in the next (cheaper) bucket
+		}
+		if conf/total < FeeEstSuccessPct {
+			break
+		}
+		// this range of buckets passes - remember its average fee and try lower
+		if txcnt > 0 {
+			spb = spbsum / txcnt
+		}
+		conf, total, txcnt, spbsum = 0, 0, 0, 0
+	}
+	return
+}
+
+
+// Saves the fee estimator's statistics to the given folder
+func FeeEstSave(dir string) {
+	buf := new(bytes.Buffer)
+	FeeEstMutex.Lock()
+	binary.Write(buf, binary.LittleEndian, feeEstHeight)
+	binary.Write(buf, binary.LittleEndian, uint32(len(feeEstBuckets)))
+	for _, b := range feeEstBuckets {
+		binary.Write(buf, binary.LittleEndian, b)
+	}
+	FeeEstMutex.Unlock()
+	ioutil.WriteFile(dir+FeeEstFileName, buf.Bytes(), 0600)
+}
+
+
+// Loads statistics saved by FeeEstSave (ignores them if the buckets do not match)
+func FeeEstLoad(dir string) {
+	var height, cnt uint32
+	f, er := os.Open(dir+FeeEstFileName)
+	if er != nil {
+		return
+	}
+	defer f.Close()
+	if binary.Read(f, binary.LittleEndian, &height)!=nil || binary.Read(f, binary.LittleEndian, &cnt)!=nil {
+		return
+	}
+	if int(cnt) != len(feeEstBuckets) {
+		println(FeeEstFileName, "- buckets count mismatch", cnt, len(feeEstBuckets))
+		return
+	}
+	bcks := make([]*feeEstBucket, cnt)
+	for i := range bcks {
+		bcks[i] = new(feeEstBucket)
+		if binary.Read(f, binary.LittleEndian, bcks[i])!=nil || bcks[i].MaxSPB!=feeEstBuckets[i].MaxSPB {
+			println(FeeEstFileName, "- corrupt or from a different version")
+			return
+		}
+	}
+	FeeEstMutex.Lock()
+	feeEstBuckets = bcks
+	feeEstHeight = height
+	FeeEstMutex.Unlock()
+}
+
+
+func init() {
+	for spb:=FeeEstMinSPB; spb<FeeEstMaxSPB; spb*=FeeEstBucketStep {
+		feeEstBuckets = append(feeEstBuckets, &feeEstBucket{MaxSPB:spb})
+	}
+	feeEstBuckets = append(feeEstBuckets, &feeEstBucket{MaxSPB:1e99}) // all the higher fees
+}
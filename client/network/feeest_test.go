@@ -0,0 +1,193 @@
+package network
+
+import (
+	"math"
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// Starts the fee estimator with empty statistics at the given height. Returns function restoring the previous state.
+func testFeeEstReset(height uint32) func() {
+	bcks, txs, hei, last := feeEstBuckets, feeEstTxs, feeEstHeight, common.Last.Block
+	feeEstBuckets = nil
+	for _, b := range bcks {
+		feeEstBuckets = append(feeEstBuckets, &feeEstBucket{MaxSPB:b.MaxSPB})
+	}
+	feeEstTxs = make(map[[btc.Uint256IdxLen]byte] *feeEstTx)
+	feeEstHeight = height
+	common.Last.Block = &chain.BlockTreeNode{Height:height}
+	return func() {
+		feeEstBuckets, feeEstTxs, feeEstHeight, common.Last.Block = bcks, txs, hei, last
+	}
+}
+
+var testFeeEstCnt uint32
+
+// Returns a new mempool record of the given fee rate
+func testFeeEstTx(spb uint64) *OneTxToSend {
+	testFeeEstCnt++
+	tx := &btc.Tx{Lock_time:testFeeEstCnt}
+	tx.Hash = btc.NewSha2Hash(tx.Serialize())
+	return &OneTxToSend{Data:make([]byte, 200), Fee:200*spb, Tx:tx}
+}
+
+// Mines a block with the given txs at the next height
+func testFeeEstMine(txs ...*OneTxToSend) {
+	bl := &btc.Block{Height:feeEstHeight+1, Txs:[]*btc.Tx{new(btc.Tx)}}
+	for _, t := range txs {
+		bl.Txs = append(bl.Txs, t.Tx)
+	}
+	feeEstBlockMined(bl)
+	common.Last.Block.Height = bl.Height
+}
+
+func TestFeeEstBucketIdx(t *testing.T) {
+	var tv = []struct {
+		spb float64
+		idx int
+	} {
+		{0, 0},
+		{FeeEstMinSPB, 0},
+		{FeeEstMinSPB*FeeEstBucketStep, 1},
+		{FeeEstMinSPB*FeeEstBucketStep+0.01, 2},
+		{FeeEstMaxSPB, len(feeEstBuckets)-1},
+		{1e12, len(feeEstBuckets)-1},
+	}
+	for i := range tv {
+		if idx := feeEstBucketIdx(tv[i].spb); idx != tv[i].idx {
+			t.Error(i, "Bad bucket", idx)
+		}
+	}
+	for i := 1; i < len(feeEstBuckets); i++ {
+		if feeEstBuckets[i].MaxSPB <= feeEstBuckets[i-1].MaxSPB {
+			t.Fatal(i, "Buckets not sorted")
+		}
+	}
+}
+
+func TestFeeEstAccounting(t *testing.T) {
+	defer testFeeEstReset(1000)()
+
+	own, meminp, fast, slow, expired := testFeeEstTx(10), testFeeEstTx(10), testFeeEstTx(10), testFeeEstTx(3), testFeeEstTx(3)
+	own.Own = 1
+	meminp.MemInputs = true
+	for _, r := range []*OneTxToSend{own, meminp, fast, slow, expired} {
+		feeEstTxAdded(r)
+	}
+	if len(feeEstTxs) != 3 {
+		t.Fatal("Own txs or txs with unconfirmed inputs recorded", len(feeEstTxs))
+	}
+	fb, sb := feeEstBuckets[feeEstBucketIdx(10)], feeEstBuckets[feeEstBucketIdx(3)]
+
+	testFeeEstMine(fast) // 1001
+	if fb.TxCnt != 1 || fb.SPBSum != 10 || fb.Conf[0] != 1 || fb.Conf[FeeEstMaxTarget-1] != 1 {
+		t.Error("Bad stats of the fast tx", fb.TxCnt, fb.SPBSum, fb.Conf)
+	}
+	testFeeEstMine() // 1002
+	testFeeEstMine(slow) // 1003
+	if sb.TxCnt != 1 || sb.Conf[1] != 0 || sb.Conf[2] != 1 {
+		t.Error("Bad stats of the slow tx", sb.Conf)
+	}
+	if math.Abs(fb.TxCnt - FeeEstDecay*FeeEstDecay) > 1e-9 || math.Abs(fb.Conf[0] - FeeEstDecay*FeeEstDecay) > 1e-9 {
+		t.Error("Not decayed", fb.TxCnt, fb.Conf[0])
+	}
+	feeEstTxRemoved(expired, true) // was seen at 1000
+	if sb.Failed[0] != 1 || sb.Failed[2] != 1 || sb.Failed[3] != 0 {
+		t.Error("Bad failed stats", sb.Failed)
+	}
+	if len(feeEstTxs) != 0 {
+		t.Error("Txs left", len(feeEstTxs))
+	}
+
+	// an old block (reorg) and a removed tx that has been mined do not change anything
+	feeEstTxAdded(fast)
+	testFeeEstMine()
+	feeEstBlockMined(&btc.Block{Height:1000, Txs:[]*btc.Tx{new(btc.Tx), fast.Tx}})
+	feeEstTxRemoved(fast, false)
+	if fb.Conf[0] != FeeEstDecay*FeeEstDecay*FeeEstDecay || len(feeEstTxs) != 0 {
+		t.Error("Stats changed", fb.Conf[0], len(feeEstTxs))
+	}
+}
+
+func TestEstimateFee(t *testing.T) {
+	defer testFeeEstReset(1000)()
+
+	if spb, blocks := EstimateFee(1); spb != 0 || blocks != 0 {
+		t.Error("Estimate without data", spb, blocks)
+	}
+
+	// each block: 20 txs paying 20 SPB mined in the next block and 20 txs paying 5 SPB mined after 5 blocks
+	var slow [][]*OneTxToSend
+	for blk := 0; blk < 200; blk++ {
+		var mined []*OneTxToSend
+		var s []*OneTxToSend
+		for i := 0; i < 20; i++ {
+			r := testFeeEstTx(20)
+			feeEstTxAdded(r)
+			mined = append(mined, r)
+			r = testFeeEstTx(5)
+			feeEstTxAdded(r)
+			s = append(s, r)
+		}
+		slow = append(slow, s)
+		if len(slow) > 4 {
+			mined = append(mined, slow[0]...)
+			slow = slow[1:]
+		}
+		testFeeEstMine(mined...)
+	}
+
+	var tv = []struct {
+		target uint
+		spb float64
+		blocks uint
+	} {
+		{0, 20, 1},
+		{1, 20, 1},
+		{4, 20, 4},
+		{5, 5, 5},
+		{FeeEstMaxTarget, 5, FeeEstMaxTarget},
+		{FeeEstMaxTarget+1, 0, 0},
+	}
+	for i := range tv {
+		if spb, blocks := EstimateFee(tv[i].target); math.Abs(spb-tv[i].spb) > 1e-9 || blocks != tv[i].blocks {
+			t.Error(i, "Bad estimate", spb, blocks)
+		}
+	}
+
+	// the cheap txs stop getting mined - they must not pull down the estimate anymore
+	for blk := 0; blk < 100; blk++ {
+		for i := 0; i < 20; i++ {
+			feeEstTxAdded(testFeeEstTx(5))
+		}
+		testFeeEstMine()
+	}
+	if spb, blocks := EstimateFee(5); math.Abs(spb-20) > 1e-9 || blocks != 5 {
+		t.Error("Bad estimate with unconfirmed txs", spb, blocks)
+	}
+}
+
+func TestFeeEstSaveLoad(t *testing.T) {
+	defer testFeeEstReset(1000)()
+	dir := t.TempDir() + "/"
+	r := testFeeEstTx(20)
+	feeEstTxAdded(r)
+	testFeeEstMine(r)
+	FeeEstSave(dir)
+
+	testFeeEstReset(0)
+	FeeEstLoad(dir)
+	if b := feeEstBuckets[feeEstBucketIdx(20)]; feeEstHeight != 1001 || b.TxCnt != 1 || b.SPBSum != 20 || b.Conf[0] != 1 {
+		t.Error("Bad stats loaded", feeEstHeight, b.TxCnt, b.SPBSum, b.Conf[0])
+	}
+
+	// a file with different buckets gets ignored
+	feeEstBuckets = feeEstBuckets[1:]
+	testFeeEstReset(0)
+	FeeEstLoad(dir)
+	if feeEstHeight != 0 {
+		t.Error("Stats loaded to different buckets")
+	}
+}
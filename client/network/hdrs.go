@@ -1,13 +1,11 @@
 package network
 
 import (
-	"fmt"
 	//"time"
-	"bytes"
 	//"sync/atomic"
 	//"encoding/hex"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/client/common"
 )
@@ -18,33 +16,22 @@ func (c *OneConnection) HandleHeaders(pl []byte) {
 
 	c.X.GetHeadersInProgress = false
 
-	b := bytes.NewReader(pl)
-	cnt, e := btc.ReadVLen(b)
+	hdrs, e := wire.ParseHeaders(pl)
 	if e != nil {
 		println("HandleHeaders:", e.Error(), c.PeerAddr.Ip())
+		if e == wire.ErrTxnCount {
+			c.DoS("HdrErr2")
+		} else if e == wire.ErrTooShort {
+			c.DoS("HdrErr1")
+		}
 		return
 	}
 
 	var new_headers_got int
 
-	if cnt>0 {
-		for i:=0; i<int(cnt); i++ {
-			var hdr [81]byte
-
-			n, _ := b.Read(hdr[:])
-			if n!=81 {
-				println("HandleHeaders: pl too short", c.PeerAddr.Ip())
-				c.DoS("HdrErr1")
-				return
-			}
-
-			if hdr[80]!=0 {
-				fmt.Println("Unexpected value of txn_count from", c.PeerAddr.Ip())
-				c.DoS("HdrErr2")
-				return
-			}
-
-			bh := btc.NewSha2Hash(hdr[:80])
+	if len(hdrs)>0 {
+		for _, hdr := range hdrs {
+			bh := btc.NewSha2Hash(hdr)
 			MutexRcv.Lock()
 			if _, ok := ReceivedBlocks[bh.BIdx()]; !ok {
 				if b2g, ok := BlocksToGet[bh.BIdx()]; !ok {
@@ -52,7 +39,7 @@ func (c *OneConnection) HandleHeaders(pl []byte) {
 					new_headers_got++
 					//fmt.Println("", i, bh.String(), " - NEW!")
 
-					bl, er := btc.NewBlock(hdr[:])
+					bl, er := btc.NewBlock(append(hdr, 0))
 					if er == nil {
 						common.BlockChain.BlockIndexAccess.Lock()
 						er, dos, _ := common.BlockChain.PreCheckBlock(bl)
@@ -68,6 +55,7 @@ func (c *OneConnection) HandleHeaders(pl []byte) {
 							BlocksToGet[bh.BIdx()] = &OneBlockToGet{Block:bl, BlockTreeNode:node, InProgress:0}
 						} else {
 							common.CountSafe("HeaderCheckFail")
+							c.SendBlockReject(bh, er)
 							if dos {
 								c.DoS("BadHeader")
 							} else {
@@ -101,12 +89,13 @@ func (c *OneConnection) HandleHeaders(pl []byte) {
 // Handle getheaders protocol command
 // https://en.bitcoin.it/wiki/Protocol_specification#getheaders
 func (c *OneConnection) GetHeaders(pl []byte) {
-	h2get, hashstop, e := parseLocatorsPayload(pl)
-	if e != nil || hashstop==nil {
+	loc, e := wire.ParseLocator(pl)
+	if e != nil {
 		println("GetHeaders: error parsing payload from", c.PeerAddr.Ip())
 		c.DoS("BadGetHdrs")
 		return
 	}
+	h2get, hashstop := loc.Hashes, loc.Stop
 
 	if common.DebugLevel > 1 {
 		println("GetHeaders", len(h2get), hashstop.String())
@@ -144,7 +133,7 @@ func (c *OneConnection) GetHeaders(pl []byte) {
 	//best_bl_ch := len(best_block.Childs)
 	//last_block = common.BlockChain.BlockTreeEnd
 
-	var resp []byte
+	var resp [][]byte
 	var cnt uint32
 
 	defer func() {
@@ -172,10 +161,7 @@ func (c *OneConnection) GetHeaders(pl []byte) {
 		common.BlockChain.BlockIndexAccess.Unlock()
 
 		// send the response
-		out := new(bytes.Buffer)
-		btc.WriteVlen(out, uint64(cnt))
-		out.Write(resp)
-		c.SendRawMsg("headers", out.Bytes())
+		c.SendRawMsg("headers", wire.EncodeHeaders(resp))
 	}()
 
 	for cnt<2000 {
@@ -188,7 +174,7 @@ func (c *OneConnection) GetHeaders(pl []byte) {
 			//println("resp:", hex.EncodeToString(resp))
 			break
 		}
-		resp = append(resp, append(best_block.BlockHeader[:], 0)...) // 81st byte is always zero
+		resp = append(resp, best_block.BlockHeader[:])
 		cnt++
 	}
 
@@ -206,12 +192,12 @@ func (c *OneConnection) sendGetHeaders() {
 		min_height = 0
 	}
 
-	blks := new(bytes.Buffer)
+	loc := &wire.MsgLocator{Version:common.Version}
 	var cnt uint64
 	var step int
 	step = 1
 	for cnt<50/*it shoudl never get that far, but just in case...*/ {
-		blks.Write(lb.BlockHash.Hash[:])
+		loc.Hashes = append(loc.Hashes, lb.BlockHash)
 		cnt++
 		//println(" geth", cnt, "height", lb.Height, lb.BlockHash.String())
 		if int(lb.Height) <= min_height {
@@ -227,13 +213,7 @@ func (c *OneConnection) sendGetHeaders() {
 			step = step*2
 		}
 	}
-	var null_stop [32]byte
-	blks.Write(null_stop[:])
-
-	bhdr := new(bytes.Buffer)
-	binary.Write(bhdr, binary.LittleEndian, common.Version)
-	btc.WriteVlen(bhdr, cnt)
 
-	c.SendRawMsg("getheaders", append(bhdr.Bytes(), blks.Bytes()...))
+	c.SendRawMsg("getheaders", loc.Bytes())
 	c.X.GetHeadersInProgress = true
 }
@@ -2,10 +2,10 @@ package network
 
 import (
 	"fmt"
+	"time"
 	//"time"
-	"bytes"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/client/common"
 )
@@ -27,23 +27,23 @@ func blockPending(bh *btc.Uint256) (ok bool) {
 
 
 func (c *OneConnection) ProcessInv(pl []byte) {
-	if len(pl) < 37 {
-		//println(c.PeerAddr.Ip(), "inv payload too short", len(pl))
+	invs, e := wire.ParseInv(pl)
+	if e != nil {
+		//println(c.PeerAddr.Ip(), "inv:", e.Error())
+		c.Misbehave("InvBroken", MisbehaveMalformed)
+		return
+	}
+	if len(invs) == 0 {
 		c.DoS("InvEmpty")
 		return
 	}
 	c.X.InvsRecieved++
 
-	cnt, of := btc.VLen(pl)
-	if len(pl) != of + 36*cnt {
-		println("inv payload length mismatch", len(pl), of, cnt)
-	}
-
-	for i:=0; i<cnt; i++ {
-		typ := binary.LittleEndian.Uint32(pl[of:of+4])
+	for i := range invs {
+		typ := invs[i].Type
 		common.CountSafe(fmt.Sprint("InvGot",typ))
-		if typ==2 {
-			bhash := btc.NewUint256(pl[of+4:of+36])
+		if typ==wire.MSG_BLOCK {
+			bhash := btc.NewUint256(invs[i].Hash[:])
 			if !c.X.AllHeadersReceived {
 				common.CountSafe("InvBlockIgnored")
 			} else {
@@ -66,8 +66,10 @@ func (c *OneConnection) ProcessInv(pl []byte) {
 					common.CountSafe("InvBlockOld")
 				}
 			}
-		} else if typ==1 {
-			if common.CFG.TXPool.Enabled {
+		} else if typ==wire.MSG_TX {
+			if c.X.BlockOnly {
+				common.CountSafe("InvTxBlockOnly") // we have told the peer not to send these
+			} else if common.CFG.TXPool.Enabled || (c.X.Perms&common.PERM_RELAY)!=0 {
 				MutexRcv.Lock()
 				pending_blocks := len(BlocksToGet) + len(CachedBlocks) + len(NetBlocks)
 				MutexRcv.Unlock()
@@ -75,11 +77,16 @@ func (c *OneConnection) ProcessInv(pl []byte) {
 				if pending_blocks > 10 {
 					common.CountSafe("InvTxIgnored") // do not process TXs if the chain is not synchronized
 				} else {
-					c.TxInvNotify(pl[of+4:of+36])
+					c.TxInvNotify(invs[i].Hash[:])
 				}
 			}
+		} else if typ==wire.MSG_DANDELION_TX {
+			if c.X.BlockOnly || !common.CFG.TXPool.Enabled {
+				common.CountSafe("InvStemIgnored")
+			} else {
+				c.stemInvNotify(invs[i].Hash[:])
+			}
 		}
-		of+= 36
 	}
 
 	return
@@ -91,22 +98,26 @@ func NetRouteInv(typ uint32, h *btc.Uint256, fromConn *OneConnection) (cnt uint)
 	common.CountSafe(fmt.Sprint("NetRouteInv", typ))
 
 	// Prepare the inv
-	inv := new([36]byte)
-	binary.LittleEndian.PutUint32(inv[0:4], typ)
-	copy(inv[4:36], h.Bytes())
+	inv := &wire.InvVect{Type:typ, Hash:h.Hash}
 
 	// Append it to PendingInvs in each open connection
 	Mutex_net.Lock()
 	for _, v := range OpenCons {
 		if v != fromConn { // except the one that this inv came from
 			v.Mutex.Lock()
-			if v.Node.DoNotRelayTxs && typ==1 {
+			if (v.Node.DoNotRelayTxs || v.X.BlockOnly) && typ==1 {
 				// This node does not want tx inv (it came with its version message)
 				common.CountSafe("SendInvNoTxNode")
 			} else {
 				if fromConn==nil && v.X.InvsRecieved==0 {
 					// Do not broadcast own txs to nodes that never sent any invs to us
 					common.CountSafe("SendInvOwnBlocked")
+				} else if typ==wire.MSG_TX {
+					if v.queueTxInv(inv, fromConn==nil) {
+						cnt++
+					} else {
+						common.CountSafe("SendInvIgnored")
+					}
 				} else if len(v.PendingInvs)<500 {
 					v.PendingInvs = append(v.PendingInvs, inv)
 					cnt++
@@ -141,14 +152,14 @@ func addInvBlockBranch(inv map[[32]byte] bool, bl *chain.BlockTreeNode, stop *bt
 
 
 func (c *OneConnection) GetBlocks(pl []byte) {
-	h2get, hashstop, e := parseLocatorsPayload(pl)
-
-	if e!=nil || len(h2get)<1 || hashstop==nil {
+	loc, e := wire.ParseLocator(pl)
+	if e!=nil || len(loc.Hashes)<1 {
 		println("GetBlocks: error parsing payload from", c.PeerAddr.Ip())
 		c.DoS("BadGetBlks")
 		return
 	}
 
+	h2get, hashstop := loc.Hashes, loc.Stop
 	invs := make(map[[32]byte] bool, 500)
 	for i := range h2get {
 		common.BlockChain.BlockIndexAccess.Lock()
@@ -168,13 +179,11 @@ func (c *OneConnection) GetBlocks(pl []byte) {
 					if len(invs)>0 {
 						common.BlockChain.BlockIndexAccess.Unlock()
 
-						inv := new(bytes.Buffer)
-						btc.WriteVlen(inv, uint64(len(invs)))
+						inv := make([]wire.InvVect, 0, len(invs))
 						for k, _ := range invs {
-							binary.Write(inv, binary.LittleEndian, uint32(2))
-							inv.Write(k[:])
+							inv = append(inv, wire.InvVect{Type:wire.MSG_BLOCK, Hash:k})
 						}
-						c.SendRawMsg("inv", inv.Bytes())
+						c.SendRawMsg("inv", wire.EncodeInv(inv))
 						return
 					}
 				}
@@ -189,23 +198,32 @@ func (c *OneConnection) GetBlocks(pl []byte) {
 
 
 func (c *OneConnection) SendInvs() (res bool) {
-	b_txs := new(bytes.Buffer)
-	b_blk := new(bytes.Buffer)
+	var b_txs []wire.InvVect
+	var b_blk [][]byte
+	var cmpct []*btc.Uint256
+	var filtered []*wire.InvVect
 
 	c.Mutex.Lock()
+	queued := c.dueTxInvs(time.Now())
 	if len(c.PendingInvs)>0 {
-		for i := range c.PendingInvs {
-			if c.Node.SendHeaders && binary.LittleEndian.Uint32((*c.PendingInvs[i])[:4])==2 {
+		for _, inv := range c.PendingInvs {
+			if c.Node.HighBandwidth && c.Node.SendCmpctVer==1 && common.CFG.Net.CompactBlocks &&
+				inv.Type==wire.MSG_BLOCK {
+				// the peer wants new blocks as cmpctblock
+				cmpct = append(cmpct, btc.NewUint256(inv.Hash[:]))
+			} else if c.Node.SendHeaders && inv.Type==wire.MSG_BLOCK {
 				// convert block inv to block header
 				common.BlockChain.BlockIndexAccess.Lock()
-				bl := common.BlockChain.BlockIndex[btc.NewUint256((*c.PendingInvs[i])[4:]).BIdx()]
+				bl := common.BlockChain.BlockIndex[btc.NewUint256(inv.Hash[:]).BIdx()]
 				if bl != nil {
-					b_blk.Write(bl.BlockHeader[:])
-					b_blk.Write([]byte{0}) // 0 txs
+					b_blk = append(b_blk, bl.BlockHeader[:])
 				}
 				common.BlockChain.BlockIndexAccess.Unlock()
+			} else if (c.bloom!=nil || c.Node.FeeFilter>0) && inv.Type==wire.MSG_TX {
+				// SPV peer or one with feefilter - the tx needs to be checked
+				filtered = append(filtered, inv)
 			} else {
-				b_txs.Write((*c.PendingInvs[i])[:])
+				b_txs = append(b_txs, *inv)
 			}
 		}
 		res = true
@@ -213,18 +231,39 @@ func (c *OneConnection) SendInvs() (res bool) {
 	c.PendingInvs = nil
 	c.Mutex.Unlock()
 
-	if b_blk.Len() > 0 {
+	if len(queued) > 0 {
+		b_txs = append(b_txs, c.sortTxInvs(queued)...)
+		res = true
+	}
+
+	if len(filtered) > 0 {
+		TxMutex.Lock()
+		for _, inv := range filtered {
+			if tx, ok := TransactionsToSend[btc.NewUint256(inv.Hash[:]).BIdx()]; !ok {
+				common.CountSafe("InvFilteredGone")
+			} else if tx.SPKB() < c.Node.FeeFilter {
+				common.CountSafe("InvFeeFiltered")
+			} else if c.bloom!=nil && !c.bloom.MatchTx(tx.Tx) {
+				common.CountSafe("InvBloomFiltered")
+			} else {
+				b_txs = append(b_txs, *inv)
+			}
+		}
+		TxMutex.Unlock()
+	}
+
+	for _, h := range cmpct {
+		common.CountSafe("InvSentAsCmpct")
+		c.SendCmpctBlock(h)
+	}
+
+	if len(b_blk) > 0 {
 		common.CountSafe("InvSentAsHeader")
-		b := new(bytes.Buffer)
-		btc.WriteVlen(b, uint64(b_blk.Len()/81))
-		c.SendRawMsg("headers", append(b.Bytes(), b_blk.Bytes()...))
-		//println("sent block's header(s)", b_blk.Len(), uint64(b_blk.Len()/81))
+		c.SendRawMsg("headers", wire.EncodeHeaders(b_blk))
 	}
 
-	if b_txs.Len() > 0 {
-		b := new(bytes.Buffer)
-		btc.WriteVlen(b, uint64(b_txs.Len()/36))
-		c.SendRawMsg("inv", append(b.Bytes(), b_txs.Bytes()...))
+	if len(b_txs) > 0 {
+		c.SendRawMsg("inv", wire.EncodeInv(b_txs))
 	}
 
 	return
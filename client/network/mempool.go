@@ -0,0 +1,110 @@
+package network
+
+import (
+	"sync/atomic"
+	"github.com/piotrnar/gocoin/lib/wire"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+/*
+  "mempool" (BIP35) and "feefilter" (BIP133)
+*/
+
+const (
+	FEEFILTER_MIN_VERSION = 70013
+	MEMPOOL_MIN_VERSION = 60002
+	MempoolAskPeers = 2 // after startup, ask this many peers for the content of their mempools
+	MempoolInvBatch = 1000 // number of txs in each inv sent in response to "mempool"
+)
+
+var mempoolAsked uint32 // number of peers that we have sent "mempool" to
+
+
+// Returns fee rate of the tx in satoshis per 1000 bytes
+func (t *OneTxToSend) SPKB() uint64 {
+	return 1000 * t.Fee / uint64(len(t.Data))
+}
+
+
+// Handles "mempool" - sends invs of all the txs from our pool that we would relay.
+// Like Core, we answer it if we offer SERVICE_BLOOM or the peer has PERM_MEMPOOL.
+func (c *OneConnection) HandleMempool() {
+	if (c.X.Perms&common.PERM_MEMPOOL)==0 && (common.Services&common.SERVICE_BLOOM)==0 {
+		common.CountSafe("MempoolIgnored")
+		return
+	}
+	if c.Node.DoNotRelayTxs && c.bloom==nil {
+		common.CountSafe("MempoolNoRelay")
+		return
+	}
+
+	var invs []wire.InvVect
+	TxMutex.Lock()
+	for _, v := range TransactionsToSend {
+		if v.Blocked!=0 || !v.Stem.IsZero() || v.SPKB() < c.Node.FeeFilter {
+			continue
+		}
+		if c.bloom!=nil && !c.bloom.MatchTx(v.Tx) {
+			continue
+		}
+		invs = append(invs, wire.InvVect{Type:wire.MSG_TX, Hash:v.Hash.Hash})
+		if len(invs) >= wire.MaxInvCount {
+			break
+		}
+	}
+	TxMutex.Unlock()
+
+	common.CountSafeAdd("MempoolInvs", uint64(len(invs)))
+	for len(invs) > 0 {
+		n := len(invs)
+		if n > MempoolInvBatch {
+			n = MempoolInvBatch
+		}
+		if c.SendRawMsg("inv", wire.EncodeInv(invs[:n])) != nil {
+			return
+		}
+		invs = invs[n:]
+	}
+}
+
+
+// Handles "feefilter" - the peer does not want invs of txs paying less than this
+func (c *OneConnection) HandleFeeFilter(pl []byte) {
+	spkb, e := wire.ParseFeeFilter(pl)
+	if e != nil {
+		c.DoS("FeeFilterBroken")
+		return
+	}
+	c.Mutex.Lock()
+	c.Node.FeeFilter = spkb
+	c.Mutex.Unlock()
+}
+
+
+// Called from Tick() - sends our "feefilter" (again if TXPool.FeePerByte has changed)
+// and, after the startup, asks a few peers for the content of their mempools.
+func (c *OneConnection) mempoolTick() {
+	if c.X.BlockOnly || !common.CFG.TXPool.Enabled {
+		return // we have told the peer not to send us any txs
+	}
+
+	if c.Node.Version >= FEEFILTER_MIN_VERSION {
+		if spkb := 1000 * atomic.LoadUint64(&common.CFG.TXPool.FeePerByte); spkb != c.X.FeeFilterSent {
+			c.X.FeeFilterSent = spkb
+			c.SendRawMsg("feefilter", wire.EncodeFeeFilter(spkb))
+		}
+	}
+
+	if !c.X.MempoolAsked && !c.X.Incomming && c.Node.Version >= MEMPOOL_MIN_VERSION &&
+		(c.Node.Services&common.SERVICE_BLOOM)!=0 && atomic.LoadUint32(&mempoolAsked) < MempoolAskPeers {
+		MutexRcv.Lock()
+		pending_blocks := len(BlocksToGet) + len(CachedBlocks) + len(NetBlocks)
+		MutexRcv.Unlock()
+		if pending_blocks <= 10 { // we would ignore the invs, if the chain was not synchronized
+			c.X.MempoolAsked = true
+			atomic.AddUint32(&mempoolAsked, 1)
+			common.CountSafe("MempoolAsked")
+			c.SendRawMsg("mempool", nil)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+func TestHandleFeeFilter(t *testing.T) {
+	var tv = []struct {
+		pl []byte
+		ban bool
+		spkb uint64
+	} {
+		{wire.EncodeFeeFilter(1000), false, 1000},
+		{wire.EncodeFeeFilter(0), false, 0},
+		{wire.EncodeFeeFilter(0xffffffffffffffff), false, 0xffffffffffffffff},
+		{[]byte{1, 2, 3, 4, 5, 6, 7}, true, 0},
+		{append(wire.EncodeFeeFilter(1000), 0), true, 0},
+		{nil, true, 0},
+	}
+	for i := range tv {
+		c := testConn()
+		c.HandleFeeFilter(tv[i].pl)
+		if !testPunished(c, tv[i].ban, 0) || c.Node.FeeFilter != tv[i].spkb {
+			t.Error(i, "Unexpected result", c.banit, c.Node.FeeFilter)
+		}
+	}
+}
+
+func TestSPKB(t *testing.T) {
+	var tv = []struct {
+		fee uint64
+		size int
+		spkb uint64
+	} {
+		{1000, 250, 4000},
+		{0, 250, 0},
+		{1, 1001, 0},
+		{21e6 * 1e8, 60, 21e6 * 1e8 * 1000 / 60}, // all the money does not overflow
+	}
+	for i := range tv {
+		rec := &OneTxToSend{Data: make([]byte, tv[i].size), Fee: tv[i].fee, Tx: new(btc.Tx)}
+		if s := rec.SPKB(); s != tv[i].spkb {
+			t.Error(i, "Bad SPKB", s)
+		} else if s >= 0xffffffffffffffff {
+			t.Error(i, "Passes the highest fee filter", s)
+		}
+	}
+}
+
+func TestHandleMempool(t *testing.T) {
+	tx := &btc.Tx{TxOut:[]*btc.TxOut{{Value:1e8, Pk_script:[]byte{0x51}}}}
+	tx.Hash = btc.NewSha2Hash(tx.Serialize())
+	TxMutex.Lock()
+	TransactionsToSend[tx.Hash.BIdx()] = &OneTxToSend{Data:make([]byte, 100), Fee:1000, Tx:tx}
+	TxMutex.Unlock()
+	prv_srvs, prv_bloom := common.Services, common.CFG.Net.BloomFilters
+	common.CFG.Net.BloomFilters = true // so peers can load filters
+	defer func() {
+		TxMutex.Lock()
+		delete(TransactionsToSend, tx.Hash.BIdx())
+		TxMutex.Unlock()
+		common.Services, common.CFG.Net.BloomFilters = prv_srvs, prv_bloom
+	}()
+
+	var tv = []struct {
+		services uint64 // what we advertise
+		perms uint32
+		filter bool // the peer has loaded a filter (not matching our tx)
+		norelay bool
+		feefilter uint64
+		sent bool
+	} {
+		{common.SERVICE_NETWORK, 0, false, false, 0, false},
+		{common.SERVICE_NETWORK, 0, true, false, 0, false},
+		{common.SERVICE_NETWORK, common.PERM_MEMPOOL, false, false, 0, true},
+		{common.SERVICE_NETWORK|common.SERVICE_BLOOM, 0, false, false, 0, true},
+		{common.SERVICE_NETWORK|common.SERVICE_BLOOM, 0, true, false, 0, false},
+		{common.SERVICE_NETWORK|common.SERVICE_BLOOM, 0, false, true, 0, false},
+		{common.SERVICE_NETWORK|common.SERVICE_BLOOM, 0, false, false, 10000, true},
+		{common.SERVICE_NETWORK|common.SERVICE_BLOOM, 0, false, false, 10001, false},
+	}
+	for i := range tv {
+		common.Services = tv[i].services
+		c := testConn()
+		c.X.Perms = tv[i].perms
+		c.Node.DoNotRelayTxs = tv[i].norelay
+		c.Node.FeeFilter = tv[i].feefilter
+		if tv[i].filter {
+			c.HandleFilterMsg("filterload", testFilterLoad(100, 10))
+		}
+		c.HandleMempool()
+		if sent := c.counters["sent_inv"] != 0; sent != tv[i].sent {
+			t.Error(i, "Unexpected result", sent)
+		} else if sent && (c.counters["sent_inv"] != 1 || c.counters["sbts_inv"] != 1+36) {
+			t.Error(i, "Bad inv", c.counters["sent_inv"], c.counters["sbts_inv"])
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"sort"
 	"sync/atomic"
 	"crypto/rand"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/client/common"
 )
 
@@ -49,6 +51,9 @@ func drop_slowest_peer() {
 			// If this is an incomming connection, but we are not full yet, ignore it
 			continue
 		}
+		if v.X.BlockOnly || v.X.AddNode || v.X.Feeler || (v.X.Perms&common.PERM_NOBAN)!=0 {
+			continue
+		}
 		v.Mutex.Lock()
 		ap := v.GetAveragePing()
 		v.Mutex.Unlock()
@@ -70,9 +75,11 @@ func drop_slowest_peer() {
 
 func (c *OneConnection) TryPing() bool {
 	if c.Node.Version>60000 && c.PingInProgress == nil && time.Now().After(c.NextPing) {
-		c.PingInProgress = make([]byte, 8)
-		rand.Read(c.PingInProgress[:])
-		c.SendRawMsg("ping", c.PingInProgress)
+		var nonce [8]byte
+		rand.Read(nonce[:])
+		c.PingInProgress = new(uint64)
+		*c.PingInProgress = binary.LittleEndian.Uint64(nonce[:])
+		c.SendRawMsg("ping", wire.EncodePing(*c.PingInProgress))
 		c.LastPingSent = time.Now()
 		//println(c.PeerAddr.Ip(), "ping...")
 		return true
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+/*
+  Reject messages (BIP61)
+*/
+
+const (
+	REJECT_MIN_VERSION = 70002 // peers older than this do not understand "reject"
+	MaxRejectsKept = 10 // how many recently received rejects to keep per connection
+)
+
+// Reject received from a peer
+type RejectInfo struct {
+	Time time.Time
+	Message string
+	Code byte
+	Reason string
+	Hash string // of the rejected tx or block (empty if none)
+}
+
+
+// Sends "reject" to the peer, if it supports it. hash can be nil.
+func (c *OneConnection) SendReject(cmd string, code byte, reason string, hash *btc.Uint256) {
+	c.Mutex.Lock()
+	ver := c.Node.Version // we may be called from outside of the peer's goroutine
+	c.Mutex.Unlock()
+	if ver < REJECT_MIN_VERSION {
+		return
+	}
+	r := &wire.MsgReject{Message:cmd, Code:code, Reason:reason}
+	if hash != nil {
+		r.Data = hash.Hash[:]
+	}
+	common.CountSafe(fmt.Sprint("RejectSent-", code))
+	c.SendRawMsg("reject", r.Bytes())
+}
+
+
+// Returns BIP61 code and reason for the given TX_REJECTED_* value.
+// Zero code means that the peer should not be notified.
+func txRejectCode(why byte) (code byte, reason string) {
+	switch why {
+		case TX_REJECTED_TOO_BIG: return wire.REJECT_NONSTANDARD, "tx-size"
+		case TX_REJECTED_FORMAT: return wire.REJECT_MALFORMED, "error parsing message"
+		case TX_REJECTED_LEN_MISMATCH: return wire.REJECT_MALFORMED, "bad-txns-length"
+		case TX_REJECTED_EMPTY_INPUT: return wire.REJECT_INVALID, "bad-txns-vin-empty"
+		case TX_REJECTED_DOUBLE_SPEND: return wire.REJECT_DUPLICATE, "txn-mempool-conflict"
+		case TX_REJECTED_DUST: return wire.REJECT_DUST, "dust"
+		case TX_REJECTED_OVERSPEND: return wire.REJECT_INVALID, "bad-txns-in-belowout"
+		case TX_REJECTED_LOW_FEE: return wire.REJECT_INSUFFICIENTFEE, "insufficient fee"
+		case TX_REJECTED_SCRIPT_FAIL: return wire.REJECT_INVALID, "mandatory-script-verify-flag-failed"
+		case TX_REJECTED_BAD_INPUT: return wire.REJECT_INVALID, "bad-txns-inputs-missingorspent"
+		case TX_REJECTED_NOT_MINED: return wire.REJECT_NONSTANDARD, "unconfirmed-inputs"
+		case TX_REJECTED_CB_INMATURE: return wire.REJECT_INVALID, "bad-txns-premature-spend-of-coinbase"
+	}
+	return // orphans (TX_REJECTED_NO_TXOU) are not invalid, we just do not know the inputs yet
+}
+
+
+// Tells the peer why we did not accept its transaction
+func (c *OneConnection) SendTxReject(hash *btc.Uint256, why byte) {
+	if code, reason := txRejectCode(why); code != 0 {
+		c.SendReject("tx", code, reason, hash)
+	}
+}
+
+
+// Returns BIP61 code and reason for the error returned by the chain's block checking functions
+func blockRejectCode(e error) (code byte, reason string) {
+	reason = "inconclusive"
+	if idx := strings.Index(e.Error(), "- RPC_Result:"); idx != -1 {
+		reason = e.Error()[idx+13:]
+	}
+	switch reason {
+		case "duplicate": code = wire.REJECT_DUPLICATE
+		case "bad-version": code = wire.REJECT_OBSOLETE
+		case "bad-blk-length": code = wire.REJECT_MALFORMED
+		default: code = wire.REJECT_INVALID
+	}
+	return
+}
+
+
+// Tells the peer why we did not accept its block (or header)
+func (c *OneConnection) SendBlockReject(hash *btc.Uint256, e error) {
+	code, reason := blockRejectCode(e)
+	c.SendReject("block", code, reason, hash)
+}
+
+
+// Handles "reject" message - keeps it for diagnostics
+func (c *OneConnection) HandleReject(pl []byte) {
+	r, e := wire.ParseReject(pl)
+	if e != nil {
+		common.CountSafe("RejectBroken")
+		return
+	}
+	common.CountSafe("RejectRcvd-"+r.Message)
+
+	ri := &RejectInfo{Time:time.Now(), Message:r.Message, Code:r.Code, Reason:r.Reason}
+	if len(r.Data) == 32 {
+		ri.Hash = btc.NewUint256(r.Data).String()
+	} else if len(r.Data) > 0 {
+		ri.Hash = hex.EncodeToString(r.Data)
+	}
+	c.Mutex.Lock()
+	if len(c.rejects) >= MaxRejectsKept {
+		c.rejects = c.rejects[1:]
+	}
+	c.rejects = append(c.rejects, ri)
+	c.Mutex.Unlock()
+
+	if common.DebugLevel > 0 {
+		println(c.PeerAddr.Ip(), "rejected", r.Message, ri.Hash, "-", r.Code, r.Reason)
+	}
+
+	if r.Message == "tx" && len(r.Data) == 32 {
+		TxMutex.Lock()
+		tx, ok := TransactionsToSend[btc.NewUint256(r.Data).BIdx()]
+		own := ok && tx.Own != 0
+		TxMutex.Unlock()
+		if own {
+			select {
+				case NetAlerts <- fmt.Sprint("Own tx ", ri.Hash, " rejected by ", c.PeerAddr.Ip(), ": ", r.Reason):
+				default:
+			}
+		}
+	}
+}
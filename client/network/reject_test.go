@@ -0,0 +1,77 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
+)
+
+func TestHandleReject(t *testing.T) {
+	hash := btc.NewSha2Hash([]byte("tx"))
+	var tv = []struct {
+		pl []byte
+		ok bool
+		msg, reason, hash string
+	} {
+		{testPl(0, 2, []byte("tx"), []byte{wire.REJECT_DUST}, 4, []byte("dust"), hash.Hash[:]), true, "tx", "dust", hash.String()},
+		{testPl(0, 5, []byte("block"), []byte{wire.REJECT_INVALID}, 0, []byte{1, 2}), true, "block", "", "0102"},
+		{testPl(0, 7, []byte("version"), []byte{wire.REJECT_OBSOLETE}, 0), true, "version", "", ""},
+		{testPl(0), false, "", "", ""},
+		{testPl(0, 2, []byte("tx")), false, "", "", ""},
+		{testPl(0, 13, make([]byte, 13), []byte{1}, 0), false, "", "", ""},
+		{testPl(0, 2, []byte("tx"), []byte{1}, wire.MaxRejectLen+1, make([]byte, wire.MaxRejectLen+1)), false, "", "", ""},
+		{testPl(0, 2, []byte("tx"), []byte{1}, 10, []byte("short")), false, "", "", ""},
+		{testPl(0, uint64(0xffffffffffffffff)), false, "", "", ""},
+		{testPl(0, 2, []byte("tx"), []byte{1}, uint64(0xffffffffffffffff)), false, "", "", ""},
+	}
+	for i := range tv {
+		c := new(OneConnection)
+		c.HandleReject(tv[i].pl)
+		if !tv[i].ok {
+			if len(c.rejects) != 0 {
+				t.Error(i, "Broken reject accepted")
+			}
+			continue
+		}
+		if len(c.rejects) != 1 {
+			t.Error(i, "Reject not kept")
+			continue
+		}
+		if r := c.rejects[0]; r.Message != tv[i].msg || r.Reason != tv[i].reason || r.Hash != tv[i].hash {
+			t.Error(i, "Bad reject", r.Message, r.Reason, r.Hash)
+		}
+	}
+
+	c := new(OneConnection)
+	for i := 0; i < MaxRejectsKept+5; i++ {
+		c.HandleReject(tv[0].pl)
+	}
+	if len(c.rejects) != MaxRejectsKept {
+		t.Error("Rejects kept", len(c.rejects))
+	}
+}
+
+func TestRejectCodes(t *testing.T) {
+	var tv = []struct {
+		e error
+		code byte
+		reason string
+	} {
+		{errors.New("Bad block - RPC_Result:bad-version"), wire.REJECT_OBSOLETE, "bad-version"},
+		{errors.New("Known - RPC_Result:duplicate"), wire.REJECT_DUPLICATE, "duplicate"},
+		{errors.New("Short - RPC_Result:bad-blk-length"), wire.REJECT_MALFORMED, "bad-blk-length"},
+		{errors.New("Some error"), wire.REJECT_INVALID, "inconclusive"},
+	}
+	for i := range tv {
+		if code, reason := blockRejectCode(tv[i].e); code != tv[i].code || reason != tv[i].reason {
+			t.Error(i, "Bad block reject", code, reason)
+		}
+	}
+	if code, reason := txRejectCode(TX_REJECTED_LEN_MISMATCH); code != wire.REJECT_MALFORMED || reason != "bad-txns-length" {
+		t.Error("Bad tx reject", code, reason)
+	}
+	if code, _ := txRejectCode(TX_REJECTED_NO_TXOU); code != 0 {
+		t.Error("Orphan should not be rejected", code)
+	}
+}
@@ -0,0 +1,146 @@
+package network
+
+import (
+	"io"
+	"fmt"
+	"net"
+	"time"
+	"errors"
+	"math/rand"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
+)
+
+// Outgoing connections via SOCKS5 proxy (e.g. Tor)
+
+
+// Returns the proxy that shall be used for the given peer, or an empty string to connect directly
+func proxyFor(ad *peersdb.PeerAddr) (proxy string) {
+	common.LockCfg()
+	if common.CFG.Net.Proxy!="" && (!ad.IsIP() || !common.CFG.Net.ProxyOnlyOnion) {
+		proxy = common.CFG.Net.Proxy
+	}
+	common.UnlockCfg()
+	return
+}
+
+
+// Returns true if the peer cannot be connected to (.onion without a proxy) or is connected already.
+// Used as the filter for peersdb.GetBestPeers()
+func ConnectionActiveOrUnreachable(ad *peersdb.PeerAddr) bool {
+	if ad.NetID==btc.NET_I2P || !ad.IsIP() && proxyFor(ad)=="" {
+		return true // we only learn and relay I2P addresses
+	}
+	return ConnectionActive(ad)
+}
+
+
+// Opens TCP connection to the peer, either directly or via the proxy
+func dialPeer(ad *peersdb.PeerAddr) (conn net.Conn, e error) {
+	proxy := proxyFor(ad)
+	if proxy=="" {
+		if !ad.IsIP() {
+			return nil, errors.New("No proxy configured for " + ad.Ip())
+		}
+		return net.DialTimeout("tcp", ad.Ip(), TCPDialTimeout)
+	}
+
+	conn, e = net.DialTimeout("tcp", proxy, TCPDialTimeout)
+	if e != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(TCPDialTimeout))
+	if e = socks5Connect(conn, &ad.NetAddr); e != nil {
+		conn.Close()
+		conn = nil
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	common.CountSafe("ProxyConnected")
+	return
+}
+
+
+// Performs SOCKS5 handshake (RFC1928), requesting connection to the given address
+func socks5Connect(conn net.Conn, ad *btc.NetAddr) (e error) {
+	var buf [4]byte
+
+	common.LockCfg()
+	isolate := common.CFG.Net.ProxyIsolate
+	common.UnlockCfg()
+
+	if isolate {
+		_, e = conn.Write([]byte{5, 2, 0, 2}) // no auth or username/password
+	} else {
+		_, e = conn.Write([]byte{5, 1, 0}) // no auth
+	}
+	if e != nil {
+		return
+	}
+	if _, e = io.ReadFull(conn, buf[:2]); e != nil {
+		return
+	}
+	if buf[0] != 5 {
+		return errors.New("We only support SOCKS5 proxy")
+	}
+
+	switch buf[1] {
+		case 0:
+		case 2:
+			// Random credentials make Tor use a separate circuit for each connection (RFC1929)
+			user := fmt.Sprintf("%x", rand.Int63())
+			req := append([]byte{1, byte(len(user))}, user...)
+			req = append(append(req, byte(len(user))), user...)
+			if _, e = conn.Write(req); e != nil {
+				return
+			}
+			if _, e = io.ReadFull(conn, buf[:2]); e != nil {
+				return
+			}
+			if buf[1] != 0 {
+				return errors.New("SOCKS proxy authentication failed")
+			}
+		default:
+			return errors.New("SOCKS proxy connection refused")
+	}
+
+	req := []byte{5, 1, 0}
+	if ad.IsIP() {
+		if ad.IsIPv4() {
+			req = append(append(req, 1), ad.Ip4[:]...)
+		} else {
+			ip := ad.Ip16()
+			req = append(append(req, 4), ip[:]...)
+		}
+	} else {
+		host := ad.Host()
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = append(req, byte(ad.Port>>8), byte(ad.Port))
+	if _, e = conn.Write(req); e != nil {
+		return
+	}
+
+	// the reply: VER, REP, RSV, ATYP, BND.ADDR, BND.PORT
+	if _, e = io.ReadFull(conn, buf[:4]); e != nil {
+		return
+	}
+	if buf[1] != 0 {
+		return errors.New(fmt.Sprint("SOCKS proxy connection failed with code ", buf[1]))
+	}
+	var le int
+	switch buf[3] {
+		case 1: le = 4
+		case 4: le = 16
+		case 3:
+			if _, e = io.ReadFull(conn, buf[:1]); e != nil {
+				return
+			}
+			le = int(buf[0])
+		default:
+			return errors.New("SOCKS proxy returned unknown address type")
+	}
+	_, e = io.ReadFull(conn, make([]byte, le+2)) // we do not need BND.ADDR nor BND.PORT
+	return
+}
@@ -0,0 +1,148 @@
+package network
+
+import (
+	"time"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+/*
+  Each block requested from a peer gets a deadline, based on the peer's measured
+  download speed and the amount of data requested before it. A peer that misses
+  the deadline is stalling the download - its blocks go back to BlocksToGet, to be
+  fetched from other peers. After BlockStallsMax stalls in a row it gets dropped,
+  unless it has PERM_NOBAN.
+*/
+
+const (
+	BlockDlDefaultSpeed = 100e3 // bytes per second assumed, before we measure it
+	BlockDlMinSpeed = 10e3 // never assume a peer to be slower than this
+	BlockDlWindowTime = 10*time.Second // request as much data, as the peer can deliver in this time
+	BlockStallsMax = 3 // disconnect the peer after this many stalls in a row
+)
+
+
+// Returns the download speed of the peer (bytes per second) to be used for the deadlines
+func (c *OneConnection) blockDlSpeed() float64 {
+	if c.X.BlockDlSpeed == 0 {
+		return BlockDlDefaultSpeed
+	}
+	if c.X.BlockDlSpeed < BlockDlMinSpeed {
+		return BlockDlMinSpeed
+	}
+	return float64(c.X.BlockDlSpeed)
+}
+
+
+// Returns how many bytes of blocks we can have in progress with this peer
+func (c *OneConnection) blockDlWindow(avg_block_size uint) uint {
+	if c.X.BlockDlSpeed == 0 {
+		return MAX_GETDATA_FORWARD // not measured yet
+	}
+	win := uint(c.blockDlSpeed() * BlockDlWindowTime.Seconds())
+	if win < avg_block_size {
+		return avg_block_size // always allow at least one block
+	}
+	if win > MAX_GETDATA_FORWARD {
+		return MAX_GETDATA_FORWARD
+	}
+	return win
+}
+
+
+// Creates the in-progress record for a block requested from the peer - call it with c.Mutex locked
+func (c *OneConnection) newBlockDl(hash *btc.Uint256, avg_block_size uint) *oneBlockDl {
+	now := time.Now()
+	ahead := float64(uint(len(c.GetBlockInProgress)+1) * avg_block_size)
+	return &oneBlockDl{hash:hash, start:now,
+		deadline:now.Add(GetBlockTimeout + time.Duration(ahead/c.blockDlSpeed()*float64(time.Second)))}
+}
+
+
+// Updates the peer's download speed after receiving a block - call it with c.Mutex locked
+func (c *OneConnection) blockDlDone(bip *oneBlockDl, size int, now time.Time) {
+	from := bip.start
+	if c.lastBlockRcvd.After(from) {
+		from = c.lastBlockRcvd // the block was waiting in the queue behind the previous one
+	}
+	c.lastBlockRcvd = now
+	if dur := now.Sub(from); dur > 0 {
+		speed := uint64(float64(size) / dur.Seconds())
+		if c.X.BlockDlSpeed == 0 {
+			c.X.BlockDlSpeed = speed
+		} else {
+			c.X.BlockDlSpeed = (3*c.X.BlockDlSpeed + speed) / 4
+		}
+	}
+	if now.Before(bip.deadline) {
+		c.X.BlockStalls = 0
+	}
+}
+
+
+// Called from Tick() - takes back the blocks that the peer did not deliver in time
+func (c *OneConnection) checkBlockStall() {
+	now := time.Now()
+	var stalled []*oneBlockDl
+
+	c.Mutex.Lock()
+	for k, v := range c.GetBlockInProgress {
+		if now.After(v.deadline) {
+			stalled = append(stalled, v)
+			delete(c.GetBlockInProgress, k)
+			if c.stalledBlocks == nil {
+				c.stalledBlocks = make(map[[btc.Uint256IdxLen]byte] *oneBlockDl)
+			}
+			c.stalledBlocks[k] = v // in case it still arrives
+		}
+	}
+	for k, v := range c.stalledBlocks {
+		if now.Sub(v.start) > ExpireCachedAfter {
+			delete(c.stalledBlocks, k)
+		}
+	}
+	if len(stalled) > 0 {
+		c.X.BlockStalls++
+		c.X.BlocksStalled += uint64(len(stalled))
+		// so we would ask it for less
+		if c.X.BlockDlSpeed /= 2; c.X.BlockDlSpeed < BlockDlMinSpeed {
+			c.X.BlockDlSpeed = BlockDlMinSpeed
+		}
+	}
+	stalls := c.X.BlockStalls
+	noban := (c.X.Perms&common.PERM_NOBAN)!=0
+	c.Mutex.Unlock()
+
+	if len(stalled) == 0 {
+		return
+	}
+
+	common.CountSafe("BlockDlStall")
+	common.CountSafeAdd("BlockDlStalled", uint64(len(stalled)))
+	MutexRcv.Lock()
+	for _, v := range stalled {
+		if rec, ok := BlocksToGet[v.hash.BIdx()]; ok && rec.InProgress > 0 {
+			rec.InProgress--
+		}
+	}
+	MutexRcv.Unlock()
+
+	// Let the other peers fetch the blocks
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if v != c {
+			v.Mutex.Lock()
+			v.X.GetBlocksDataNow = true
+			v.Mutex.Unlock()
+		}
+	}
+	Mutex_net.Unlock()
+
+	if common.DebugLevel > 0 {
+		println(c.PeerAddr.Ip(), "stalled", len(stalled), "block(s) - stall", stalls, "in a row")
+	}
+	if stalls >= BlockStallsMax && !noban {
+		common.CountSafe("BlockDlStallDrop")
+		c.Disconnect()
+	}
+}
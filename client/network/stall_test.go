@@ -0,0 +1,200 @@
+package network
+
+import (
+	"time"
+	"testing"
+	"sync/atomic"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+func TestBlockDlWindow(t *testing.T) {
+	var tv = []struct {
+		speed uint64
+		avg uint
+		dlspeed float64
+		window uint
+	} {
+		{0, 1e6, BlockDlDefaultSpeed, MAX_GETDATA_FORWARD},
+		{1, 1e3, BlockDlMinSpeed, BlockDlMinSpeed*10},
+		{1, 1e6, BlockDlMinSpeed, 1e6},
+		{50e3, 1e3, 50e3, 500e3},
+		{50e3, 1e6, 50e3, 1e6},
+		{10e6, 1e6, 10e6, MAX_GETDATA_FORWARD},
+	}
+	for i := range tv {
+		c := testConn()
+		c.X.BlockDlSpeed = tv[i].speed
+		if res := c.blockDlSpeed(); res != tv[i].dlspeed {
+			t.Error(i, "Bad speed", res)
+		}
+		if res := c.blockDlWindow(tv[i].avg); res != tv[i].window {
+			t.Error(i, "Bad window", res)
+		}
+	}
+}
+
+func TestBlockDlDeadline(t *testing.T) {
+	c := testConn()
+	c.GetBlockInProgress = make(map[[btc.Uint256IdxLen]byte] *oneBlockDl)
+	c.X.BlockDlSpeed = 100e3
+	for i := 0; i < 3; i++ {
+		bip := c.newBlockDl(btc.NewSha2Hash([]byte{byte(i)}), 200e3)
+		// each block waits for the ones requested before it
+		if exp := GetBlockTimeout + time.Duration(2*(i+1))*time.Second; bip.deadline.Sub(bip.start) != exp {
+			t.Error(i, "Bad deadline", bip.deadline.Sub(bip.start), exp)
+		}
+		c.GetBlockInProgress[bip.hash.BIdx()] = bip
+	}
+}
+
+func TestBlockDlDone(t *testing.T) {
+	now := time.Now()
+	var tv = []struct {
+		speed uint64 // before
+		start, last time.Duration // block requested and the previous one received (before now)
+		late bool // after the deadline
+		stalls uint // before
+		newspeed uint64
+		newstalls uint
+	} {
+		{0, 2*time.Second, 0, false, 0, 50e3, 0},
+		{0, 2*time.Second, time.Second, false, 2, 100e3, 0},
+		{50e3, time.Second, 0, false, 1, 62500, 0},
+		{100e3, 4*time.Second, 0, true, 2, 81250, 2},
+		{100e3, time.Second, 2*time.Second, false, 0, 100e3, 0},
+	}
+	for i := range tv {
+		c := testConn()
+		c.X.BlockDlSpeed = tv[i].speed
+		c.X.BlockStalls = tv[i].stalls
+		if tv[i].last != 0 {
+			c.lastBlockRcvd = now.Add(-tv[i].last)
+		}
+		bip := &oneBlockDl{start:now.Add(-tv[i].start), deadline:now.Add(time.Second)}
+		if tv[i].late {
+			bip.deadline = now.Add(-time.Second)
+		}
+		c.blockDlDone(bip, 100e3, now)
+		if c.X.BlockDlSpeed != tv[i].newspeed || c.X.BlockStalls != tv[i].newstalls {
+			t.Error(i, "Unexpected result", c.X.BlockDlSpeed, c.X.BlockStalls)
+		}
+		if !c.lastBlockRcvd.Equal(now) {
+			t.Error(i, "lastBlockRcvd not updated")
+		}
+	}
+}
+
+func TestCheckBlockStall(t *testing.T) {
+	now := time.Now()
+	hashes := []*btc.Uint256{btc.NewSha2Hash([]byte{1}), btc.NewSha2Hash([]byte{2})}
+	c := testConn()
+	c.GetBlockInProgress = make(map[[btc.Uint256IdxLen]byte] *oneBlockDl)
+	c.X.BlockDlSpeed = 15e3
+	MutexRcv.Lock()
+	for i, h := range hashes {
+		c.GetBlockInProgress[h.BIdx()] = &oneBlockDl{hash:h, start:now, deadline:now.Add(time.Duration(2*i-1)*time.Second)}
+		BlocksToGet[h.BIdx()] = &OneBlockToGet{Block:&btc.Block{Hash:h}, InProgress:1}
+	}
+	MutexRcv.Unlock()
+	defer func() {
+		MutexRcv.Lock()
+		for _, h := range hashes {
+			delete(BlocksToGet, h.BIdx())
+		}
+		MutexRcv.Unlock()
+	}()
+
+	c.checkBlockStall()
+	if _, ok := c.stalledBlocks[hashes[0].BIdx()]; !ok || len(c.stalledBlocks) != 1 {
+		t.Error("Block not moved to stalledBlocks")
+	}
+	if _, ok := c.GetBlockInProgress[hashes[1].BIdx()]; !ok || len(c.GetBlockInProgress) != 1 {
+		t.Error("Block taken back before its deadline")
+	}
+	if BlocksToGet[hashes[0].BIdx()].InProgress != 0 || BlocksToGet[hashes[1].BIdx()].InProgress != 1 {
+		t.Error("Bad InProgress")
+	}
+	if c.X.BlockStalls != 1 || c.X.BlocksStalled != 1 || c.X.BlockDlSpeed != BlockDlMinSpeed {
+		t.Error("Bad stats", c.X.BlockStalls, c.X.BlocksStalled, c.X.BlockDlSpeed)
+	}
+
+	// stall again and again, until the peer gets dropped
+	for i := 2; i <= BlockStallsMax; i++ {
+		if c.IsBroken() {
+			t.Fatal(i, "Disconnected too early")
+		}
+		h := btc.NewSha2Hash([]byte{byte(10+i)})
+		c.GetBlockInProgress[h.BIdx()] = &oneBlockDl{hash:h, start:now, deadline:now.Add(-time.Second)}
+		c.checkBlockStall()
+		if c.X.BlockStalls != uint(i) || c.X.BlocksStalled != uint64(i) {
+			t.Error(i, "Bad stall counters", c.X.BlockStalls, c.X.BlocksStalled)
+		}
+	}
+	if !c.IsBroken() {
+		t.Error("Not disconnected after", BlockStallsMax, "stalls")
+	}
+
+	// a peer with PERM_NOBAN is never dropped
+	nb := testConn()
+	nb.X.Perms = common.PERM_NOBAN
+	nb.X.BlockStalls = BlockStallsMax
+	nb.GetBlockInProgress = map[[btc.Uint256IdxLen]byte] *oneBlockDl{hashes[1].BIdx():{hash:hashes[1], start:now, deadline:now.Add(-time.Second)}}
+	nb.checkBlockStall()
+	if nb.IsBroken() || nb.X.BlockStalls != BlockStallsMax+1 {
+		t.Error("PERM_NOBAN peer dropped")
+	}
+
+	// stalled records expire
+	c.stalledBlocks[hashes[0].BIdx()].start = now.Add(-ExpireCachedAfter-time.Second)
+	c.checkBlockStall()
+	if _, ok := c.stalledBlocks[hashes[0].BIdx()]; ok || len(c.stalledBlocks) != BlockStallsMax-1 {
+		t.Error("Stalled record not expired")
+	}
+}
+
+func TestGetBlockDataSkipsStalled(t *testing.T) {
+	common.Last.Mutex.Lock()
+	prv := common.Last.Block
+	common.Last.Block = &chain.BlockTreeNode{Height:10}
+	common.Last.Mutex.Unlock()
+	prvavg := atomic.LoadUint32(&common.AverageBlockSize)
+	atomic.StoreUint32(&common.AverageBlockSize, 1e3)
+	var hashes []*btc.Uint256
+	MutexRcv.Lock()
+	for i := 0; i < 2; i++ {
+		h := btc.NewSha2Hash([]byte{byte(i)})
+		hashes = append(hashes, h)
+		BlocksToGet[h.BIdx()] = &OneBlockToGet{Block:&btc.Block{Hash:h, Height:uint32(11+i)},
+			BlockTreeNode:&chain.BlockTreeNode{BlockHash:h, Height:uint32(11+i)}}
+	}
+	MutexRcv.Unlock()
+	defer func() {
+		MutexRcv.Lock()
+		for _, h := range hashes {
+			delete(BlocksToGet, h.BIdx())
+		}
+		MutexRcv.Unlock()
+		common.Last.Mutex.Lock()
+		common.Last.Block = prv
+		common.Last.Mutex.Unlock()
+		atomic.StoreUint32(&common.AverageBlockSize, prvavg)
+	}()
+
+	c := testConn()
+	c.broken = true // so nothing gets sent
+	c.counters = make(map[string]uint64)
+	c.Node.Height = 100
+	c.GetBlockInProgress = make(map[[btc.Uint256IdxLen]byte] *oneBlockDl)
+	c.stalledBlocks = map[[btc.Uint256IdxLen]byte] *oneBlockDl{hashes[0].BIdx():{hash:hashes[0], start:time.Now()}}
+	if !c.GetBlockData() {
+		t.Fatal("Nothing requested")
+	}
+	if _, ok := c.GetBlockInProgress[hashes[0].BIdx()]; ok {
+		t.Error("Stalled block requested again")
+	}
+	if _, ok := c.GetBlockInProgress[hashes[1].BIdx()]; !ok || len(c.GetBlockInProgress) != 1 {
+		t.Error("Block not requested")
+	}
+}
@@ -4,9 +4,8 @@ import (
 	"fmt"
 	"net"
 	"time"
-	"bytes"
-	"math/rand"
 	"sync/atomic"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
@@ -22,7 +21,7 @@ func (c *OneConnection) SendPendingData() bool {
 			bytes_to_send = SendBufSize-c.SendBufCons
 		}
 
-		n, e := common.SockWrite(c.Conn, c.sendBuf[c.SendBufCons:c.SendBufCons+bytes_to_send])
+		n, e := common.SockWrite(c.Conn, c.sendBuf[c.SendBufCons:c.SendBufCons+bytes_to_send], (c.X.Perms&common.PERM_DOWNLOAD)!=0)
 		if n > 0 {
 			c.Mutex.Lock()
 			c.X.LastSent = time.Now()
@@ -50,7 +49,7 @@ func (c *OneConnection) SendPendingData() bool {
 
 func (c *OneConnection) Tick() {
 	// Disconnect and ban useless peers (sych that don't send invs)
-	if c.X.InvsRecieved==0 && c.X.ConnectedAt.Add(15*time.Minute).Before(time.Now()) {
+	if c.X.InvsRecieved==0 && !c.X.BlockOnly && (c.X.Perms&common.PERM_NOBAN)==0 && c.X.ConnectedAt.Add(15*time.Minute).Before(time.Now()) {
 		c.DoS("PeerUseless")
 		return
 	}
@@ -79,8 +78,8 @@ func (c *OneConnection) Tick() {
 		c.HandlePong()  // this will set LastPingSent to nil
 	}
 
-	// Ask node for new addresses...?
-	if time.Now().After(c.X.NextGetAddr) {
+	// Ask node for new addresses...? (but not the block-relay-only ones)
+	if !c.X.BlockOnly && time.Now().After(c.X.NextGetAddr) {
 		if peersdb.PeerDB.Count() > common.MaxPeersNeeded {
 			// If we have a lot of peers, do not ask for more, to save bandwidth
 			common.CountSafe("AddrEnough")
@@ -92,11 +91,16 @@ func (c *OneConnection) Tick() {
 		return
 	}
 
+	c.mempoolTick()
+
 	// Need to send some invs...?
 	if c.SendInvs() {
 		return
 	}
 
+	c.cmpctCheckTimeout()
+	c.checkBlockStall()
+
 	if c.CheckGetBlockData() {
 		return
 	}
@@ -123,13 +127,36 @@ func (c *OneConnection) Tick() {
 		return
 	}
 
+	if blocks_to_get > 0 && time.Now().Sub(c.X.LastFetchTried) > time.Second {
+		// If the peer's download window is less than half full, ask it for more blocks
+		avg_block_size := common.GetAverageBlockSize()
+		c.Mutex.Lock()
+		in_progress := uint(len(c.GetBlockInProgress))
+		c.Mutex.Unlock()
+		if 2*in_progress*avg_block_size < c.blockDlWindow(avg_block_size) {
+			c.X.GetBlocksDataNow = true
+		}
+	}
+
 	// if we got here, means we had nothing to send - just wait for a moment
 	time.Sleep(150*time.Millisecond)
 }
 
 func DoNetwork(ad *peersdb.PeerAddr) {
+	doConnect(ad, OUT_FULL)
+}
+
+
+// Returns false if we are already connected to this peer
+func doConnect(ad *peersdb.PeerAddr, kind int) bool {
 	var e error
 	conn := NewConnection(ad)
+	conn.X.Feeler = kind==OUT_FEELER
+	conn.X.AddNode = kind==OUT_ADDNODE
+	conn.X.BlockOnly = kind==OUT_BLOCKONLY
+	if ad.IsIP() {
+		conn.X.Perms = common.PeerPermissions(ad.IP())
+	}
 	Mutex_net.Lock()
 	if _, ok := OpenCons[ad.UniqID()]; ok {
 		if common.DebugLevel>0 {
@@ -137,14 +164,17 @@ func DoNetwork(ad *peersdb.PeerAddr) {
 		}
 		common.CountSafe("ConnectingAgain")
 		Mutex_net.Unlock()
-		return
+		return false
 	}
 	OpenCons[ad.UniqID()] = conn
-	OutConsActive++
+	if kind==OUT_FULL {
+		OutConsActive++
+	} else if kind==OUT_BLOCKONLY {
+		BlockOnlyActive++
+	}
 	Mutex_net.Unlock()
 	go func() {
-		conn.Conn, e = net.DialTimeout("tcp4", fmt.Sprintf("%d.%d.%d.%d:%d",
-			ad.Ip4[0], ad.Ip4[1], ad.Ip4[2], ad.Ip4[3], ad.Port), TCPDialTimeout)
+		conn.Conn, e = dialPeer(ad)
 		if e == nil {
 			conn.X.ConnectedAt = time.Now()
 			if common.DebugLevel!=0 {
@@ -159,10 +189,18 @@ func DoNetwork(ad *peersdb.PeerAddr) {
 		}
 		Mutex_net.Lock()
 		delete(OpenCons, ad.UniqID())
-		OutConsActive--
+		if kind==OUT_FULL {
+			OutConsActive--
+		} else if kind==OUT_BLOCKONLY {
+			BlockOnlyActive--
+		}
 		Mutex_net.Unlock()
 		ad.Dead()
+		if kind==OUT_ADDNODE {
+			addNodeDone(ad, conn.X.VerackReceived)
+		}
 	}()
+	return true
 }
 
 
@@ -170,18 +208,20 @@ var (
 	TCPServerStarted bool
 	next_drop_slowest time.Time
 	next_clean_hammers time.Time
+	next_feeler time.Time
 )
 
 
 // TCP server
 func tcp_server() {
-	ad, e := net.ResolveTCPAddr("tcp4", fmt.Sprint("0.0.0.0:", common.DefaultTcpPort))
+	// listen on all the interfaces, both IPv4 and IPv6
+	ad, e := net.ResolveTCPAddr("tcp", fmt.Sprint(":", common.DefaultTcpPort))
 	if e != nil {
 		println("ResolveTCPAddr", e.Error())
 		return
 	}
 
-	lis, e := net.ListenTCP("tcp4", ad)
+	lis, e := net.ListenTCP("tcp", ad)
 	if e != nil {
 		println("ListenTCP", e.Error())
 		return
@@ -195,23 +235,30 @@ func tcp_server() {
 		Mutex_net.Lock()
 		ica := InConsActive
 		Mutex_net.Unlock()
-		if ica < atomic.LoadUint32(&common.CFG.Net.MaxInCons) {
+		if ica < atomic.LoadUint32(&common.CFG.Net.MaxInCons) || len(common.Whitelist) > 0 {
 			lis.SetDeadline(time.Now().Add(time.Second))
 			tc, e := lis.AcceptTCP()
 			if e == nil {
 				var terminate bool
+				var perms uint32
 
 				if common.DebugLevel>0 {
 					fmt.Println("Incoming connection from", tc.RemoteAddr().String())
 				}
+				if ta, ok := tc.RemoteAddr().(*net.TCPAddr); ok {
+					perms = common.PeerPermissions(ta.IP)
+				}
 				// set port to default, for incomming connections
 				ad, e := peersdb.NewPeerFromString(tc.RemoteAddr().String(), true)
-				if e == nil {
+				if e == nil && ica >= atomic.LoadUint32(&common.CFG.Net.MaxInCons) && (perms&common.PERM_BYPASS)==0 {
+					common.CountSafe("InConnNoSlots")
+					terminate = true
+				} else if e == nil {
 					// Hammering protection
 					HammeringMutex.Lock()
-					ti, ok := RecentlyDisconencted[ad.NetAddr.Ip4]
+					ti, ok := RecentlyDisconencted[ad.NetAddr.Ip16()]
 					HammeringMutex.Unlock()
-					if ok && time.Now().Sub(ti) < HammeringMinReconnect {
+					if ok && time.Now().Sub(ti) < HammeringMinReconnect && (perms&common.PERM_NOBAN)==0 {
 						//println(ad.Ip(), "is hammering within", time.Now().Sub(ti).String())
 						common.CountSafe("BanHammerIn")
 						ad.Ban()
@@ -223,6 +270,7 @@ func tcp_server() {
 						conn := NewConnection(ad)
 						conn.X.ConnectedAt = time.Now()
 						conn.X.Incomming = true
+						conn.X.Perms = perms
 						conn.Conn = tc
 						Mutex_net.Lock()
 						if _, ok := OpenCons[ad.UniqID()]; ok {
@@ -273,6 +321,8 @@ func tcp_server() {
 
 
 func NetworkTick() {
+	dandelionTick()
+
 	if common.IsListenTCP() {
 		if !TCPServerStarted {
 			TCPServerStarted = true
@@ -308,9 +358,13 @@ func NetworkTick() {
 		next_clean_hammers = time.Now().Add(HammeringMinReconnect)
 	}
 
+	if peersdb.ConnectOnly == "" {
+		tickAddNodes()
+	}
+
 	for conn_cnt < atomic.LoadUint32(&common.CFG.Net.MaxOutCons) {
-		adrs := peersdb.GetBestPeers(16, ConnectionActive)
-		if len(adrs)==0 {
+		ad := peersdb.SelectPeer(false, outConnUnwanted)
+		if ad==nil {
 			common.LockCfg()
 			if common.CFG.ConnectOnly=="" && common.DebugLevel>0 {
 				println("no new peers", len(OpenCons), conn_cnt)
@@ -318,16 +372,68 @@ func NetworkTick() {
 			common.UnlockCfg()
 			break
 		}
-		DoNetwork(adrs[rand.Int31n(int32(len(adrs)))])
+		DoNetwork(ad)
 		Mutex_net.Lock()
 		conn_cnt = OutConsActive
 		Mutex_net.Unlock()
 	}
+
+	if peersdb.ConnectOnly == "" {
+		tickBlockOnly()
+	}
+
+	// Having all the outgoing connections, test new addresses from time to time
+	if next_feeler.IsZero() {
+		next_feeler = time.Now().Add(FeelerEvery)
+	} else if conn_cnt >= atomic.LoadUint32(&common.CFG.Net.MaxOutCons) && time.Now().After(next_feeler) {
+		if ad := peersdb.SelectPeer(true, ConnectionActiveOrUnreachable); ad!=nil {
+			common.CountSafe("FeelerConnect")
+			doConnect(ad, OUT_FEELER)
+		}
+		next_feeler = time.Now().Add(FeelerEvery)
+	}
+}
+
+
+// Makes the block-relay-only connections, reconnecting to the anchors first
+func tickBlockOnly() {
+	Mutex_net.Lock()
+	cnt := BlockOnlyActive
+	Mutex_net.Unlock()
+	for cnt < atomic.LoadUint32(&common.CFG.Net.MaxBlockOnlyCons) {
+		var ad *peersdb.PeerAddr
+		if len(anchors) > 0 {
+			ad = anchors[0]
+			anchors = anchors[1:]
+			if outConnUnwanted(ad) {
+				continue
+			}
+			common.CountSafe("AnchorConnect")
+		} else if ad = peersdb.SelectPeer(false, outConnUnwanted); ad==nil {
+			break
+		}
+		doConnect(ad, OUT_BLOCKONLY)
+		Mutex_net.Lock()
+		cnt = BlockOnlyActive
+		Mutex_net.Unlock()
+	}
+}
+
+
+// We do not want more than one outgoing connection to the same network group (or AS)
+func outConnUnwanted(ad *peersdb.PeerAddr) bool {
+	return ConnectionActiveOrUnreachable(ad) || OutGroupConnected(ad)
 }
 
 
 // Process that handles communication with a single peer
 func (c *OneConnection) Run() {
+	if !c.handshake() {
+		if c.Conn != nil {
+			c.Conn.Close()
+		}
+		return
+	}
 	c.SendVersion()
 
 	c.Mutex.Lock()
@@ -380,10 +486,21 @@ func (c *OneConnection) Run() {
 				if c.Node.Version >= 70012 {
 					c.SendRawMsg("sendheaders", nil)
 				}
+				if c.Node.Version >= 70014 && common.CFG.Net.CompactBlocks {
+					c.SendCmpct(false)
+				}
 
 			case "verack":
 				c.X.VerackReceived = true
-				if common.IsListenTCP() {
+				if !c.X.Incomming {
+					c.PeerAddr.Good()
+				}
+				if c.X.Feeler {
+					common.CountSafe("FeelerGood")
+					c.Disconnect()
+					break
+				}
+				if common.IsListenTCP() && !c.X.BlockOnly {
 					c.SendOwnAddr()
 				}
 
@@ -392,12 +509,30 @@ func (c *OneConnection) Run() {
 				c.CheckGetBlockData()
 
 			case "tx":
-				if common.CFG.TXPool.Enabled {
+				if c.X.BlockOnly {
+					common.CountSafe("TxBlockOnlyIgnored")
+				} else if common.CFG.TXPool.Enabled || (c.X.Perms&common.PERM_RELAY)!=0 {
 					c.ParseTxNet(cmd.pl)
 				}
 
 			case "addr":
-				c.ParseAddr(cmd.pl)
+				if !c.X.BlockOnly {
+					c.ParseAddr(cmd.pl)
+				}
+
+			case "addrv2":
+				if !c.X.BlockOnly {
+					c.ParseAddrV2(cmd.pl)
+				}
+
+			case "sendaddrv2":
+				if c.X.VerackReceived {
+					c.Misbehave("SendAddrV2Late", 100) // BIP155 says it must come before verack
+				} else {
+					c.Mutex.Lock()
+					c.Node.SendAddrV2 = true
+					c.Mutex.Unlock()
+				}
 
 			case "block": //block received
 				netBlockReceived(c, cmd.pl)
@@ -409,20 +544,24 @@ func (c *OneConnection) Run() {
 				c.ProcessGetData(cmd.pl)
 
 			case "getaddr":
-				c.SendAddr()
+				if !c.X.BlockOnly {
+					c.SendAddr()
+				}
 
 			case "alert":
 				c.HandleAlert(cmd.pl)
 
 			case "ping":
-				re := make([]byte, len(cmd.pl))
-				copy(re, cmd.pl)
-				c.SendRawMsg("pong", re)
+				if n, e := wire.ParsePing(cmd.pl); e == nil {
+					c.SendRawMsg("pong", wire.EncodePing(n))
+				} else {
+					common.CountSafe("PingBroken") // old peers send ping without nonce, not expecting pong
+				}
 
 			case "pong":
 				if c.PingInProgress==nil {
 					common.CountSafe("PongUnexpected")
-				} else if bytes.Equal(cmd.pl, c.PingInProgress) {
+				} else if n, e := wire.ParsePing(cmd.pl); e == nil && n == *c.PingInProgress {
 					c.HandlePong()
 				} else {
 					common.CountSafe("PongMismatch")
@@ -441,6 +580,41 @@ func (c *OneConnection) Run() {
 			case "sendheaders":
 				c.Node.SendHeaders = true
 
+			case "sendcmpct":
+				c.HandleSendCmpct(cmd.pl)
+
+			case "cmpctblock":
+				if common.CFG.Net.CompactBlocks {
+					c.ProcessCmpctBlock(cmd.pl)
+				}
+
+			case "getblocktxn":
+				c.ProcessGetBlockTxn(cmd.pl)
+
+			case "blocktxn":
+				c.ProcessBlockTxn(cmd.pl)
+
+			case "filterload", "filteradd", "filterclear":
+				c.HandleFilterMsg(cmd.cmd, cmd.pl)
+
+			case "reject":
+				c.HandleReject(cmd.pl)
+
+			case "mempool":
+				c.HandleMempool()
+
+			case "feefilter":
+				c.HandleFeeFilter(cmd.pl)
+
+			case "getcfilters":
+				c.ProcessGetCFilters(cmd.pl)
+
+			case "getcfheaders":
+				c.ProcessGetCFHeaders(cmd.pl)
+
+			case "getcfcheckpt":
+				c.ProcessGetCFCheckpt(cmd.pl)
+
 			default:
 				if common.DebugLevel>0 {
 					println(cmd.cmd, "from", c.PeerAddr.Ip())
@@ -462,12 +636,24 @@ func (c *OneConnection) Run() {
 
 	ban := c.banit
 	c.Mutex.Unlock()
-	if ban {
+
+	Mutex_net.Lock()
+	for i, id := range cmpctHBPeers {
+		if id == c.ConnID {
+			cmpctHBPeers = append(cmpctHBPeers[:i], cmpctHBPeers[i+1:]...)
+			break
+		}
+	}
+	Mutex_net.Unlock()
+
+	deletePeerOrphans(c.ConnID)
+
+	if ban && (c.X.Perms&common.PERM_NOBAN)==0 {
 		c.PeerAddr.Ban()
 		common.CountSafe("PeersBanned")
 	} else if c.X.Incomming {
 		HammeringMutex.Lock()
-		RecentlyDisconencted[c.PeerAddr.NetAddr.Ip4] = time.Now()
+		RecentlyDisconencted[c.PeerAddr.NetAddr.Ip16()] = time.Now()
 		HammeringMutex.Unlock()
 	}
 	if common.DebugLevel!=0 {
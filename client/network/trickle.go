@@ -0,0 +1,118 @@
+package network
+
+import (
+	"sort"
+	"time"
+	"math/rand"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+/*
+  Transaction invs are not sent to peers as soon as we accept a tx.
+  Instead they wait in per-peer queues flushed at random (Poisson) times,
+  so it would be hard to tell which node has seen the tx first.
+*/
+
+const (
+	TxInvIntervalOut = 2*time.Second // average delay of tx invs sent to outgoing connections
+	TxInvIntervalIn = 5*time.Second // ... and to incoming ones
+	OwnTxInvInterval = 15*time.Second // average delay of our own txs, whichever the connection
+	MaxTxInvsQueued = 5000 // per peer
+	MaxTxInvsPerFlush = 1000
+)
+
+
+// Returns exponentially distributed random delay with the given average
+func poissonDelay(avg time.Duration) time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(avg))
+}
+
+
+// Queues the tx inv to be sent at the next flush - call it with c.Mutex locked
+func (c *OneConnection) queueTxInv(inv *wire.InvVect, own bool) bool {
+	if own {
+		if len(c.ownTxInvs) >= MaxTxInvsQueued {
+			return false
+		}
+		c.ownTxInvs = append(c.ownTxInvs, inv)
+	} else {
+		if len(c.txInvs) >= MaxTxInvsQueued {
+			return false
+		}
+		c.txInvs = append(c.txInvs, inv)
+	}
+	return true
+}
+
+
+// Takes the tx invs that are due to be sent - call it with c.Mutex locked
+func (c *OneConnection) dueTxInvs(now time.Time) (res []*wire.InvVect) {
+	if now.After(c.X.NextTxInvs) {
+		if c.X.Incomming {
+			c.X.NextTxInvs = now.Add(poissonDelay(TxInvIntervalIn))
+		} else {
+			c.X.NextTxInvs = now.Add(poissonDelay(TxInvIntervalOut))
+		}
+		res = c.txInvs
+		c.txInvs = nil
+	}
+	if now.After(c.X.NextOwnTxInvs) {
+		c.X.NextOwnTxInvs = now.Add(poissonDelay(OwnTxInvInterval))
+		res = append(res, c.ownTxInvs...)
+		c.ownTxInvs = nil
+	}
+	return
+}
+
+
+// Filters the tx invs (bloom, feefilter) and returns them sorted by the fee rate, highest first.
+// Whatever does not fit into MaxTxInvsPerFlush, goes back to the queue.
+func (c *OneConnection) sortTxInvs(invs []*wire.InvVect) (res []wire.InvVect) {
+	type one_inv struct {
+		inv *wire.InvVect
+		spkb uint64
+		own bool
+	}
+	lst := make([]one_inv, 0, len(invs))
+
+	TxMutex.Lock()
+	for _, inv := range invs {
+		tx, ok := TransactionsToSend[btc.NewUint256(inv.Hash[:]).BIdx()]
+		if !ok {
+			common.CountSafe("InvTxGone")
+			continue
+		}
+		if tx.SPKB() < c.Node.FeeFilter {
+			common.CountSafe("InvFeeFiltered")
+			continue
+		}
+		if c.bloom!=nil && !c.bloom.MatchTx(tx.Tx) {
+			common.CountSafe("InvBloomFiltered")
+			continue
+		}
+		lst = append(lst, one_inv{inv:inv, spkb:tx.SPKB(), own:tx.Own!=0})
+	}
+	TxMutex.Unlock()
+
+	sort.Slice(lst, func(i, j int) bool {
+		return lst[i].spkb > lst[j].spkb
+	})
+
+	if len(lst) > MaxTxInvsPerFlush {
+		common.CountSafeAdd("InvTxRequeued", uint64(len(lst)-MaxTxInvsPerFlush))
+		c.Mutex.Lock()
+		for _, v := range lst[MaxTxInvsPerFlush:] {
+			c.queueTxInv(v.inv, v.own)
+		}
+		c.Mutex.Unlock()
+		lst = lst[:MaxTxInvsPerFlush]
+	}
+
+	res = make([]wire.InvVect, len(lst))
+	for i := range lst {
+		res[i] = *lst[i].inv
+	}
+	return
+}
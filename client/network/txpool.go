@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"time"
 	"sync"
+	"math/rand"
 	"sync/atomic"
 	"encoding/hex"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/script"
 	"github.com/piotrnar/gocoin/client/common"
@@ -57,6 +59,16 @@ var (
 	// Transactions that are waiting for inputs:
 	WaitingForInputs map[[btc.Uint256IdxLen]byte] *OneWaitingList =
 		make(map[[btc.Uint256IdxLen]byte] *OneWaitingList)
+	OrphansCount int // Number of txs in WaitingForInputs
+	OrphansPerPeer map[uint32] int = make(map[uint32] int) // ... and how many of them came from each peer
+	orphanIds [][btc.Uint256IdxLen]byte // IDs of all the txs in WaitingForInputs, to evict them from
+	orphanIdx map[[btc.Uint256IdxLen]byte] int = make(map[[btc.Uint256IdxLen]byte] int) // ... and their positions in orphanIds
+
+	// Blocks that have been disconnected from the chain, but their txs are not back in the pool yet:
+	undoneBlocks []*btc.Block
+
+	// Own txs that have been mined recently (with the block height), in case they get undone:
+	ownTxsMined map[[btc.Uint256IdxLen]byte] uint32 = make(map[[btc.Uint256IdxLen]byte] uint32)
 )
 
 
@@ -71,12 +83,15 @@ type OneTxToSend struct {
 	Blocked byte // if non-zero, it gives you the reason why this tx nas not been routed
 	MemInputs bool // transaction is spending inputs from other unconfirmed tx(s)
 	Sigops uint
+	Stem time.Time // Dandelion embargo - if not zero, the tx is in the stem phase (see dandelion.go)
+	StemTo uint32 // ConnID of the peer that we passed the stem tx to
 }
 
 
 type Wait4Input struct {
 	missingTx *btc.Uint256
 	*TxRcvd
+	PeerID uint32 // ConnID of the peer that sent us the tx (0 if not from network)
 }
 
 type OneTxRejected struct {
@@ -118,12 +133,13 @@ func NeedThisTx(id *btc.Uint256, cb func()) (res bool) {
 
 // Handle tx-inv notifications
 func (c *OneConnection) TxInvNotify(hash []byte) {
-	if NeedThisTx(btc.NewUint256(hash), nil) {
-		var b [1+4+32]byte
-		b[0] = 1 // One inv
-		b[1] = 1 // Tx
-		copy(b[5:37], hash)
-		c.SendRawMsg("getdata", b[:])
+	id := btc.NewUint256(hash)
+	if NeedThisTx(id, nil) {
+		inv := wire.InvVect{Type:wire.MSG_TX}
+		copy(inv.Hash[:], hash)
+		c.SendRawMsg("getdata", wire.EncodeInv([]wire.InvVect{inv}))
+	} else if common.CFG.TXRoute.Dandelion {
+		dandelionSeen(id)
 	}
 }
 
@@ -137,42 +153,56 @@ func RejectTx(id *btc.Uint256, size int, why byte) *OneTxRejected {
 	rec.Time = time.Now()
 	rec.Size = uint32(size)
 	rec.Reason = why
+	deleteRejected(id.BIdx()) // do not leave a stale orphan record behind
 	TransactionsRejected[id.BIdx()] = rec
 	TransactionsRejectedSize += uint64(rec.Size)
 	return rec
 }
 
 
+// Puts the tx on the rejected list and tells the peer that sent it to us why
+func rejectNetTx(ntx *TxRcvd, why byte) *OneTxRejected {
+	if ntx.conn != nil { // txs from RPC, the wallet or the block undo have no peer to tell
+		ntx.conn.SendTxReject(ntx.tx.Hash, why)
+	}
+	return RejectTx(ntx.tx.Hash, len(ntx.raw), why)
+}
+
+
 // Handle incoming "tx" msg
 func (c *OneConnection) ParseTxNet(pl []byte) {
 	tid := btc.NewSha2Hash(pl)
+	stem := c.stemRequested(tid)
 	NeedThisTx(tid, func() {
 		// This body is called with a locked TxMutex
 		if uint32(len(pl)) > atomic.LoadUint32(&common.CFG.TXPool.MaxTxSize) {
 			common.CountSafe("TxRejectedBig")
 			RejectTx(tid, len(pl), TX_REJECTED_TOO_BIG)
+			c.SendTxReject(tid, TX_REJECTED_TOO_BIG)
 			return
 		}
-		tx, le := btc.NewTx(pl)
-		if tx == nil {
-			RejectTx(tid, len(pl), TX_REJECTED_FORMAT)
-			c.DoS("TxRejectedBroken")
+		tx, e := wire.ParseTx(pl)
+		if e == wire.ErrTrailing {
+			RejectTx(tid, len(pl), TX_REJECTED_LEN_MISMATCH)
+			c.SendTxReject(tid, TX_REJECTED_LEN_MISMATCH)
+			c.Misbehave("TxRejectedLenMismatch", MisbehaveMalformed)
 			return
 		}
-		if le != len(pl) {
-			RejectTx(tid, len(pl), TX_REJECTED_LEN_MISMATCH)
-			c.DoS("TxRejectedLenMismatch")
+		if e != nil {
+			RejectTx(tid, len(pl), TX_REJECTED_FORMAT)
+			c.SendTxReject(tid, TX_REJECTED_FORMAT)
+			c.Misbehave("TxRejectedBroken", MisbehaveMalformed)
 			return
 		}
 		if len(tx.TxIn)<1 {
 			RejectTx(tid, len(pl), TX_REJECTED_EMPTY_INPUT)
+			c.SendTxReject(tid, TX_REJECTED_EMPTY_INPUT)
 			c.Misbehave("TxRejectedNoInputs", 100)
 			return
 		}
 
-		tx.Hash = tid
 		select {
-			case NetTxs <- &TxRcvd{conn:c, tx:tx, raw:pl}:
+			case NetTxs <- &TxRcvd{conn:c, tx:tx, raw:pl, stem:stem}:
 				TransactionsPending[tid.BIdx()] = true
 			default:
 				common.CountSafe("TxRejectedFullQ")
@@ -219,7 +249,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 		spent[i] = tx.TxIn[i].Input.UIdx()
 
 		if _, ok := SpentOutputs[spent[i]]; ok {
-			RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_DOUBLE_SPEND)
+			rejectNetTx(ntx, TX_REJECTED_DOUBLE_SPEND)
 			TxMutex.Unlock()
 			common.CountSafe("TxRejectedDoubleSpnd")
 			return
@@ -228,7 +258,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 		inptx := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
 		if txinmem, ok := TransactionsToSend[inptx.BIdx()]; common.CFG.TXPool.AllowMemInputs && ok {
 			if int(tx.TxIn[i].Input.Vout) >= len(txinmem.TxOut) {
-				RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_BAD_INPUT)
+				rejectNetTx(ntx, TX_REJECTED_BAD_INPUT)
 				TxMutex.Unlock()
 				common.CountSafe("TxRejectedBadInput")
 				return
@@ -242,17 +272,34 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 				var newone bool
 
 				if !common.CFG.TXPool.AllowMemInputs {
-					RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_NOT_MINED)
+					rejectNetTx(ntx, TX_REJECTED_NOT_MINED)
 					TxMutex.Unlock()
 					common.CountSafe("TxRejectedMemInput")
 					return
 				}
 				// In this case, let's "save" it for later...
 				missingid := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
-				nrtx := RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_NO_TXOU)
+				var peerid uint32
+				if ntx.conn != nil {
+					peerid = ntx.conn.ConnID
+				}
+				if OrphansPerPeer[peerid] >= int(common.CFG.TXPool.MaxOrphansPerPeer) {
+					rejectNetTx(ntx, TX_REJECTED_NO_TXOU)
+					TxMutex.Unlock()
+					common.CountSafe("TxOrphanPeerLimit")
+					return
+				}
+				for OrphansCount >= int(common.CFG.TXPool.MaxOrphans) && len(orphanIds) > 0 {
+					evictRandomOrphan()
+				}
+				nrtx := rejectNetTx(ntx, TX_REJECTED_NO_TXOU)
 
 				if nrtx != nil {
-					nrtx.Wait4Input = &Wait4Input{missingTx: missingid, TxRcvd: ntx}
+					nrtx.Wait4Input = &Wait4Input{missingTx: missingid, TxRcvd: ntx, PeerID: peerid}
+					OrphansCount++
+					OrphansPerPeer[peerid]++
+					orphanIdx[tx.Hash.BIdx()] = len(orphanIds)
+					orphanIds = append(orphanIds, tx.Hash.BIdx())
 
 					// Add to waiting list:
 					var rec *OneWaitingList
@@ -269,6 +316,10 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 				TxMutex.Unlock()
 				if newone {
 					common.CountSafe("TxRejectedNoInpNew")
+					if ntx.conn != nil {
+						// Ask the peer that sent us the orphan for its parent
+						ntx.conn.TxInvNotify(missingid.Hash[:])
+					}
 				} else {
 					common.CountSafe("TxRejectedNoInpOld")
 				}
@@ -279,7 +330,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 					last_height := common.Last.Block.Height
 					common.Last.Mutex.Unlock()
 					if last_height+1 - pos[i].BlockHeight < chain.COINBASE_MATURITY {
-						RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_CB_INMATURE)
+						rejectNetTx(ntx, TX_REJECTED_CB_INMATURE)
 						TxMutex.Unlock()
 						common.CountSafe("TxRejectedCBInmature")
 						fmt.Println(tx.Hash.String(), "trying to spend inmature coinbase block", pos[i].BlockHeight, "at", last_height)
@@ -295,7 +346,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 	minout := uint64(btc.MAX_MONEY)
 	for i := range tx.TxOut {
 		if tx.TxOut[i].Value < atomic.LoadUint64(&common.CFG.TXPool.MinVoutValue) {
-			RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_DUST)
+			rejectNetTx(ntx, TX_REJECTED_DUST)
 			TxMutex.Unlock()
 			common.CountSafe("TxRejectedDust")
 			return
@@ -308,16 +359,18 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 
 
 	if totout > totinp {
-		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_OVERSPEND)
+		rejectNetTx(ntx, TX_REJECTED_OVERSPEND)
 		TxMutex.Unlock()
-		ntx.conn.DoS("TxOverspend")
+		if ntx.conn != nil {
+			ntx.conn.DoS("TxOverspend")
+		}
 		return
 	}
 
 	// Check for a proper fee
 	fee := totinp - totout
 	if fee < (uint64(len(ntx.raw)) * atomic.LoadUint64(&common.CFG.TXPool.FeePerByte)) {
-		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_LOW_FEE)
+		rejectNetTx(ntx, TX_REJECTED_LOW_FEE)
 		TxMutex.Unlock()
 		common.CountSafe("TxRejectedLowFee")
 		return
@@ -334,9 +387,11 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 
 	for i := range tx.TxIn {
 		if !(<- done) {
-			RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_SCRIPT_FAIL)
+			rejectNetTx(ntx, TX_REJECTED_SCRIPT_FAIL)
 			TxMutex.Unlock()
-			ntx.conn.DoS("TxScriptFail")
+			if ntx.conn != nil {
+				ntx.conn.DoS("TxScriptFail")
+			}
 			return
 		}
 		if btc.IsP2SH(pos[i].Pk_script) {
@@ -344,6 +399,10 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 		}
 	}
 
+	for i := range tx.TxIn {
+		script.CacheAdd(pos[i].Pk_script, i, tx, script.VER_P2SH|script.VER_DERSIG|script.VER_CLTV)
+	}
+
 	rec := &OneTxToSend{Data:ntx.raw, Spent:spent, Volume:totinp,
 		Fee:fee, Firstseen:time.Now(), Tx:tx, Minout:minout, MemInputs:frommem,
 		Sigops:sigops2}
@@ -361,12 +420,25 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 	TxMutex.Unlock()
 	common.CountSafe("TxAccepted")
 
+	feeEstTxAdded(rec)
+
 	if frommem {
 		// Gocoin does not route txs that need unconfirmed inputs
 		rec.Blocked = TX_REJECTED_NOT_MINED
 		common.CountSafe("TxRouteNotMined")
-	} else if isRoutable(rec) {
+	} else if ntx.conn!=nil && (ntx.conn.X.Perms&common.PERM_FORCERELAY)!=0 {
 		rec.Invsentcnt += NetRouteInv(1, tx.Hash, ntx.conn)
+		common.CountSafe("TxRouteForced")
+	} else if isRoutable(rec) {
+		if ntx.stem {
+			to := dandelionPickStem(ntx.conn)
+			TxMutex.Lock()
+			ntx.stem = dandelionStem(rec, to)
+			TxMutex.Unlock()
+		}
+		if !ntx.stem {
+			rec.Invsentcnt += NetRouteInv(1, tx.Hash, ntx.conn)
+		}
 		common.CountSafe("TxRouteOK")
 	}
 
@@ -401,17 +473,26 @@ func isRoutable(rec *OneTxToSend) bool {
 
 
 func RetryWaitingForInput(wtg *OneWaitingList) {
+	var pend []*TxRcvd
+	var times []time.Time
+	TxMutex.Lock()
 	for k, t := range wtg.Ids {
-		pendtxrcv := TransactionsRejected[k].Wait4Input.TxRcvd
+		if tr, ok := TransactionsRejected[k]; ok && tr.Wait4Input!=nil {
+			pend = append(pend, tr.Wait4Input.TxRcvd)
+			times = append(times, t)
+		}
+	}
+	TxMutex.Unlock()
+	for i, pendtxrcv := range pend {
 		if HandleNetTx(pendtxrcv, true) {
 			common.CountSafe("TxRetryAccepted")
 			if common.DebugLevel>0 {
-				fmt.Println(pendtxrcv.tx.Hash.String(), "accepted after", time.Now().Sub(t).String())
+				fmt.Println(pendtxrcv.tx.Hash.String(), "accepted after", time.Now().Sub(times[i]).String())
 			}
 		} else {
 			common.CountSafe("TxRetryRejected")
 			if common.DebugLevel>0 {
-				fmt.Println(pendtxrcv.tx.Hash.String(), "still rejected", TransactionsRejected[k].Reason)
+				fmt.Println(pendtxrcv.tx.Hash.String(), "still rejected")
 			}
 		}
 	}
@@ -420,6 +501,7 @@ func RetryWaitingForInput(wtg *OneWaitingList) {
 
 // Make sure to call it with locked TxMutex
 func DeleteToSend(rec *OneTxToSend) {
+	feeEstTxRemoved(rec, false)
 	for i := range rec.Spent {
 		delete(SpentOutputs, rec.Spent[i])
 	}
@@ -427,6 +509,179 @@ func DeleteToSend(rec *OneTxToSend) {
 	delete(TransactionsToSend, rec.Tx.Hash.BIdx())
 }
 
+// This function is called for each new block that has been connected to the chain
+func BlockMined(bl *btc.Block) {
+	feeEstBlockMined(bl)
+	TxMutex.Lock()
+	for idx, height := range ownTxsMined {
+		if height+common.BlockChain.Unspent.UnwindBufLen < bl.Height {
+			delete(ownTxsMined, idx) // it will not get undone anymore
+		}
+	}
+	for i:=1; i<len(bl.Txs); i++ {
+		if rec, ok := TransactionsToSend[bl.Txs[i].Hash.BIdx()]; ok && rec.Own!=0 {
+			ownTxsMined[bl.Txs[i].Hash.BIdx()] = bl.Height
+		}
+	}
+	TxMutex.Unlock()
+	for i:=1; i<len(bl.Txs); i++ {
+		TxMined(bl.Txs[i])
+	}
+	ReaddUndoneTxs()
+}
+
+
+// This function is called by the chain for each block that has been disconnected from it
+// The txs get back to the pool with the next ReaddUndoneTxs()
+func BlockUndone(bl *btc.Block) {
+	TxMutex.Lock()
+	undoneBlocks = append(undoneBlocks, bl)
+	TxMutex.Unlock()
+}
+
+
+// Puts txs from the disconnected blocks back into the pool
+// and removes the pool's txs that are no longer valid
+// Call it from the chain's thread, after the blocks have been undone (and the new ones applied)
+func ReaddUndoneTxs() {
+	TxMutex.Lock()
+	bls := undoneBlocks
+	undoneBlocks = nil
+	TxMutex.Unlock()
+	if len(bls)==0 {
+		return
+	}
+
+	// The blocks were undone from the top, so the last one is the lowest
+	mined := minedAbove(bls[len(bls)-1].Height-1)
+
+	// Go through them backwards, so the parents get in before their children
+	for ib:=len(bls)-1; ib>=0; ib-- {
+		bl := bls[ib]
+		for i:=1; i<len(bl.Txs); i++ {
+			tx := bl.Txs[i]
+			if mined[tx.Hash.BIdx()] {
+				common.CountSafe("TxUndoneStillMined") // it has been mined in the new branch
+				continue
+			}
+			TxMutex.Lock()
+			_, present := TransactionsToSend[tx.Hash.BIdx()]
+			deleteRejected(tx.Hash.BIdx())
+			delete(TransactionsPending, tx.Hash.BIdx())
+			TxMutex.Unlock()
+			if present {
+				continue
+			}
+			if HandleNetTx(&TxRcvd{tx:tx, raw:tx.Serialize()}, true) {
+				common.CountSafe("TxUndoneAccepted")
+				TxMutex.Lock()
+				if _, ok := ownTxsMined[tx.Hash.BIdx()]; ok {
+					TransactionsToSend[tx.Hash.BIdx()].Own = 1 // so it would not expire
+					delete(ownTxsMined, tx.Hash.BIdx())
+				}
+				TxMutex.Unlock()
+			} else {
+				common.CountSafe("TxUndoneRejected")
+			}
+		}
+	}
+
+	TxMutex.Lock()
+	removeInvalidToSend()
+	TxMutex.Unlock()
+}
+
+
+// Returns IDs of the txs from the blocks of the current chain above the given height
+func minedAbove(height uint32) (res map[[btc.Uint256IdxLen]byte] bool) {
+	res = make(map[[btc.Uint256IdxLen]byte] bool)
+	for n := common.BlockChain.BlockTreeEnd; n != nil && n.Height > height; n = n.Parent {
+		raw, _, e := common.BlockChain.Blocks.BlockGet(n.BlockHash)
+		if e != nil {
+			common.CountSafe("TxUndoneBlockGetErr")
+			continue
+		}
+		bl, e := btc.NewBlock(raw)
+		if e == nil {
+			e = bl.BuildTxList()
+		}
+		if e != nil {
+			common.CountSafe("TxUndoneBlockErr")
+			continue
+		}
+		for i:=1; i<len(bl.Txs); i++ {
+			res[bl.Txs[i].Hash.BIdx()] = true
+		}
+	}
+	return
+}
+
+
+// Removes txs that cannot be mined in the current chain (e.g. after a reorg)
+// Make sure to call it with locked TxMutex, from the chain's thread
+func removeInvalidToSend() {
+	height := common.BlockChain.BlockTreeEnd.Height
+	tim := uint32(time.Now().Unix())
+
+	for _, rec := range TransactionsToSend {
+		if rec.Own!=0 {
+			continue // Own txs are up to the user
+		}
+		if why := invalidToSend(rec, height, tim); why != "" {
+			deleteWithChildren(rec, why)
+		}
+	}
+}
+
+
+// Removes the tx and (recursively) all the pool's txs spending its outputs
+// Make sure to call it with locked TxMutex
+func deleteWithChildren(rec *OneTxToSend, why string) {
+	common.CountSafe("TxPoolInvalid"+why)
+	DeleteToSend(rec)
+	po := btc.TxPrevOut{Hash:rec.Hash.Hash}
+	for po.Vout=0; int(po.Vout)<len(rec.TxOut); po.Vout++ {
+		if bidx, ok := SpentOutputs[po.UIdx()]; ok {
+			if child, ok := TransactionsToSend[bidx]; ok && child.Own==0 && spends(child.Tx, &po) {
+				deleteWithChildren(child, "Parent")
+			}
+		}
+	}
+}
+
+
+// Returns true if the tx spends the given output (UIdx of SpentOutputs is not unique)
+func spends(tx *btc.Tx, po *btc.TxPrevOut) bool {
+	for i := range tx.TxIn {
+		if tx.TxIn[i].Input == *po {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Returns a reason why the tx cannot be mined in the next block, or an empty string
+func invalidToSend(rec *OneTxToSend, height, tim uint32) string {
+	if !rec.Tx.IsFinal(height+1, tim) {
+		return "NotFinal"
+	}
+	for i := range rec.TxIn {
+		if _, ok := TransactionsToSend[btc.NewUint256(rec.TxIn[i].Input.Hash[:]).BIdx()]; ok {
+			continue
+		}
+		po, _ := common.BlockChain.Unspent.UnspentGet(&rec.TxIn[i].Input)
+		if po == nil {
+			return "NoInput"
+		}
+		if po.WasCoinbase && height+1-po.BlockHeight < chain.COINBASE_MATURITY {
+			return "CBInmature"
+		}
+	}
+	return ""
+}
+
+
 // This function is called for each tx mined in a new block
 func TxMined(tx *btc.Tx) {
 	h := tx.Hash
@@ -475,27 +730,6 @@ func TxMined(tx *btc.Tx) {
 }
 
 
-func txChecker(h *btc.Uint256) bool {
-	TxMutex.Lock()
-	rec, ok := TransactionsToSend[h.BIdx()]
-	TxMutex.Unlock()
-	if ok && rec.Own!=0 {
-		return false // Assume own txs as non-trusted
-	}
-	if ok {
-		common.CountSafe("TxScrBoosted")
-	} else {
-		common.CountSafe("TxScrMissed")
-	}
-	return ok
-}
-
-
-func init() {
-	chain.TrustedTxChecker = txChecker
-}
-
-
 func expireTime(size int) (t time.Time) {
 	if !common.CFG.TXPool.Enabled {
 		return // return zero time which should expire immediatelly
@@ -512,11 +746,17 @@ func expireTime(size int) (t time.Time) {
 func deleteRejected(bidx [btc.Uint256IdxLen]byte) {
 	if tr, ok := TransactionsRejected[bidx]; ok {
 		if tr.Wait4Input!=nil {
-			w4i, _ := WaitingForInputs[tr.Wait4Input.missingTx.BIdx()]
-			delete(w4i.Ids, bidx)
-			if len(w4i.Ids)==0 {
-				delete(WaitingForInputs, tr.Wait4Input.missingTx.BIdx())
+			if w4i, _ := WaitingForInputs[tr.Wait4Input.missingTx.BIdx()]; w4i!=nil {
+				delete(w4i.Ids, bidx)
+				if len(w4i.Ids)==0 {
+					delete(WaitingForInputs, tr.Wait4Input.missingTx.BIdx())
+				}
 			}
+			OrphansCount--
+			if OrphansPerPeer[tr.Wait4Input.PeerID]--; OrphansPerPeer[tr.Wait4Input.PeerID]<=0 {
+				delete(OrphansPerPeer, tr.Wait4Input.PeerID)
+			}
+			removeOrphanId(bidx)
 		}
 		TransactionsRejectedSize -= uint64(TransactionsRejected[bidx].Size)
 		delete(TransactionsRejected, bidx)
@@ -524,12 +764,60 @@ func deleteRejected(bidx [btc.Uint256IdxLen]byte) {
 }
 
 
+// Make sure to call it with locked TxMutex
+func removeOrphanId(bidx [btc.Uint256IdxLen]byte) {
+	if i, ok := orphanIdx[bidx]; ok {
+		last := len(orphanIds)-1
+		orphanIds[i] = orphanIds[last]
+		orphanIdx[orphanIds[i]] = i
+		orphanIds = orphanIds[:last]
+		delete(orphanIdx, bidx)
+	}
+}
+
+
+// Removes a random tx from WaitingForInputs
+// Make sure to call it with locked TxMutex
+func evictRandomOrphan() {
+	if len(orphanIds)==0 {
+		return
+	}
+	bidx := orphanIds[rand.Intn(len(orphanIds))]
+	deleteRejected(bidx)
+	removeOrphanId(bidx) // in case there was no rejected record for it
+	common.CountSafe("TxOrphanEvicted")
+}
+
+
+// Removes all the orphans that came from a disconnected peer
+func deletePeerOrphans(peerid uint32) {
+	var ids [][btc.Uint256IdxLen]byte
+	TxMutex.Lock()
+	for _, bidx := range orphanIds {
+		if tr, ok := TransactionsRejected[bidx]; ok && tr.Wait4Input!=nil && tr.Wait4Input.PeerID==peerid {
+			ids = append(ids, bidx)
+		}
+	}
+	for _, bidx := range ids {
+		deleteRejected(bidx)
+	}
+	delete(OrphansPerPeer, peerid)
+	TxMutex.Unlock()
+	if len(ids) > 0 {
+		common.CounterMutex.Lock()
+		common.Counter["TxOrphanPeerGone"] += uint64(len(ids))
+		common.CounterMutex.Unlock()
+	}
+}
+
+
 func ExpireTxs() {
-	var cnt1a, cnt1b, cnt2 uint64
+	var cnt1a, cnt1b, cnt2, cnt3 uint64
 
 	TxMutex.Lock()
 	for _, v := range TransactionsToSend {
 		if v.Own==0 && v.Firstseen.Before(expireTime(len(v.Data))) {  // Do not expire own txs
+			feeEstTxRemoved(v, true)
 			DeleteToSend(v)
 			if v.Blocked==0 {
 				cnt1a++
@@ -538,8 +826,12 @@ func ExpireTxs() {
 			}
 		}
 	}
+	orphexp := time.Now().Add(-time.Duration(common.CFG.TXPool.OrphanExpireMin)*time.Minute)
 	for k, v := range TransactionsRejected {
-		if v.Time.Before(expireTime(int(v.Size))) {
+		if v.Wait4Input!=nil && v.Time.Before(orphexp) {
+			deleteRejected(k)
+			cnt3++
+		} else if v.Time.Before(expireTime(int(v.Size))) {
 			deleteRejected(k)
 			cnt2++
 		}
@@ -557,5 +849,8 @@ func ExpireTxs() {
 	if cnt2 > 0 {
 		common.Counter["TxPurgedRejected"] += cnt2
 	}
+	if cnt3 > 0 {
+		common.Counter["TxPurgedOrphans"] += cnt3
+	}
 	common.CounterMutex.Unlock()
 }
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"time"
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+
+func addTestOrphan(id, missing byte, peerid uint32) {
+	txid := btc.NewSha2Hash([]byte{id})
+	misid := btc.NewSha2Hash([]byte{missing})
+	rec := RejectTx(txid, 100, TX_REJECTED_NO_TXOU)
+	rec.Wait4Input = &Wait4Input{missingTx: misid, PeerID: peerid}
+	OrphansCount++
+	OrphansPerPeer[peerid]++
+	orphanIdx[txid.BIdx()] = len(orphanIds)
+	orphanIds = append(orphanIds, txid.BIdx())
+	w4i := WaitingForInputs[misid.BIdx()]
+	if w4i == nil {
+		w4i = &OneWaitingList{TxID: misid, Ids: make(map[[btc.Uint256IdxLen]byte] time.Time)}
+		WaitingForInputs[misid.BIdx()] = w4i
+	}
+	w4i.Ids[txid.BIdx()] = time.Now()
+}
+
+
+func TestOrphans(t *testing.T) {
+	TxMutex.Lock()
+	for i := byte(0); i < 10; i++ {
+		addTestOrphan(i, i/3, uint32(i%2)+1)
+	}
+	// an id without a rejected record must not stop the eviction
+	stale := btc.NewSha2Hash([]byte("stale")).BIdx()
+	orphanIdx[stale] = len(orphanIds)
+	orphanIds = append(orphanIds, stale)
+	for OrphansCount >= 5 && len(orphanIds) > 0 {
+		evictRandomOrphan()
+	}
+	if OrphansCount != 4 {
+		t.Error("OrphansCount", OrphansCount)
+	}
+	TxMutex.Unlock()
+
+	deletePeerOrphans(1)
+	deletePeerOrphans(2)
+
+	if OrphansCount != 0 || len(OrphansPerPeer) != 0 || len(WaitingForInputs) != 0 || len(TransactionsRejected) != 0 {
+		t.Error("Orphans left", OrphansCount, OrphansPerPeer, len(WaitingForInputs), len(TransactionsRejected))
+	}
+	if _, ok := orphanIdx[stale]; len(orphanIds) > 1 || len(orphanIdx) != len(orphanIds) || (len(orphanIds)==1 && !ok) {
+		t.Error("orphanIds", len(orphanIds), len(orphanIdx))
+	}
+}
+
+
+func addTestToSend(id byte, own byte, parents ...*OneTxToSend) *OneTxToSend {
+	tx := &btc.Tx{Hash: btc.NewSha2Hash([]byte{id}), TxOut: make([]*btc.TxOut, 2)}
+	rec := &OneTxToSend{Tx: tx, Own: own}
+	for _, p := range parents {
+		po := btc.TxPrevOut{Hash: p.Hash.Hash, Vout: 1}
+		tx.TxIn = append(tx.TxIn, &btc.TxIn{Input: po})
+		rec.Spent = append(rec.Spent, po.UIdx())
+		SpentOutputs[po.UIdx()] = tx.Hash.BIdx()
+	}
+	TransactionsToSend[tx.Hash.BIdx()] = rec
+	return rec
+}
+
+
+func TestDeleteWithChildren(t *testing.T) {
+	TxMutex.Lock()
+	defer TxMutex.Unlock()
+	a := addTestToSend(1, 0)
+	b := addTestToSend(2, 0, a)
+	c := addTestToSend(3, 0, b)
+	own := addTestToSend(4, 1, c)
+	other := addTestToSend(5, 0)
+	deleteWithChildren(a, "Test")
+	for _, rec := range []*OneTxToSend{a, b, c} {
+		if _, ok := TransactionsToSend[rec.Hash.BIdx()]; ok {
+			t.Error("Child not removed", rec.Hash.String())
+		}
+	}
+	if _, ok := TransactionsToSend[own.Hash.BIdx()]; !ok {
+		t.Error("Own tx removed")
+	}
+	if _, ok := TransactionsToSend[other.Hash.BIdx()]; !ok {
+		t.Error("Unrelated tx removed")
+	}
+	DeleteToSend(own)
+	DeleteToSend(other)
+	if len(SpentOutputs) != 0 {
+		t.Error("SpentOutputs left", len(SpentOutputs))
+	}
+}
@@ -0,0 +1,177 @@
+package network
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// Encrypted transport protocol v2 (BIP324)
+
+const (
+	V2HandshakeTimeout = 10*time.Second
+	V2MaxPacketSize = 4e6 // contents of a packet (block is the biggest message we accept)
+)
+
+
+// Performs the v2 handshake, if it is enabled and possible. Returns false if the connection shall be closed.
+// For outgoing connections to peers that do not respond to v2, it reconnects using v1.
+func (c *OneConnection) handshake() bool {
+	if !common.CFG.Net.V2Transport {
+		return true
+	}
+	if c.X.Incomming {
+		return c.v2Respond()
+	}
+	if (c.PeerAddr.Services&common.SERVICE_P2P_V2)==0 {
+		return true
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(V2HandshakeTimeout))
+	v2, rcvd, e := btc.V2Handshake(c.Conn, common.Magic[:], true, nil)
+	c.Conn.SetDeadline(time.Time{})
+	if e == nil {
+		c.v2Established(v2)
+		return true
+	}
+	if rcvd {
+		if common.DebugLevel>0 {
+			println(c.PeerAddr.Ip(), "v2 handshake:", e.Error())
+		}
+		return false
+	}
+
+	// The peer has not sent anything, so it probably only speaks v1
+	common.CountSafe("V2FallbackV1")
+	c.Conn.Close()
+	if c.Conn, e = dialPeer(c.PeerAddr); e != nil {
+		c.Conn = nil
+		return false
+	}
+	return true
+}
+
+
+// Detects whether the incoming connection uses v1 or v2 and does the v2 handshake
+func (c *OneConnection) v2Respond() bool {
+	var their [btc.V2_PUBKEY_LEN]byte
+	c.Conn.SetDeadline(time.Now().Add(V2HandshakeTimeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	// v1 peers start with the version message
+	v1_prefix := append(append([]byte{}, common.Magic[:]...), "version\000\000\000\000\000"...)
+	if _, e := io.ReadFull(c.Conn, their[:len(v1_prefix)]); e != nil {
+		return false
+	}
+	if bytes.Equal(their[:len(v1_prefix)], v1_prefix) {
+		copy(c.recv.hdr[:], v1_prefix) // pass it to FetchMessage
+		c.recv.hdr_len = len(v1_prefix)
+		return true
+	}
+	if _, e := io.ReadFull(c.Conn, their[len(v1_prefix):]); e != nil {
+		return false
+	}
+
+	v2, _, e := btc.V2Handshake(c.Conn, common.Magic[:], false, their[:])
+	if e != nil {
+		if common.DebugLevel>0 {
+			println(c.PeerAddr.Ip(), "v2 handshake:", e.Error())
+		}
+		return false
+	}
+	c.v2Established(v2)
+	return true
+}
+
+
+func (c *OneConnection) v2Established(v2 *btc.V2Cipher) {
+	c.Mutex.Lock()
+	c.v2 = v2
+	c.X.Encrypted = true
+	c.Mutex.Unlock()
+	common.CountSafe("V2Connected")
+}
+
+
+// Non-blocking reception of v2 packets, called from FetchMessage
+func (c *OneConnection) fetchMessageV2() (*BCmsg) {
+	var e error
+	var n int
+
+	for c.recv.hdr_len < btc.V2_LENGTH_LEN {
+		n, e = common.SockRead(c.Conn, c.recv.hdr[c.recv.hdr_len:btc.V2_LENGTH_LEN])
+		c.Mutex.Lock()
+		c.recv.hdr_len += n
+		if e != nil {
+			c.Mutex.Unlock()
+			c.HandleError(e)
+			return nil
+		}
+		if c.broken {
+			c.Mutex.Unlock()
+			return nil
+		}
+		if c.recv.hdr_len >= btc.V2_LENGTH_LEN {
+			c.recv.pl_len = uint32(c.v2.DecryptLength(c.recv.hdr[:btc.V2_LENGTH_LEN]))
+		}
+		c.Mutex.Unlock()
+	}
+
+	if c.recv.dat == nil {
+		if c.recv.pl_len > V2MaxPacketSize+btc.V2_OVERHEAD {
+			c.DoS("V2PacketBig")
+			return nil
+		}
+		c.Mutex.Lock()
+		c.recv.dat = make([]byte, c.recv.pl_len)
+		c.recv.datlen = 0
+		c.Mutex.Unlock()
+	}
+	for c.recv.datlen < c.recv.pl_len {
+		n, e = common.SockRead(c.Conn, c.recv.dat[c.recv.datlen:])
+		if n > 0 {
+			c.Mutex.Lock()
+			c.recv.datlen += uint32(n)
+			c.Mutex.Unlock()
+		}
+		if e != nil {
+			c.HandleError(e)
+			return nil
+		}
+		if c.broken {
+			return nil
+		}
+	}
+
+	contents, ignore, ok := c.v2.Decrypt(c.recv.dat, nil)
+
+	c.Mutex.Lock()
+	c.recv.dat = nil
+	c.recv.hdr_len = 0
+	c.X.BytesReceived += uint64(btc.V2_LENGTH_LEN+c.recv.pl_len)
+	c.Mutex.Unlock()
+
+	if !ok {
+		common.CountSafe("V2PacketBadAuth")
+		c.Disconnect()
+		return nil
+	}
+	if ignore {
+		common.CountSafe("V2PacketDecoy")
+		return nil
+	}
+
+	ret := new(BCmsg)
+	if ret.cmd, ret.pl, ok = btc.V2DecodeMsg(contents); !ok {
+		common.CountSafe("V2UnknownMsgType")
+		return nil
+	}
+	if uint32(len(ret.pl)) > wire.MaxMsgSize(ret.cmd) {
+		c.DoS("Big-"+ret.cmd)
+		return nil
+	}
+	return ret
+}
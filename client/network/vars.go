@@ -26,6 +26,7 @@ type TxRcvd struct {
 	conn *OneConnection
 	tx *btc.Tx
 	raw []byte
+	stem bool // requested with MSG_DANDELION_TX
 }
 
 type OneBlockToGet struct {
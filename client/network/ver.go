@@ -2,11 +2,11 @@ package network
 
 import (
 	"fmt"
+	"net"
 	"time"
-	"bytes"
 	"errors"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/lib/others/sys"
 	"github.com/piotrnar/gocoin/client/common"
 )
@@ -14,41 +14,30 @@ import (
 var IgnoreExternalIpFrom = []string{"/Snoopy:0.1/", "/libbitcoin:2.0.0/", "/Snoopy:0.2.1/"}
 
 func (c *OneConnection) SendVersion() {
-	b := bytes.NewBuffer([]byte{})
+	v := &wire.MsgVersion{Version:common.Version, Services:common.Services,
+		Timestamp:uint64(time.Now().Unix()), Nonce:nonce, UserAgent:common.CFG.UserAgent}
 
-	binary.Write(b, binary.LittleEndian, uint32(common.Version))
-	binary.Write(b, binary.LittleEndian, uint64(common.Services))
-	binary.Write(b, binary.LittleEndian, uint64(time.Now().Unix()))
-
-	b.Write(c.PeerAddr.NetAddr.Bytes())
+	copy(v.AddrRecv[:], c.PeerAddr.NetAddr.Bytes())
 	if ExternalAddrLen()>0 {
-		b.Write(BestExternalAddr())
-	} else {
-		b.Write(bytes.Repeat([]byte{0}, 26))
+		copy(v.AddrFrom[:], BestExternalAddr())
 	}
 
-	b.Write(nonce[:])
-
-	b.WriteByte(byte(len(common.CFG.UserAgent)))
-	b.Write([]byte(common.CFG.UserAgent))
-
 	common.Last.Mutex.Lock()
-	binary.Write(b, binary.LittleEndian, uint32(common.Last.Block.Height))
+	v.Height = common.Last.Block.Height
 	common.Last.Mutex.Unlock()
-	if !common.CFG.TXPool.Enabled {
-		b.WriteByte(0)  // don't notify me about txs
-	}
+	// don't notify me about txs, if I don't want them
+	v.Relay = !(!common.CFG.TXPool.Enabled && (c.X.Perms&common.PERM_RELAY)==0 || c.X.BlockOnly)
 
-	c.SendRawMsg("version", b.Bytes())
+	c.SendRawMsg("version", v.Bytes())
 }
 
 
 
 func (c *OneConnection) HandleVersion(pl []byte) error {
-	if len(pl) >= 80 /*Up to, includiong, the nonce */ {
+	if v, er := wire.ParseVersion(pl); er == nil {
 		c.Mutex.Lock()
-		c.Node.Version = binary.LittleEndian.Uint32(pl[0:4])
-		if bytes.Equal(pl[72:80], nonce[:]) {
+		c.Node.Version = v.Version
+		if v.Nonce == nonce {
 			c.Mutex.Unlock()
 			return errors.New("Connecting to ourselves")
 		}
@@ -56,28 +45,24 @@ func (c *OneConnection) HandleVersion(pl []byte) error {
 			c.Mutex.Unlock()
 			return errors.New("Client version too low")
 		}
-		c.Node.Services = binary.LittleEndian.Uint64(pl[4:12])
-		c.Node.Timestamp = binary.LittleEndian.Uint64(pl[12:20])
-		c.Node.ReportedIp4 = binary.BigEndian.Uint32(pl[40:44])
-		if len(pl) >= 86 {
-			le, of := btc.VLen(pl[80:])
-			of += 80
-			c.Node.Agent = string(pl[of:of+le])
-			of += le
-			if len(pl) >= of+4 {
-				c.Node.Height = binary.LittleEndian.Uint32(pl[of:of+4])
-				c.X.GetBlocksDataNow = true
-				of += 4
-				if len(pl) > of && pl[of]==0 {
-					c.Node.DoNotRelayTxs = true
-				}
-			}
+		c.Node.Services = v.Services
+		if !c.X.Incomming {
+			c.PeerAddr.Services = c.Node.Services // to know next time if it supports v2 transport
 		}
+		c.Node.Timestamp = v.Timestamp
+		var na btc.NetAddr
+		na.SetIP(net.IP(v.AddrRecv[8:24]))
+		reported_ip := na.Ip16()
+		c.Node.ReportedIp = net.IP(reported_ip[:])
+		c.Node.Agent = v.UserAgent
+		c.Node.Height = v.Height
+		c.Node.DoNotRelayTxs = !v.Relay
+		c.X.GetBlocksDataNow = true
 		c.Mutex.Unlock()
 
-		if sys.ValidIp4(pl[40:44]) {
+		if sys.ValidIp(net.IP(reported_ip[:])) {
 			ExternalIpMutex.Lock()
-			_, use_this_ip := ExternalIp4[c.Node.ReportedIp4]
+			_, use_this_ip := ExternalIp[reported_ip]
 			if !use_this_ip { // New IP
 				use_this_ip = true
 				for x, v := range IgnoreExternalIpFrom {
@@ -88,18 +73,21 @@ func (c *OneConnection) HandleVersion(pl []byte) error {
 					}
 				}
 				if use_this_ip {
-					fmt.Printf("New external IP %d.%d.%d.%d from %s\n> ",
-						pl[40], pl[41], pl[42], pl[43], c.Node.Agent)
+					fmt.Printf("New external IP %s from %s\n> ",
+						net.IP(reported_ip[:]).String(), c.Node.Agent)
 				}
 			}
 			if use_this_ip {
-				ExternalIp4[c.Node.ReportedIp4] = [2]uint {ExternalIp4[c.Node.ReportedIp4][0]+1,
+				ExternalIp[reported_ip] = [2]uint {ExternalIp[reported_ip][0]+1,
 					uint(time.Now().Unix())}
 			}
 			ExternalIpMutex.Unlock()
 		}
 	} else {
-		return errors.New("version message too short")
+		return errors.New("version message: "+er.Error())
+	}
+	if c.Node.Version >= 70016 {
+		c.SendRawMsg("sendaddrv2", nil) // it must go before verack
 	}
 	c.SendRawMsg("verack", []byte{})
 	return nil
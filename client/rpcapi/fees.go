@@ -0,0 +1,53 @@
+package rpcapi
+
+import (
+	"encoding/json"
+	"github.com/piotrnar/gocoin/client/network"
+)
+
+/*
+
+{"result":
+	{"feerate":0.00012345,
+	"blocks":2
+}
+*/
+
+type EstimateSmartFeeResponse struct {
+	FeeRate float64 `json:"feerate"` // BTC per kB
+	Blocks uint `json:"blocks"`
+}
+
+func EstimateSmartFee(cmd *RpcCommand, resp *RpcResponse) {
+	var target uint64
+
+	switch uu := cmd.Params.(type) {
+		case []interface{}:
+			if len(uu)<1 {
+				resp.Error = RpcError{Code: -1, Message: "empty params array"}
+				return
+			}
+			n, ok := uu[0].(json.Number)
+			if !ok {
+				resp.Error = RpcError{Code: -3, Message: "conf_target must be a number"}
+				return
+			}
+			v, er := n.Int64()
+			if er != nil || v<1 || v>network.FeeEstMaxTarget {
+				resp.Error = RpcError{Code: -8, Message: "Invalid conf_target"}
+				return
+			}
+			target = uint64(v)
+
+		default:
+			resp.Error = RpcError{Code: -2, Message: "incorrect params type"}
+			return
+	}
+
+	spb, blocks := network.EstimateFee(uint(target))
+	if blocks==0 {
+		resp.Error = RpcError{Code: -4, Message: "Insufficient data or no feerate found"}
+		return
+	}
+	resp.Result = &EstimateSmartFeeResponse{FeeRate:spb*1000/1e8, Blocks:blocks}
+}
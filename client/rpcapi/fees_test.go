@@ -0,0 +1,81 @@
+package rpcapi
+
+import (
+	"bytes"
+	"testing"
+	"io/ioutil"
+	"encoding/json"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/client/network"
+)
+
+// Writes fee estimator's stats file where only txs paying 20 SPB have been mined, within 2 blocks
+func testFeeEstFile(t *testing.T) (dir string) {
+	var bcks []float64
+	for spb := network.FeeEstMinSPB; spb < network.FeeEstMaxSPB; spb *= network.FeeEstBucketStep {
+		bcks = append(bcks, spb)
+	}
+	bcks = append(bcks, 1e99)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(1000))
+	binary.Write(buf, binary.LittleEndian, uint32(len(bcks)))
+	for i, max := range bcks {
+		var cnt float64
+		if 20 <= max && (i == 0 || 20 > bcks[i-1]) {
+			cnt = 1000
+		}
+		var conf, failed [network.FeeEstMaxTarget]float64
+		for j := 1; j < len(conf); j++ {
+			conf[j] = cnt
+		}
+		binary.Write(buf, binary.LittleEndian, []float64{max, cnt, 20*cnt})
+		binary.Write(buf, binary.LittleEndian, conf)
+		binary.Write(buf, binary.LittleEndian, failed)
+	}
+	dir = t.TempDir() + "/"
+	if e := ioutil.WriteFile(dir+network.FeeEstFileName, buf.Bytes(), 0600); e != nil {
+		t.Fatal(e)
+	}
+	return
+}
+
+func TestEstimateSmartFee(t *testing.T) {
+	var tv = []struct {
+		params interface{}
+		code int
+		blocks uint
+	} {
+		{[]interface{}{json.Number("1")}, 0, 2},
+		{[]interface{}{json.Number("2")}, 0, 2},
+		{[]interface{}{json.Number("25"), "CONSERVATIVE"}, 0, 25},
+		{[]interface{}{json.Number("0")}, -8, 0},
+		{[]interface{}{json.Number("26")}, -8, 0},
+		{[]interface{}{json.Number("1.5")}, -8, 0},
+		{[]interface{}{"2"}, -3, 0},
+		{[]interface{}{}, -1, 0},
+		{json.Number("2"), -2, 0},
+		{nil, -2, 0},
+	}
+
+	var resp RpcResponse
+	EstimateSmartFee(&RpcCommand{Params:[]interface{}{json.Number("2")}}, &resp)
+	if e, ok := resp.Error.(RpcError); !ok || e.Code != -4 {
+		t.Error("Estimate without data", resp.Error, resp.Result)
+	}
+
+	network.FeeEstLoad(testFeeEstFile(t))
+	for i := range tv {
+		resp = RpcResponse{}
+		EstimateSmartFee(&RpcCommand{Params:tv[i].params}, &resp)
+		if tv[i].code != 0 {
+			if e, ok := resp.Error.(RpcError); !ok || e.Code != tv[i].code || resp.Result != nil {
+				t.Error(i, "Unexpected result", resp.Error, resp.Result)
+			}
+			continue
+		}
+		r, ok := resp.Result.(*EstimateSmartFeeResponse)
+		if resp.Error != nil || !ok || r.Blocks != tv[i].blocks || r.FeeRate != 0.0002 { // 20 SPB in BTC/kB
+			t.Error(i, "Unexpected result", resp.Error, resp.Result)
+		}
+	}
+}
@@ -123,6 +123,9 @@ func my_handler(w http.ResponseWriter, r *http.Request) {
 			//ioutil.WriteFile("submitblock.json", b, 0777)
 			SubmitBlock(&RpcCmd, &resp, b)
 
+		case "estimatesmartfee":
+			EstimateSmartFee(&RpcCmd, &resp)
+
 		default:
 			fmt.Println("Method:", RpcCmd.Method, len(b))
 			//w.Write(bitcoind_result)
@@ -6,6 +6,7 @@ import (
 	"sort"
 	"bytes"
 	"strconv"
+	"strings"
 	"io/ioutil"
 	"encoding/hex"
 	"github.com/piotrnar/gocoin/lib/btc"
@@ -401,12 +402,39 @@ func unarm_stealth(p string) {
 }
 
 
+func filter_scan(par string) {
+	var from uint64
+	pars := strings.Split(par, " ")
+	if len(pars)>1 {
+		from, _ = strconv.ParseUint(pars[1], 10, 32)
+	}
+	var scrs [][]byte
+	for _, s := range strings.Split(pars[0], ",") {
+		ad, e := btc.NewAddrFromString(s)
+		if e != nil || ad.StealthAddr != nil {
+			fmt.Println("Specify comma separated list of addresses and optionally starting block height")
+			return
+		}
+		scrs = append(scrs, ad.OutScript())
+	}
+	res, e := common.BlockChain.BlockFiltersScan(uint32(from), scrs)
+	for _, n := range res {
+		fmt.Println(n.Height, n.BlockHash.String())
+	}
+	if e != nil {
+		fmt.Println(e.Error())
+	}
+	fmt.Println(len(res), "block(s) found")
+}
+
+
 func init() {
 	newUi("arm", false, arm_stealth, "Arm the client with a private stealth secret. Add switch -c when creating a new key")
 	newUi("armed", false, listarmkeys, "Show currently armed private stealth keys. Optional param: seed, file, addr, save")
 	newUi("unarm ua", false, unarm_stealth, "Purge an armed private stealth secret from memory. Specify number or * for all")
 	newUi("balance bal", true, show_balance, "Show & save balance of currently loaded or a specified wallet")
 	newUi("balstat", true, show_balance_stats, "Show balance cache statistics")
+	newUi("cfscan", true, filter_scan, "Find blocks with txs of the given address(es) using the local block filters (BIP158)")
 	newUi("scan", true, scan_stealth, "Get balance of a stealth address")
 	newUi("scan0", true, scan_all_stealth, "Get balance of a stealth address. Ignore the prefix")
 	newUi("unspent u", true, list_unspent, "Shows unpent outputs for a given address")
@@ -45,7 +45,7 @@ func do_mining(s string) {
 		}
 
 		bt, _ := btc.NewBlock(bl)
-		cbasetx, cbtxlen := btc.NewTx(bl[bt.TxOffset:])
+		cbasetx, cbtxlen, _ := btc.NewTx(bl[bt.TxOffset:])
 
 		tot_blocks++
 		tot_blocks_len += len(bl)
@@ -2,6 +2,8 @@ package textui
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"sort"
 	"time"
 	"strconv"
@@ -32,13 +34,82 @@ func (sk SortedKeys) Swap(a, b int) {
 func net_drop(par string) {
 	conid, e := strconv.ParseUint(par, 10, 32)
 	if e != nil {
-		println(e.Error())
-		return
+		// not a connection ID - try it as an IP (v4 or v6)
+		ip := net.ParseIP(strings.Trim(par, "[]"))
+		if ip == nil {
+			fmt.Println("Specify connection ID or IP address")
+			return
+		}
+		network.Mutex_net.Lock()
+		for _, v := range network.OpenCons {
+			if v.PeerAddr.IP().Equal(ip) {
+				conid = uint64(v.ConnID)
+				break
+			}
+		}
+		network.Mutex_net.Unlock()
+		if conid == 0 {
+			fmt.Println("Not connected to", ip.String())
+			return
+		}
 	}
 	network.DropPeer(uint32(conid))
 }
 
 
+func net_ban(par string) {
+	if par == "" {
+		bl := peersdb.GetBanList()
+		for _, b := range bl {
+			until := "for ever"
+			if !b.Until.IsZero() {
+				until = "until " + b.Until.Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%32s  %-22s %s\n", b.Net.String(), until, b.Reason)
+		}
+		bp := peersdb.GetBannedPeers()
+		for _, p := range bp {
+			fmt.Println(p.String())
+		}
+		fmt.Println(len(bl), "banned subnets and", len(bp), "banned peers")
+		return
+	}
+
+	ss := strings.SplitN(par, " ", 3)
+	n, e := peersdb.ParseSubnet(ss[0])
+	if e != nil {
+		fmt.Println(e.Error())
+		return
+	}
+	var hours uint64
+	if len(ss) > 1 {
+		if hours, e = strconv.ParseUint(ss[1], 10, 32); e != nil {
+			fmt.Println("Specify number of hours (0 for ever)")
+			return
+		}
+	}
+	why := "TextUI"
+	if len(ss) > 2 {
+		why = ss[2]
+	}
+	peersdb.BanSubnet(n, time.Duration(hours)*time.Hour, why)
+	fmt.Println(n.String(), "banned")
+	if cnt := network.DropBannedPeers(); cnt > 0 {
+		fmt.Println(cnt, "connections dropped")
+	}
+}
+
+
+func net_unban(par string) {
+	n, e := peersdb.ParseSubnet(par)
+	if e != nil {
+		fmt.Println("Specify IP or subnet to unban")
+		return
+	}
+	fmt.Println(peersdb.UnbanSubnet(n), "bans removed")
+}
+
+
 func node_info(par string) {
 	conid, e := strconv.ParseUint(par, 10, 32)
 	if e != nil {
@@ -74,9 +145,16 @@ func node_info(par string) {
 			fmt.Println("Node Version:", r.Version, "/ Services:", fmt.Sprintf("0x%x", r.Services))
 			fmt.Println("User Agent:", r.Agent)
 			fmt.Println("Chain Height:", r.Height)
-			fmt.Printf("Reported IP: %d.%d.%d.%d\n", byte(r.ReportedIp4>>24), byte(r.ReportedIp4>>16),
-				byte(r.ReportedIp4>>8), byte(r.ReportedIp4))
+			fmt.Println("Reported IP:", r.ReportedIp.String())
 			fmt.Println("SendHeaders:", r.SendHeaders)
+			fmt.Println("Fee filter (SPKB):", r.FeeFilter, " / Ours:", r.FeeFilterSent)
+			fmt.Println("Misbehavior score:", r.Misbehave, r.LastOffence)
+		}
+		if r.Encrypted {
+			fmt.Println("Encrypted (v2) transport, session ID:", r.SessionID)
+		}
+		if r.Permissions!="" {
+			fmt.Println("Permissions:", r.Permissions)
 		}
 		fmt.Println("Last data got:", time.Now().Sub(r.LastDataGot).String())
 		fmt.Println("Last data sent:", time.Now().Sub(r.LastSent).String())
@@ -86,8 +164,15 @@ func node_info(par string) {
 		fmt.Print("Bytes to send:", r.BytesToSend, " (", r.MaxSentBufSize, " max)\n")
 		fmt.Print("BlockInProgress:", r.BlocksInProgress, "  GetHeadersInProgress:", r.GetHeadersInProgress, "\n")
 		fmt.Println("GetBlocksDataNow:", r.GetBlocksDataNow)
+		fmt.Println("Block download speed:", r.BlockDlSpeed, "B/s  Stalls:", r.BlockStalls, "in a row,", r.BlocksStalled, "blocks total")
 		fmt.Println("AllHeadersReceived:", r.AllHeadersReceived)
 		fmt.Println("Total Received:", r.BytesReceived, " /  Sent:", r.BytesSent)
+		if len(r.Rejects)>0 {
+			fmt.Println("Rejects received:", len(r.Rejects))
+			for _, rj := range r.Rejects {
+				fmt.Printf("  %s  %-5s 0x%02x %-24s %s\n", rj.Time.Format("15:04:05"), rj.Message, rj.Code, rj.Reason, rj.Hash)
+			}
+		}
 		for k, v := range r.Counters {
 			fmt.Println(k, ":", v)
 		}
@@ -118,7 +203,8 @@ func net_stats(par string) {
 	}
 
 	network.Mutex_net.Lock()
-	fmt.Printf("%d active net connections, %d outgoing\n", len(network.OpenCons), network.OutConsActive)
+	fmt.Printf("%d active net connections, %d outgoing, %d block-relay-only\n", len(network.OpenCons),
+		network.OutConsActive, network.BlockOnlyActive)
 	srt := make(SortedKeys, len(network.OpenCons))
 	cnt := 0
 	for k, v := range network.OpenCons {
@@ -134,6 +220,8 @@ func net_stats(par string) {
 
 		if v.X.Incomming {
 			fmt.Print("<- ")
+		} else if v.X.BlockOnly {
+			fmt.Print("b->")
 		} else {
 			fmt.Print(" ->")
 		}
@@ -152,8 +240,8 @@ func net_stats(par string) {
 	if network.ExternalAddrLen()>0 {
 		fmt.Print("External addresses:")
 		network.ExternalIpMutex.Lock()
-		for ip, cnt := range network.ExternalIp4 {
-			fmt.Printf(" %d.%d.%d.%d(%d)", byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip), cnt)
+		for ip, cnt := range network.ExternalIp {
+			fmt.Printf(" %s(%d)", net.IP(ip[:]).String(), cnt)
 		}
 		network.ExternalIpMutex.Unlock()
 		fmt.Println()
@@ -166,7 +254,7 @@ func net_stats(par string) {
 	fmt.Print("RecentlyDisconencted:")
 	network.HammeringMutex.Lock()
 	for ip, ti := range network.RecentlyDisconencted {
-		fmt.Printf(" %d.%d.%d.%d-%s", ip[0], ip[1], ip[2], ip[3], time.Now().Sub(ti).String())
+		fmt.Printf(" %s-%s", net.IP(ip[:]).String(), time.Now().Sub(ti).String())
 	}
 	network.HammeringMutex.Unlock()
 	fmt.Println()
@@ -177,6 +265,8 @@ func net_stats(par string) {
 
 func init() {
 	newUi("net n", false, net_stats, "Show network statistics. Specify ID to see its details.")
-	newUi("drop", false, net_drop, "Disconenct from node with a given IP")
-	newUi("conn", false, net_conn, "Connect to the given node (specify IP and optionally a port)")
+	newUi("drop", false, net_drop, "Disconenct from node with a given connection ID or IP")
+	newUi("ban", false, net_ban, "Ban IP or subnet: <ip[/bits]> [hours] [reason]. Without params lists all the bans")
+	newUi("unban", false, net_unban, "Remove bans of the given IP or subnet (also of single peers from it)")
+	newUi("conn", false, net_conn, "Connect to the given node (specify IP and optionally a port, use [] for IPv6 with port)")
 }
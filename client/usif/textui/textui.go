@@ -9,6 +9,7 @@ import (
 	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/lib"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 	"github.com/piotrnar/gocoin/lib/others/sys"
 	"github.com/piotrnar/gocoin/lib/qdb"
@@ -157,6 +158,7 @@ func show_info(par string) {
 		len(network.TransactionsPending), len(network.NetTxs))
 	fmt.Printf("WaitingForInputs:%d,  SpentOutputs:%d,  Hashrate:%s,  AverageFee:%.1f SpB\n",
 		len(network.WaitingForInputs), len(network.SpentOutputs), usif.GetNetworkHashRate(), common.GetAverageFee())
+	fmt.Printf("ScriptCache:%d/%d\n", script.CacheLen(), script.CacheMaxEntries)
 	network.TxMutex.Unlock()
 
 	common.PrintStats()
@@ -364,6 +366,8 @@ func save_config(s string) {
 
 func show_addresses(par string) {
 	fmt.Println(peersdb.PeerDB.Count(), "peers in the database")
+	nc, tc := peersdb.AddrManStats()
+	fmt.Println(nc, "in the new table and", tc, "in the tried table")
 	if par=="list" {
 		cnt :=  0
 		peersdb.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
@@ -375,7 +379,7 @@ func show_addresses(par string) {
 		cnt :=  0
 		peersdb.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 			pr := peersdb.NewPeer(v)
-			if pr.Banned != 0 {
+			if pr.BanUntil != 0 {
 				cnt++
 				fmt.Printf("%4d) %s\n", cnt, pr.String())
 			}
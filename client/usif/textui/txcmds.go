@@ -41,6 +41,10 @@ func send_tx(par string) {
 	network.TxMutex.Lock()
 	if ptx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
 		network.TxMutex.Unlock()
+		if network.DandelionSend(txid) {
+			fmt.Println("TxID", txid.String(), "sent to a Dandelion stem peer")
+			return
+		}
 		cnt := network.NetRouteInv(1, txid, nil)
 		ptx.Invsentcnt += cnt
 		fmt.Println("INV for TxID", txid.String(), "sent to", cnt, "node(s)")
@@ -176,6 +180,27 @@ func baned_txs(par string) {
 }
 
 
+func orphan_txs(par string) {
+	network.TxMutex.Lock()
+	fmt.Println(network.OrphansCount, "transaction(s) waiting for", len(network.WaitingForInputs), "missing input(s):")
+	cnt := 0
+	for _, w4i := range network.WaitingForInputs {
+		cnt++
+		fmt.Println("", cnt, "missing", w4i.TxID.String())
+		for k, t := range w4i.Ids {
+			if v, ok := network.TransactionsRejected[k]; ok && v.Wait4Input!=nil {
+				fmt.Println("   ", v.Id.String(), "-", v.Size, "bytes - from peer", v.Wait4Input.PeerID,
+					"-", time.Now().Sub(t).String(), "ago")
+			}
+		}
+	}
+	if len(network.OrphansPerPeer) > 0 {
+		fmt.Println("Orphans per peer ID:", network.OrphansPerPeer)
+	}
+	network.TxMutex.Unlock()
+}
+
+
 func send_all_tx(par string) {
 	network.TxMutex.Lock()
 	for k, v := range network.TransactionsToSend {
@@ -197,5 +222,6 @@ func init () {
 	newUi("txdecode td", true, dec_tx, "Decode a transaction from memory pool (identified by a given <txid>)")
 	newUi("txlist ltx", true, list_txs, "List all the transaction loaded into memory pool up to 1MB space <max_size>")
 	newUi("txlistban ltxb", true, baned_txs, "List the transaction that we have rejected")
+	newUi("txorphans lto", true, orphan_txs, "List the transactions that are waiting for their inputs")
 	newUi("mempool mp", true, mempool_stats, "Show the mempool statistics")
 }
@@ -8,8 +8,8 @@ import (
 	"errors"
 	"math/rand"
 	"encoding/hex"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/lib/script"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
@@ -115,9 +115,13 @@ func LoadRawTx(buf []byte) (s string) {
 	}
 
 	// At this place we should have raw transaction in txd
-	tx, le := btc.NewTx(txd)
-	if tx==nil || le != len(txd) {
-		s += fmt.Sprintln("Could not decode transaction file or it has some extra data")
+	tx, le, er := btc.NewTx(txd)
+	if er != nil {
+		s += fmt.Sprintln("Could not decode transaction file:", er.Error())
+		return
+	}
+	if le != len(txd) {
+		s += fmt.Sprintln("Transaction file has some extra data")
 		return
 	}
 	tx.Hash = btc.NewSha2Hash(txd)
@@ -155,9 +159,7 @@ func SendInvToRandomPeer(typ uint32, h *btc.Uint256) {
 	common.CountSafe(fmt.Sprint("NetSendOneInv", typ))
 
 	// Prepare the inv
-	inv := new([36]byte)
-	binary.LittleEndian.PutUint32(inv[0:4], typ)
-	copy(inv[4:36], h.Bytes())
+	inv := &wire.InvVect{Type:typ, Hash:h.Hash}
 
 	// Append it to PendingInvs in a random connection
 	network.Mutex_net.Lock()
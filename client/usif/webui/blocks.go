@@ -67,7 +67,7 @@ func json_blocks(w http.ResponseWriter, r *http.Request) {
 		b.Size = len(bl)
 		b.Version = block.Version()
 
-		cbasetx, cbaselen := btc.NewTx(bl[block.TxOffset:])
+		cbasetx, cbaselen, _ := btc.NewTx(bl[block.TxOffset:])
 		for o := range cbasetx.TxOut {
 			b.Reward += cbasetx.TxOut[o].Value
 		}
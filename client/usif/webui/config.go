@@ -2,11 +2,13 @@ package webui
 
 import (
 	"os"
+	"time"
 	"strconv"
 	"net/http"
 	"io/ioutil"
 	"encoding/json"
 	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/wallet"
 	"github.com/piotrnar/gocoin/client/network"
@@ -86,6 +88,27 @@ func p_cfg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(r.Form["ban"])>0 {
+		if n, e := peersdb.ParseSubnet(r.Form["ban"][0]); e == nil {
+			var hours uint64
+			if len(r.Form["hours"])>0 {
+				hours, _ = strconv.ParseUint(r.Form["hours"][0], 10, 32)
+			}
+			peersdb.BanSubnet(n, time.Duration(hours)*time.Hour, "WebUI")
+			network.DropBannedPeers()
+		}
+		http.Redirect(w, r, "net", http.StatusFound)
+		return
+	}
+
+	if len(r.Form["unban"])>0 {
+		if n, e := peersdb.ParseSubnet(r.Form["unban"][0]); e == nil {
+			peersdb.UnbanSubnet(n)
+		}
+		http.Redirect(w, r, "net", http.StatusFound)
+		return
+	}
+
 	if len(r.Form["savecfg"])>0 {
 		dat, _ := json.Marshal(&common.CFG)
 		if dat != nil {
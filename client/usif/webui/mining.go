@@ -84,7 +84,7 @@ func p_miners(w http.ResponseWriter, r *http.Request) {
 		}
 
 		block, e := btc.NewBlock(bl)
-		cbasetx, _ := btc.NewTx(bl[block.TxOffset:])
+		cbasetx, _, _ := btc.NewTx(bl[block.TxOffset:])
 
 		block_versions[binary.LittleEndian.Uint32(bl[0:4])]++
 		diff += btc.GetDifficulty(end.Bits())
@@ -3,6 +3,7 @@ package webui
 import (
 	"fmt"
 	"sort"
+	"net"
 	"strings"
 	"strconv"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
 
 type sorted_net_cons []network.ConnInfo
@@ -165,9 +167,9 @@ func json_bwidth(w http.ResponseWriter, r *http.Request) {
 	network.Mutex_net.Unlock()
 
 	network.ExternalIpMutex.Lock()
-	for ip, rec := range network.ExternalIp4 {
+	for ip, rec := range network.ExternalIp {
 		out.ExternalIP = append(out.ExternalIP, one_ext_ip{
-			Ip : fmt.Sprintf("%d.%d.%d.%d", byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)),
+			Ip : net.IP(ip[:]).String(),
 			Count:rec[0], Timestamp:rec[1]})
 	}
 	network.ExternalIpMutex.Unlock()
@@ -224,3 +226,37 @@ func json_bwchar(w http.ResponseWriter, r *http.Request) {
 		println(er.Error())
 	}
 }
+
+
+func json_bans(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+
+	type one_ban struct {
+		Net string
+		Until int64
+		Reason string
+	}
+
+	out := make([]one_ban, 0)
+	for _, b := range peersdb.GetBanList() {
+		var until int64
+		if !b.Until.IsZero() {
+			until = b.Until.Unix()
+		}
+		out = append(out, one_ban{Net:b.Net.String(), Until:until, Reason:b.Reason})
+	}
+	for _, p := range peersdb.GetBannedPeers() {
+		out = append(out, one_ban{Net:p.Ip(), Reason:"misbehaving",
+			Until:int64(p.BanUntil)})
+	}
+
+	bx, er := json.Marshal(out)
+	if er == nil {
+		w.Header()["Content-Type"] = []string{"application/json"}
+		w.Write(bx)
+	} else {
+		println(er.Error())
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/wallet"
+	"github.com/piotrnar/gocoin/client/network"
 )
 
 
@@ -296,6 +297,20 @@ func p_snd(w http.ResponseWriter, r *http.Request) {
 
 		wal = strings.Replace(wal, "/*WALLET_ENTRY_JS*/", "const ADDR_LIST_SIZE = " + fmt.Sprint(common.CFG.WebUI.AddrListLen), 1)
 
+		// Fee estimates for different confirmation targets
+		fees := "var fee_est_target = " + fmt.Sprint(common.CFG.EstimateFeeBlocks) + "\nvar fee_estimates = ["
+		var last_blocks uint
+		for _, target := range []uint{1, 2, 3, 6, 12, network.FeeEstMaxTarget} {
+			if spb, blocks := network.EstimateFee(target); blocks>last_blocks {
+				if last_blocks!=0 {
+					fees += ", "
+				}
+				fees += fmt.Sprint("[", blocks, ", ", spb, "]")
+				last_blocks = blocks
+			}
+		}
+		wal = strings.Replace(wal, "/*FEE_ESTIMATES_JS*/", fees + "]", 1)
+
 		s = strings.Replace(s, "<!--WALLET-->", wal, 1)
 	} else {
 		if wallet.MyWallet==nil {
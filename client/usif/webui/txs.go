@@ -210,11 +210,13 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 				network.TxMutex.Lock()
 				if ptx, ok := network.TransactionsToSend[tid.BIdx()]; ok {
 					network.TxMutex.Unlock()
-					cnt := network.NetRouteInv(1, tid, nil)
-					if cnt==0 {
-						usif.SendInvToRandomPeer(1, tid)
-					} else {
-						ptx.Invsentcnt += cnt
+					if !network.DandelionSend(tid) {
+						cnt := network.NetRouteInv(1, tid, nil)
+						if cnt==0 {
+							usif.SendInvToRandomPeer(1, tid)
+						} else {
+							ptx.Invsentcnt += cnt
+						}
 					}
 				} else {
 					network.TxMutex.Unlock()
@@ -321,9 +323,11 @@ func xml_txw4i(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "<id>", v.TxID.String(), "</id>")
 		for x, t := range v.Ids {
 			w.Write([]byte("<tx>"))
-			if v, ok := network.TransactionsRejected[x]; ok {
+			if v, ok := network.TransactionsRejected[x]; ok && v.Wait4Input!=nil {
 				fmt.Fprint(w, "<id>", v.Id.String(), "</id>")
 				fmt.Fprint(w, "<time>", t.Unix(), "</time>")
+				fmt.Fprint(w, "<len>", v.Size, "</len>")
+				fmt.Fprint(w, "<peer>", v.Wait4Input.PeerID, "</peer>")
 			} else {
 				fmt.Fprint(w, "<id>FATAL ERROR!!! This should not happen! Please report</id>")
 				fmt.Fprint(w, "<time>", time.Now().Unix(), "</time>")
@@ -383,7 +387,8 @@ func json_txstat(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(fmt.Sprint("\"ptr1_cnt\":", len(network.TransactionsPending), ",")))
 	w.Write([]byte(fmt.Sprint("\"ptr2_cnt\":", len(network.NetTxs), ",")))
 	w.Write([]byte(fmt.Sprint("\"spent_outs_cnt\":", len(network.SpentOutputs), ",")))
-	w.Write([]byte(fmt.Sprint("\"awaiting_inputs\":", len(network.WaitingForInputs), "")))
+	w.Write([]byte(fmt.Sprint("\"awaiting_inputs\":", len(network.WaitingForInputs), ",")))
+	w.Write([]byte(fmt.Sprint("\"orphans_cnt\":", network.OrphansCount, "")))
 
 	network.TxMutex.Unlock()
 
@@ -4,6 +4,7 @@ import (
 	"os"
 	"fmt"
 	"time"
+	"net"
 	"strings"
 	"net/http"
 	"io/ioutil"
@@ -33,14 +34,16 @@ func ipchecker(r *http.Request) bool {
 	if common.NetworkClosed {
 		return false
 	}
-	var a,b,c,d uint32
-	n, _ := fmt.Sscanf(r.RemoteAddr, "%d.%d.%d.%d", &a, &b, &c, &d)
-	if n!=4 {
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
+		return false
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
 		return false
 	}
-	addr := (a<<24) | (b<<16) | (c<<8) | d
 	for i := range common.WebUIAllowed {
-		if (addr&common.WebUIAllowed[i].Mask)==common.WebUIAllowed[i].Addr {
+		if common.WebUIAllowed[i].Contains(addr) {
 			r.ParseForm()
 			return true
 		}
@@ -243,6 +246,7 @@ func ServerThread(iface string) {
 	http.HandleFunc("/wallet.json", json_wallet)
 	http.HandleFunc("/peerst.json", json_peerst)
 	http.HandleFunc("/bwchar.json", json_bwchar)
+	http.HandleFunc("/bans.json", json_bans)
 	http.HandleFunc("/mempool_stats.json", json_mempool_stats)
 
 	http.HandleFunc("/mempool_fees.txt", txt_mempool_fees)
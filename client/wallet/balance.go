@@ -12,6 +12,7 @@ import (
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
 )
 
 var (
@@ -468,6 +469,10 @@ func UpdateBalanceFolder() string {
 	if BalanceInvalid {
 		UpdateBalance()
 	}
+	if spb, _ := network.EstimateFee(common.CFG.EstimateFeeBlocks); spb > 0 {
+		// the offline wallet uses it as the default fee rate
+		ioutil.WriteFile("balance/feerate.txt", []byte(fmt.Sprintf("%.3f\n", spb)), 0600)
+	}
 	utxt, _ := os.Create("balance/unspent.txt")
 	return DumpBalance(MyBalance, utxt, true, false)
 }
@@ -2,17 +2,16 @@ package main
 
 import (
 	"time"
-	"bytes"
 	"math/rand"
-	"github.com/piotrnar/gocoin/lib/qdb"
-	"github.com/piotrnar/gocoin/lib/btc"
-	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
 
 
 func get_best_peer() (peer *peersdb.PeerAddr) {
-	adrs := peersdb.GetBestPeers(100, is_connected)
+	adrs := peersdb.GetBestPeers(100, func(p *peersdb.PeerAddr) bool {
+		return !p.IsIP() || is_connected(p) // we can only connect to IPv4 and IPv6 peers
+	})
 	if len(adrs)==0 {
 		return nil
 	}
@@ -20,33 +19,47 @@ func get_best_peer() (peer *peersdb.PeerAddr) {
 }
 
 
-func parse_addr(pl []byte) {
-	b := bytes.NewBuffer(pl)
-	cnt, _ := btc.ReadVLen(b)
-	for i := 0; i < int(cnt); i++ {
-		var buf [30]byte
-		n, e := b.Read(buf[:])
-		if n!=len(buf) || e!=nil {
-			COUNTER("ADER")
-			break
-		}
-		a := peersdb.NewPeer(buf[:])
-		if !sys.ValidIp4(a.Ip4[:]) {
-			COUNTER("ADNO")
-		} else if time.Unix(int64(a.Time), 0).Before(time.Now().Add(time.Minute)) {
-			if time.Now().Before(time.Unix(int64(a.Time), 0).Add(peersdb.ExpirePeerAfter)) {
-				k := qdb.KeyType(a.UniqID())
-				v := peersdb.PeerDB.Get(k)
-				if v != nil {
-					a.Banned = peersdb.NewPeer(v[:]).Banned
-				}
-				peersdb.PeerDB.Put(k, a.Bytes())
-			} else {
-				COUNTER("ADST")
+func parse_addr(pl []byte, src *peersdb.PeerAddr) {
+	addrs, e := wire.ParseAddr(pl)
+	if e != nil {
+		COUNTER("ADER")
+	}
+	addrs_received(addrs, src)
+}
+
+
+func parse_addrv2(pl []byte, src *peersdb.PeerAddr) {
+	addrs, e := wire.ParseAddrV2(pl)
+	if e != nil {
+		COUNTER("ADER")
+	}
+	addrs_received(addrs, src)
+}
+
+
+func addrs_received(addrs []*wire.Addr, src *peersdb.PeerAddr) {
+	for _, ad := range addrs {
+		a := peersdb.NewEmptyPeer()
+		a.NetAddr = ad.NetAddr
+		a.Time = ad.Time
+		addr_received(a, src)
+	}
+}
+
+
+func addr_received(a, src *peersdb.PeerAddr) {
+	if !a.Routable() {
+		COUNTER("ADNO")
+	} else if time.Unix(int64(a.Time), 0).Before(time.Now().Add(time.Minute)) {
+		if time.Now().Before(time.Unix(int64(a.Time), 0).Add(peersdb.ExpirePeerAfter)) {
+			if !peersdb.AddrReceived(a, src) {
+				COUNTER("ADNR")
 			}
 		} else {
-			COUNTER("ADFU")
+			COUNTER("ADST")
 		}
+	} else {
+		COUNTER("ADFU")
 	}
 }
 
@@ -10,6 +10,7 @@ import (
 	"sync/atomic"
 	"encoding/hex"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 )
 
 const (
@@ -192,8 +193,7 @@ func (c *one_net_conn) block(d []byte) {
 // returns true if block has been added to the queue
 func (c *one_net_conn) get_more_blocks() {
 	var cnt int
-	b := new(bytes.Buffer)
-	vl := new(bytes.Buffer)
+	var invs []wire.InvVect
 
 	BlocksMutex.Lock()
 
@@ -230,15 +230,13 @@ func (c *one_net_conn) get_more_blocks() {
 		c.inprogress++
 		BlocksInProgress[bh] = cbip
 
-		b.Write([]byte{2,0,0,0})
-		b.Write(bh[:])
+		invs = append(invs, wire.InvVect{Type:wire.MSG_BLOCK, Hash:bh})
 		cnt++
 	}
 	BlocksMutex.Unlock()
 
 	if cnt > 0 {
-		btc.WriteVlen(vl, uint64(cnt))
-		c.sendmsg("getdata", append(vl.Bytes(), b.Bytes()...))
+		c.sendmsg("getdata", wire.EncodeInv(invs))
 		COUNTER("GDYE")
 	} else {
 		COUNTER("GDNO")
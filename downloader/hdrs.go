@@ -4,10 +4,9 @@ import (
 	"fmt"
 	"time"
 	"sync"
-	"bytes"
 	"sync/atomic"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
@@ -49,36 +48,26 @@ func (c *one_net_conn) hdr_idle() bool {
 
 
 func (c *one_net_conn) getheaders() {
-	var b [4+1+32+32]byte
-	binary.LittleEndian.PutUint32(b[0:4], Version)
-	b[4] = 1 // one inv
+	loc := &wire.MsgLocator{Version:Version}
 	LastBlock.Mutex.Lock()
-	copy(b[5:37], LastBlock.node.BlockHash.Hash[:])
+	loc.Hashes = []*btc.Uint256{LastBlock.node.BlockHash}
 	LastBlock.Mutex.Unlock()
-	c.sendmsg("getheaders", b[:])
+	c.sendmsg("getheaders", loc.Bytes())
 }
 
 
 func (c *one_net_conn) headers(d []byte) {
-	var hdr [81]byte
-	b := bytes.NewReader(d)
-	cnt, er := btc.ReadVLen(b)
+	hdrs, er := wire.ParseHeaders(d)
 	if er != nil {
+		fmt.Println(LastBlock.node.Height, "headers:", er.Error())
 		return
 	}
-	if cnt==0 /*|| LastBlock.node.Height>=140e3*/ {
+	if len(hdrs)==0 /*|| LastBlock.node.Height>=140e3*/ {
 		SetAllHeadersDone(true)
 		return
 	}
-	for i := uint64(0); i < cnt; i++ {
-		if _, er = b.Read(hdr[:]); er != nil {
-			return
-		}
-		if hdr[80]!=0 {
-			fmt.Println(LastBlock.node.Height, "Unexpected value of txn_count")
-			continue
-		}
-		bl, er := btc.NewBlock(hdr[:])
+	for _, hdr := range hdrs {
+		bl, er := btc.NewBlock(append(hdr, 0))
 		TheBlockChain.BlockIndexAccess.Lock()
 		er, _, _ = TheBlockChain.PreCheckBlock(bl)
 		if er == nil {
@@ -5,12 +5,12 @@ import (
 	"fmt"
 	"time"
 	"sync"
-	"bytes"
+	"errors"
 	//"runtime"
-	"strings"
 	"sync/atomic"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/wire"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
 
@@ -26,7 +26,7 @@ const (
 )
 
 var (
-	open_connection_list map[[4]byte] *one_net_conn = make(map [[4]byte] *one_net_conn)
+	open_connection_list map[[16]byte] *one_net_conn = make(map [[16]byte] *one_net_conn)
 	open_connection_mutex sync.Mutex
 	curid uint32
 	switch_to_next_peer bool
@@ -51,11 +51,13 @@ type one_net_conn struct {
 	closed_r bool
 
 	net.Conn
+	v2 *btc.V2Cipher // set if the connection uses the encrypted transport
 
 	// Message receiving state machine:
 	recv struct {
-		hdr [24]byte
+		hdr [wire.HeaderLen]byte
 		hdr_len int
+		msg *wire.Header
 		pl_len uint32 // length taken from the message header
 		cmd string
 		dat []byte
@@ -131,16 +133,14 @@ func (c *one_net_conn) sendbuflen() (sbl int) {
 
 func (c *one_net_conn) sendmsg(cmd string, pl []byte) (e error) {
 	//println(c.PeerAddr.Ip(), "sending", cmd, len(pl))
-	sbuf := make([]byte, 24+len(pl))
-
-	binary.LittleEndian.PutUint32(sbuf[0:4], Version)
-	copy(sbuf[0:4], Magic[:])
-	copy(sbuf[4:16], cmd)
-	binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
+	if c.v2 != nil {
+		c.Mutex.Lock()
+		c.send.buf = append(c.send.buf, c.v2.Encrypt(btc.V2EncodeMsg(cmd, pl), nil, false)...)
+		c.Mutex.Unlock()
+		return
+	}
 
-	sh := btc.Sha2Sum(pl[:])
-	copy(sbuf[20:24], sh[:4])
-	copy(sbuf[24:], pl)
+	sbuf := wire.Encode(Magic, cmd, pl)
 
 	c.Mutex.Lock()
 	c.send.buf = append(c.send.buf, sbuf...)
@@ -151,24 +151,12 @@ func (c *one_net_conn) sendmsg(cmd string, pl []byte) (e error) {
 
 
 func (c *one_net_conn) sendver() {
-	b := bytes.NewBuffer([]byte{})
-	binary.Write(b, binary.LittleEndian, uint32(Version))
-	binary.Write(b, binary.LittleEndian, uint64(Services))
-	binary.Write(b, binary.LittleEndian, uint64(time.Now().Unix()))
-
+	v := &wire.MsgVersion{Version:Version, Services:Services, Timestamp:uint64(time.Now().Unix()),
+		UserAgent:UserAgent, Relay:false /*don't notify me about txs*/}
 	// Remote Addr
-	binary.Write(b, binary.LittleEndian, Services)
-	b.Write(bytes.Repeat([]byte{0}, 12)) // ip6
-	b.Write(bytes.Repeat([]byte{0}, 4)) // ip4
-	binary.Write(b, binary.LittleEndian, uint16(peersdb.DefaultTcpPort())) // port
-
-	b.Write(bytes.Repeat([]byte{0}, 26)) // Local Addr
-	b.Write(bytes.Repeat([]byte{0}, 8)) // nonce
-	b.WriteByte(byte(len(UserAgent)))
-	b.Write([]byte(UserAgent))
-	binary.Write(b, binary.LittleEndian, uint32(0))  // Last Block Height
-	b.WriteByte(0)  // don't notify me about txs
-	c.sendmsg("version", b.Bytes())
+	binary.LittleEndian.PutUint64(v.AddrRecv[0:8], Services)
+	binary.LittleEndian.PutUint16(v.AddrRecv[24:26], uint16(peersdb.DefaultTcpPort())) // port
+	c.sendmsg("version", v.Bytes())
 }
 
 // Lock the mutex before calling it
@@ -180,7 +168,10 @@ func (c *one_net_conn) bps() (res float64) {
 
 func (c *one_net_conn) readmsg() *one_net_cmd {
 	c.SetReadDeadline(time.Now().Add(10*time.Millisecond))
-	if c.recv.hdr_len<24 {
+	if c.v2 != nil {
+		return c.readmsg_v2()
+	}
+	if c.recv.hdr_len<wire.HeaderLen {
 		for {
 			n, e := c.Read(c.recv.hdr[c.recv.hdr_len:])
 			if e != nil {
@@ -196,21 +187,19 @@ func (c *one_net_conn) readmsg() *one_net_cmd {
 			c.bytes_received += uint64(n)
 			c.Unlock()
 			c.recv.hdr_len += n
-			if c.recv.hdr_len>=4 {
-				if !bytes.Equal(c.recv.hdr[:4], Magic[:]) {
-					fmt.Println(c.Ip(), "NetBadMagic")
+			if c.recv.hdr_len==wire.HeaderLen {
+				if c.recv.msg, e = wire.ParseHeader(Magic, c.recv.hdr[:]); e != nil {
+					fmt.Println(c.Ip(), "readmsg:", e.Error())
 					c.setbroken(true)
 					return nil
 				}
-				if c.recv.hdr_len==24 {
-					c.recv.cmd = strings.TrimRight(string(c.recv.hdr[4:16]), "\000")
-					c.recv.pl_len = binary.LittleEndian.Uint32(c.recv.hdr[16:20])
-					c.recv.datlen = 0
-					if c.recv.pl_len > 0 {
-						c.recv.dat = make([]byte, c.recv.pl_len)
-					}
-					break
+				c.recv.cmd = c.recv.msg.Cmd
+				c.recv.pl_len = c.recv.msg.Len
+				c.recv.datlen = 0
+				if c.recv.pl_len > 0 {
+					c.recv.dat = make([]byte, c.recv.pl_len)
 				}
+				break
 			}
 		}
 	}
@@ -233,8 +222,7 @@ func (c *one_net_conn) readmsg() *one_net_cmd {
 		}
 	}
 
-	sh := btc.Sha2Sum(c.recv.dat)
-	if !bytes.Equal(c.recv.hdr[20:24], sh[:4]) {
+	if c.recv.msg.Verify(c.recv.dat) != nil {
 		fmt.Println(c.Ip(), "Msg checksum error")
 		c.setbroken(true)
 		return nil
@@ -272,7 +260,7 @@ func (c *one_net_conn) cleanup() {
 
 		// Remove from open connections
 		open_connection_mutex.Lock()
-		delete(open_connection_list, c.Ip4)
+		delete(open_connection_list, c.Ip16())
 		open_connection_mutex.Unlock()
 
 		// Remove from pending blocks
@@ -361,6 +349,9 @@ func (c *one_net_conn) run_recv() {
 				c.block(msg.pl)
 
 			case "version":
+				if len(msg.pl) >= 4 && binary.LittleEndian.Uint32(msg.pl[0:4]) >= 70016 {
+					c.sendmsg("sendaddrv2", nil) // BIP155 - it must go before verack
+				}
 				c.sendmsg("verack", nil)
 				veracksent = true
 
@@ -369,7 +360,10 @@ func (c *one_net_conn) run_recv() {
 				c.setbroken(true)
 
 			case "addr":
-				parse_addr(msg.pl)
+				parse_addr(msg.pl, c.PeerAddr)
+
+			case "addrv2":
+				parse_addrv2(msg.pl, c.PeerAddr)
 
 			/*case "ping":
 				re := make([]byte, len(msg.pl))
@@ -391,7 +385,12 @@ func (c *one_net_conn) run_recv() {
 
 func (res *one_net_conn) connect() {
 	//fmt.Println("connecting to", res.Ip())
-	con, er := net.DialTimeout("tcp4", res.Ip(), DIAL_TIMEOUT)
+	con, er := net.DialTimeout("tcp", res.Ip(), DIAL_TIMEOUT)
+	if er == nil {
+		if con = res.v2handshake(con); con == nil {
+			er = errors.New("v2 handshake failed")
+		}
+	}
 	if er != nil {
 		COUNTER("CERR")
 		res.setbroken(true)
@@ -415,7 +414,7 @@ func new_connection(ad *peersdb.PeerAddr) *one_net_conn {
 	res.PeerAddr = ad
 	res.id = atomic.AddUint32(&curid, 1)
 	open_connection_mutex.Lock()
-	open_connection_list[ad.Ip4] = res
+	open_connection_list[ad.Ip16()] = res
 	open_connection_mutex.Unlock()
 	go res.connect()
 	return res
@@ -470,7 +469,7 @@ func mark_all_hdrs_done() {
 func is_connected(p *peersdb.PeerAddr) (yes bool) {
 	open_connection_mutex.Lock()
 	for _, v := range open_connection_list {
-		if v.Ip4==p.Ip4 {
+		if v.Ip16()==p.Ip16() {
 			yes = true
 			break
 		}
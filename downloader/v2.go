@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"time"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// BIP324 encrypted transport
+
+const (
+	SERVICE_P2P_V2 = 0x800
+	V2_HANDSHAKE_TIMEOUT = 10*time.Second
+	V2_MAX_PACKET = 4e6
+)
+
+
+// Tries the v2 handshake with peers that advertise it.
+// If the peer does not respond, it reconnects using v1.
+// Returns nil if the connection failed.
+func (c *one_net_conn) v2handshake(con net.Conn) net.Conn {
+	if (c.PeerAddr.Services&SERVICE_P2P_V2)==0 {
+		return con
+	}
+	con.SetDeadline(time.Now().Add(V2_HANDSHAKE_TIMEOUT))
+	v2, rcvd, e := btc.V2Handshake(con, Magic[:], true, nil)
+	if e == nil {
+		con.SetDeadline(time.Time{})
+		COUNTER("V2OK")
+		c.v2 = v2
+		return con
+	}
+	con.Close()
+	if rcvd {
+		COUNTER("V2ER")
+		return nil
+	}
+	COUNTER("V2V1")
+	if con, e = net.DialTimeout("tcp", c.Ip(), DIAL_TIMEOUT); e != nil {
+		return nil
+	}
+	return con
+}
+
+
+func (c *one_net_conn) readmsg_v2() *one_net_cmd {
+	for c.recv.hdr_len < btc.V2_LENGTH_LEN {
+		n, e := c.Read(c.recv.hdr[c.recv.hdr_len:btc.V2_LENGTH_LEN])
+		if e != nil {
+			if nerr, ok := e.(net.Error); !ok || !nerr.Timeout() {
+				c.setbroken(true)
+			}
+			return nil
+		}
+		c.Lock()
+		c.bytes_received += uint64(n)
+		c.Unlock()
+		c.recv.hdr_len += n
+		if c.recv.hdr_len == btc.V2_LENGTH_LEN {
+			c.recv.pl_len = uint32(c.v2.DecryptLength(c.recv.hdr[:btc.V2_LENGTH_LEN]))
+			if c.recv.pl_len > V2_MAX_PACKET+btc.V2_OVERHEAD {
+				COUNTER("V2BG")
+				c.setbroken(true)
+				return nil
+			}
+			c.recv.dat = make([]byte, c.recv.pl_len)
+			c.recv.datlen = 0
+		}
+	}
+
+	for c.recv.datlen < c.recv.pl_len {
+		n, e := c.Read(c.recv.dat[c.recv.datlen:])
+		if e != nil {
+			if nerr, ok := e.(net.Error); !ok || !nerr.Timeout() {
+				c.setbroken(true)
+			}
+			return nil
+		}
+		if n > 0 {
+			c.recv.datlen += uint32(n)
+			c.Lock()
+			c.bytes_received += uint64(n)
+			c.Unlock()
+		}
+	}
+
+	contents, ignore, ok := c.v2.Decrypt(c.recv.dat, nil)
+	c.recv.hdr_len = 0
+	c.recv.dat = nil
+	if !ok {
+		COUNTER("V2AU")
+		c.setbroken(true)
+		return nil
+	}
+	if ignore {
+		return nil
+	}
+
+	res := new(one_net_cmd)
+	if res.cmd, res.pl, ok = btc.V2DecodeMsg(contents); !ok {
+		COUNTER("V2UN")
+		return nil
+	}
+	return res
+}
@@ -1,6 +1,7 @@
 package btc
 
 import (
+	"fmt"
 	"errors"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/others/sys"
@@ -24,17 +25,21 @@ type Block struct {
 
 func NewBlock(data []byte) (*Block, error) {
 	if len(data)<81 {
-		return nil, errors.New("Block too short")
+		return nil, fmt.Errorf("Block: %w", ErrTruncated)
 	}
 
 	var bl Block
 	bl.Hash = NewSha2Hash(data[:80])
 	bl.Raw = data
-	bl.TxCount, bl.TxOffset = VLen(data[80:])
-	if bl.TxOffset == 0 {
-		return nil, errors.New("Block's txn_count field corrupt - RPC_Result:bad-blk-length")
+	var e error
+	bl.TxCount, bl.TxOffset, e = ParseVLen(data[80:])
+	if e != nil {
+		return nil, fmt.Errorf("Block's txn_count field corrupt: %w - RPC_Result:bad-blk-length", e)
 	}
 	bl.TxOffset += 80
+	if bl.TxCount > (len(data)-bl.TxOffset)/10 { // each tx takes at least 10 bytes
+		return nil, fmt.Errorf("Block's txn_count too big for its size: %w - RPC_Result:bad-blk-length", ErrTruncated)
+	}
 	return &bl, nil
 }
 
@@ -71,13 +76,20 @@ func (bl *Block) SerializedSize() int {
 // It would be more elegant to use bytes.Reader here, but this solution is ~20% faster.
 func (bl *Block) BuildTxList() (e error) {
 	if bl.TxCount==0 {
-		bl.TxCount, bl.TxOffset = VLen(bl.Raw[80:])
-		if bl.TxCount==0 || bl.TxOffset==0 {
-			e = errors.New("Block's txn_count field corrupt - RPC_Result:bad-blk-length")
+		if bl.TxCount, bl.TxOffset, e = ParseVLen(bl.Raw[80:]); e != nil {
+			e = fmt.Errorf("Block's txn_count field corrupt: %w - RPC_Result:bad-blk-length", e)
+			return
+		}
+		if bl.TxCount==0 {
+			e = errors.New("Block has no transactions - RPC_Result:bad-blk-length")
 			return
 		}
 		bl.TxOffset += 80
 	}
+	if bl.TxCount > (len(bl.Raw)-bl.TxOffset)/10 {
+		e = fmt.Errorf("Block's txn_count too big for its size: %w - RPC_Result:bad-blk-length", ErrTruncated)
+		return
+	}
 	bl.Txs = make([]*Tx, bl.TxCount)
 
 	offs := bl.TxOffset
@@ -89,9 +101,9 @@ func (bl *Block) BuildTxList() (e error) {
 
 	for i:=0; i<bl.TxCount; i++ {
 		var n int
-		bl.Txs[i], n = NewTx(bl.Raw[offs:])
-		if bl.Txs[i] == nil || n==0 {
-			e = errors.New("NewTx failed")
+		bl.Txs[i], n, e = NewTx(bl.Raw[offs:])
+		if e != nil {
+			e = fmt.Errorf("Tx %d: %w - RPC_Result:bad-blk-length", i, e)
 			break
 		}
 		bl.Txs[i].Size = uint32(n)
@@ -103,14 +115,22 @@ func (bl *Block) BuildTxList() (e error) {
 		offs += n
 	}
 
-	for i := range bl.Txs[0].TxOut {
-		bl.Txs[0].TxOut[i].WasCoinbase = true
-	}
-
 	// Wait for all the pending missions to complete...
 	for i:=0; i<sys.UseThreads; i++ {
 		_ = <- done
 	}
+
+	if e != nil {
+		return
+	}
+	if offs != len(bl.Raw) {
+		e = fmt.Errorf("Block's transactions: %w - RPC_Result:bad-blk-length", ErrTrailingData)
+		return
+	}
+
+	for i := range bl.Txs[0].TxOut {
+		bl.Txs[0].TxOut[i].WasCoinbase = true
+	}
 	return
 }
 
@@ -118,6 +138,9 @@ func (bl *Block) BuildTxList() (e error) {
 func (bl *Block) ComputeMerkel() (res []byte, mutated bool) {
 	tx_cnt, offs := VLen(bl.Raw[80:])
 	offs += 80
+	if tx_cnt > (len(bl.Raw)-offs)/10 {
+		return // broken block - no merkle root
+	}
 
 	mtr := make([][]byte, tx_cnt)
 
@@ -0,0 +1,279 @@
+package btc
+
+import (
+	"math"
+	"bytes"
+	"errors"
+	"encoding/binary"
+)
+
+// Bloom filters for SPV clients (BIP37)
+
+const (
+	MAX_BLOOM_FILTER_SIZE = 36000 // bytes
+	MAX_BLOOM_HASH_FUNCS = 50
+
+	BLOOM_UPDATE_NONE = 0
+	BLOOM_UPDATE_ALL = 1
+	BLOOM_UPDATE_P2PUBKEY_ONLY = 2
+	BLOOM_UPDATE_MASK = 3
+)
+
+type BloomFilter struct {
+	Data []byte
+	HashFuncs uint32
+	Tweak uint32
+	Flags byte
+}
+
+
+// Creates an empty filter for the given number of elements and false positive rate
+func NewBloomFilter(elements int, fprate float64, tweak uint32, flags byte) (bf *BloomFilter) {
+	size := int(-1 / (math.Ln2*math.Ln2) * float64(elements) * math.Log(fprate) / 8)
+	if size > MAX_BLOOM_FILTER_SIZE {
+		size = MAX_BLOOM_FILTER_SIZE
+	}
+	if size < 1 {
+		size = 1
+	}
+	funcs := uint32(float64(size*8) / float64(elements) * math.Ln2)
+	if funcs > MAX_BLOOM_HASH_FUNCS {
+		funcs = MAX_BLOOM_HASH_FUNCS
+	}
+	bf = &BloomFilter{Data:make([]byte, size), HashFuncs:funcs, Tweak:tweak, Flags:flags}
+	return
+}
+
+
+// Parses the payload of "filterload" message
+func NewBloomFilterFromMsg(pl []byte) (bf *BloomFilter, e error) {
+	b := bytes.NewReader(pl)
+	le, e := ReadVLen(b)
+	if e != nil {
+		return
+	}
+	if le > MAX_BLOOM_FILTER_SIZE || int(le)+9 != b.Len() {
+		e = errors.New("filterload: bad filter size")
+		return
+	}
+	bf = new(BloomFilter)
+	bf.Data = make([]byte, le)
+	b.Read(bf.Data)
+	binary.Read(b, binary.LittleEndian, &bf.HashFuncs)
+	binary.Read(b, binary.LittleEndian, &bf.Tweak)
+	bf.Flags, _ = b.ReadByte()
+	if bf.HashFuncs > MAX_BLOOM_HASH_FUNCS {
+		e = errors.New("filterload: too many hash functions")
+		bf = nil
+	}
+	return
+}
+
+
+// Returns the filter serialized as in "filterload" message
+func (bf *BloomFilter) Bytes() []byte {
+	b := new(bytes.Buffer)
+	WriteVlen(b, uint64(len(bf.Data)))
+	b.Write(bf.Data)
+	binary.Write(b, binary.LittleEndian, bf.HashFuncs)
+	binary.Write(b, binary.LittleEndian, bf.Tweak)
+	b.WriteByte(bf.Flags)
+	return b.Bytes()
+}
+
+
+func MurmurHash3(seed uint32, data []byte) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+	h1 := seed
+	nblocks := len(data) / 4
+	for i:=0; i<nblocks; i++ {
+		k1 := binary.LittleEndian.Uint32(data[i*4:])
+		k1 *= c1
+		k1 = (k1 << 15) | (k1 >> 17)
+		k1 *= c2
+		h1 ^= k1
+		h1 = (h1 << 13) | (h1 >> 19)
+		h1 = h1*5 + 0xe6546b64
+	}
+
+	tail := data[nblocks*4:]
+	var k1 uint32
+	switch len(tail) {
+		case 3:
+			k1 ^= uint32(tail[2]) << 16
+			fallthrough
+		case 2:
+			k1 ^= uint32(tail[1]) << 8
+			fallthrough
+		case 1:
+			k1 ^= uint32(tail[0])
+			k1 *= c1
+			k1 = (k1 << 15) | (k1 >> 17)
+			k1 *= c2
+			h1 ^= k1
+	}
+
+	h1 ^= uint32(len(data))
+	h1 ^= h1 >> 16
+	h1 *= 0x85ebca6b
+	h1 ^= h1 >> 13
+	h1 *= 0xc2b2ae35
+	h1 ^= h1 >> 16
+	return h1
+}
+
+
+func (bf *BloomFilter) bitIdx(n uint32, data []byte) uint32 {
+	return MurmurHash3(n*0xfba4c795+bf.Tweak, data) % uint32(len(bf.Data)*8)
+}
+
+
+func (bf *BloomFilter) Add(data []byte) {
+	if len(bf.Data)==0 {
+		return
+	}
+	for i:=uint32(0); i<bf.HashFuncs; i++ {
+		idx := bf.bitIdx(i, data)
+		bf.Data[idx>>3] |= 1 << (idx&7)
+	}
+}
+
+
+func (bf *BloomFilter) Contains(data []byte) bool {
+	if len(bf.Data)==0 {
+		return false
+	}
+	for i:=uint32(0); i<bf.HashFuncs; i++ {
+		idx := bf.bitIdx(i, data)
+		if (bf.Data[idx>>3] & (1 << (idx&7))) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+
+func (po *TxPrevOut) Bytes() []byte {
+	var b [36]byte
+	copy(b[:32], po.Hash[:])
+	binary.LittleEndian.PutUint32(b[32:36], po.Vout)
+	return b[:]
+}
+
+
+// Returns true if the tx matches the filter.
+// Depending on the filter's flags, it may also add the matching outputs to it.
+func (bf *BloomFilter) MatchTx(tx *Tx) (match bool) {
+	if bf.Contains(tx.Hash.Hash[:]) {
+		match = true
+	}
+
+	for i, out := range tx.TxOut {
+		scr := out.Pk_script
+		for pc := 0; pc < len(scr); {
+			_, data, le, e := GetOpcode(scr[pc:])
+			if e != nil {
+				break
+			}
+			pc += le
+			if len(data)>0 && bf.Contains(data) {
+				match = true
+				upd := bf.Flags & BLOOM_UPDATE_MASK
+				if upd==BLOOM_UPDATE_ALL || upd==BLOOM_UPDATE_P2PUBKEY_ONLY && isPubkeyOrMultisig(scr) {
+					bf.Add((&TxPrevOut{Hash:tx.Hash.Hash, Vout:uint32(i)}).Bytes())
+				}
+				break
+			}
+		}
+	}
+
+	if match {
+		return
+	}
+
+	for _, in := range tx.TxIn {
+		if bf.Contains(in.Input.Bytes()) {
+			return true
+		}
+		scr := in.ScriptSig
+		for pc := 0; pc < len(scr); {
+			_, data, le, e := GetOpcode(scr[pc:])
+			if e != nil {
+				break
+			}
+			pc += le
+			if len(data)>0 && bf.Contains(data) {
+				return true
+			}
+		}
+	}
+	return
+}
+
+
+// Returns true for P2PK and bare multisig output scripts
+func isPubkeyOrMultisig(scr []byte) bool {
+	if (len(scr)==35 && scr[0]==33 || len(scr)==67 && scr[0]==65) && scr[len(scr)-1]==0xac/*OP_CHECKSIG*/ {
+		return true
+	}
+	return len(scr)>=3 && scr[0]>=OP_1 && scr[0]<=OP_16 && scr[len(scr)-2]>=OP_1 && scr[len(scr)-2]<=OP_16 &&
+		scr[len(scr)-1]==OP_CHECKMULTISIG
+}
+
+
+// Builds the partial merkle tree (BIP37) of the given tx hashes, including the ones that are matched.
+// Returns the hashes and the flag bits (packed) to be put into "merkleblock" message.
+func PartialMerkleTree(txids [][]byte, matches []bool) (hashes [][]byte, flags []byte) {
+	var bits []bool
+	var height uint
+	for treeWidth(len(txids), height) > 1 {
+		height++
+	}
+	pmtBuild(txids, matches, height, 0, &hashes, &bits)
+	flags = make([]byte, (len(bits)+7)/8)
+	for i := range bits {
+		if bits[i] {
+			flags[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return
+}
+
+
+func treeWidth(cnt int, height uint) int {
+	return (cnt + (1 << height) - 1) >> height
+}
+
+
+func pmtHash(txids [][]byte, height uint, pos int) []byte {
+	if height==0 {
+		return txids[pos]
+	}
+	left := pmtHash(txids, height-1, pos*2)
+	right := left
+	if pos*2+1 < treeWidth(len(txids), height-1) {
+		right = pmtHash(txids, height-1, pos*2+1)
+	}
+	res := Sha2Sum(append(append([]byte{}, left...), right...))
+	return res[:]
+}
+
+
+func pmtBuild(txids [][]byte, matches []bool, height uint, pos int, hashes *[][]byte, bits *[]bool) {
+	var parent_of_match bool
+	for p := pos << height; p < (pos+1) << height && p < len(txids); p++ {
+		if matches[p] {
+			parent_of_match = true
+			break
+		}
+	}
+	*bits = append(*bits, parent_of_match)
+	if height==0 || !parent_of_match {
+		*hashes = append(*hashes, pmtHash(txids, height, pos))
+		return
+	}
+	pmtBuild(txids, matches, height-1, pos*2, hashes, bits)
+	if pos*2+1 < treeWidth(len(txids), height-1) {
+		pmtBuild(txids, matches, height-1, pos*2+1, hashes, bits)
+	}
+}
@@ -0,0 +1,136 @@
+package btc
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+)
+
+func TestMurmurHash3(t *testing.T) {
+	var tv = []struct {
+		seed uint32
+		data string
+		res uint32
+	} {
+		{0x00000000, "", 0x00000000},
+		{0xFBA4C795, "", 0x6a396f08},
+		{0xffffffff, "", 0x81f16f39},
+		{0x00000000, "00", 0x514E28B7},
+		{0xFBA4C795, "00", 0xEA3F0B17},
+		{0x00000000, "ff", 0xFD6CF10D},
+		{0x00000000, "0011", 0x16C6B7AB},
+		{0x00000000, "001122", 0x8EB51C3D},
+		{0x00000000, "00112233", 0xB4471BF8},
+		{0x00000000, "0011223344", 0xE2301FA8},
+		{0x00000000, "001122334455", 0xFC2E4A15},
+		{0x00000000, "00112233445566", 0xB074502C},
+		{0x00000000, "0011223344556677", 0x8034D2A0},
+		{0x00000000, "001122334455667788", 0xB4698DEF},
+	}
+	for i := range tv {
+		d, _ := hex.DecodeString(tv[i].data)
+		if res := MurmurHash3(tv[i].seed, d); res != tv[i].res {
+			t.Error(i, "MurmurHash3 mismatch", res, tv[i].res)
+		}
+	}
+}
+
+
+func TestBloomFilter(t *testing.T) {
+	bf := NewBloomFilter(3, 0.01, 0, BLOOM_UPDATE_ALL)
+
+	d, _ := hex.DecodeString("99108ad8ed9bb6274d3980bab5a85c048f0950c8")
+	bf.Add(d)
+	if !bf.Contains(d) {
+		t.Error("Does not contain the first element")
+	}
+	d, _ = hex.DecodeString("19108ad8ed9bb6274d3980bab5a85c048f0950c8")
+	if bf.Contains(d) {
+		t.Error("Contains an element that has not been added")
+	}
+	d, _ = hex.DecodeString("b5a2c786d9ef4658287ced5914b37a1b4aa32eee")
+	bf.Add(d)
+	if !bf.Contains(d) {
+		t.Error("Does not contain the second element")
+	}
+	d, _ = hex.DecodeString("b9300670b4c5366e95b2699e8b18bc75e5f729c5")
+	bf.Add(d)
+	if !bf.Contains(d) {
+		t.Error("Does not contain the third element")
+	}
+
+	exp, _ := hex.DecodeString("03614e9b050000000000000001")
+	if !bytes.Equal(bf.Bytes(), exp) {
+		t.Error("Serialized filter mismatch", hex.EncodeToString(bf.Bytes()))
+	}
+
+	bf2, er := NewBloomFilterFromMsg(exp)
+	if er != nil || !bytes.Equal(bf2.Bytes(), exp) {
+		t.Error("NewBloomFilterFromMsg failed", er)
+	}
+}
+
+
+// Extracts the matched hashes and calculates the merkle root from the partial merkle tree
+func pmtExtract(cnt int, hashes [][]byte, flags []byte, height uint, pos int, bitpos, hashpos *int, matched *[][]byte) []byte {
+	bit := (flags[*bitpos/8] >> uint(*bitpos%8)) & 1
+	(*bitpos)++
+	if height==0 || bit==0 {
+		h := hashes[*hashpos]
+		(*hashpos)++
+		if height==0 && bit==1 {
+			*matched = append(*matched, h)
+		}
+		return h
+	}
+	left := pmtExtract(cnt, hashes, flags, height-1, pos*2, bitpos, hashpos, matched)
+	right := left
+	if pos*2+1 < treeWidth(cnt, height-1) {
+		right = pmtExtract(cnt, hashes, flags, height-1, pos*2+1, bitpos, hashpos, matched)
+	}
+	res := Sha2Sum(append(append([]byte{}, left...), right...))
+	return res[:]
+}
+
+
+func TestPartialMerkleTree(t *testing.T) {
+	for cnt:=1; cnt<=17; cnt++ {
+		txids := make([][]byte, cnt)
+		for i := range txids {
+			h := Sha2Sum([]byte{byte(i)})
+			txids[i] = h[:]
+		}
+		root, _ := CalcMerkel(append([][]byte{}, txids...))
+		for m:=0; m<cnt; m++ {
+			matches := make([]bool, cnt)
+			matches[m] = true
+			matches[(m*7)%cnt] = true
+			hashes, flags := PartialMerkleTree(txids, matches)
+
+			var height uint
+			for treeWidth(cnt, height) > 1 {
+				height++
+			}
+			var bitpos, hashpos int
+			var matched [][]byte
+			res := pmtExtract(cnt, hashes, flags, height, 0, &bitpos, &hashpos, &matched)
+			if !bytes.Equal(res, root) {
+				t.Error("Merkle root mismatch", cnt, m)
+			}
+			if hashpos != len(hashes) {
+				t.Error("Not all hashes used", cnt, m)
+			}
+			for _, h := range matched {
+				var ok bool
+				for i := range txids {
+					if matches[i] && bytes.Equal(txids[i], h) {
+						ok = true
+					}
+				}
+				if !ok {
+					t.Error("Unexpected tx matched", cnt, m)
+				}
+			}
+		}
+	}
+}
@@ -13,6 +13,25 @@ import (
 	"crypto/sha256"
 )
 
+// Errors returned by the parsers of the raw data
+var (
+	ErrTruncated = errors.New("data truncated")
+	ErrNonCanonical = errors.New("non-canonical var_int")
+	ErrTooBig = errors.New("var_int value too big")
+	ErrTrailingData = errors.New("unexpected data at the end")
+)
+
+// IsParseError returns true if the error comes from malformed (e.g. truncated) data,
+// rather than from well-formed data that is invalid.
+func IsParseError(e error) bool {
+	return errors.Is(e, ErrTruncated) || errors.Is(e, ErrNonCanonical) ||
+		errors.Is(e, ErrTooBig) || errors.Is(e, ErrTrailingData)
+}
+
+// MaxVLen is the highest var_int value that the parsers accept as a length or a count (the protocol's max message size)
+const MaxVLen = 0x02000000
+
+
 func allzeros(b []byte) bool {
 	for i := range b {
 		if b[i]!=0 {
@@ -84,30 +103,58 @@ func VLenSize(uvl uint64) int {
 // Returns length and number of bytes that the var_int took
 // If there is not enough bytes in the buffer 0, 0 gets returned
 func VLen(b []byte) (le int, var_int_siz int) {
-	switch b[0] {
-		case 0xfd:
-			return int(binary.LittleEndian.Uint16(b[1:3])), 3
-		case 0xfe:
-			return int(binary.LittleEndian.Uint32(b[1:5])), 5
-		case 0xff:
-			return int(binary.LittleEndian.Uint64(b[1:9])), 9
-		default:
-			return int(b[0]), 1
+	v, n := VULe(b)
+	if v > MaxVLen {
+		return 0, 0
 	}
+	return int(v), n
 }
 
 
+// Returns value and number of bytes that the var_int took
+// If there is not enough bytes in the buffer 0, 0 gets returned
 func VULe(b []byte) (le uint64, var_int_siz int) {
+	if len(b)==0 {
+		return
+	}
 	switch b[0] {
 		case 0xfd:
-			return uint64(binary.LittleEndian.Uint16(b[1:3])), 3
+			if len(b)>=3 {
+				return uint64(binary.LittleEndian.Uint16(b[1:3])), 3
+			}
 		case 0xfe:
-			return uint64(binary.LittleEndian.Uint32(b[1:5])), 5
+			if len(b)>=5 {
+				return uint64(binary.LittleEndian.Uint32(b[1:5])), 5
+			}
 		case 0xff:
-			return binary.LittleEndian.Uint64(b[1:9]), 9
+			if len(b)>=9 {
+				return binary.LittleEndian.Uint64(b[1:9]), 9
+			}
 		default:
 			return uint64(b[0]), 1
 	}
+	return
+}
+
+
+// ParseVLen decodes var_int that is used as a length or a count of items.
+// Unlike VLen, it fails on non-canonical encoding and values above MaxVLen.
+func ParseVLen(b []byte) (le int, var_int_siz int, e error) {
+	var v uint64
+	if v, var_int_siz = VULe(b); var_int_siz == 0 {
+		e = ErrTruncated
+		return
+	}
+	if var_int_siz != VLenSize(v) {
+		e = ErrNonCanonical
+		return
+	}
+	if v > MaxVLen {
+		e = ErrTooBig
+		return
+	}
+	le = int(v)
+	return
 }
 
 
@@ -148,8 +195,18 @@ func GetMerkel(txs []*Tx) (res []byte, mutated bool) {
 }
 
 
-// Reads var_len from the given reader
+// Reads var_len from the given reader.
+// Like ParseVLen, it fails on non-canonical encoding and values above MaxVLen.
 func ReadVLen(b io.Reader) (res uint64, e error) {
+	if res, e = readVULe(b); e == nil && res > MaxVLen {
+		e = ErrTooBig
+	}
+	return
+}
+
+
+// Reads canonically encoded var_int of any value from the given reader
+func readVULe(b io.Reader) (res uint64, e error) {
 	var buf [8]byte;
 	var n int
 
@@ -183,6 +240,9 @@ func ReadVLen(b io.Reader) (res uint64, e error) {
 	for i:=0; i<c; i++ {
 		res |= (uint64(buf[i]) << uint64(8*i))
 	}
+	if VLenSize(res) != 1+c {
+		e = ErrNonCanonical
+	}
 	return
 }
 
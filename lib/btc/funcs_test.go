@@ -1,6 +1,9 @@
 package btc
 
 import (
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -59,3 +62,80 @@ func TestParseAmount(t *testing.T) {
 		}
 	}
 }
+
+func TestParseVLen(t *testing.T) {
+	var tv = []struct {
+		b []byte
+		le, n int
+		e error
+	} {
+		{[]byte{0xfc}, 0xfc, 1, nil},
+		{[]byte{0xfd, 0xfd, 0x00}, 0xfd, 3, nil},
+		{[]byte{0xfe, 0x00, 0x00, 0x00, 0x02}, MaxVLen, 5, nil},
+		{[]byte{}, 0, 0, ErrTruncated},
+		{[]byte{0xfd, 0xfd}, 0, 0, ErrTruncated},
+		{[]byte{0xfd, 0x10, 0x00}, 0, 0, ErrNonCanonical},
+		{[]byte{0xfe, 0xff, 0xff, 0x00, 0x00}, 0, 0, ErrNonCanonical},
+		{[]byte{0xff, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, 0, 0, ErrNonCanonical},
+		{[]byte{0xfe, 0x01, 0x00, 0x00, 0x02}, 0, 0, ErrTooBig},
+		{[]byte{0xff, 0, 0, 0, 0, 1, 0, 0, 0}, 0, 0, ErrTooBig},
+	}
+	for i := range tv {
+		le, n, e := ParseVLen(tv[i].b)
+		if e != tv[i].e || e == nil && (le != tv[i].le || n != tv[i].n) {
+			t.Error(i, "ParseVLen mismatch", le, n, e)
+		}
+		if tv[i].e == ErrTruncated {
+			continue
+		}
+		rle, e := ReadVLen(bytes.NewReader(tv[i].b))
+		if e != tv[i].e || e == nil && rle != uint64(tv[i].le) {
+			t.Error(i, "ReadVLen mismatch", rle, e)
+		}
+	}
+
+	// Services in addrv2 may use all 64 bits
+	if v, e := readVULe(bytes.NewReader([]byte{0xff, 0, 0, 0, 0, 1, 0, 0, 0})); e != nil || v != 1<<32 {
+		t.Error("readVULe failed", v, e)
+	}
+}
+
+func TestTxSizeNonCanonical(t *testing.T) {
+	// 1 input, 1 output, with the output count encoded as 0xfd0100
+	raw := make([]byte, 4, 100)
+	raw = append(raw, 1)
+	raw = append(raw, make([]byte, 36)...)
+	raw = append(raw, 0, 0, 0, 0, 0, 0xfd, 1, 0)
+	raw = append(raw, make([]byte, 8)...)
+	raw = append(raw, 0, 0, 0, 0, 0)
+	if _, _, e := NewTx(raw); !IsParseError(e) {
+		t.Error("NewTx accepted non-canonical var_int", e)
+	}
+	if TxSize(raw) != 0 {
+		t.Error("TxSize accepted non-canonical var_int")
+	}
+	raw[46] = 1 // canonical now
+	raw = append(raw[:47], raw[49:]...)
+	if tx, n, e := NewTx(raw); e != nil || n != len(raw) || TxSize(raw) != n || len(tx.TxOut) != 1 {
+		t.Error("Canonical tx rejected", n, e)
+	}
+}
+
+func TestBlockParseError(t *testing.T) {
+	raw := make([]byte, 80, 200)
+	raw = append(raw, 2)
+	raw = append(raw, make([]byte, 60)...)
+	bl, e := NewBlock(raw)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = bl.BuildTxList(); !IsParseError(e) || !strings.Contains(e.Error(), "RPC_Result:bad-blk-length") {
+		t.Error("Bad error from BuildTxList", e)
+	}
+	if _, e = NewBlock(append(raw[:80], 0xfd, 2, 0)); !IsParseError(e) {
+		t.Error("Bad error from NewBlock", e)
+	}
+	if IsParseError(errors.New("bad-txns-vin-empty")) {
+		t.Error("Not a parse error")
+	}
+}
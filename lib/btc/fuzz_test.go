@@ -0,0 +1,117 @@
+package btc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// A simple 1-in-1-out transaction
+const fuzzTxHex = "0100000001" +
+	"0000000000000000000000000000000000000000000000000000000000000000ffffffff" +
+	"0704ffff001d0104ffffffff" +
+	"0100f2052a01000000" +
+	"434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac" +
+	"00000000"
+
+
+func fuzzTx(f *testing.F) []byte {
+	raw, e := hex.DecodeString(fuzzTxHex)
+	if e != nil {
+		f.Fatal(e)
+	}
+	return raw
+}
+
+
+func FuzzParseVLen(f *testing.F) {
+	f.Add([]byte{0x00})
+	f.Add([]byte{0xfc})
+	f.Add([]byte{0xfd, 0xfd, 0x00})
+	f.Add([]byte{0xfd, 0x10, 0x00})
+	f.Add([]byte{0xfe, 0x00, 0x00, 0x01, 0x00})
+	f.Add([]byte{0xff, 0, 0, 0, 0, 1, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		le, n, e := ParseVLen(b)
+		rle, re := ReadVLen(bytes.NewReader(b))
+		if (e == nil) != (re == nil) || e == nil && rle != uint64(le) {
+			t.Fatalf("ReadVLen mismatch for %x: %v / %v", b, e, re)
+		}
+		if e != nil {
+			return
+		}
+		if n < 1 || n > len(b) || le < 0 || le > MaxVLen {
+			t.Fatalf("bad result %d/%d for %x", le, n, b)
+		}
+		buf := new(bytes.Buffer)
+		WriteVlen(buf, uint64(le))
+		if !bytes.Equal(b[:n], buf.Bytes()) {
+			t.Fatalf("%x is not canonical", b[:n])
+		}
+	})
+}
+
+
+func FuzzNewTxIn(f *testing.F) {
+	f.Add(fuzzTx(f)[5:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, n, e := NewTxIn(b)
+		if e != nil {
+			return
+		}
+		if n > len(b) || n != TxInSize(b) {
+			t.Fatalf("size mismatch %d / %d", n, TxInSize(b))
+		}
+	})
+}
+
+
+func FuzzNewTxOut(f *testing.F) {
+	raw := fuzzTx(f)
+	f.Add(raw[len(raw)-4-76:len(raw)-4])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, n, e := NewTxOut(b)
+		if e != nil {
+			return
+		}
+		if n > len(b) || n != TxOutSize(b) {
+			t.Fatalf("size mismatch %d / %d", n, TxOutSize(b))
+		}
+	})
+}
+
+
+func FuzzNewTx(f *testing.F) {
+	f.Add(fuzzTx(f))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tx, n, e := NewTx(b)
+		if e != nil {
+			return
+		}
+		if n > len(b) || n != TxSize(b) {
+			t.Fatalf("size mismatch %d / %d", n, TxSize(b))
+		}
+		if !bytes.Equal(tx.Serialize(), b[:n]) {
+			t.Fatalf("serialize mismatch for %x", b[:n])
+		}
+	})
+}
+
+
+func FuzzNewBlock(f *testing.F) {
+	hdr := make([]byte, 80)
+	f.Add(append(append(hdr, 0x01), fuzzTx(f)...))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		bl, e := NewBlock(b)
+		if e != nil {
+			return
+		}
+		if bl.BuildTxList() != nil {
+			return
+		}
+		if len(bl.Txs) != bl.TxCount {
+			t.Fatalf("got %d txs, expected %d", len(bl.Txs), bl.TxCount)
+		}
+		bl.ComputeMerkel()
+	})
+}
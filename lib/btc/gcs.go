@@ -0,0 +1,240 @@
+package btc
+
+import (
+	"sort"
+	"bytes"
+	"errors"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/others/siphash"
+)
+
+// Golomb-coded set filters for compact block filters (BIP158)
+
+const (
+	BASIC_FILTER = 0 // the only filter type defined by BIP158
+
+	GCS_P = 19
+	GCS_M = 784931
+)
+
+type GCSFilter struct {
+	N uint64 // number of items in the set
+	K0, K1 uint64 // siphash key (taken from the block hash)
+	Data []byte // golomb-rice coded deltas
+}
+
+
+func gcsKey(blhash []byte) (k0, k1 uint64) {
+	k0 = binary.LittleEndian.Uint64(blhash[0:8])
+	k1 = binary.LittleEndian.Uint64(blhash[8:16])
+	return
+}
+
+
+// Returns high 64 bits of a*b
+func mulHi64(a, b uint64) uint64 {
+	a_hi, a_lo := a>>32, a&0xffffffff
+	b_hi, b_lo := b>>32, b&0xffffffff
+	mid := a_hi*b_lo + (a_lo*b_lo)>>32
+	return a_hi*b_hi + mid>>32 + (a_lo*b_hi + mid&0xffffffff)>>32
+}
+
+
+func (f *GCSFilter) hashItem(item []byte) uint64 {
+	return mulHi64(siphash.Hash(f.K0, f.K1, item), f.N*GCS_M)
+}
+
+
+// Builds a filter of the given items. blhash is the block hash (as in Uint256.Hash)
+func NewGCSFilter(blhash []byte, items [][]byte) (f *GCSFilter) {
+	f = new(GCSFilter)
+	f.K0, f.K1 = gcsKey(blhash)
+	f.N = uint64(len(items))
+
+	vals := make([]uint64, len(items))
+	for i := range items {
+		vals[i] = f.hashItem(items[i])
+	}
+	sort.Sort(uint64Slice(vals))
+
+	var bw bitWriter
+	var last uint64
+	for _, v := range vals {
+		delta := v - last
+		last = v
+		for q := delta >> GCS_P; q > 0; q-- {
+			bw.writeBit(1)
+		}
+		bw.writeBit(0)
+		bw.writeBits(delta, GCS_P)
+	}
+	f.Data = bw.buf
+	return
+}
+
+
+// Decodes a filter as serialized in "cfilter" message
+func NewGCSFilterFromBytes(blhash []byte, raw []byte) (f *GCSFilter, e error) {
+	b := bytes.NewReader(raw)
+	n, e := ReadVLen(b)
+	if e != nil {
+		return
+	}
+	f = new(GCSFilter)
+	f.K0, f.K1 = gcsKey(blhash)
+	f.N = n
+	f.Data = raw[len(raw)-b.Len():]
+	if f.N > uint64(len(f.Data))*8 {
+		f, e = nil, errors.New("GCS filter too short")
+	}
+	return
+}
+
+
+// Returns the filter serialized as in "cfilter" message
+func (f *GCSFilter) Bytes() []byte {
+	b := new(bytes.Buffer)
+	WriteVlen(b, f.N)
+	b.Write(f.Data)
+	return b.Bytes()
+}
+
+
+// Returns true if any of the given items is (probably) in the set
+func (f *GCSFilter) MatchAny(items [][]byte) bool {
+	if f.N==0 || len(items)==0 {
+		return false
+	}
+	vals := make([]uint64, len(items))
+	for i := range items {
+		vals[i] = f.hashItem(items[i])
+	}
+	sort.Sort(uint64Slice(vals))
+
+	br := bitReader{buf:f.Data}
+	var val uint64
+	var idx int
+	for n := uint64(0); n < f.N; n++ {
+		var q uint64
+		for {
+			bit, ok := br.readBit()
+			if !ok {
+				return false
+			}
+			if bit==0 {
+				break
+			}
+			q++
+		}
+		r, ok := br.readBits(GCS_P)
+		if !ok {
+			return false
+		}
+		val += q<<GCS_P | r
+		for vals[idx] < val {
+			idx++
+			if idx==len(vals) {
+				return false
+			}
+		}
+		if vals[idx]==val {
+			return true
+		}
+	}
+	return false
+}
+
+
+func (f *GCSFilter) Match(item []byte) bool {
+	return f.MatchAny([][]byte{item})
+}
+
+
+// Returns the items of the basic filter for the block.
+// spent must contain pk_scripts of all the outputs spent by the block.
+func BasicFilterItems(bl *Block, spent [][]byte) (items [][]byte) {
+	uniq := make(map[string]bool)
+	add := func(scr []byte) {
+		if len(scr)==0 || uniq[string(scr)] {
+			return
+		}
+		uniq[string(scr)] = true
+		items = append(items, scr)
+	}
+	for _, tx := range bl.Txs {
+		for _, out := range tx.TxOut {
+			if len(out.Pk_script)>0 && out.Pk_script[0]==0x6a/*OP_RETURN*/ {
+				continue
+			}
+			add(out.Pk_script)
+		}
+	}
+	for _, scr := range spent {
+		add(scr)
+	}
+	return
+}
+
+
+// Returns the filter header for the given serialized filter and the previous header
+func FilterHeader(filter []byte, prev []byte) (res [32]byte) {
+	fh := Sha2Sum(filter)
+	res = Sha2Sum(append(fh[:], prev...))
+	return
+}
+
+
+type uint64Slice []uint64
+func (p uint64Slice) Len() int { return len(p) }
+func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint64Slice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+
+type bitWriter struct {
+	buf []byte
+	nbits uint
+}
+
+func (w *bitWriter) writeBit(bit byte) {
+	if w.nbits&7 == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	if bit!=0 {
+		w.buf[len(w.buf)-1] |= 0x80 >> (w.nbits&7)
+	}
+	w.nbits++
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		n--
+		w.writeBit(byte(v>>n) & 1)
+	}
+}
+
+
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+func (r *bitReader) readBit() (byte, bool) {
+	if r.pos>>3 >= uint(len(r.buf)) {
+		return 0, false
+	}
+	bit := (r.buf[r.pos>>3] >> (7 - r.pos&7)) & 1
+	r.pos++
+	return bit, true
+}
+
+func (r *bitReader) readBits(n uint) (v uint64, ok bool) {
+	var bit byte
+	for ; n > 0; n-- {
+		if bit, ok = r.readBit(); !ok {
+			return
+		}
+		v = v<<1 | uint64(bit)
+	}
+	ok = true
+	return
+}
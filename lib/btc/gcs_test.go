@@ -0,0 +1,67 @@
+package btc
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+)
+
+// Output script of the genesis block's coinbase (same on mainnet and testnet3)
+const genesisPkScr = "4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac"
+
+func TestGCSGenesis(t *testing.T) {
+	// BIP158 test vector for testnet3 block #0
+	blhash := NewUint256FromString("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
+	scr, _ := hex.DecodeString(genesisPkScr)
+	f := NewGCSFilter(blhash.Hash[:], [][]byte{scr})
+	if hex.EncodeToString(f.Bytes()) != "019dfca8" {
+		t.Error("Bad filter", hex.EncodeToString(f.Bytes()))
+	}
+	hdr := FilterHeader(f.Bytes(), make([]byte, 32))
+	if NewUint256(hdr[:]).String() != "21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750" {
+		t.Error("Bad filter header", NewUint256(hdr[:]).String())
+	}
+	if !f.Match(scr) {
+		t.Error("Match failed")
+	}
+}
+
+
+func TestGCSMatch(t *testing.T) {
+	var items [][]byte
+	for i := 0; i < 500; i++ {
+		items = append(items, []byte{byte(i), byte(i>>8), 0xab})
+	}
+	blhash := Sha2Sum([]byte("gcs"))
+	f := NewGCSFilter(blhash[:], items)
+
+	f2, e := NewGCSFilterFromBytes(blhash[:], f.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if f2.N != 500 || !bytes.Equal(f2.Data, f.Data) {
+		t.Error("Deserialize mismatch")
+	}
+	for i := range items {
+		if !f2.Match(items[i]) {
+			t.Error("Item", i, "not matched")
+		}
+	}
+	var fp int
+	for i := 0; i < 10000; i++ {
+		if f2.Match([]byte{byte(i), byte(i>>8), 0xcd}) {
+			fp++
+		}
+	}
+	if fp > 1 {
+		t.Error("Too many false positives", fp)
+	}
+	if !f2.MatchAny([][]byte{[]byte("none"), items[123]}) {
+		t.Error("MatchAny failed")
+	}
+
+	empty := NewGCSFilter(blhash[:], nil)
+	if !bytes.Equal(empty.Bytes(), []byte{0}) || empty.Match(items[0]) {
+		t.Error("Empty filter broken")
+	}
+}
@@ -1,8 +1,25 @@
 package btc
 
 import (
-	"fmt"
+	"io"
+	"net"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"encoding/base32"
 	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/others/sha3"
+)
+
+// Network IDs (BIP155)
+const (
+	NET_IPV4 = 1
+	NET_IPV6 = 2
+	NET_TORV3 = 4
+	NET_I2P = 5
+
+	MAX_ADDRV2_SIZE = 512
 )
 
 type NetAddr struct {
@@ -10,6 +27,8 @@ type NetAddr struct {
 	Ip6 [12]byte
 	Ip4 [4]byte
 	Port uint16
+	NetID byte // network ID of a non-IP address (zero for IPv4 and IPv6)
+	Addr []byte // the non-IP address (e.g. TorV3 public key)
 }
 
 func NewNetAddr(b []byte) (na *NetAddr) {
@@ -35,6 +54,233 @@ func (a *NetAddr) Bytes() (res []byte) {
 }
 
 
+// Returns true if it is an IPv4 address (either IPv4-mapped or with the IPv6 part zeroed)
+func (a *NetAddr) IsIPv4() bool {
+	if a.NetID!=0 {
+		return false
+	}
+	for i:=0; i<10; i++ {
+		if a.Ip6[i]!=0 {
+			return false
+		}
+	}
+	return a.Ip6[10]==0xff && a.Ip6[11]==0xff || a.Ip6[10]==0 && a.Ip6[11]==0
+}
+
+
+// Returns the address as 16 bytes (IPv4 addresses are always mapped as ::ffff:a.b.c.d)
+func (a *NetAddr) Ip16() (res [16]byte) {
+	if a.IsIPv4() {
+		res[10], res[11] = 0xff, 0xff
+	} else {
+		copy(res[:12], a.Ip6[:])
+	}
+	copy(res[12:], a.Ip4[:])
+	return
+}
+
+
+func (a *NetAddr) IP() net.IP {
+	ip := a.Ip16()
+	return net.IP(ip[:])
+}
+
+
+// Sets the address from either IPv4 or IPv6 net.IP
+func (a *NetAddr) SetIP(ip net.IP) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return
+	}
+	copy(a.Ip6[:], ip16[:12])
+	copy(a.Ip4[:], ip16[12:16])
+	a.NetID, a.Addr = 0, nil
+}
+
+
+// Sets the address from IPv4, IPv6, TorV3 ("xxx.onion") or I2P ("xxx.b32.i2p") host string
+func (a *NetAddr) SetHost(host string) (e error) {
+	if strings.HasSuffix(host, ".onion") {
+		var pk []byte
+		if pk, e = ParseTorV3(host); e == nil {
+			a.Ip6, a.Ip4 = [12]byte{}, [4]byte{}
+			a.NetID, a.Addr = NET_TORV3, pk
+		}
+		return
+	}
+	if strings.HasSuffix(host, ".b32.i2p") {
+		var h []byte
+		if h, e = ParseI2P(host); e == nil {
+			a.Ip6, a.Ip4 = [12]byte{}, [4]byte{}
+			a.NetID, a.Addr = NET_I2P, h
+		}
+		return
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return errors.New("Error parsing IP '"+host+"'")
+	}
+	a.SetIP(ip)
+	return
+}
+
+
+// Returns BIP155 network ID of the address
+func (a *NetAddr) Network() byte {
+	if a.NetID!=0 {
+		return a.NetID
+	}
+	if a.IsIPv4() {
+		return NET_IPV4
+	}
+	return NET_IPV6
+}
+
+
+// Returns true for the addresses that can be serialized in legacy "addr" message
+func (a *NetAddr) IsIP() bool {
+	return a.NetID==0
+}
+
+
+// Returns IP, onion or i2p address, without the port
+func (a *NetAddr) Host() string {
+	switch a.NetID {
+		case NET_TORV3: return TorV3String(a.Addr)
+		case NET_I2P: return I2PString(a.Addr)
+	}
+	return a.IP().String()
+}
+
+
+// Returns "a.b.c.d:port", "[ipv6]:port" or "xxx.onion:port"
 func (a *NetAddr) String() string {
-	return fmt.Sprintf("%d.%d.%d.%d:%d", a.Ip4[0], a.Ip4[1], a.Ip4[2], a.Ip4[3], a.Port)
+	return net.JoinHostPort(a.Host(), strconv.Itoa(int(a.Port)))
+}
+
+
+// Serializes the address as in "addrv2" message (without the time field)
+func (a *NetAddr) BytesV2() []byte {
+	b := new(bytes.Buffer)
+	WriteVlen(b, a.Services)
+	id := a.Network()
+	b.WriteByte(id)
+	switch id {
+		case NET_IPV4:
+			WriteVlen(b, 4)
+			b.Write(a.Ip4[:])
+		case NET_IPV6:
+			ip := a.Ip16()
+			WriteVlen(b, 16)
+			b.Write(ip[:])
+		default:
+			WriteVlen(b, uint64(len(a.Addr)))
+			b.Write(a.Addr)
+	}
+	binary.Write(b, binary.BigEndian, a.Port)
+	return b.Bytes()
+}
+
+
+// Reads an address as serialized in "addrv2" message (without the time field).
+// Addresses from unknown networks are returned with NetID and Addr set.
+func ReadNetAddrV2(rd io.Reader) (a *NetAddr, e error) {
+	var id [1]byte
+	var le uint64
+	a = new(NetAddr)
+	if a.Services, e = readVULe(rd); e != nil {
+		return
+	}
+	if _, e = io.ReadFull(rd, id[:]); e != nil {
+		return
+	}
+	if le, e = ReadVLen(rd); e != nil {
+		return
+	}
+	if le > MAX_ADDRV2_SIZE {
+		e = errors.New("addrv2: address too long")
+		return
+	}
+	addr := make([]byte, le)
+	if _, e = io.ReadFull(rd, addr); e != nil {
+		return
+	}
+	if e = binary.Read(rd, binary.BigEndian, &a.Port); e != nil {
+		return
+	}
+	switch id[0] {
+		case NET_IPV4:
+			if le != 4 {
+				e = errors.New("addrv2: bad IPv4 length")
+				return
+			}
+			a.SetIP(net.IP(addr))
+		case NET_IPV6:
+			if le != 16 {
+				e = errors.New("addrv2: bad IPv6 length")
+				return
+			}
+			a.SetIP(net.IP(addr))
+		case NET_TORV3, NET_I2P:
+			if le != 32 {
+				e = errors.New("addrv2: bad TorV3/I2P length")
+				return
+			}
+			fallthrough
+		default:
+			a.NetID, a.Addr = id[0], addr
+	}
+	return
+}
+
+
+func torV3Checksum(pubkey []byte) [32]byte {
+	return sha3.Sum256(append(append([]byte(".onion checksum"), pubkey...), 3))
+}
+
+
+// Returns "<base32>.onion" of the given TorV3 public key
+func TorV3String(pubkey []byte) string {
+	var b [35]byte
+	copy(b[:32], pubkey)
+	ck := torV3Checksum(pubkey)
+	b[32], b[33], b[34] = ck[0], ck[1], 3
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b[:])) + ".onion"
+}
+
+
+// Decodes "<base32>.onion" into TorV3 public key
+func ParseTorV3(s string) (pubkey []byte, e error) {
+	b, e := base32.StdEncoding.DecodeString(strings.ToUpper(strings.TrimSuffix(s, ".onion")))
+	if e != nil {
+		return
+	}
+	if len(b)!=35 || b[34]!=3 {
+		e = errors.New("Not a TorV3 onion address")
+		return
+	}
+	if ck := torV3Checksum(b[:32]); ck[0]!=b[32] || ck[1]!=b[33] {
+		e = errors.New("Bad onion address checksum")
+		return
+	}
+	pubkey = b[:32]
+	return
+}
+
+
+// Returns "<base32>.b32.i2p" of the given I2P destination hash
+func I2PString(hash []byte) string {
+	return strings.ToLower(strings.TrimRight(base32.StdEncoding.EncodeToString(hash), "=")) + ".b32.i2p"
+}
+
+
+// Decodes "<base32>.b32.i2p" into I2P destination hash
+func ParseI2P(s string) (hash []byte, e error) {
+	b32 := strings.ToUpper(strings.TrimSuffix(s, ".b32.i2p"))
+	if len(b32) != 52 {
+		e = errors.New("Not an I2P address")
+		return
+	}
+	hash, e = base32.StdEncoding.DecodeString(b32 + "====")
+	return
 }
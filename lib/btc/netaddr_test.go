@@ -0,0 +1,82 @@
+package btc
+
+import (
+	"net"
+	"bytes"
+	"testing"
+)
+
+func TestNetAddr(t *testing.T) {
+	var tv = []struct {
+		ip string
+		port uint16
+		str string
+		v4 bool
+	} {
+		{"1.2.3.4", 8333, "1.2.3.4:8333", true},
+		{"2001:470:1f0b::1", 18333, "[2001:470:1f0b::1]:18333", false},
+		{"::ffff:10.0.0.1", 1, "10.0.0.1:1", true},
+	}
+	for i := range tv {
+		var a NetAddr
+		a.SetIP(net.ParseIP(tv[i].ip))
+		a.Port = tv[i].port
+		if a.String() != tv[i].str {
+			t.Error(i, "Bad string", a.String())
+		}
+		if a.IsIPv4() != tv[i].v4 {
+			t.Error(i, "Bad IsIPv4")
+		}
+		b := NewNetAddr(a.Bytes())
+		if b.Ip16() != a.Ip16() || b.Port != a.Port {
+			t.Error(i, "Serialize mismatch")
+		}
+	}
+
+	// old records may have IPv4 stored with the IPv6 part zeroed
+	var a NetAddr
+	copy(a.Ip4[:], []byte{5, 6, 7, 8})
+	if !a.IsIPv4() || a.IP().String() != "5.6.7.8" {
+		t.Error("Zero-prefixed IPv4 not handled", a.IP().String())
+	}
+}
+
+
+func TestTorV3(t *testing.T) {
+	const onion = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion"
+	var a NetAddr
+	if e := a.SetHost(onion); e != nil {
+		t.Fatal(e.Error())
+	}
+	if a.Network() != NET_TORV3 || a.IsIPv4() || a.IsIP() {
+		t.Error("Bad network")
+	}
+	a.Port = 8333
+	if a.String() != onion+":8333" {
+		t.Error("Bad string", a.String())
+	}
+	b, e := ReadNetAddrV2(bytes.NewReader(a.BytesV2()))
+	if e != nil || b.NetID != NET_TORV3 || !bytes.Equal(b.Addr, a.Addr) || b.Port != 8333 {
+		t.Error("addrv2 round trip failed", e)
+	}
+
+	if _, e := ParseTorV3("pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscrya.onion"); e == nil {
+		t.Error("Bad checksum not detected")
+	}
+}
+
+
+func TestI2P(t *testing.T) {
+	const i2p = "ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p"
+	var a NetAddr
+	if e := a.SetHost(i2p); e != nil {
+		t.Fatal(e.Error())
+	}
+	if a.Network() != NET_I2P || len(a.Addr) != 32 || a.Host() != i2p {
+		t.Error("Bad I2P address", a.Host())
+	}
+	b, e := ReadNetAddrV2(bytes.NewReader(a.BytesV2()))
+	if e != nil || b.NetID != NET_I2P || !bytes.Equal(b.Addr, a.Addr) {
+		t.Error("addrv2 round trip failed", e)
+	}
+}
@@ -330,20 +330,25 @@ func (tx *Tx) IsFinal(blockheight, timestamp uint32) bool {
 
 // Decode a raw transaction output from a given bytes slice.
 // Returns the output and the size it took in the buffer.
-func NewTxOut(b []byte) (txout *TxOut, offs int) {
+func NewTxOut(b []byte) (txout *TxOut, offs int, e error) {
 	var le, n int
 
+	if len(b) < 9 {
+		e = ErrTruncated
+		return
+	}
 	txout = new(TxOut)
-
 	txout.Value = binary.LittleEndian.Uint64(b[0:8])
 	offs = 8
 
-	le, n = VLen(b[offs:])
-	if n==0 {
-		return nil, 0
+	if le, n, e = ParseVLen(b[offs:]); e != nil {
+		return nil, 0, fmt.Errorf("pk_script length: %w", e)
 	}
-	offs+= n
+	offs += n
 
+	if len(b) < offs+le {
+		return nil, 0, fmt.Errorf("pk_script: %w", ErrTruncated)
+	}
 	txout.Pk_script = make([]byte, le)
 	copy(txout.Pk_script[:], b[offs:offs+le])
 	offs += le
@@ -354,24 +359,29 @@ func NewTxOut(b []byte) (txout *TxOut, offs int) {
 
 // Decode a raw transaction input from a given bytes slice.
 // Returns the input and the size it took in the buffer.
-func NewTxIn(b []byte) (txin *TxIn, offs int) {
+func NewTxIn(b []byte) (txin *TxIn, offs int, e error) {
 	var le, n int
 
+	if len(b) < 41 {
+		e = ErrTruncated
+		return
+	}
 	txin = new(TxIn)
-
 	copy(txin.Input.Hash[:], b[0:32])
 	txin.Input.Vout = binary.LittleEndian.Uint32(b[32:36])
 	offs = 36
 
-	le, n = VLen(b[offs:])
-	if n==0 {
-		return nil, 0
+	if le, n, e = ParseVLen(b[offs:]); e != nil {
+		return nil, 0, fmt.Errorf("sig_script length: %w", e)
 	}
-	offs+= n
+	offs += n
 
+	if len(b) < offs+le+4 {
+		return nil, 0, fmt.Errorf("sig_script: %w", ErrTruncated)
+	}
 	txin.ScriptSig = make([]byte, le)
 	copy(txin.ScriptSig[:], b[offs:offs+le])
-	offs+= le
+	offs += le
 
 	// Sequence
 	txin.Sequence = binary.LittleEndian.Uint32(b[offs:offs+4])
@@ -384,46 +394,52 @@ func NewTxIn(b []byte) (txin *TxIn, offs int) {
 // Decode a raw transaction from a given bytes slice.
 // Returns the transaction and the size it took in the buffer.
 // WARNING: This function does not set Tx.Hash neither Tx.Size
-func NewTx(b []byte) (tx *Tx, offs int) {
-	defer func() { // In case if the buffer was too short, to recover from a panic
-		if r := recover(); r != nil {
-			println("NewTx failed")
-			tx = nil
-			offs = 0
-		}
-	}()
-
+func NewTx(b []byte) (tx *Tx, offs int, e error) {
 	var le, n int
 
+	if len(b) < 10 {
+		e = ErrTruncated
+		return
+	}
 	tx = new(Tx)
-
 	tx.Version = binary.LittleEndian.Uint32(b[0:4])
 	offs = 4
 
 	// TxIn
-	le, n = VLen(b[offs:])
-	if n==0 {
-		return nil, 0
+	if le, n, e = ParseVLen(b[offs:]); e != nil {
+		return nil, 0, fmt.Errorf("NewTx: txin count: %w", e)
 	}
 	offs += n
+	if le > (len(b)-offs)/41 {
+		return nil, 0, fmt.Errorf("NewTx: %d inputs: %w", le, ErrTruncated)
+	}
 	tx.TxIn = make([]*TxIn, le)
 	for i := range tx.TxIn {
-		tx.TxIn[i], n = NewTxIn(b[offs:])
+		if tx.TxIn[i], n, e = NewTxIn(b[offs:]); e != nil {
+			return nil, 0, fmt.Errorf("NewTx: txin %d: %w", i, e)
+		}
 		offs += n
 	}
 
 	// TxOut
-	le, n = VLen(b[offs:])
-	if n==0 {
-		return nil, 0
+	if le, n, e = ParseVLen(b[offs:]); e != nil {
+		return nil, 0, fmt.Errorf("NewTx: txout count: %w", e)
 	}
 	offs += n
+	if le > (len(b)-offs)/9 {
+		return nil, 0, fmt.Errorf("NewTx: %d outputs: %w", le, ErrTruncated)
+	}
 	tx.TxOut = make([]*TxOut, le)
 	for i := range tx.TxOut {
-		tx.TxOut[i], n = NewTxOut(b[offs:])
+		if tx.TxOut[i], n, e = NewTxOut(b[offs:]); e != nil {
+			return nil, 0, fmt.Errorf("NewTx: txout %d: %w", i, e)
+		}
 		offs += n
 	}
 
+	if len(b) < offs+4 {
+		return nil, 0, fmt.Errorf("NewTx: lock_time: %w", ErrTruncated)
+	}
 	tx.Lock_time = binary.LittleEndian.Uint32(b[offs:offs+4])
 	offs += 4
 
@@ -431,58 +447,71 @@ func NewTx(b []byte) (tx *Tx, offs int) {
 }
 
 
+// Returns size of the raw tx input or 0 if the data is broken
 func TxInSize(b []byte) int {
-	le, n := VLen(b[36:])
-	if n==0 {
+	if len(b) < 41 {
+		return 0
+	}
+	le, n, e := ParseVLen(b[36:])
+	if e != nil || len(b) < 36+n+le+4 {
 		return 0
 	}
 	return 36+n+le+4
 }
 
 
+// Returns size of the raw tx output or 0 if the data is broken
 func TxOutSize(b []byte) int {
-	le, n := VLen(b[8:])
-	if n==0 {
+	if len(b) < 9 {
+		return 0
+	}
+	le, n, e := ParseVLen(b[8:])
+	if e != nil || len(b) < 8+n+le {
 		return 0
 	}
 	return 8+n+le
 }
 
 
+// Returns size of the raw tx or 0 if the data is broken
 func TxSize(b []byte) (offs int) {
-	defer func() { // In case if the buffer was too short, to recover from a panic
-		if r := recover(); r != nil {
-			println("NewSize failed")
-			offs = 0
-		}
-	}()
-
 	var le, n int
+	var e error
 
+	if len(b) < 10 {
+		return 0
+	}
 	offs = 4 // version
 
 	// TxIn
-	le, n = VLen(b[offs:])  // in_cnt
-	if n==0 {
+	le, n, e = ParseVLen(b[offs:])  // in_cnt
+	if e != nil {
 		return 0
 	}
 	offs += n
 	for ; le>0; le-- {
-		n = TxInSize(b[offs:])
+		if n = TxInSize(b[offs:]); n==0 {
+			return 0
+		}
 		offs += n
 	}
 
 	// TxOut
-	le, n = VLen(b[offs:])
-	if n==0 {
+	le, n, e = ParseVLen(b[offs:])
+	if e != nil {
 		return 0
 	}
 	offs += n
 	for ; le>0; le-- {
-		n = TxOutSize(b[offs:])
+		if n = TxOutSize(b[offs:]); n==0 {
+			return 0
+		}
 		offs += n
 	}
 
+	if len(b) < offs+4 {
+		return 0
+	}
 	offs += 4  // Lock_time
 
 	return
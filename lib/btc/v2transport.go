@@ -0,0 +1,369 @@
+package btc
+
+import (
+	"io"
+	"bytes"
+	"errors"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+	"github.com/piotrnar/gocoin/lib/others/chacha20"
+)
+
+// Encrypted P2P transport protocol v2 (BIP324)
+
+const (
+	V2_PUBKEY_LEN = 64
+	V2_GARBAGE_TERMINATOR_LEN = 16
+	V2_MAX_GARBAGE_LEN = 4095
+	V2_LENGTH_LEN = 3
+	V2_HEADER_LEN = 1
+	V2_OVERHEAD = V2_LENGTH_LEN + V2_HEADER_LEN + chacha20.TagSize // on top of the packet's contents
+	V2_IGNORE_BIT = 0x80
+	V2_MAX_HANDSHAKE_PACKET = 1<<20 // we do not accept bigger packets (version or decoys) during the handshake
+
+	v2_rekey_interval = 224
+)
+
+// Message types that have one byte IDs (index in the table)
+var V2ShortIDs = []string{"",
+	"addr", "block", "blocktxn", "cmpctblock", "feefilter", "filteradd", "filterclear",
+	"filterload", "getblocks", "getblocktxn", "getdata", "getheaders", "headers", "inv",
+	"mempool", "merkleblock", "notfound", "ping", "pong", "sendcmpct", "tx", "getcfilters",
+	"cfilter", "getcfheaders", "cfheaders", "getcfcheckpt", "cfcheckpt", "addrv2"}
+
+var v2_short_id map[string]byte
+
+
+// ChaCha20 with rekeying every v2_rekey_interval chunks - encrypts the length fields
+type fsChaCha20 struct {
+	key [32]byte
+	chunk_counter uint32
+	rekey_counter uint64
+	block_counter uint32
+	ks [chacha20.BlockSize]byte
+	ks_pos int
+}
+
+func (f *fsChaCha20) init(key []byte) {
+	copy(f.key[:], key)
+	f.ks_pos = len(f.ks)
+}
+
+func (f *fsChaCha20) keystream(out []byte) {
+	var nonce [chacha20.NonceSize]byte
+	for i := range out {
+		if f.ks_pos == len(f.ks) {
+			binary.LittleEndian.PutUint64(nonce[4:], f.rekey_counter)
+			chacha20.Block(f.key[:], nonce[:], f.block_counter, &f.ks)
+			f.block_counter++
+			f.ks_pos = 0
+		}
+		out[i] = f.ks[f.ks_pos]
+		f.ks_pos++
+	}
+}
+
+func (f *fsChaCha20) crypt(d []byte) {
+	ks := make([]byte, len(d))
+	f.keystream(ks)
+	for i := range d {
+		d[i] ^= ks[i]
+	}
+	if f.chunk_counter++; f.chunk_counter == v2_rekey_interval {
+		f.keystream(f.key[:])
+		f.chunk_counter = 0
+		f.rekey_counter++
+		f.block_counter = 0
+		f.ks_pos = len(f.ks)
+	}
+}
+
+
+// ChaCha20-Poly1305 with rekeying every v2_rekey_interval packets - encrypts the packets
+type fsAEAD struct {
+	key [32]byte
+	packet_counter uint32
+	rekey_counter uint64
+}
+
+func (f *fsAEAD) nonce() []byte {
+	var nonce [chacha20.NonceSize]byte
+	binary.LittleEndian.PutUint32(nonce[0:], f.packet_counter)
+	binary.LittleEndian.PutUint64(nonce[4:], f.rekey_counter)
+	return nonce[:]
+}
+
+func (f *fsAEAD) next() {
+	if f.packet_counter++; f.packet_counter == v2_rekey_interval {
+		var nonce [chacha20.NonceSize]byte
+		binary.LittleEndian.PutUint32(nonce[0:], 0xffffffff)
+		binary.LittleEndian.PutUint64(nonce[4:], f.rekey_counter)
+		var zero [32]byte
+		chacha20.XORKeyStream(f.key[:], zero[:], f.key[:], nonce[:], 1)
+		f.packet_counter = 0
+		f.rekey_counter++
+	}
+}
+
+func (f *fsAEAD) seal(aad, plain []byte) (res []byte) {
+	res = chacha20.Seal(f.key[:], f.nonce(), aad, plain)
+	f.next()
+	return
+}
+
+func (f *fsAEAD) open(aad, ct []byte) (res []byte) {
+	res = chacha20.Open(f.key[:], f.nonce(), aad, ct)
+	f.next()
+	return
+}
+
+
+// V2Cipher keeps the state of one v2 connection
+type V2Cipher struct {
+	priv [32]byte
+	OurPubkey []byte // ElligatorSwift encoded, to be sent to the peer at the beginning
+	SessionID [32]byte
+	SendTerminator, RecvTerminator [V2_GARBAGE_TERMINATOR_LEN]byte
+
+	send_l, recv_l fsChaCha20
+	send_p, recv_p fsAEAD
+}
+
+
+// NewV2Cipher generates a new ephemeral key
+func NewV2Cipher() (c *V2Cipher) {
+	c = new(V2Cipher)
+	for {
+		rand.Read(c.priv[:])
+		if v2ValidKey(c.priv[:]) {
+			break
+		}
+	}
+	c.OurPubkey = secp256k1.EllSwiftCreate(c.priv[:])
+	return
+}
+
+
+// Returns true if 0 < k < N, without branching on the key's bytes
+func v2ValidKey(k []byte) bool {
+	var borrow, nonzero uint32
+	n := secp256k1.TheCurve.Order.Bytes()
+	for i := 31; i >= 0; i-- {
+		d := uint32(k[i]) - uint32(n[i]) - borrow
+		borrow = d >> 31
+		nonzero |= uint32(k[i])
+	}
+	return borrow==1 && nonzero!=0
+}
+
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	th := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(th[:])
+	h.Write(th[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+
+// Initialize computes the shared secret and all the keys, after receiving the peer's public key.
+// magic is the network's message start.
+func (c *V2Cipher) Initialize(their_pubkey []byte, initiator bool, magic []byte) {
+	ecdh := secp256k1.EllSwiftXonlyECDH(their_pubkey, c.priv[:])
+	var secret []byte
+	if initiator {
+		secret = taggedHash("bip324_ellswift_xonly_ecdh", c.OurPubkey, their_pubkey, ecdh)
+	} else {
+		secret = taggedHash("bip324_ellswift_xonly_ecdh", their_pubkey, c.OurPubkey, ecdh)
+	}
+
+	// HKDF-SHA256
+	prk := hmacSha256(append([]byte("bitcoin_v2_shared_secret"), magic...), secret)
+	expand := func(info string) []byte {
+		return hmacSha256(prk, []byte(info), []byte{1})
+	}
+	initiator_l, initiator_p := expand("initiator_L"), expand("initiator_P")
+	responder_l, responder_p := expand("responder_L"), expand("responder_P")
+	terminators := expand("garbage_terminators")
+	copy(c.SessionID[:], expand("session_id"))
+
+	if initiator {
+		c.send_l.init(initiator_l)
+		copy(c.send_p.key[:], initiator_p)
+		c.recv_l.init(responder_l)
+		copy(c.recv_p.key[:], responder_p)
+		copy(c.SendTerminator[:], terminators[:16])
+		copy(c.RecvTerminator[:], terminators[16:])
+	} else {
+		c.send_l.init(responder_l)
+		copy(c.send_p.key[:], responder_p)
+		c.recv_l.init(initiator_l)
+		copy(c.recv_p.key[:], initiator_p)
+		copy(c.SendTerminator[:], terminators[16:])
+		copy(c.RecvTerminator[:], terminators[:16])
+	}
+}
+
+
+// Encrypt returns the packet with the given contents (aad is only used for the first packet after the garbage)
+func (c *V2Cipher) Encrypt(contents, aad []byte, ignore bool) (res []byte) {
+	res = make([]byte, V2_LENGTH_LEN, len(contents)+V2_OVERHEAD)
+	res[0], res[1], res[2] = byte(len(contents)), byte(len(contents)>>8), byte(len(contents)>>16)
+	c.send_l.crypt(res)
+	plain := make([]byte, V2_HEADER_LEN+len(contents))
+	if ignore {
+		plain[0] = V2_IGNORE_BIT
+	}
+	copy(plain[V2_HEADER_LEN:], contents)
+	res = append(res, c.send_p.seal(aad, plain)...)
+	return
+}
+
+
+// DecryptLength decrypts the first V2_LENGTH_LEN bytes of a packet and returns the number of bytes that follow.
+// It must be called exactly once for each received packet.
+func (c *V2Cipher) DecryptLength(enc []byte) int {
+	var l [V2_LENGTH_LEN]byte
+	copy(l[:], enc)
+	c.recv_l.crypt(l[:])
+	return (int(l[0]) | int(l[1])<<8 | int(l[2])<<16) + V2_HEADER_LEN + chacha20.TagSize
+}
+
+
+// Decrypt authenticates and decrypts the rest of the packet (after the length).
+// Returns ok=false if the authentication has failed.
+func (c *V2Cipher) Decrypt(enc, aad []byte) (contents []byte, ignore bool, ok bool) {
+	plain := c.recv_p.open(aad, enc)
+	if len(plain) < V2_HEADER_LEN {
+		return
+	}
+	return plain[V2_HEADER_LEN:], (plain[0]&V2_IGNORE_BIT)!=0, true
+}
+
+
+// V2Handshake performs the whole handshake over the connection (which should have a deadline set).
+// For the responder, their_pubkey is the initiator's key, which the caller has already read.
+// rcvd is set if we have received anything (if not, the peer probably only speaks v1).
+func V2Handshake(conn io.ReadWriter, magic []byte, initiator bool, their_pubkey []byte) (c *V2Cipher, rcvd bool, e error) {
+	var garbage [V2_MAX_GARBAGE_LEN+2]byte
+	c = NewV2Cipher()
+	rand.Read(garbage[:])
+	glen := int(binary.LittleEndian.Uint16(garbage[V2_MAX_GARBAGE_LEN:])) % (V2_MAX_GARBAGE_LEN+1)
+	if _, e = conn.Write(append(append([]byte{}, c.OurPubkey...), garbage[:glen]...)); e != nil {
+		return
+	}
+	if initiator {
+		their_pubkey = make([]byte, V2_PUBKEY_LEN)
+		var n int
+		n, e = io.ReadFull(conn, their_pubkey)
+		if rcvd = n > 0; e != nil {
+			return
+		}
+	}
+	rcvd = true
+
+	c.Initialize(their_pubkey, initiator, magic)
+	if _, e = conn.Write(append(c.SendTerminator[:], c.Encrypt(nil, garbage[:glen], false)...)); e != nil {
+		return
+	}
+
+	// skip the peer's garbage
+	buf := make([]byte, V2_GARBAGE_TERMINATOR_LEN, V2_MAX_GARBAGE_LEN+V2_GARBAGE_TERMINATOR_LEN)
+	if _, e = io.ReadFull(conn, buf); e != nil {
+		return
+	}
+	for !bytes.Equal(buf[len(buf)-V2_GARBAGE_TERMINATOR_LEN:], c.RecvTerminator[:]) {
+		if len(buf) == cap(buf) {
+			e = errors.New("v2 garbage terminator not found")
+			return
+		}
+		buf = buf[:len(buf)+1]
+		if _, e = io.ReadFull(conn, buf[len(buf)-1:]); e != nil {
+			return
+		}
+	}
+
+	// the version packet, possibly preceded by decoys (only the first packet authenticates the garbage)
+	aad := buf[:len(buf)-V2_GARBAGE_TERMINATOR_LEN]
+	for {
+		var hdr [V2_LENGTH_LEN]byte
+		if _, e = io.ReadFull(conn, hdr[:]); e != nil {
+			return
+		}
+		le := c.DecryptLength(hdr[:])
+		if le > V2_MAX_HANDSHAKE_PACKET {
+			e = errors.New("v2 handshake packet too big")
+			return
+		}
+		dat := make([]byte, le)
+		if _, e = io.ReadFull(conn, dat); e != nil {
+			return
+		}
+		_, ignore, ok := c.Decrypt(dat, aad)
+		if !ok {
+			e = errors.New("v2 handshake packet authentication failed")
+			return
+		}
+		if !ignore {
+			return
+		}
+		aad = nil
+	}
+}
+
+
+// V2EncodeMsg returns contents of a packet carrying the given message
+func V2EncodeMsg(cmd string, pl []byte) (res []byte) {
+	if id, ok := v2_short_id[cmd]; ok {
+		res = make([]byte, 1+len(pl))
+		res[0] = id
+		copy(res[1:], pl)
+	} else {
+		res = make([]byte, 13+len(pl))
+		copy(res[1:13], cmd)
+		copy(res[13:], pl)
+	}
+	return
+}
+
+
+// V2DecodeMsg extracts the message from a packet's contents
+func V2DecodeMsg(contents []byte) (cmd string, pl []byte, ok bool) {
+	if len(contents) == 0 {
+		return
+	}
+	if id := contents[0]; id != 0 {
+		if int(id) < len(V2ShortIDs) {
+			cmd, pl, ok = V2ShortIDs[id], contents[1:], true
+		}
+		return
+	}
+	if len(contents) < 13 {
+		return
+	}
+	cmd = string(bytes.TrimRight(contents[1:13], "\000"))
+	pl, ok = contents[13:], true
+	return
+}
+
+
+func init() {
+	v2_short_id = make(map[string]byte, len(V2ShortIDs))
+	for i := 1; i < len(V2ShortIDs); i++ {
+		v2_short_id[V2ShortIDs[i]] = byte(i)
+	}
+}
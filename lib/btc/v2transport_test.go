@@ -0,0 +1,221 @@
+package btc
+
+import (
+	"io"
+	"os"
+	"net"
+	"bytes"
+	"testing"
+	"strconv"
+	"encoding/csv"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+func TestV2Transport(t *testing.T) {
+	magic := []byte{0xf9, 0xbe, 0xb4, 0xd9}
+	a := NewV2Cipher()
+	b := NewV2Cipher()
+	a.Initialize(b.OurPubkey, true, magic)
+	b.Initialize(a.OurPubkey, false, magic)
+	if a.SessionID != b.SessionID || a.SendTerminator != b.RecvTerminator || a.RecvTerminator != b.SendTerminator {
+		t.Fatal("Keys mismatch")
+	}
+
+	// enough packets to trigger rekeying
+	garbage := []byte("some garbage")
+	for i := 0; i < 500; i++ {
+		var aad []byte
+		if i == 0 {
+			aad = garbage
+		}
+		pl := bytes.Repeat([]byte{byte(i)}, i)
+		pkt := a.Encrypt(V2EncodeMsg("ping", pl), aad, i%7 == 3)
+		le := b.DecryptLength(pkt[:V2_LENGTH_LEN])
+		if le != len(pkt)-V2_LENGTH_LEN {
+			t.Fatal("Length mismatch", i, le, len(pkt))
+		}
+		contents, ignore, ok := b.Decrypt(pkt[V2_LENGTH_LEN:], aad)
+		if !ok || ignore != (i%7 == 3) {
+			t.Fatal("Decrypt failed", i)
+		}
+		cmd, res, ok := V2DecodeMsg(contents)
+		if !ok || cmd != "ping" || !bytes.Equal(res, pl) {
+			t.Fatal("Message mismatch", i)
+		}
+
+		pkt = b.Encrypt(V2EncodeMsg("sendheaders", nil), nil, false)
+		a.DecryptLength(pkt)
+		contents, _, ok = a.Decrypt(pkt[V2_LENGTH_LEN:], nil)
+		if cmd, res, ok = V2DecodeMsg(contents); !ok || cmd != "sendheaders" || len(res) != 0 {
+			t.Fatal("Long message type mismatch", i)
+		}
+	}
+
+	pkt := a.Encrypt([]byte{1, 2, 3}, nil, false)
+	pkt[len(pkt)-1] ^= 1
+	b.DecryptLength(pkt)
+	if _, _, ok := b.Decrypt(pkt[V2_LENGTH_LEN:], nil); ok {
+		t.Error("Modified packet accepted")
+	}
+}
+
+func TestV2Handshake(t *testing.T) {
+	magic := []byte{0xf9, 0xbe, 0xb4, 0xd9}
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Skip(e.Error())
+	}
+	defer l.Close()
+
+	res := make(chan *V2Cipher, 1)
+	go func() {
+		con, e := l.Accept()
+		if e != nil {
+			res <- nil
+			return
+		}
+		defer con.Close()
+		their := make([]byte, V2_PUBKEY_LEN)
+		if _, e = io.ReadFull(con, their); e != nil {
+			res <- nil
+			return
+		}
+		c, _, e := V2Handshake(con, magic, false, their)
+		if e != nil {
+			c = nil
+		}
+		res <- c
+		io.Copy(io.Discard, con)
+	}()
+
+	con, e := net.Dial("tcp", l.Addr().String())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer con.Close()
+	a, rcvd, e := V2Handshake(con, magic, true, nil)
+	if e != nil || !rcvd {
+		t.Fatal("Initiator failed", e)
+	}
+	b := <-res
+	if b == nil {
+		t.Fatal("Responder failed")
+	}
+	if a.SessionID != b.SessionID {
+		t.Error("Session ID mismatch")
+	}
+}
+
+func TestV2ValidKey(t *testing.T) {
+	n := secp256k1.TheCurve.Order.Bytes()
+	var k [32]byte
+	if v2ValidKey(k[:]) {
+		t.Error("Zero key accepted")
+	}
+	k[31] = 1
+	if !v2ValidKey(k[:]) {
+		t.Error("Key 1 rejected")
+	}
+	copy(k[:], n)
+	if v2ValidKey(k[:]) {
+		t.Error("Key N accepted")
+	}
+	k[31]--
+	if !v2ValidKey(k[:]) {
+		t.Error("Key N-1 rejected")
+	}
+	for i := range k {
+		k[i] = 0xff
+	}
+	if v2ValidKey(k[:]) {
+		t.Error("Key 2^256-1 accepted")
+	}
+}
+
+// BIP324 packet_encoding_test_vectors.csv - see ../test/README.md
+func TestV2PacketVectors(t *testing.T) {
+	f, e := os.Open("../test/bip324_packet_encoding_test_vectors.csv")
+	if e != nil {
+		t.Skip(e.Error())
+	}
+	defer f.Close()
+	recs, e := csv.NewReader(f).ReadAll()
+	if e != nil || len(recs) < 2 {
+		t.Fatal("Bad CSV file", e)
+	}
+	col := make(map[string]int)
+	for i, n := range recs[0] {
+		col[n] = i
+	}
+	for _, n := range []string{"in_idx", "in_priv_ours", "in_ellswift_ours", "in_ellswift_theirs", "in_initiating",
+		"in_contents", "in_multiply", "in_aad", "in_ignore", "mid_x_ours", "mid_x_theirs", "mid_x_shared",
+		"mid_shared_secret", "mid_initiator_l", "mid_initiator_p", "mid_responder_l", "mid_responder_p",
+		"mid_send_garbage_terminator", "mid_recv_garbage_terminator", "out_session_id",
+		"out_ciphertext", "out_ciphertext_endswith"} {
+		if _, ok := col[n]; !ok {
+			t.Fatal("Missing column", n)
+		}
+	}
+	magic := []byte{0xf9, 0xbe, 0xb4, 0xd9}
+
+	for i, r := range recs[1:] {
+		hx := func(n string) []byte {
+			d, _ := hex.DecodeString(r[col[n]])
+			return d
+		}
+		num := func(n string) int {
+			v, _ := strconv.Atoi(r[col[n]])
+			return v
+		}
+		check := func(n string, got []byte) {
+			if !bytes.Equal(got, hx(n)) {
+				t.Error(i, n, "mismatch", hex.EncodeToString(got))
+			}
+		}
+
+		c := new(V2Cipher)
+		copy(c.priv[:], hx("in_priv_ours"))
+		c.OurPubkey = hx("in_ellswift_ours")
+		theirs := hx("in_ellswift_theirs")
+		initiator := num("in_initiating") != 0
+
+		check("mid_x_ours", secp256k1.EllSwiftDecode(c.OurPubkey))
+		check("mid_x_theirs", secp256k1.EllSwiftDecode(theirs))
+		ecdh := secp256k1.EllSwiftXonlyECDH(theirs, c.priv[:])
+		check("mid_x_shared", ecdh)
+		if initiator {
+			check("mid_shared_secret", taggedHash("bip324_ellswift_xonly_ecdh", c.OurPubkey, theirs, ecdh))
+		} else {
+			check("mid_shared_secret", taggedHash("bip324_ellswift_xonly_ecdh", theirs, c.OurPubkey, ecdh))
+		}
+
+		c.Initialize(theirs, initiator, magic)
+		if initiator {
+			check("mid_initiator_l", c.send_l.key[:])
+			check("mid_initiator_p", c.send_p.key[:])
+			check("mid_responder_l", c.recv_l.key[:])
+			check("mid_responder_p", c.recv_p.key[:])
+		} else {
+			check("mid_initiator_l", c.recv_l.key[:])
+			check("mid_initiator_p", c.recv_p.key[:])
+			check("mid_responder_l", c.send_l.key[:])
+			check("mid_responder_p", c.send_p.key[:])
+		}
+		check("mid_send_garbage_terminator", c.SendTerminator[:])
+		check("mid_recv_garbage_terminator", c.RecvTerminator[:])
+		check("out_session_id", c.SessionID[:])
+
+		for j := 0; j < num("in_idx"); j++ {
+			c.Encrypt(nil, nil, false)
+		}
+		contents := bytes.Repeat(hx("in_contents"), num("in_multiply"))
+		pkt := c.Encrypt(contents, hx("in_aad"), num("in_ignore") != 0)
+		if r[col["out_ciphertext"]] != "" {
+			check("out_ciphertext", pkt)
+		}
+		if end := hx("out_ciphertext_endswith"); !bytes.HasSuffix(pkt, end) {
+			t.Error(i, "out_ciphertext_endswith mismatch")
+		}
+	}
+}
@@ -289,6 +289,15 @@ func (db *BlockDB) BlockInvalid(hash []byte) {
 }
 
 
+// Returns true if the block's data is already in the database
+func (db *BlockDB) BlockStored(hash *btc.Uint256) (ok bool) {
+	db.mutex.Lock()
+	_, ok = db.blockIndex[hash.BIdx()]
+	db.mutex.Unlock()
+	return
+}
+
+
 func (db *BlockDB) BlockTrusted(hash []byte) {
 	idx := btc.NewUint256(hash).BIdx()
 	db.mutex.Lock()
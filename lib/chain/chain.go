@@ -15,6 +15,7 @@ var AbortNow bool  // set it to true to abort any activity
 type Chain struct {
 	Blocks *BlockDB      // blockchain.dat and blockchain.idx
 	Unspent *UnspentDB    // unspent folder
+	Filters *FilterDB     // blockfilters.dat and blockfilters.idx (nil if not enabled)
 
 	BlockTreeRoot *BlockTreeNode
 	BlockTreeEnd *BlockTreeNode
@@ -41,6 +42,9 @@ type NewChanOpts struct {
 	NotifyTxAdd func (*QdbRec)
 	NotifyTxDel func ([]byte, []bool)
 
+	// If set, it is called for each block that has been disconnected from the chain
+	BlockUndone func (*btc.Block)
+
 	// These two are used only during loading
 	LoadWalk FunctionWalkUnspent // this one is called for each UTXO record that has just been loaded
 
@@ -52,6 +56,8 @@ type NewChanOpts struct {
 
 	SetBlocksDBCacheSize bool
 	BlocksDBCacheSize int // this value is only taken if SetBlocksDBCacheSize is true
+
+	BlockFilters bool // build the index of compact block filters (BIP158)
 }
 
 
@@ -87,6 +93,10 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 	} else {
 		ch.Blocks = NewBlockDB(dbrootdir)
 	}
+	if opts.BlockFilters {
+		ch.Filters = NewFilterDB(dbrootdir)
+		ch.addGenesisFilter()
+	}
 	ch.Unspent, undo_last_block = NewUnspentDb(&NewUnspentOpts{
 		Dir:dbrootdir, Chain:ch, Rescan:rescan, VolatimeMode:opts.UTXOVolatileMode})
 
@@ -198,6 +208,9 @@ func (ch *Chain) Stats() (s string) {
 func (ch *Chain) Close() {
 	ch.Blocks.Close()
 	ch.Unspent.Close()
+	if ch.Filters != nil {
+		ch.Filters.Close()
+	}
 }
 
 
@@ -2,15 +2,22 @@ package chain
 
 import (
 	"fmt"
+	"sync"
 	"errors"
+	"sync/atomic"
 	"github.com/piotrnar/gocoin/lib/btc"
-	"github.com/piotrnar/gocoin/lib/script"
-	"github.com/piotrnar/gocoin/lib/others/sys"
 )
 
-// TrustedTxChecker is meant to speed up verifying transactions that had
-// been verified already by the client while being taken to its memory pool
-var TrustedTxChecker func(*btc.Uint256) bool
+
+// Returned by CommitBlock if the block could not be applied because of a local (disk) problem.
+// It says nothing about the block's validity, so it can be tried again later.
+type LocalIOError struct {
+	Err error
+}
+
+func (e *LocalIOError) Error() string {
+	return "Local I/O error: " + e.Err.Error()
+}
 
 
 func (ch *Chain) ProcessBlockTransactions(bl *btc.Block, height, lknown uint32) (changes *BlockChanges, e error) {
@@ -64,6 +71,7 @@ func (ch *Chain)CommitBlock(bl *btc.Block, cur *BlockTreeNode) (e error) {
 	if ch.BlockTreeEnd==cur.Parent {
 		// The head of out chain - apply the transactions
 		var changes *BlockChanges
+		// This verifies the block, while the previous one may still be being applied to the UTXO db
 		changes, e = ch.ProcessBlockTransactions(bl, cur.Height, bl.LastKnownHeight)
 		if e != nil {
 			// ProcessBlockTransactions failed, so trash the block.
@@ -74,11 +82,22 @@ func (ch *Chain)CommitBlock(bl *btc.Block, cur *BlockTreeNode) (e error) {
 			ch.BlockIndexAccess.Unlock()
 		} else {
 			cur.Sigops = bl.Sigops
-			// ProcessBlockTransactions succeeded, so save the block as "trusted".
-			bl.Trusted = true
-			ch.Blocks.BlockAdd(cur.Height, bl)
 			// Apply the block's trabnsactions to the unspent database:
-			ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+			if er := ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:]); er != nil {
+				// The block is not stored, so retrying it will not add another copy
+				println("CommitBlockTxs", cur.BlockHash.String(), cur.Height, er.Error())
+				e = &LocalIOError{Err:er}
+				return
+			}
+			// ... and only then save the block as "trusted".
+			// It may be stored already, if its reorg has been stopped by an I/O error before.
+			bl.Trusted = true
+			if ch.Blocks.BlockStored(bl.Hash) {
+				ch.Blocks.BlockTrusted(bl.Hash.Hash[:])
+			} else {
+				ch.Blocks.BlockAdd(cur.Height, bl)
+			}
+			ch.addBlockFilter(bl, changes.SpentScripts)
 			if !ch.DoNotSync {
 				ch.Blocks.Sync()
 			}
@@ -88,13 +107,14 @@ func (ch *Chain)CommitBlock(bl *btc.Block, cur *BlockTreeNode) (e error) {
 		// The block's parent is not the current head of the chain...
 
 		// Save the block, though do not makt it as "trusted" just yet
-		ch.Blocks.BlockAdd(cur.Height, bl)
+		if !ch.Blocks.BlockStored(bl.Hash) {
+			ch.Blocks.BlockAdd(cur.Height, bl)
+		}
 
 		// If it has a bigger height than the current head,
 		// ... move the coin state into a new branch.
 		if cur.Height > ch.BlockTreeEnd.Height {
-			ch.MoveToBlock(cur)
-			if ch.BlockTreeEnd!=cur {
+			if e = ch.MoveToBlock(cur); e == nil && ch.BlockTreeEnd!=cur {
 				e = errors.New("CommitBlock: MoveToBlock failed")
 			}
 		}
@@ -115,8 +135,9 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 
 	blUnsp := make(map[[32]byte] []*btc.TxOut, 4*len(bl.Txs))
 
-	// create a channnel to receive results from VerifyScript threads:
-	done := make(chan bool, sys.UseThreads-1)
+	// scripts of all the block's inputs are verified in parallel, by a pool of goroutines
+	sv := newScriptVerifier(bl.VerifyFlags)
+	defer sv.abort() // in case we return an error before sv.wait()
 
 	for i := range bl.Txs {
 		txoutsum, txinsum = 0, 0
@@ -126,9 +147,6 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 		// Check each tx for a valid input, except from the first one
 		if i>0 {
 			tx_trusted := bl.Trusted
-			if !tx_trusted && TrustedTxChecker!=nil && TrustedTxChecker(bl.Txs[i].Hash) {
-				tx_trusted = true
-			}
 
 			for j:=0; j<len(bl.Txs[i].TxIn); j++ {
 				inp := &bl.Txs[i].TxIn[j].Input
@@ -196,10 +214,13 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 					}
 				}
 
-				if !tx_trusted { // run VerifyTxScript() in a parallel task
-					go func (prv []byte, i int, tx *btc.Tx) {
-						done <- script.VerifyTxScript(prv, i, tx, bl.VerifyFlags)
-					}(tout.Pk_script, j, bl.Txs[i])
+				if ch.Filters != nil {
+					changes.SpentScripts = append(changes.SpentScripts, append([]byte{}, tout.Pk_script...))
+				}
+
+				if !tx_trusted && !sv.add(tout.Pk_script, j, bl.Txs[i]) {
+					println("VerifyScript error 1")
+					return errors.New("VerifyScripts failed")
 				}
 
 				if btc.IsP2SH(tout.Pk_script) {
@@ -208,15 +229,6 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 
 				txinsum += tout.Value
 			}
-
-			if !tx_trusted {
-				for _ = range bl.Txs[i].TxIn  {
-					if !(<- done) {
-						println("VerifyScript error 2")
-						return errors.New("VerifyScripts failed")
-					}
-				}
-			}
 		} else {
 			// For coinbase tx we need to check (like satoshi) whether the script size is between 2 and 100 bytes
 			// (Previously we made sure in CheckBlock() that this was a coinbase type tx)
@@ -245,6 +257,11 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 		blUnsp[bl.Txs[i].Hash.Hash] = outs
 	}
 
+	if !sv.wait() {
+		println("VerifyScript error 2")
+		return errors.New("VerifyScripts failed")
+	}
+
 	if sumblockin < sumblockout {
 		return errors.New(fmt.Sprintf("Out:%d > In:%d", sumblockout, sumblockin))
 	}
@@ -279,21 +296,28 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 
 // Check transactions for consistency and finality. Return true if OK
 func CheckTransactions(txs []*btc.Tx, height, btime uint32) bool {
-	ok := true
-	done := make(chan bool, sys.UseThreads-1)
-	for i := range txs {
-		go func(tx *btc.Tx) {
-			if tx.CheckTransaction() != nil {
-				done <- false // check transaction failed
-			} else {
-				done <- tx.IsFinal(height, btime)
-			}
-		}(txs[i])
+	var next int32 = -1
+	var failed uint32
+	var wg sync.WaitGroup
+	n := scriptThreads()
+	if n > len(txs) {
+		n = len(txs)
 	}
-	for _ = range txs {
-		if !(<- done) {
-			ok = false
-		}
+	wg.Add(n)
+	for t := 0; t < n; t++ {
+		go func() {
+			for atomic.LoadUint32(&failed) == 0 {
+				i := int(atomic.AddInt32(&next, 1))
+				if i >= len(txs) {
+					break
+				}
+				if txs[i].CheckTransaction() != nil || !txs[i].IsFinal(height, btime) {
+					atomic.StoreUint32(&failed, 1)
+				}
+			}
+			wg.Done()
+		}()
 	}
-	return ok
+	wg.Wait()
+	return failed == 0
 }
@@ -0,0 +1,52 @@
+package chain
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCommitBlockIOError(t *testing.T) {
+	ch, funds := benchChain(t, 2*benchTxsPerBlock)
+	defer ch.Unspent.Close()
+	ch.Blocks = NewBlockDB(t.TempDir())
+	defer ch.Blocks.Close()
+	ch.DoNotSync = true
+	ch.BlockTreeEnd = &BlockTreeNode{Height:1}
+	cur := &BlockTreeNode{Parent:ch.BlockTreeEnd, Height:2}
+
+	bl, _ := benchBlock(2, funds)
+	bl.Raw = make([]byte, 80)
+	bl.TxCount = len(bl.Txs)
+	bl.LastKnownHeight = 2 // so it has the undo data
+	cur.BlockHash = bl.Hash
+
+	// the undo file cannot be written if there is a folder in its way
+	os.Mkdir(ch.Unspent.dir+"tmp", 0700)
+	for i := 0; i < 3; i++ {
+		e := ch.CommitBlock(bl, cur)
+		if _, ok := e.(*LocalIOError); !ok {
+			t.Fatal(i, "LocalIOError expected, got", e)
+		}
+		if ch.Blocks.BlockStored(bl.Hash) {
+			t.Fatal(i, "Block stored before its UTXO changes")
+		}
+		if ch.BlockTreeEnd == cur {
+			t.Fatal(i, "Chain head moved")
+		}
+	}
+
+	os.Remove(ch.Unspent.dir+"tmp")
+	if e := ch.CommitBlock(bl, cur); e != nil {
+		t.Fatal(e)
+	}
+	ch.Unspent.waitCommit()
+	if ch.BlockTreeEnd != cur {
+		t.Error("Chain head not moved")
+	}
+	if _, trusted, e := ch.Blocks.BlockGet(bl.Hash); e != nil || !trusted {
+		t.Error("Block not stored as trusted", e)
+	}
+	if n := len(ch.Blocks.blockIndex); n != 1 {
+		t.Error("Block stored", n, "times")
+	}
+}
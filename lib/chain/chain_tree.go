@@ -22,7 +22,9 @@ type BlockTreeNode struct {
 	BlockHeader [80]byte
 }
 
-func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
+// Applies the blocks up to the given one. Returns an error (*LocalIOError)
+// only if the changes could not be stored, in which case it stops at the last stored block.
+func (ch *Chain) ParseTillBlock(end *BlockTreeNode) (e error) {
 	var b []byte
 	var er error
 	var trusted bool
@@ -75,18 +77,24 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 			ch.Blocks.BlockTrusted(bl.Hash.Hash[:])
 		}
 
-		ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+		if er = ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:]); er != nil {
+			println("CommitBlockTxs", nxt.BlockHash.String(), nxt.Height, er.Error())
+			e = &LocalIOError{Err:er}
+			break
+		}
+		ch.addBlockFilter(bl, changes.SpentScripts)
 
 		ch.BlockTreeEnd = nxt
 	}
 
-	if !AbortNow && ch.BlockTreeEnd != end {
+	if !AbortNow && e == nil && ch.BlockTreeEnd != end {
 		end, _ = ch.BlockTreeRoot.FindFarthestNode()
 		fmt.Println("ParseTillBlock failed - now go to", end.Height)
-		ch.MoveToBlock(end)
+		e = ch.MoveToBlock(end)
 	}
 	ch.Unspent.Sync()
 	ch.Save()
+	return
 }
 
 func (n *BlockTreeNode) Timestamp() (uint32) {
@@ -162,7 +170,8 @@ func (n *BlockTreeNode) FindPathTo(end *BlockTreeNode) (*BlockTreeNode) {
 }
 
 
-func (ch *Chain) MoveToBlock(dst *BlockTreeNode) {
+// Returns an error only if ParseTillBlock did.
+func (ch *Chain) MoveToBlock(dst *BlockTreeNode) (e error) {
 	cur := dst
 	for cur.Height > ch.BlockTreeEnd.Height {
 		cur = cur.Parent
@@ -194,7 +203,7 @@ func (ch *Chain) MoveToBlock(dst *BlockTreeNode) {
 		}
 		ch.UndoLastBlock()
 	}
-	ch.ParseTillBlock(dst)
+	return ch.ParseTillBlock(dst)
 }
 
 
@@ -208,7 +217,12 @@ func (ch *Chain) UndoLastBlock() {
 	bl.BuildTxList()
 
 	ch.Unspent.UndoBlockTxs(bl, ch.BlockTreeEnd.Parent.BlockHash.Hash[:])
+	bl.Height = ch.BlockTreeEnd.Height
 	ch.BlockTreeEnd = ch.BlockTreeEnd.Parent
+
+	if ch.CB.BlockUndone != nil {
+		ch.CB.BlockUndone(bl)
+	}
 }
 
 
@@ -0,0 +1,220 @@
+package chain
+
+import (
+	"os"
+	"sync"
+	"errors"
+	"encoding/hex"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+/*
+	blockfilters.dat - basic filters (BIP158) as serialized in "cfilter" message
+	blockfilters.idx - contains records of 76 bytes (all values LSB):
+		[0:32]  - 256-bit block hash
+		[32:64] - 256-bit filter header
+		[64:72] - 64-bit filter pos in blockfilters.dat
+		[72:76] - 32-bit filter length in bytes
+*/
+
+// Output script of the genesis block's coinbase (it is the same on all the bitcoin chains)
+const genesisPkScript = "4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac"
+
+type oneFilter struct {
+	header [32]byte
+	fpos uint64
+	flen uint32
+}
+
+type FilterDB struct {
+	dirname string
+	index map[[btc.Uint256IdxLen]byte] *oneFilter
+	filterdata *os.File
+	filterindx *os.File
+	datpos int64
+	mutex sync.Mutex
+}
+
+
+func NewFilterDB(dir string) (db *FilterDB) {
+	var b [76]byte
+	db = new(FilterDB)
+	db.dirname = dir
+	if db.dirname!="" && db.dirname[len(db.dirname )-1]!='/' && db.dirname[len(db.dirname )-1]!='\\' {
+		db.dirname += "/"
+	}
+	db.index = make(map[[btc.Uint256IdxLen]byte] *oneFilter)
+	os.MkdirAll(db.dirname, 0770)
+	db.filterdata, _ = os.OpenFile(db.dirname+"blockfilters.dat", os.O_RDWR|os.O_CREATE, 0660)
+	if db.filterdata == nil {
+		panic("Cannot open blockfilters.dat")
+	}
+	db.filterindx, _ = os.OpenFile(db.dirname+"blockfilters.idx", os.O_RDWR|os.O_CREATE, 0660)
+	if db.filterindx == nil {
+		panic("Cannot open blockfilters.idx")
+	}
+
+	var validpos int64
+	for {
+		if n, _ := db.filterindx.Read(b[:]); n != len(b) {
+			break
+		}
+		rec := new(oneFilter)
+		copy(rec.header[:], b[32:64])
+		rec.fpos = binary.LittleEndian.Uint64(b[64:72])
+		rec.flen = binary.LittleEndian.Uint32(b[72:76])
+		db.index[btc.NewUint256(b[0:32]).BIdx()] = rec
+		if int64(rec.fpos)+int64(rec.flen) > db.datpos {
+			db.datpos = int64(rec.fpos)+int64(rec.flen)
+		}
+		validpos += int64(len(b))
+	}
+	// Truncate any trash at the end of the files
+	db.filterindx.Truncate(validpos)
+	db.filterindx.Seek(validpos, os.SEEK_SET)
+	db.filterdata.Truncate(db.datpos)
+	db.filterdata.Seek(db.datpos, os.SEEK_SET)
+	return
+}
+
+
+// Stores the filter of the given block, returning its header
+func (db *FilterDB) Add(hash *btc.Uint256, filter []byte, prevhdr []byte) (hdr [32]byte) {
+	var b [76]byte
+	hdr = btc.FilterHeader(filter, prevhdr)
+	rec := &oneFilter{header:hdr, flen:uint32(len(filter))}
+
+	db.mutex.Lock()
+	rec.fpos = uint64(db.datpos)
+	db.filterdata.Write(filter)
+	db.datpos += int64(len(filter))
+	copy(b[0:32], hash.Hash[:])
+	copy(b[32:64], hdr[:])
+	binary.LittleEndian.PutUint64(b[64:72], rec.fpos)
+	binary.LittleEndian.PutUint32(b[72:76], rec.flen)
+	db.filterindx.Write(b[:])
+	db.index[hash.BIdx()] = rec
+	db.mutex.Unlock()
+	return
+}
+
+
+// Returns the filter header of the given block
+func (db *FilterDB) Header(hash *btc.Uint256) (hdr [32]byte, ok bool) {
+	db.mutex.Lock()
+	rec, ok := db.index[hash.BIdx()]
+	if ok {
+		hdr = rec.header
+	}
+	db.mutex.Unlock()
+	return
+}
+
+
+// Returns the serialized filter of the given block
+func (db *FilterDB) Get(hash *btc.Uint256) (filter []byte, e error) {
+	db.mutex.Lock()
+	rec, ok := db.index[hash.BIdx()]
+	db.mutex.Unlock()
+	if !ok {
+		e = errors.New("Block filter not in the index")
+		return
+	}
+
+	filter = make([]byte, rec.flen)
+	// re-open the data file, to not spoil the writting pointer
+	f, e := os.Open(db.dirname+"blockfilters.dat")
+	if e != nil {
+		return
+	}
+	_, e = f.ReadAt(filter, int64(rec.fpos))
+	f.Close()
+	return
+}
+
+
+func (db *FilterDB) Sync() {
+	db.filterindx.Sync()
+	db.filterdata.Sync()
+}
+
+
+func (db *FilterDB) Close() {
+	db.filterindx.Close()
+	db.filterdata.Close()
+}
+
+
+// Adds the filter of the genesis block, if it is not there yet
+func (ch *Chain) addGenesisFilter() {
+	if _, ok := ch.Filters.Header(ch.Genesis); ok {
+		return
+	}
+	scr, _ := hex.DecodeString(genesisPkScript)
+	f := btc.NewGCSFilter(ch.Genesis.Hash[:], [][]byte{scr})
+	ch.Filters.Add(ch.Genesis, f.Bytes(), make([]byte, 32))
+}
+
+
+// Called for each block that has just been connected to the chain
+func (ch *Chain) addBlockFilter(bl *btc.Block, spent [][]byte) {
+	if ch.Filters == nil {
+		return
+	}
+	if _, ok := ch.Filters.Header(bl.Hash); ok {
+		return // we have it already (the block has been re-connected)
+	}
+	prev, ok := ch.Filters.Header(btc.NewUint256(bl.ParentHash()))
+	if !ok {
+		// The index was enabled after this chain had been parsed (rescan it to rebuild the filters)
+		return
+	}
+	f := btc.NewGCSFilter(bl.Hash.Hash[:], btc.BasicFilterItems(bl, spent))
+	ch.Filters.Add(bl.Hash, f.Bytes(), prev[:])
+	if !ch.DoNotSync {
+		ch.Filters.Sync()
+	}
+}
+
+
+// Returns true if the filter of the given block matches any of the scripts.
+// This lets local wallets find their blocks without revealing addresses to anyone.
+func (ch *Chain) BlockFilterMatch(hash *btc.Uint256, scripts [][]byte) (match bool, e error) {
+	if ch.Filters == nil {
+		e = errors.New("Block filters are disabled")
+		return
+	}
+	raw, e := ch.Filters.Get(hash)
+	if e != nil {
+		return
+	}
+	f, e := btc.NewGCSFilterFromBytes(hash.Hash[:], raw)
+	if e != nil {
+		return
+	}
+	match = f.MatchAny(scripts)
+	return
+}
+
+
+// Returns the blocks from the main chain (starting at the given height) whose filters match any of the scripts
+func (ch *Chain) BlockFiltersScan(from uint32, scripts [][]byte) (res []*BlockTreeNode, e error) {
+	var nodes []*BlockTreeNode
+	ch.BlockIndexAccess.Lock()
+	for n := ch.BlockTreeEnd; n != nil && n.Height >= from; n = n.Parent {
+		nodes = append(nodes, n)
+	}
+	ch.BlockIndexAccess.Unlock()
+
+	for i := len(nodes)-1; i >= 0; i-- {
+		var match bool
+		if match, e = ch.BlockFilterMatch(nodes[i].BlockHash, scripts); e != nil {
+			return
+		}
+		if match {
+			res = append(res, nodes[i])
+		}
+	}
+	return
+}
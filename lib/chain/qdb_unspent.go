@@ -7,6 +7,7 @@ import (
 	"errors"
 	"strconv"
 	"strings"
+	"sync"
 	"io/ioutil"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
@@ -27,6 +28,7 @@ type BlockChanges struct {
 	AddList []*QdbRec
 	DeledTxs map[[32]byte] []bool
 	UndoData map[[32]byte] *QdbRec
+	SpentScripts [][]byte // pk_scripts of all the spent outputs (only collected for block filters)
 }
 
 
@@ -42,6 +44,14 @@ type UnspentDB struct {
 	ch *Chain
 	volatimemode bool
 	UnwindBufLen uint32
+
+	tdbMutex sync.Mutex // protects tdb, which is lazily open by DbN()
+
+	// The last block's changes are applied in the background (see CommitBlockTxs)
+	commitMutex sync.Mutex // locked until they are applied
+	pendingMutex sync.Mutex
+	pending *BlockChanges
+	pendingAdded map[[32]byte] *QdbRec
 }
 
 type NewUnspentOpts struct {
@@ -105,8 +115,14 @@ func NewUnspentDb(opts *NewUnspentOpts) (db *UnspentDB, undo_last_block bool) {
 }
 
 
-// Commit the given add/del transactions to UTXO and Wnwind DBs
+// Commit the given add/del transactions to UTXO and Wnwind DBs.
+// The changes are applied to the database in the background, so the next block
+// can be verified in the meantime (UnspentGet takes them into account already).
+// Returns an error if the undo data could not be written, in which case
+// none of the changes have been applied.
 func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e error) {
+	db.waitCommit()
+
 	undo_fn := fmt.Sprint(db.dir, changes.Height)
 
 	if changes.UndoData!=nil || (changes.Height%db.UnwindBufLen)==0 {
@@ -119,18 +135,16 @@ func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e err
 				bu.Write(bin)
 			}
 		}
-		ioutil.WriteFile(db.dir+"tmp", bu.Bytes(), 0666)
-		os.Rename(db.dir+"tmp", undo_fn+".tmp")
+		if e = ioutil.WriteFile(db.dir+"tmp", bu.Bytes(), 0666); e != nil {
+			return
+		}
+		if e = os.Rename(db.dir+"tmp", undo_fn+".tmp"); e != nil {
+			return
+		}
 	}
 
 	db.nosync()
-	db.commit(changes)
-	if changes.LastKnownHeight<=changes.Height {
-		db.Sync()
-	}
-
-	os.Rename(undo_fn+".tmp", undo_fn)
-
+	db.notify(changes)
 
 	if db.LastBlockHash==nil {
 		db.LastBlockHash = make([]byte, 32)
@@ -138,19 +152,73 @@ func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e err
 	copy(db.LastBlockHash, blhash)
 	db.LastBlockHeight = changes.Height
 
-	if changes.Height>db.UnwindBufLen {
-		os.Remove(fmt.Sprint(db.dir, changes.Height-db.UnwindBufLen))
+	db.setPending(changes)
+	db.commitMutex.Lock()
+	go func() {
+		db.commit(changes)
+		if changes.LastKnownHeight<=changes.Height {
+			db.sync()
+		}
+		os.Rename(undo_fn+".tmp", undo_fn)
+		if changes.Height>db.UnwindBufLen {
+			os.Remove(fmt.Sprint(db.dir, changes.Height-db.UnwindBufLen))
+		}
+		db.setPending(nil)
+		db.commitMutex.Unlock()
+	}()
+	return
+}
+
+
+// Waits for the changes of the last block to be applied to the database
+func (db *UnspentDB) waitCommit() {
+	db.commitMutex.Lock()
+	db.commitMutex.Unlock()
+}
+
+
+// Sets the changes that are being applied to the database in the background
+func (db *UnspentDB) setPending(changes *BlockChanges) {
+	var added map[[32]byte] *QdbRec
+	if changes != nil {
+		added = make(map[[32]byte] *QdbRec, len(changes.AddList))
+		for _, rec := range changes.AddList {
+			added[rec.TxID] = rec
+		}
+	}
+	db.pendingMutex.Lock()
+	db.pending = changes
+	db.pendingAdded = added
+	db.pendingMutex.Unlock()
+}
+
+
+// Looks for the output in the changes that are being applied in the background.
+// Returns found=false if the database needs to be checked.
+func (db *UnspentDB) pendingGet(po *btc.TxPrevOut) (rec *QdbRec, found bool) {
+	db.pendingMutex.Lock()
+	defer db.pendingMutex.Unlock()
+	if db.pending == nil {
+		return
+	}
+	if outs, ok := db.pending.DeledTxs[po.Hash]; ok && int(po.Vout)<len(outs) && outs[po.Vout] {
+		return nil, true // spent by the pending block
 	}
+	rec, found = db.pendingAdded[po.Hash]
 	return
 }
 
 
 func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
+	db.waitCommit()
 	for _, tx := range bl.Txs {
 		lst := make([]bool, len(tx.TxOut))
 		for i := range lst {
 			lst[i] = true
 		}
+		if db.ch.CB.NotifyTxDel!=nil {
+			db.ch.CB.NotifyTxDel(tx.Hash.Hash[:], lst)
+		}
 		db.del(tx.Hash.Hash[:], lst)
 	}
 
@@ -202,12 +270,20 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 
 // Flush all the data to files
 func (db *UnspentDB) Sync() {
+	db.waitCommit()
+	db.sync()
+}
+
+
+func (db *UnspentDB) sync() {
+	db.tdbMutex.Lock()
 	db.nosyncinprogress = false
 	for i := range db.tdb {
 		if db.tdb[i]!=nil {
 			db.tdb[i].Sync()
 		}
 	}
+	db.tdbMutex.Unlock()
 	db.syncUnpent()
 }
 
@@ -224,17 +300,22 @@ func (db *UnspentDB) syncUnpent() {
 
 // Hold on writing data to disk untill next sync is called
 func (db *UnspentDB) nosync() {
+	db.tdbMutex.Lock()
 	db.nosyncinprogress = true
 	for i := range db.tdb {
 		if db.tdb[i]!=nil {
 			db.tdb[i].NoSync()
 		}
 	}
+	db.tdbMutex.Unlock()
 }
 
 
 // Flush the data and close all the files
 func (db *UnspentDB) Close() {
+	db.waitCommit()
+	db.tdbMutex.Lock()
+	defer db.tdbMutex.Unlock()
 	for i := range db.tdb {
 		if db.tdb[i]!=nil {
 			if db.FullDefragOnClose {
@@ -250,6 +331,9 @@ func (db *UnspentDB) Close() {
 
 // Call it when the main thread is idle - this will do DB defrag
 func (db *UnspentDB) Idle() bool {
+	db.waitCommit()
+	db.tdbMutex.Lock()
+	defer db.tdbMutex.Unlock()
 	for _ = range db.tdb {
 		db.defragIndex++
 		if db.defragIndex >= len(db.tdb) {
@@ -266,26 +350,33 @@ func (db *UnspentDB) Idle() bool {
 
 // Flush all the data to disk
 func (db *UnspentDB) Save() {
+	db.waitCommit()
+	db.tdbMutex.Lock()
 	for i := range db.tdb {
 		if db.tdb[i]!=nil {
 			db.tdb[i].Flush()
 		}
 	}
+	db.tdbMutex.Unlock()
 	db.syncUnpent()
 }
 
 
 // Get ne unspent output
 func (db *UnspentDB) UnspentGet(po *btc.TxPrevOut) (res *btc.TxOut, e error) {
-	ind := qdb.KeyType(binary.LittleEndian.Uint64(po.Hash[:8]))
-	v := db.DbN(int(po.Hash[31])%NumberOfUnspentSubDBs).Get(ind)
-	if v==nil {
+	rec, found := db.pendingGet(po)
+	if !found {
+		ind := qdb.KeyType(binary.LittleEndian.Uint64(po.Hash[:8]))
+		if v := db.DbN(int(po.Hash[31])%NumberOfUnspentSubDBs).Get(ind); v != nil {
+			rec = NewQdbRec(ind, v)
+		}
+	}
+	if rec==nil {
 		e = errors.New("Unspent TX not found")
 		return
 	}
 
-	rec := NewQdbRec(ind, v)
-	if len(rec.Outs)<int(po.Vout) || rec.Outs[po.Vout]==nil {
+	if len(rec.Outs)<=int(po.Vout) || rec.Outs[po.Vout]==nil {
 		e = errors.New("Unspent VOut not found")
 		return
 	}
@@ -302,6 +393,7 @@ func (db *UnspentDB) UnspentGet(po *btc.TxPrevOut) (res *btc.TxOut, e error) {
 // Browse through all unspent outputs
 func (db *UnspentDB) BrowseUTXO(quick bool, walk FunctionWalkUnspent) {
 	var i int
+	db.waitCommit()
 	brfn := func(k qdb.KeyType, v []byte) (fl uint32) {
 		walk(NewQdbRecStatic(k, v))
 		return
@@ -319,6 +411,8 @@ func (db *UnspentDB) BrowseUTXO(quick bool, walk FunctionWalkUnspent) {
 }
 
 func (db *UnspentDB) DbN(i int) (*qdb.DB) {
+	db.tdbMutex.Lock()
+	defer db.tdbMutex.Unlock()
 	if db.tdb[i]==nil {
 		qdb.NewDBExt(&db.tdb[i], &qdb.NewDBOpts {
 			Dir : db.dir+fmt.Sprintf("%06d", i),
@@ -341,9 +435,6 @@ func (db *UnspentDB) DbN(i int) (*qdb.DB) {
 
 
 func (db *UnspentDB) del(hash []byte, outs []bool) {
-	if db.ch.CB.NotifyTxDel!=nil {
-		db.ch.CB.NotifyTxDel(hash, outs)
-	}
 	ind := qdb.KeyType(binary.LittleEndian.Uint64(hash[:8]))
 	_db := db.DbN(int(hash[31])%NumberOfUnspentSubDBs)
 	v := _db.Get(ind)
@@ -367,13 +458,25 @@ func (db *UnspentDB) del(hash []byte, outs []bool) {
 }
 
 
+// Calls the chain's callbacks for the given changes
+func (db *UnspentDB) notify(changes *BlockChanges) {
+	if db.ch.CB.NotifyTxAdd!=nil {
+		for _, rec := range changes.AddList {
+			db.ch.CB.NotifyTxAdd(rec)
+		}
+	}
+	if db.ch.CB.NotifyTxDel!=nil {
+		for k, v := range changes.DeledTxs {
+			db.ch.CB.NotifyTxDel(k[:], v)
+		}
+	}
+}
+
+
 func (db *UnspentDB) commit(changes *BlockChanges) {
 	// Now aplly the unspent changes
 	for _, rec := range changes.AddList {
 		ind := qdb.KeyType(binary.LittleEndian.Uint64(rec.TxID[:8]))
-		if db.ch.CB.NotifyTxAdd!=nil {
-			db.ch.CB.NotifyTxAdd(rec)
-		}
 		db.DbN(int(rec.TxID[31])%NumberOfUnspentSubDBs).PutExt(ind, rec.Bytes(), 0)
 	}
 	for k, v := range changes.DeledTxs {
@@ -383,6 +486,7 @@ func (db *UnspentDB) commit(changes *BlockChanges) {
 
 
 func (db *UnspentDB) PrintCoinAge() {
+	db.waitCommit()
 	const chunk = 10000
 	var maxbl uint32
 	type onerec struct {
@@ -431,6 +535,7 @@ func (db *UnspentDB) PrintCoinAge() {
 func (db *UnspentDB) GetStats() (s string) {
 	var tot, outcnt, sum, sumcb, stealth_uns, stealth_tot uint64
 	var mincnt, maxcnt, totdatasize, unspendable uint64
+	db.waitCommit()
 	for i := range db.tdb {
 		dbcnt := uint64(db.DbN(i).Count())
 		if i==0 {
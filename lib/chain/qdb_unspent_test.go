@@ -0,0 +1,108 @@
+package chain
+
+import (
+	"testing"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+const (
+	benchTxsPerBlock = 2000
+	benchLastKnown = 1e6 // we are far from the top, like during the initial sync
+)
+
+// Returns a chain with an UTXO database of outs non-coinbase outputs
+func benchChain(t testing.TB, outs int) (ch *Chain, funds []btc.TxPrevOut) {
+	ch = new(Chain)
+	ch.Unspent, _ = NewUnspentDb(&NewUnspentOpts{Dir:t.TempDir()+"/", Chain:ch})
+
+	changes := &BlockChanges{Height:1, LastKnownHeight:benchLastKnown, DeledTxs:make(map[[32]byte][]bool)}
+	for i := 0; i < outs/2; i++ {
+		rec := &QdbRec{InBlock:1, Outs:[]*QdbTxOut{{Value:1e8, PKScr:[]byte{0x51}}, {Value:1e8, PKScr:[]byte{0x51}}}}
+		binary.LittleEndian.PutUint64(rec.TxID[:], uint64(i))
+		rec.TxID[31] = byte(i)
+		changes.AddList = append(changes.AddList, rec)
+		funds = append(funds, btc.TxPrevOut{Hash:rec.TxID, Vout:0}, btc.TxPrevOut{Hash:rec.TxID, Vout:1})
+	}
+	if e := ch.Unspent.CommitBlockTxs(changes, make([]byte, 32)); e != nil {
+		t.Fatal(e)
+	}
+	ch.Unspent.waitCommit()
+	return
+}
+
+// Returns a trusted block, spending the first 2*benchTxsPerBlock funds
+func benchBlock(height uint32, funds []btc.TxPrevOut) (bl *btc.Block, rest []btc.TxPrevOut) {
+	bl = &btc.Block{Trusted:true, Hash:btc.NewSha2Hash([]byte{byte(height), byte(height>>8), byte(height>>16)})}
+	cb := &btc.Tx{TxIn:[]*btc.TxIn{{ScriptSig:[]byte{byte(height), byte(height>>8), byte(height>>16)}}},
+		TxOut:[]*btc.TxOut{{Value:1e8, Pk_script:[]byte{0x51}}}}
+	cb.Hash = btc.NewSha2Hash(cb.Serialize())
+	bl.Txs = append(bl.Txs, cb)
+	for i := 0; i < benchTxsPerBlock; i++ {
+		tx := &btc.Tx{Version:1, TxIn:[]*btc.TxIn{{Input:funds[0]}, {Input:funds[1]}},
+			TxOut:[]*btc.TxOut{{Value:1e8, Pk_script:[]byte{0x51}}, {Value:1e8, Pk_script:[]byte{0x51}}}}
+		tx.Hash = btc.NewSha2Hash(tx.Serialize())
+		bl.Txs = append(bl.Txs, tx)
+		funds = append(funds[2:], btc.TxPrevOut{Hash:tx.Hash.Hash, Vout:0}, btc.TxPrevOut{Hash:tx.Hash.Hash, Vout:1})
+	}
+	rest = funds
+	return
+}
+
+func benchCommitBlocks(b *testing.B, pipelined bool) {
+	// Each block spends outputs of the previous one, which may be still being applied
+	ch, funds := benchChain(b, 2*benchTxsPerBlock)
+	defer ch.Unspent.Close()
+	blocks := make([]*btc.Block, b.N)
+	for i := range blocks {
+		blocks[i], funds = benchBlock(uint32(i+2), funds)
+	}
+	b.ResetTimer()
+	for i, bl := range blocks {
+		changes, e := ch.ProcessBlockTransactions(bl, uint32(i+2), benchLastKnown)
+		if e != nil {
+			b.Fatal(i, e)
+		}
+		if e = ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:]); e != nil {
+			b.Fatal(i, e)
+		}
+		if !pipelined {
+			ch.Unspent.waitCommit()
+		}
+	}
+	ch.Unspent.waitCommit()
+}
+
+func BenchmarkCommitBlockSerial(b *testing.B) {
+	benchCommitBlocks(b, false)
+}
+
+func BenchmarkCommitBlockPipelined(b *testing.B) {
+	benchCommitBlocks(b, true)
+}
+
+func TestCommitBlockTxsPending(t *testing.T) {
+	ch, funds := benchChain(t, 2*benchTxsPerBlock)
+	defer ch.Unspent.Close()
+	bl, rest := benchBlock(2, funds)
+	changes, e := ch.ProcessBlockTransactions(bl, 2, benchLastKnown)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:]); e != nil {
+		t.Fatal(e)
+	}
+	// The changes may not be in the database yet, but they must be seen
+	for i := 0; i < 2; i++ {
+		if ch.PickUnspent(&funds[0]) != nil {
+			t.Error(i, "Spent output found")
+		}
+		if out := ch.PickUnspent(&rest[len(rest)-1]); out == nil || out.BlockHeight != 2 {
+			t.Error(i, "New output not found")
+		}
+		if _, e = ch.ProcessBlockTransactions(bl, 3, benchLastKnown); e == nil {
+			t.Error(i, "Double spend not detected")
+		}
+		ch.Unspent.waitCommit()
+	}
+}
@@ -0,0 +1,95 @@
+package chain
+
+import (
+	"sync"
+	"runtime"
+	"sync/atomic"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+// ScriptThreads is the number of goroutines verifying scripts of a block.
+// If it is zero, runtime.GOMAXPROCS() is used.
+var ScriptThreads int
+
+
+func scriptThreads() int {
+	if ScriptThreads > 0 {
+		return ScriptThreads
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+
+type scriptCheck struct {
+	pkscr []byte
+	idx int
+	tx *btc.Tx
+}
+
+// scriptVerifier is a pool of goroutines verifying input scripts of a block.
+// After the first failure, the remaining checks are skipped.
+type scriptVerifier struct {
+	checks chan scriptCheck
+	wg sync.WaitGroup
+	failed uint32
+	flags uint32
+	closed bool
+}
+
+
+func newScriptVerifier(flags uint32) (sv *scriptVerifier) {
+	sv = &scriptVerifier{flags:flags}
+	n := scriptThreads()
+	sv.checks = make(chan scriptCheck, 64*n)
+	sv.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go sv.worker()
+	}
+	return
+}
+
+
+func (sv *scriptVerifier) worker() {
+	for c := range sv.checks {
+		if atomic.LoadUint32(&sv.failed) != 0 {
+			continue // just drain the channel
+		}
+		if script.CacheHas(c.pkscr, c.idx, c.tx, sv.flags, true) {
+			continue // already verified by the memory pool
+		}
+		// script.VerifyTxScript() also calls script.VerifyConsensus, if set
+		if !script.VerifyTxScript(c.pkscr, c.idx, c.tx, sv.flags) {
+			atomic.StoreUint32(&sv.failed, 1)
+		}
+	}
+	sv.wg.Done()
+}
+
+
+// Queues verification of the given input. Returns false if any of the scripts has already failed.
+func (sv *scriptVerifier) add(pkscr []byte, idx int, tx *btc.Tx) bool {
+	if atomic.LoadUint32(&sv.failed) != 0 {
+		return false
+	}
+	sv.checks <- scriptCheck{pkscr:pkscr, idx:idx, tx:tx}
+	return true
+}
+
+
+// Waits for all the queued checks to finish. Returns true if all the scripts were OK.
+func (sv *scriptVerifier) wait() bool {
+	if !sv.closed {
+		sv.closed = true
+		close(sv.checks)
+		sv.wg.Wait()
+	}
+	return atomic.LoadUint32(&sv.failed) == 0
+}
+
+
+// Aborts the remaining checks (in case the block has failed for another reason)
+func (sv *scriptVerifier) abort() {
+	atomic.StoreUint32(&sv.failed, 1)
+	sv.wait()
+}
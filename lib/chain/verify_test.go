@@ -0,0 +1,162 @@
+package chain
+
+import (
+	"time"
+	"testing"
+	"runtime"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Returns a tx with the given number of inputs and scriptSig of each one
+func testScriptTx(inputs int, sigscr []byte) (tx *btc.Tx) {
+	tx = &btc.Tx{Version:1, TxOut:[]*btc.TxOut{{Value:1e8, Pk_script:[]byte{0x51}}}}
+	for i := 0; i < inputs; i++ {
+		tx.TxIn = append(tx.TxIn, &btc.TxIn{Input:btc.TxPrevOut{Hash:[32]byte{1}, Vout:uint32(i)},
+			ScriptSig:sigscr, Sequence:0xffffffff})
+	}
+	tx.Hash = btc.NewSha2Hash(tx.Serialize())
+	return
+}
+
+// Fails the test if the number of goroutines does not go back to n within a second
+func testGoroutines(t *testing.T, n int) {
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10*time.Millisecond)
+	}
+	if runtime.NumGoroutine() > n {
+		t.Error("Goroutines left:", runtime.NumGoroutine()-n)
+	}
+}
+
+// Fails the test if f does not return within 10 seconds
+func testNoDeadlock(t *testing.T, f func()) {
+	done := make(chan bool)
+	go func() {
+		f()
+		done <- true
+	}()
+	select {
+		case <-done:
+		case <-time.After(10*time.Second):
+			t.Fatal("Deadlock")
+	}
+}
+
+func TestScriptVerifier(t *testing.T) {
+	defer func(n int) {
+		ScriptThreads = n
+	}(ScriptThreads)
+	good := testScriptTx(500, nil) // OP_1 in pkscript is enough
+	bad := testScriptTx(1, []byte{0x6a}) // OP_RETURN in scriptSig
+	ngr := runtime.NumGoroutine()
+
+	var tv = []struct {
+		threads int
+		bad int // index of the input that fails or -1
+	} {
+		{1, -1},
+		{4, -1},
+		{1, 0},
+		{4, 0},
+		{4, 250},
+		{4, 499},
+		{64, 499},
+	}
+	for i := range tv {
+		ScriptThreads = tv[i].threads
+		testNoDeadlock(t, func() {
+			sv := newScriptVerifier(0)
+			for j := range good.TxIn {
+				var ok bool
+				if j == tv[i].bad {
+					ok = sv.add([]byte{0x51}, 0, bad)
+				} else {
+					ok = sv.add([]byte{0x51}, j, good)
+				}
+				if !ok {
+					break // it has failed already - the block would be rejected now
+				}
+			}
+			if sv.wait() != (tv[i].bad == -1) {
+				t.Error(i, "Bad result")
+			}
+			if tv[i].bad != -1 && sv.add([]byte{0x51}, 0, good) {
+				t.Error(i, "Check added after the failure")
+			}
+			sv.abort() // it is deferred in commitTxs, so it gets called after wait() as well
+		})
+		testGoroutines(t, ngr)
+	}
+
+	// the block fails for other reason, before wait()
+	ScriptThreads = 4
+	testNoDeadlock(t, func() {
+		sv := newScriptVerifier(0)
+		for j := 0; j < 100; j++ {
+			sv.add([]byte{0x51}, j, good)
+		}
+		sv.abort()
+		if sv.wait() || sv.add([]byte{0x51}, 0, good) {
+			t.Error("Aborted verifier not failed")
+		}
+	})
+	testGoroutines(t, ngr)
+}
+
+func TestCommitTxsScripts(t *testing.T) {
+	ch, funds := benchChain(t, 2*benchTxsPerBlock)
+	defer ch.Unspent.Close()
+	ngr := runtime.NumGoroutine()
+	var tv = []struct {
+		badsig int // index of the tx with an invalid script or -1
+		doublespend bool
+		ok bool
+	} {
+		{-1, false, true},
+		{1, false, false},
+		{benchTxsPerBlock/2, false, false},
+		{benchTxsPerBlock, false, false},
+		{-1, true, false},
+	}
+	for i := range tv {
+		bl, _ := benchBlock(2, funds)
+		bl.Trusted = false
+		if tv[i].badsig >= 0 {
+			bl.Txs[tv[i].badsig].TxIn[1].ScriptSig = []byte{0x6a}
+		}
+		if tv[i].doublespend {
+			// the last tx spends the same as the first one - fails before all the scripts are checked
+			bl.Txs[benchTxsPerBlock].TxIn[0].Input = bl.Txs[1].TxIn[0].Input
+		}
+		testNoDeadlock(t, func() {
+			if _, e := ch.ProcessBlockTransactions(bl, 2, benchLastKnown); (e == nil) != tv[i].ok {
+				t.Error(i, "Unexpected result", e)
+			}
+		})
+		testGoroutines(t, ngr)
+	}
+}
+
+func TestCheckTransactions(t *testing.T) {
+	final := testScriptTx(2, nil)
+	locked := testScriptTx(2, nil)
+	locked.Lock_time = 101
+	locked.TxIn[1].Sequence = 0
+	var tv = []struct {
+		txs []*btc.Tx
+		height uint32
+		ok bool
+	} {
+		{[]*btc.Tx{final}, 100, true},
+		{[]*btc.Tx{final, final, final}, 100, true},
+		{[]*btc.Tx{final, locked, final}, 100, false},
+		{[]*btc.Tx{final, final, locked}, 101, false},
+		{[]*btc.Tx{final, final, locked}, 102, true},
+		{[]*btc.Tx{final, {Version:1, TxOut:final.TxOut}}, 100, false}, // no inputs
+	}
+	for i := range tv {
+		if CheckTransactions(tv[i].txs, tv[i].height, 1500000000) != tv[i].ok {
+			t.Error(i, "Unexpected result")
+		}
+	}
+}
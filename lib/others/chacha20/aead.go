@@ -0,0 +1,47 @@
+package chacha20
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+)
+
+func aeadTag(key, nonce, aad, ct, tag []byte) {
+	var blk [BlockSize]byte
+	var pad [16]byte
+	var lens [16]byte
+	Block(key, nonce, 0, &blk)
+	p := NewPoly1305(blk[:32])
+	p.Write(aad)
+	p.Write(pad[:(16-len(aad)%16)%16])
+	p.Write(ct)
+	p.Write(pad[:(16-len(ct)%16)%16])
+	binary.LittleEndian.PutUint64(lens[0:], uint64(len(aad)))
+	binary.LittleEndian.PutUint64(lens[8:], uint64(len(ct)))
+	p.Write(lens[:])
+	p.Sum(tag)
+}
+
+// Seal encrypts and authenticates the plaintext, returning ciphertext followed by the tag
+func Seal(key, nonce, aad, plain []byte) (res []byte) {
+	res = make([]byte, len(plain)+TagSize)
+	XORKeyStream(res, plain, key, nonce, 1)
+	aeadTag(key, nonce, aad, res[:len(plain)], res[len(plain):])
+	return
+}
+
+// Open verifies and decrypts the ciphertext (followed by the tag).
+// Returns nil if the authentication fails.
+func Open(key, nonce, aad, ct []byte) (res []byte) {
+	var tag [TagSize]byte
+	if len(ct) < TagSize {
+		return
+	}
+	le := len(ct)-TagSize
+	aeadTag(key, nonce, aad, ct[:le], tag[:])
+	if subtle.ConstantTimeCompare(tag[:], ct[le:]) != 1 {
+		return
+	}
+	res = make([]byte, le)
+	XORKeyStream(res, ct[:le], key, nonce, 1)
+	return
+}
@@ -0,0 +1,70 @@
+// Package chacha20 implements ChaCha20 stream cipher, Poly1305 authenticator
+// and ChaCha20-Poly1305 AEAD (RFC 8439), as used by BIP324 encrypted transport.
+package chacha20
+
+import (
+	"encoding/binary"
+)
+
+const (
+	KeySize = 32
+	NonceSize = 12
+	BlockSize = 64
+)
+
+func rotl(x uint32, b uint) uint32 {
+	return (x << b) | (x >> (32 - b))
+}
+
+func quarter(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b; d ^= a; d = rotl(d, 16)
+	c += d; b ^= c; b = rotl(b, 12)
+	a += b; d ^= a; d = rotl(d, 8)
+	c += d; b ^= c; b = rotl(b, 7)
+	return a, b, c, d
+}
+
+// Block computes one block of the key stream
+func Block(key []byte, nonce []byte, counter uint32, out *[BlockSize]byte) {
+	var s, x [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		s[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	s[12] = counter
+	s[13] = binary.LittleEndian.Uint32(nonce[0:])
+	s[14] = binary.LittleEndian.Uint32(nonce[4:])
+	s[15] = binary.LittleEndian.Uint32(nonce[8:])
+	x = s
+	for i := 0; i < 10; i++ {
+		x[0], x[4], x[8], x[12] = quarter(x[0], x[4], x[8], x[12])
+		x[1], x[5], x[9], x[13] = quarter(x[1], x[5], x[9], x[13])
+		x[2], x[6], x[10], x[14] = quarter(x[2], x[6], x[10], x[14])
+		x[3], x[7], x[11], x[15] = quarter(x[3], x[7], x[11], x[15])
+		x[0], x[5], x[10], x[15] = quarter(x[0], x[5], x[10], x[15])
+		x[1], x[6], x[11], x[12] = quarter(x[1], x[6], x[11], x[12])
+		x[2], x[7], x[8], x[13] = quarter(x[2], x[7], x[8], x[13])
+		x[3], x[4], x[9], x[14] = quarter(x[3], x[4], x[9], x[14])
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+s[i])
+	}
+}
+
+// XORKeyStream encrypts (or decrypts) src into dst, starting from the given block counter.
+// dst and src may overlap entirely.
+func XORKeyStream(dst, src []byte, key []byte, nonce []byte, counter uint32) {
+	var ks [BlockSize]byte
+	for len(src) > 0 {
+		Block(key, nonce, counter, &ks)
+		counter++
+		n := len(src)
+		if n > BlockSize {
+			n = BlockSize
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ ks[i]
+		}
+		dst, src = dst[n:], src[n:]
+	}
+}
@@ -0,0 +1,59 @@
+package chacha20
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+)
+
+// Test vectors are from RFC 8439
+
+func TestBlock(t *testing.T) {
+	var out [BlockSize]byte
+	key := make([]byte, KeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce, _ := hex.DecodeString("000000090000004a00000000")
+	Block(key, nonce, 1, &out)
+	if hex.EncodeToString(out[:]) != "10f1e7e4d13b5915500fdd1fa32071c4c7d1f4c733c068030422aa9ac3d46c4e"+
+		"d2826446079faa0914c2d705d98b02a2b5129cd1de164eb9cbd083e8a2503c4e" {
+		t.Error("Block mismatch", hex.EncodeToString(out[:]))
+	}
+}
+
+func TestPoly1305(t *testing.T) {
+	var tag [TagSize]byte
+	key, _ := hex.DecodeString("85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b")
+	msg := []byte("Cryptographic Forum Research Group")
+	for split := 0; split <= len(msg); split++ {
+		p := NewPoly1305(key)
+		p.Write(msg[:split])
+		p.Write(msg[split:])
+		p.Sum(tag[:])
+		if hex.EncodeToString(tag[:]) != "a8061dc1305136c6c22b8baf0c0127a9" {
+			t.Error("Poly1305 mismatch at split", split, hex.EncodeToString(tag[:]))
+		}
+	}
+}
+
+func TestAEAD(t *testing.T) {
+	key, _ := hex.DecodeString("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce, _ := hex.DecodeString("070000004041424344454647")
+	aad, _ := hex.DecodeString("50515253c0c1c2c3c4c5c6c7")
+	pt := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	exp, _ := hex.DecodeString("d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d63dbea45e8ca9671282fafb69da92728b" +
+		"1a71de0a9e060b2905d6a5b67ecd3b3692ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc3ff4def08e4b7a9de576d26586cec64b6116" +
+		"1ae10b594f09e26a7e902ecbd0600691")
+	ct := Seal(key, nonce, aad, pt)
+	if !bytes.Equal(ct, exp) {
+		t.Error("Seal mismatch", hex.EncodeToString(ct))
+	}
+	if res := Open(key, nonce, aad, ct); !bytes.Equal(res, pt) {
+		t.Error("Open failed")
+	}
+	ct[10] ^= 0x01
+	if Open(key, nonce, aad, ct) != nil {
+		t.Error("Open accepted modified ciphertext")
+	}
+}
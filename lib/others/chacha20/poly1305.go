@@ -0,0 +1,119 @@
+package chacha20
+
+import (
+	"encoding/binary"
+)
+
+const TagSize = 16
+
+// Poly1305 computes the one-time authenticator (based on poly1305-donna-32)
+type Poly1305 struct {
+	r, h [5]uint32
+	pad [4]uint32
+	buf [16]byte
+	n int
+}
+
+// NewPoly1305 initializes the authenticator with a 32 bytes one-time key
+func NewPoly1305(key []byte) (p *Poly1305) {
+	p = new(Poly1305)
+	p.r[0] = binary.LittleEndian.Uint32(key[0:]) & 0x3ffffff
+	p.r[1] = (binary.LittleEndian.Uint32(key[3:]) >> 2) & 0x3ffff03
+	p.r[2] = (binary.LittleEndian.Uint32(key[6:]) >> 4) & 0x3ffc0ff
+	p.r[3] = (binary.LittleEndian.Uint32(key[9:]) >> 6) & 0x3f03fff
+	p.r[4] = (binary.LittleEndian.Uint32(key[12:]) >> 8) & 0x00fffff
+	for i := range p.pad {
+		p.pad[i] = binary.LittleEndian.Uint32(key[16+4*i:])
+	}
+	return
+}
+
+func (p *Poly1305) block(m []byte, hibit uint32) {
+	r0, r1, r2, r3, r4 := uint64(p.r[0]), uint64(p.r[1]), uint64(p.r[2]), uint64(p.r[3]), uint64(p.r[4])
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+
+	h0 := uint64(p.h[0] + binary.LittleEndian.Uint32(m[0:]) & 0x3ffffff)
+	h1 := uint64(p.h[1] + (binary.LittleEndian.Uint32(m[3:]) >> 2) & 0x3ffffff)
+	h2 := uint64(p.h[2] + (binary.LittleEndian.Uint32(m[6:]) >> 4) & 0x3ffffff)
+	h3 := uint64(p.h[3] + (binary.LittleEndian.Uint32(m[9:]) >> 6) & 0x3ffffff)
+	h4 := uint64(p.h[4] + ((binary.LittleEndian.Uint32(m[12:]) >> 8) | hibit))
+
+	d0 := h0*r0 + h1*s4 + h2*s3 + h3*s2 + h4*s1
+	d1 := h0*r1 + h1*r0 + h2*s4 + h3*s3 + h4*s2
+	d2 := h0*r2 + h1*r1 + h2*r0 + h3*s4 + h4*s3
+	d3 := h0*r3 + h1*r2 + h2*r1 + h3*r0 + h4*s4
+	d4 := h0*r4 + h1*r3 + h2*r2 + h3*r1 + h4*r0
+
+	c := d0 >> 26; p.h[0] = uint32(d0) & 0x3ffffff
+	d1 += c; c = d1 >> 26; p.h[1] = uint32(d1) & 0x3ffffff
+	d2 += c; c = d2 >> 26; p.h[2] = uint32(d2) & 0x3ffffff
+	d3 += c; c = d3 >> 26; p.h[3] = uint32(d3) & 0x3ffffff
+	d4 += c; c = d4 >> 26; p.h[4] = uint32(d4) & 0x3ffffff
+	p.h[0] += uint32(c) * 5
+	p.h[1] += p.h[0] >> 26
+	p.h[0] &= 0x3ffffff
+}
+
+// Write adds the data to the authenticated message
+func (p *Poly1305) Write(d []byte) {
+	if p.n > 0 {
+		n := copy(p.buf[p.n:], d)
+		p.n += n
+		d = d[n:]
+		if p.n < 16 {
+			return
+		}
+		p.block(p.buf[:], 1<<24)
+		p.n = 0
+	}
+	for len(d) >= 16 {
+		p.block(d, 1<<24)
+		d = d[16:]
+	}
+	p.n = copy(p.buf[:], d)
+}
+
+// Sum returns the tag. The authenticator cannot be used afterwards.
+func (p *Poly1305) Sum(tag []byte) {
+	if p.n > 0 {
+		p.buf[p.n] = 1
+		for i := p.n+1; i < 16; i++ {
+			p.buf[i] = 0
+		}
+		p.block(p.buf[:], 0)
+	}
+
+	h0, h1, h2, h3, h4 := p.h[0], p.h[1], p.h[2], p.h[3], p.h[4]
+	c := h1 >> 26; h1 &= 0x3ffffff
+	h2 += c; c = h2 >> 26; h2 &= 0x3ffffff
+	h3 += c; c = h3 >> 26; h3 &= 0x3ffffff
+	h4 += c; c = h4 >> 26; h4 &= 0x3ffffff
+	h0 += c * 5; c = h0 >> 26; h0 &= 0x3ffffff
+	h1 += c
+
+	// g = h + -p
+	g0 := h0 + 5; c = g0 >> 26; g0 &= 0x3ffffff
+	g1 := h1 + c; c = g1 >> 26; g1 &= 0x3ffffff
+	g2 := h2 + c; c = g2 >> 26; g2 &= 0x3ffffff
+	g3 := h3 + c; c = g3 >> 26; g3 &= 0x3ffffff
+	g4 := h4 + c - (1 << 26)
+
+	// select h if h < p, or g if h >= p
+	mask := (g4 >> 31) - 1
+	h0 = (h0 & ^mask) | (g0 & mask)
+	h1 = (h1 & ^mask) | (g1 & mask)
+	h2 = (h2 & ^mask) | (g2 & mask)
+	h3 = (h3 & ^mask) | (g3 & mask)
+	h4 = (h4 & ^mask) | (g4 & mask)
+
+	// h = (h % 2^128) + pad
+	h0 = h0 | (h1 << 26)
+	h1 = (h1 >> 6) | (h2 << 20)
+	h2 = (h2 >> 12) | (h3 << 14)
+	h3 = (h3 >> 18) | (h4 << 8)
+
+	f := uint64(h0) + uint64(p.pad[0]); binary.LittleEndian.PutUint32(tag[0:], uint32(f))
+	f = uint64(h1) + uint64(p.pad[1]) + (f >> 32); binary.LittleEndian.PutUint32(tag[4:], uint32(f))
+	f = uint64(h2) + uint64(p.pad[2]) + (f >> 32); binary.LittleEndian.PutUint32(tag[8:], uint32(f))
+	f = uint64(h3) + uint64(p.pad[3]) + (f >> 32); binary.LittleEndian.PutUint32(tag[12:], uint32(f))
+}
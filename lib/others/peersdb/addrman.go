@@ -0,0 +1,415 @@
+package peersdb
+
+import (
+	"net"
+	"sync"
+	"time"
+	"strings"
+	"strconv"
+	"math/rand"
+	"io/ioutil"
+	"hash/crc32"
+	crand "crypto/rand"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/qdb"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/others/siphash"
+)
+
+/*
+Address manager - protects us from eclipse attacks.
+
+Each known peer occupies a single slot in one of two tables:
+ * "new" - addresses we have heard about. The bucket depends on the network group
+   of the address and of the peer that has told us about it, so a single source
+   can only fill a few buckets, no matter how many addresses it sends.
+ * "tried" - addresses we have successfully connected to, bucketed by their group.
+The slot positions are computed with a secret key, so nobody can tell in advance
+which addresses will collide. When a slot is taken, the old entry is kept
+unless it is banned or expired.
+*/
+
+const (
+	NEW_BUCKETS = 1024
+	TRIED_BUCKETS = 256
+	BUCKET_SIZE = 64
+
+	NEW_BUCKETS_PER_SOURCE = 64
+	TRIED_BUCKETS_PER_GROUP = 8
+
+	SELECT_PEER_TRIES = 4*NEW_BUCKETS // buckets to look into before SelectPeer gives up
+	SELECT_PEER_CHECKS = 100 // peers to check before SelectPeer gives up
+)
+
+var (
+	am_k0, am_k1 uint64
+	new_tab [NEW_BUCKETS][BUCKET_SIZE]uint64 // UniqID of the peer or zero for an empty slot
+	tried_tab [TRIED_BUCKETS][BUCKET_SIZE]uint64
+	new_cnt, tried_cnt int
+)
+
+
+// Returns the group (IPv4 /16, IPv6 /32) used for bucketing
+func (p *PeerAddr) NetGroup() []byte {
+	switch {
+		case p.NetID != 0:
+			if len(p.Addr) > 0 {
+				return []byte{p.NetID, p.Addr[0]>>4}
+			}
+			return []byte{p.NetID}
+		case p.IsIPv4():
+			return []byte{btc.NET_IPV4, p.Ip4[0], p.Ip4[1]}
+	}
+	return []byte{btc.NET_IPV6, p.Ip6[0], p.Ip6[1], p.Ip6[2], p.Ip6[3]}
+}
+
+
+// Returns the group to which we allow only one outgoing connection: AS number if known, or NetGroup()
+func (p *PeerAddr) Group() []byte {
+	if p.IsIP() {
+		if asn := ASN(p.IP()); asn != 0 {
+			res := []byte{'A', 'S', 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(res[2:], asn)
+			return res
+		}
+	}
+	return p.NetGroup()
+}
+
+
+func amHash(data ...[]byte) uint64 {
+	var b []byte
+	for _, d := range data {
+		b = append(b, d...)
+	}
+	return siphash.Hash(am_k0, am_k1, b)
+}
+
+
+func u64b(v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return b[:]
+}
+
+
+func newPos(p *PeerAddr) (bucket, pos uint64) {
+	src := make([]byte, 4)
+	binary.LittleEndian.PutUint32(src, p.Source)
+	grp := p.NetGroup()
+	bucket = amHash(src, u64b(amHash(grp, src)%NEW_BUCKETS_PER_SOURCE)) % NEW_BUCKETS
+	pos = amHash([]byte{'N'}, u64b(bucket), u64b(p.UniqID())) % BUCKET_SIZE
+	return
+}
+
+
+func triedPos(p *PeerAddr) (bucket, pos uint64) {
+	grp := p.NetGroup()
+	bucket = amHash(grp, u64b(amHash(u64b(p.UniqID()))%TRIED_BUCKETS_PER_GROUP)) % TRIED_BUCKETS
+	pos = amHash([]byte{'K'}, u64b(bucket), u64b(p.UniqID())) % BUCKET_SIZE
+	return
+}
+
+
+func slotOf(p *PeerAddr) *uint64 {
+	if p.Tried {
+		b, i := triedPos(p)
+		return &tried_tab[b][i]
+	}
+	b, i := newPos(p)
+	return &new_tab[b][i]
+}
+
+
+// Returns true if the entry can be replaced by another one
+func isTerrible(p *PeerAddr) bool {
+	return p.IsBanned() || time.Now().After(time.Unix(int64(p.Time), 0).Add(ExpirePeerAfter))
+}
+
+
+// Puts the peer into its slot. Returns false if the slot is taken.
+// If the existing entry is terrible, it gets removed from the DB.
+func amPut(p *PeerAddr) bool {
+	slot := slotOf(p)
+	id := p.UniqID()
+	if *slot == id {
+		return true
+	}
+	if *slot != 0 {
+		if v := PeerDB.Get(qdb.KeyType(*slot)); v != nil && !isTerrible(NewPeer(v)) {
+			return false
+		}
+		PeerDB.Del(qdb.KeyType(*slot))
+		amCount(p.Tried, -1)
+	}
+	*slot = id
+	amCount(p.Tried, 1)
+	return true
+}
+
+
+// Removes the peer from its slot
+func amDel(p *PeerAddr) {
+	if slot := slotOf(p); *slot == p.UniqID() {
+		*slot = 0
+		amCount(p.Tried, -1)
+	}
+}
+
+
+func amCount(tried bool, n int) {
+	if tried {
+		tried_cnt += n
+	} else {
+		new_cnt += n
+	}
+}
+
+
+// Hash of the network group of the given peer, to be stored as Source
+func sourceOf(src *PeerAddr) uint32 {
+	if src == nil {
+		return 0
+	}
+	return crc32.ChecksumIEEE(src.NetGroup())
+}
+
+
+// Stores a new address (or updates the known one). The source is the peer that has told us about it.
+// Returns false if there was no room for it in the "new" table.
+func AddrReceived(a *PeerAddr, src *PeerAddr) bool {
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+	return addPeer(a, sourceOf(src))
+}
+
+
+func addPeer(a *PeerAddr, source uint32) bool {
+	if v := PeerDB.Get(qdb.KeyType(a.UniqID())); v != nil {
+		p := NewPeer(v)
+		if a.Time > p.Time {
+			p.Time = a.Time
+		}
+		p.Services |= a.Services
+		*a.OnePeer = *p.OnePeer
+		a.put()
+		return true
+	}
+	a.Tried = false
+	a.Source = source
+	if !amPut(a) {
+		return false
+	}
+	a.put()
+	return true
+}
+
+
+// Marks the peer as good (we have connected to it), moving it to the "tried" table.
+// Whoever was in that slot goes back to the "new" table.
+func (p *PeerAddr) Good() {
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+	if v := PeerDB.Get(qdb.KeyType(p.UniqID())); v != nil {
+		rec := NewPeer(v)
+		p.Tried, p.Source = rec.Tried, rec.Source
+	}
+	if p.Tried {
+		return
+	}
+	amDel(p)
+
+	b, i := triedPos(p)
+	if id := tried_tab[b][i]; id != 0 {
+		tried_tab[b][i] = 0
+		tried_cnt--
+		if v := PeerDB.Get(qdb.KeyType(id)); v != nil {
+			old := NewPeer(v)
+			old.Tried = false
+			if amPut(old) {
+				old.put()
+			} else {
+				PeerDB.Del(qdb.KeyType(id))
+			}
+		}
+	}
+	p.Tried = true
+	tried_tab[b][i] = p.UniqID()
+	tried_cnt++
+	p.put()
+}
+
+
+// Returns UniqID from a random slot of a random bucket, or zero if the bucket is empty.
+// Starting from the random slot, it takes the first non-empty one. Call it with peerdb_mutex locked.
+func randomSlot(tab [][BUCKET_SIZE]uint64) uint64 {
+	b := &tab[rand.Intn(len(tab))]
+	pos := rand.Intn(BUCKET_SIZE)
+	for i := 0; i < BUCKET_SIZE; i++ {
+		if id := b[(pos+i)%BUCKET_SIZE]; id != 0 {
+			return id
+		}
+	}
+	return 0
+}
+
+
+// Returns a random peer from the tables, or nil if there is none that passes the filter.
+// If new_only is false, there is 50% chance of getting a peer from the "tried" table.
+// It looks into random buckets, so it gives up after SELECT_PEER_TRIES empty ones
+// or SELECT_PEER_CHECKS peers not passing the filter.
+func SelectPeer(new_only bool, skip func(*PeerAddr) bool) *PeerAddr {
+	if proxyPeer != nil {
+		if skip == nil || !skip(proxyPeer) {
+			return proxyPeer
+		}
+		return nil
+	}
+
+	var checks int
+	for try := 0; try < SELECT_PEER_TRIES && checks < SELECT_PEER_CHECKS; try++ {
+		var id uint64
+		peerdb_mutex.Lock()
+		if !new_only && tried_cnt > 0 && (new_cnt == 0 || rand.Intn(2) == 0) {
+			id = randomSlot(tried_tab[:])
+		} else if new_cnt > 0 {
+			id = randomSlot(new_tab[:])
+		} else {
+			peerdb_mutex.Unlock()
+			return nil // no peers
+		}
+		peerdb_mutex.Unlock()
+		if id == 0 {
+			continue
+		}
+		checks++
+		if v := PeerDB.Get(qdb.KeyType(id)); v != nil {
+			ad := NewPeer(v)
+			if !ad.IsBanned() && ad.Routable() && (skip == nil || !skip(ad)) {
+				return ad
+			}
+		}
+	}
+	return nil
+}
+
+
+// Returns the number of peers in the "new" and in the "tried" table
+func AddrManStats() (int, int) {
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+	return new_cnt, tried_cnt
+}
+
+
+// Loads (or creates) the secret key and puts all the peers from the DB into the tables.
+// The ones that do not fit are removed from the DB.
+func initAddrMan(dir string) {
+	key, _ := ioutil.ReadFile(dir+"addrman.key")
+	if len(key) != 16 {
+		key = make([]byte, 16)
+		crand.Read(key)
+		ioutil.WriteFile(dir+"addrman.key", key, 0600)
+	}
+	am_k0 = binary.LittleEndian.Uint64(key[0:8])
+	am_k1 = binary.LittleEndian.Uint64(key[8:16])
+	new_tab, tried_tab = [NEW_BUCKETS][BUCKET_SIZE]uint64{}, [TRIED_BUCKETS][BUCKET_SIZE]uint64{}
+	new_cnt, tried_cnt = 0, 0
+
+	var all, demoted []*PeerAddr
+	var todel []qdb.KeyType
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		all = append(all, NewPeer(v)) // we cannot call Get() nor Del() from here
+		return 0
+	})
+	for _, p := range all {
+		if !p.Routable() {
+			todel = append(todel, qdb.KeyType(p.UniqID()))
+		} else if !amPut(p) {
+			if p.Tried {
+				demoted = append(demoted, p)
+			} else {
+				todel = append(todel, qdb.KeyType(p.UniqID()))
+			}
+		}
+	}
+	for _, p := range demoted {
+		p.Tried = false
+		if amPut(p) {
+			p.put()
+		} else {
+			todel = append(todel, qdb.KeyType(p.UniqID()))
+		}
+	}
+	for _, k := range todel {
+		PeerDB.Del(k)
+	}
+}
+
+
+var (
+	asmap [129]map[[16]byte]uint32 // AS number by the network prefix, for each prefix length
+	asmap_mutex sync.Mutex
+)
+
+
+// Loads the AS map from a text file, with lines like "1.2.0.0/16 AS1234" or "2001:db8::/32 1234".
+// Empty file name disables the map.
+func LoadASMap(fn string) (cnt int, e error) {
+	var m [129]map[[16]byte]uint32
+	if fn != "" {
+		var d []byte
+		if d, e = ioutil.ReadFile(fn); e != nil {
+			return
+		}
+		for _, line := range strings.Split(string(d), "\n") {
+			ss := strings.Fields(line)
+			if len(ss) < 2 || strings.HasPrefix(ss[0], "#") {
+				continue
+			}
+			_, nw, er := net.ParseCIDR(ss[0])
+			if er != nil {
+				continue
+			}
+			asn, er := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(ss[1]), "AS"), 10, 32)
+			if er != nil {
+				continue
+			}
+			ones, _ := nw.Mask.Size()
+			if nw.IP.To4() != nil {
+				ones += 96
+			}
+			var k [16]byte
+			copy(k[:], nw.IP.To16())
+			if m[ones] == nil {
+				m[ones] = make(map[[16]byte]uint32)
+			}
+			m[ones][k] = uint32(asn)
+			cnt++
+		}
+	}
+	asmap_mutex.Lock()
+	asmap = m
+	asmap_mutex.Unlock()
+	return
+}
+
+
+// Returns AS number of the given IP, or zero if unknown
+func ASN(ip net.IP) uint32 {
+	var k [16]byte
+	copy(k[:], ip.To16())
+	asmap_mutex.Lock()
+	defer asmap_mutex.Unlock()
+	for ones := 128; ones >= 0; ones-- {
+		if ones < 128 {
+			k[ones/8] &= ^byte(0xff >> uint(ones%8))
+		}
+		if asmap[ones] != nil {
+			if asn, ok := asmap[ones][k]; ok {
+				return asn
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,323 @@
+package peersdb
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"testing"
+	"github.com/piotrnar/gocoin/lib/qdb"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func testPeer(ip string) (p *PeerAddr) {
+	p = NewEmptyPeer()
+	p.SetIP(net.ParseIP(ip))
+	p.Port = 8333
+	p.Services = 1
+	p.Time = uint32(time.Now().Unix())
+	return
+}
+
+// Returns the peer as stored in the DB, or nil
+func testGet(p *PeerAddr) *PeerAddr {
+	if v := PeerDB.Get(qdb.KeyType(p.UniqID())); v != nil {
+		return NewPeer(v)
+	}
+	return nil
+}
+
+func testOpen(t *testing.T) {
+	OpenPeerDB(t.TempDir() + "/")
+	t.Cleanup(ClosePeerDB)
+}
+
+func TestNetGroup(t *testing.T) {
+	tor := NewEmptyPeer()
+	tor.NetID, tor.Addr = btc.NET_TORV3, append([]byte{0xab}, make([]byte, 31)...)
+	var tv = []struct {
+		p *PeerAddr
+		grp []byte
+	} {
+		{testPeer("8.8.4.4"), []byte{btc.NET_IPV4, 8, 8}},
+		{testPeer("2001:4860:1234::1"), []byte{btc.NET_IPV6, 0x20, 0x01, 0x48, 0x60}},
+		{tor, []byte{btc.NET_TORV3, 0xa}},
+	}
+	for i := range tv {
+		if g := tv[i].p.NetGroup(); string(g) != string(tv[i].grp) {
+			t.Error(i, "Bad group", g)
+		}
+		if g := tv[i].p.Group(); string(g) != string(tv[i].grp) {
+			t.Error(i, "Bad group without AS map", g)
+		}
+	}
+}
+
+func TestBucketPositions(t *testing.T) {
+	am_k0, am_k1 = 1, 2
+	src := sourceOf(testPeer("1.2.3.4"))
+	newb := make(map[uint64]bool)
+	triedb := make(map[uint64]bool)
+	for i := 0; i < 2000; i++ {
+		p := testPeer(fmt.Sprint("8.8.", i/250, ".", i%250))
+		p.Source = src
+		b, pos := newPos(p)
+		if b >= NEW_BUCKETS || pos >= BUCKET_SIZE {
+			t.Fatal(i, "Bad new position", b, pos)
+		}
+		newb[b] = true
+		if b, pos = triedPos(p); b >= TRIED_BUCKETS || pos >= BUCKET_SIZE {
+			t.Fatal(i, "Bad tried position", b, pos)
+		}
+		triedb[b] = true
+	}
+	// one source with addresses from one group can only fill a few buckets
+	if len(newb) != 1 {
+		t.Error("New buckets used by one group from one source:", len(newb))
+	}
+	if len(triedb) > TRIED_BUCKETS_PER_GROUP {
+		t.Error("Tried buckets used by one group:", len(triedb))
+	}
+	// ... but addresses from many groups from one source can fill up to NEW_BUCKETS_PER_SOURCE
+	newb = make(map[uint64]bool)
+	for i := 0; i < 2000; i++ {
+		p := testPeer(fmt.Sprint(1+i/250, ".", i%250, ".1.1"))
+		p.Source = src
+		b, _ := newPos(p)
+		newb[b] = true
+	}
+	if len(newb) > NEW_BUCKETS_PER_SOURCE || len(newb) < NEW_BUCKETS_PER_SOURCE/2 {
+		t.Error("New buckets used by one source:", len(newb))
+	}
+
+	// positions depend on the secret key
+	p := testPeer("8.8.8.8")
+	b1, p1 := newPos(p)
+	am_k0 = 3
+	if b2, p2 := newPos(p); b1 == b2 && p1 == p2 {
+		t.Error("Position does not depend on the key")
+	}
+}
+
+// Returns two different peers from the same group, that would take the same slot
+func testCollision(t *testing.T, tried bool) (a, b *PeerAddr) {
+	slots := make(map[[2]uint64]*PeerAddr)
+	for i := 0; i < 65536; i++ {
+		p := testPeer(fmt.Sprint("8.8.", i>>8, ".", i&0xff))
+		var k [2]uint64
+		if tried {
+			k[0], k[1] = triedPos(p)
+		} else {
+			k[0], k[1] = newPos(p)
+		}
+		if a = slots[k]; a != nil {
+			ab, ap := newPos(a)
+			pb, pp := newPos(p)
+			if !tried || ab != pb || ap != pp { // "tried" ones must also fit into "new" together
+				return a, p
+			}
+		}
+		slots[k] = p
+	}
+	t.Fatal("No collision found")
+	return
+}
+
+func TestAddrManNew(t *testing.T) {
+	testOpen(t)
+	a, b := testCollision(t, false)
+	if !AddrReceived(a, nil) {
+		t.Fatal("Peer not added")
+	}
+	if n, tr := AddrManStats(); n != 1 || tr != 0 {
+		t.Error("Bad stats", n, tr)
+	}
+	// the address known already gets updated
+	a2 := testPeer(a.IP().String())
+	a2.Services = 8
+	if !AddrReceived(a2, nil) || testGet(a).Services != 9 {
+		t.Error("Known peer not updated")
+	}
+	// the slot is taken by a good peer
+	if AddrReceived(b, nil) || testGet(b) != nil {
+		t.Error("Good peer evicted")
+	}
+	// ... and by a terrible one
+	old := testGet(a)
+	old.Time = uint32(time.Now().Add(-ExpirePeerAfter - time.Minute).Unix())
+	old.put()
+	if !AddrReceived(b, nil) || testGet(b) == nil || testGet(a) != nil {
+		t.Error("Terrible peer not evicted")
+	}
+	if n, _ := AddrManStats(); n != 1 || PeerDB.Count() != 1 {
+		t.Error("Bad count", n, PeerDB.Count())
+	}
+	// a banned peer is terrible as well
+	old = testGet(b)
+	old.BanUntil = uint32(time.Now().Add(time.Hour).Unix())
+	old.put()
+	if !isTerrible(old) || !AddrReceived(testPeer(a.IP().String()), nil) || testGet(b) != nil {
+		t.Error("Banned peer not evicted")
+	}
+}
+
+func TestAddrManGood(t *testing.T) {
+	testOpen(t)
+	a, b := testCollision(t, true)
+	AddrReceived(a, nil)
+	AddrReceived(b, nil)
+	if n, tr := AddrManStats(); n != 2 || tr != 0 {
+		t.Fatal("Bad stats", n, tr)
+	}
+	a.Good()
+	if rec := testGet(a); rec == nil || !rec.Tried {
+		t.Error("Peer not moved to tried")
+	}
+	if n, tr := AddrManStats(); n != 1 || tr != 1 {
+		t.Error("Bad stats", n, tr)
+	}
+	a.Good() // nothing changes
+	if n, tr := AddrManStats(); n != 1 || tr != 1 {
+		t.Error("Bad stats", n, tr)
+	}
+	// b takes the tried slot of a, which goes back to new
+	b.Good()
+	if rec := testGet(b); rec == nil || !rec.Tried {
+		t.Error("Peer not moved to tried")
+	}
+	if rec := testGet(a); rec == nil || rec.Tried {
+		t.Error("Peer not moved back to new")
+	}
+	if n, tr := AddrManStats(); n != 1 || tr != 1 {
+		t.Error("Bad stats", n, tr)
+	}
+	// Save keeps the tried flag
+	b.Tried = false
+	b.Save()
+	if !testGet(b).Tried {
+		t.Error("Save lost the tried flag")
+	}
+}
+
+func TestSelectPeer(t *testing.T) {
+	testOpen(t)
+	if SelectPeer(false, nil) != nil {
+		t.Error("Peer from empty tables")
+	}
+	peers := make(map[uint64]*PeerAddr)
+	for i := 0; i < 10; i++ {
+		p := testPeer(fmt.Sprint(i+11, ".8.8.8"))
+		AddrReceived(p, nil)
+		peers[p.UniqID()] = p
+	}
+	var good *PeerAddr
+	for _, p := range peers {
+		good = p
+		break
+	}
+	good.Good()
+	seen := make(map[uint64]bool)
+	for i := 0; i < 200; i++ {
+		p := SelectPeer(false, nil)
+		if p == nil || peers[p.UniqID()] == nil {
+			t.Fatal(i, "Bad peer selected", p)
+		}
+		seen[p.UniqID()] = true
+		if p = SelectPeer(true, nil); p == nil || p.UniqID() == good.UniqID() {
+			t.Fatal(i, "Tried peer selected for new only")
+		}
+	}
+	if len(seen) < 5 || !seen[good.UniqID()] {
+		t.Error("Selection not random", len(seen))
+	}
+	// it looks into random buckets, so it may give up before finding the only one
+	var found *PeerAddr
+	for i := 0; i < 3 && found == nil; i++ {
+		found = SelectPeer(false, func(p *PeerAddr) bool { return p.UniqID() != good.UniqID() })
+	}
+	if found == nil || found.UniqID() != good.UniqID() {
+		t.Error("Skip filter ignored")
+	}
+	if SelectPeer(false, func(*PeerAddr) bool { return true }) != nil {
+		t.Error("All peers skipped, but one selected")
+	}
+	good.Ban()
+	for i := 0; i < 100; i++ {
+		if SelectPeer(false, nil).UniqID() == good.UniqID() {
+			t.Fatal("Banned peer selected")
+		}
+	}
+}
+
+func TestInitAddrMan(t *testing.T) {
+	dir := t.TempDir() + "/"
+	OpenPeerDB(dir)
+	for i := 0; i < 10; i++ {
+		AddrReceived(testPeer(fmt.Sprint(i+11, ".8.8.8")), nil)
+	}
+	testPeer("11.8.8.8").Good()
+	// non routable ones get removed when loading
+	p := testPeer("10.0.0.1")
+	p.put()
+	n0, tr0 := AddrManStats()
+	cnt0 := PeerDB.Count()
+	ClosePeerDB()
+
+	OpenPeerDB(dir)
+	if n, tr := AddrManStats(); n != n0 || tr != tr0 || tr != 1 || PeerDB.Count() != cnt0-1 {
+		t.Error("Bad stats after reload", n, tr, PeerDB.Count())
+	}
+	if rec := testGet(testPeer("11.8.8.8")); rec == nil || !rec.Tried {
+		t.Error("Tried peer lost")
+	}
+	ClosePeerDB()
+
+	// new key, other slots - the tables do not keep the old entries
+	os.Remove(dir + "addrman.key")
+	testOpen(t)
+	if n, tr := AddrManStats(); n != 0 || tr != 0 {
+		t.Error("Tables not reset", n, tr)
+	}
+}
+
+func TestLoadASMap(t *testing.T) {
+	fn := t.TempDir() + "/asmap.txt"
+	os.WriteFile(fn, []byte("# comment\n1.2.0.0/16 AS1234\n1.2.3.0/24 as99\n2001:db8::/32 5678\nbad line\n3.0.0.0/8 ASx\n"), 0600)
+	cnt, e := LoadASMap(fn)
+	if e != nil || cnt != 3 {
+		t.Fatal("LoadASMap", cnt, e)
+	}
+	defer LoadASMap("")
+	var tv = []struct {
+		ip string
+		asn uint32
+	} {
+		{"1.2.3.4", 99},
+		{"1.2.4.4", 1234},
+		{"1.3.0.1", 0},
+		{"2001:db8:1::1", 5678},
+		{"2001:db9::1", 0},
+		{"3.1.1.1", 0},
+	}
+	for i := range tv {
+		if asn := ASN(net.ParseIP(tv[i].ip)); asn != tv[i].asn {
+			t.Error(i, "Bad ASN", asn)
+		}
+	}
+	if g := testPeer("1.2.3.4").Group(); string(g) != "AS\x00\x00\x00\x63" {
+		t.Error("Bad AS group", g)
+	}
+	if g := testPeer("1.3.0.1").Group(); string(g) != string([]byte{btc.NET_IPV4, 1, 3}) {
+		t.Error("Bad group outside AS map", g)
+	}
+	if _, e = LoadASMap(fn + ".none"); e == nil {
+		t.Error("No error for missing file")
+	}
+	if ASN(net.ParseIP("1.2.3.4")) != 99 {
+		t.Error("Failed load changed the map")
+	}
+	LoadASMap("")
+	if ASN(net.ParseIP("1.2.3.4")) != 0 {
+		t.Error("AS map not disabled")
+	}
+}
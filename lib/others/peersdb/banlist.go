@@ -0,0 +1,227 @@
+package peersdb
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"sync"
+	"bufio"
+	"errors"
+	"strings"
+	"strconv"
+	"github.com/piotrnar/gocoin/lib/qdb"
+)
+
+/*
+banlist.txt - subnets banned by the user, one per line:
+	<IP/bits> <unix time when the ban expires, or 0 if never> <reason>
+Single misbehaving peers are banned in their peers DB records, for BanTime.
+The records keep the ban's expiry time, so changing BanTime affects only new bans.
+*/
+
+type BanEntry struct {
+	Net *net.IPNet
+	Until time.Time // zero for a permanent ban
+	Reason string
+}
+
+var (
+	BanTime = 24*time.Hour // How long misbehaving peers get banned for
+
+	banlist []*BanEntry
+	banlist_file string
+	banlist_mutex sync.Mutex
+)
+
+
+// Returns true if the peer is banned (itself or its subnet)
+func (p *PeerAddr) IsBanned() bool {
+	if p.BanUntil != 0 && time.Now().Before(time.Unix(int64(p.BanUntil), 0)) {
+		return true
+	}
+	return p.IsIP() && SubnetBanned(p.IP())
+}
+
+
+// Parses "a.b.c.d", "a.b.c.d/bits", "ipv6" or "ipv6/bits" (port number, if present, is ignored)
+func ParseSubnet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if host, _, e := net.SplitHostPort(s); e == nil {
+		s = host
+	}
+	s = strings.Trim(s, "[]")
+	if strings.Index(s, "/") == -1 {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("Bad IP address " + s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP:ip4, Mask:net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP:ip, Mask:net.CIDRMask(128, 128)}, nil
+	}
+	_, n, e := net.ParseCIDR(s)
+	return n, e
+}
+
+
+func (b *BanEntry) expired() bool {
+	return !b.Until.IsZero() && time.Now().After(b.Until)
+}
+
+
+// Returns true if the IP belongs to any of the banned subnets
+func SubnetBanned(ip net.IP) bool {
+	banlist_mutex.Lock()
+	defer banlist_mutex.Unlock()
+	for _, b := range banlist {
+		if b.Net.Contains(ip) && !b.expired() {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Bans the subnet for the given time (zero for ever)
+func BanSubnet(n *net.IPNet, dur time.Duration, reason string) {
+	b := &BanEntry{Net:n, Reason:reason}
+	if dur != 0 {
+		b.Until = time.Now().Add(dur)
+	}
+	banlist_mutex.Lock()
+	for i := range banlist {
+		if banlist[i].Net.String() == n.String() {
+			banlist[i] = b
+			b = nil
+			break
+		}
+	}
+	if b != nil {
+		banlist = append(banlist, b)
+	}
+	saveBanList()
+	banlist_mutex.Unlock()
+}
+
+
+// Removes the subnet from the ban list and unbans all the single peers from it.
+// Returns the number of removed bans.
+func UnbanSubnet(n *net.IPNet) (cnt int) {
+	banlist_mutex.Lock()
+	for i := 0; i < len(banlist); i++ {
+		if banlist[i].Net.String() == n.String() {
+			banlist = append(banlist[:i], banlist[i+1:]...)
+			cnt++
+			break
+		}
+	}
+	saveBanList()
+	banlist_mutex.Unlock()
+
+	var unban []*PeerAddr
+	peerdb_mutex.Lock()
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		p := NewPeer(v)
+		if p.BanUntil != 0 && p.IsIP() && n.Contains(p.IP()) {
+			unban = append(unban, p) // we cannot call Put() from here
+		}
+		return 0
+	})
+	for _, p := range unban {
+		p.BanUntil = 0
+		p.put()
+	}
+	peerdb_mutex.Unlock()
+	cnt += len(unban)
+	return
+}
+
+
+// Returns the current list of banned subnets
+func GetBanList() (res []BanEntry) {
+	banlist_mutex.Lock()
+	for _, b := range banlist {
+		if !b.expired() {
+			res = append(res, *b)
+		}
+	}
+	banlist_mutex.Unlock()
+	return
+}
+
+
+// Returns all the peers from the DB that are banned now
+func GetBannedPeers() (res []*PeerAddr) {
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if p := NewPeer(v); p.BanUntil != 0 && p.IsBanned() {
+			res = append(res, p)
+		}
+		return 0
+	})
+	return
+}
+
+
+// Removes the expired entries and writes the list to disk (call it with banlist_mutex locked)
+func saveBanList() {
+	if banlist_file == "" {
+		return
+	}
+	f, e := os.Create(banlist_file)
+	if e != nil {
+		println("saveBanList:", e.Error())
+		return
+	}
+	var valid []*BanEntry
+	for _, b := range banlist {
+		if b.expired() {
+			continue
+		}
+		valid = append(valid, b)
+		var until int64
+		if !b.Until.IsZero() {
+			until = b.Until.Unix()
+		}
+		fmt.Fprintln(f, b.Net.String(), until, b.Reason)
+	}
+	f.Close()
+	banlist = valid
+}
+
+
+// Replaces the current list with the one from the file
+func loadBanList(fn string) {
+	banlist_mutex.Lock()
+	defer banlist_mutex.Unlock()
+	banlist_file = fn
+	banlist = nil
+	f, e := os.Open(fn)
+	if e != nil {
+		return
+	}
+	rd := bufio.NewScanner(f)
+	for rd.Scan() {
+		ss := strings.SplitN(strings.TrimSpace(rd.Text()), " ", 3)
+		if len(ss) < 2 {
+			continue
+		}
+		_, n, e := net.ParseCIDR(ss[0])
+		if e != nil {
+			println("banlist:", e.Error())
+			continue
+		}
+		b := &BanEntry{Net:n}
+		if until, _ := strconv.ParseInt(ss[1], 10, 64); until != 0 {
+			b.Until = time.Unix(until, 0)
+		}
+		if len(ss) > 2 {
+			b.Reason = ss[2]
+		}
+		if !b.expired() {
+			banlist = append(banlist, b)
+		}
+	}
+	f.Close()
+}
@@ -0,0 +1,140 @@
+package peersdb
+
+import (
+	"os"
+	"net"
+	"time"
+	"testing"
+)
+
+func TestParseSubnet(t *testing.T) {
+	var tv = []struct {
+		s string
+		res string // empty for an error
+	} {
+		{"1.2.3.4", "1.2.3.4/32"},
+		{" 1.2.3.4 ", "1.2.3.4/32"},
+		{"1.2.3.4:8333", "1.2.3.4/32"},
+		{"1.2.3.4/16", "1.2.0.0/16"},
+		{"1.2.3.4/33", ""},
+		{"1.2.3", ""},
+		{"", ""},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"[2001:db8::1]", "2001:db8::1/128"},
+		{"[2001:db8::1]:8333", "2001:db8::1/128"},
+		{"2001:db8::1/32", "2001:db8::/32"},
+		{"::ffff:1.2.3.4", "1.2.3.4/32"},
+		{"abc.onion", ""},
+	}
+	for i := range tv {
+		n, e := ParseSubnet(tv[i].s)
+		if tv[i].res == "" {
+			if e == nil {
+				t.Error(i, "No error for", n)
+			}
+			continue
+		}
+		if e != nil || n.String() != tv[i].res {
+			t.Error(i, "Bad result", n, e)
+		}
+	}
+}
+
+func testSubnet(s string) *net.IPNet {
+	n, _ := ParseSubnet(s)
+	return n
+}
+
+func TestBanList(t *testing.T) {
+	testOpen(t)
+	fn := t.TempDir() + "/banlist.txt"
+	loadBanList(fn)
+	BanSubnet(testSubnet("1.2.0.0/16"), 0, "for ever")
+	BanSubnet(testSubnet("2001:db8::/32"), time.Hour, "for an hour")
+	BanSubnet(testSubnet("5.6.7.8"), time.Hour, "replaced")
+	BanSubnet(testSubnet("5.6.7.8"), 2*time.Hour, "for two hours")
+	BanSubnet(testSubnet("9.9.9.9"), time.Nanosecond, "expired")
+	time.Sleep(time.Millisecond)
+	exp := GetBanList()
+	if len(exp) != 3 {
+		t.Fatal("Bad ban list", exp)
+	}
+
+	for i := 0; i < 2; i++ { // loading it again does not add the entries again
+		loadBanList(fn)
+		res := GetBanList()
+		if len(res) != len(exp) {
+			t.Fatal(i, "Bad loaded list", res)
+		}
+		for j := range res {
+			if res[j].Net.String() != exp[j].Net.String() || res[j].Reason != exp[j].Reason ||
+				res[j].Until.Unix() != exp[j].Until.Unix() || res[j].Until.IsZero() != exp[j].Until.IsZero() {
+				t.Error(i, j, "Bad entry", res[j], exp[j])
+			}
+		}
+	}
+	var tv = []struct {
+		ip string
+		banned bool
+	} {
+		{"1.2.200.1", true},
+		{"1.3.0.1", false},
+		{"2001:db8:ffff::1", true},
+		{"5.6.7.8", true},
+		{"5.6.7.9", false},
+		{"9.9.9.9", false},
+	}
+	for i := range tv {
+		if SubnetBanned(net.ParseIP(tv[i].ip)) != tv[i].banned || testPeer(tv[i].ip).IsBanned() != tv[i].banned {
+			t.Error(i, "Bad ban state")
+		}
+	}
+
+	// a single peer's ban gets removed with the subnet
+	p := testPeer("5.6.7.9")
+	p.Ban()
+	if UnbanSubnet(testSubnet("5.6.7.0/24")) != 1 || testGet(p).IsBanned() {
+		t.Error("Peer not unbanned")
+	}
+	if UnbanSubnet(testSubnet("5.6.7.8")) != 1 || SubnetBanned(net.ParseIP("5.6.7.8")) {
+		t.Error("Subnet not unbanned")
+	}
+	loadBanList(fn)
+	if len(GetBanList()) != 2 {
+		t.Error("Unban not saved")
+	}
+
+	os.Remove(fn)
+	loadBanList(fn)
+	if len(GetBanList()) != 0 {
+		t.Error("Old list kept")
+	}
+}
+
+func TestPeerBan(t *testing.T) {
+	testOpen(t)
+	defer func(bt time.Duration) {
+		BanTime = bt
+	}(BanTime)
+	BanTime = time.Hour
+	p := testPeer("8.8.8.8")
+	AddrReceived(p, nil)
+	p.Ban()
+	if rec := testGet(p); rec == nil || !rec.IsBanned() || len(GetBannedPeers()) != 1 {
+		t.Fatal("Peer not banned")
+	}
+	// changing BanTime does not change the existing bans
+	BanTime = time.Nanosecond
+	if !testGet(p).IsBanned() {
+		t.Error("Ban shortened")
+	}
+	p2 := testPeer("8.8.4.4")
+	p2.Ban()
+	time.Sleep(time.Millisecond)
+	if testGet(p2).IsBanned() {
+		t.Error("Ban not expired")
+	}
+	if until := int64(testGet(p).BanUntil) - time.Now().Add(time.Hour).Unix(); until < -2 || until > 0 {
+		t.Error("Bad ban expiry time", until)
+	}
+}
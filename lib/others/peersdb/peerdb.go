@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/qdb"
+	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/others/sys"
 	"github.com/piotrnar/gocoin/lib/others/utils"
 )
@@ -58,10 +59,10 @@ func NewPeer(v []byte) (p *PeerAddr) {
 
 func NewPeerFromString(ipstr string, force_default_port bool) (p *PeerAddr, e error) {
 	port := DefaultTcpPort()
-	x := strings.Index(ipstr, ":")
-	if x!=-1 {
+	// accepts "a.b.c.d", "ipv6", "[ipv6]" or "xxx.onion" - optionally followed by ":port"
+	if host, ps, er := net.SplitHostPort(ipstr); er == nil {
 		if !force_default_port {
-			v, er := strconv.ParseUint(ipstr[x+1:], 10, 32)
+			v, er := strconv.ParseUint(ps, 10, 32)
 			if er != nil {
 				e = er
 				return
@@ -72,28 +73,26 @@ func NewPeerFromString(ipstr string, force_default_port bool) (p *PeerAddr, e er
 			}
 			port = uint16(v)
 		}
-		ipstr = ipstr[:x] // remove port number
+		ipstr = host // remove port number
 	}
-	ip := net.ParseIP(ipstr)
-	if ip != nil && len(ip)==16 {
-		if sys.IsIPBlocked(ip[12:16]) {
+	p = NewEmptyPeer()
+	if e = p.SetHost(ipstr); e == nil {
+		if p.IsIP() && sys.IsIPBlocked(p.IP()) {
 			e = errors.New(ipstr+" is blocked")
+			p = nil
 			return
 		}
-		p = NewEmptyPeer()
-		copy(p.Ip4[:], ip[12:16])
 		p.Services = Services
-		copy(p.Ip6[:], ip[:12])
 		p.Port = port
-		if dbp := PeerDB.Get(qdb.KeyType(p.UniqID())); dbp!=nil && NewPeer(dbp).Banned!=0 {
+		if dbp := PeerDB.Get(qdb.KeyType(p.UniqID())); p.IsBanned() || dbp!=nil && NewPeer(dbp).IsBanned() {
 			e = errors.New(p.Ip() + " is banned")
 			p = nil
 		} else {
 			p.Time = uint32(time.Now().Unix())
-			p.Save()
+			AddrReceived(p, p)
 		}
 	} else {
-		e = errors.New("Error parsing IP '"+ipstr+"'")
+		p = nil
 	}
 	return
 }
@@ -103,11 +102,11 @@ func ExpirePeers() {
 	peerdb_mutex.Lock()
 	var delcnt uint32
 	now := time.Now()
-	todel := make([]qdb.KeyType, PeerDB.Count())
+	todel := make([]*PeerAddr, PeerDB.Count())
 	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 		ptim := binary.LittleEndian.Uint32(v[0:4])
 		if now.After(time.Unix(int64(ptim), 0).Add(ExpirePeerAfter)) {
-			todel[delcnt] = k // we cannot call Del() from here
+			todel[delcnt] = NewPeer(v) // we cannot call Del() from here
 			delcnt++
 		}
 		return 0
@@ -115,7 +114,8 @@ func ExpirePeers() {
 	if delcnt > 0 {
 		for delcnt > 0 && PeerDB.Count() > MinPeersInDB {
 			delcnt--
-			PeerDB.Del(todel[delcnt])
+			amDel(todel[delcnt])
+			PeerDB.Del(qdb.KeyType(todel[delcnt].UniqID()))
 		}
 		PeerDB.Defrag(false)
 	}
@@ -123,13 +123,24 @@ func ExpirePeers() {
 }
 
 
+// Stores the peer's record, keeping the address manager's fields of the one in the DB
 func (p *PeerAddr) Save() {
+	if v := PeerDB.Get(qdb.KeyType(p.UniqID())); v != nil {
+		rec := NewPeer(v)
+		p.Tried, p.Source = rec.Tried, rec.Source
+	}
+	p.put()
+}
+
+
+func (p *PeerAddr) put() {
 	PeerDB.Put(qdb.KeyType(p.UniqID()), p.Bytes())
 }
 
 
+// Bans the peer for BanTime
 func (p *PeerAddr) Ban() {
-	p.Banned = uint32(time.Now().Unix())
+	p.BanUntil = uint32(time.Now().Add(BanTime).Unix())
 	p.Save()
 }
 
@@ -150,8 +161,17 @@ func (p *PeerAddr) Dead() {
 }
 
 
+// Returns false for local IPs and for the networks we do not know
+func (p *PeerAddr) Routable() bool {
+	if p.IsIP() {
+		return sys.ValidIp(p.IP()) && !sys.IsIPBlocked(p.IP())
+	}
+	return (p.NetID==btc.NET_TORV3 || p.NetID==btc.NET_I2P) && len(p.Addr)==32
+}
+
+
 func (p *PeerAddr) Ip() (string) {
-	return fmt.Sprintf("%d.%d.%d.%d:%d", p.Ip4[0], p.Ip4[1], p.Ip4[2], p.Ip4[3], p.Port)
+	return p.NetAddr.String()
 }
 
 
@@ -159,8 +179,10 @@ func (p *PeerAddr) String() (s string) {
 	s = fmt.Sprintf("%21s", p.Ip())
 
 	now := uint32(time.Now().Unix())
-	if p.Banned != 0 {
-		s += fmt.Sprintf("  *BAN %3d min ago", (now-p.Banned)/60)
+	if p.IsBanned() && p.BanUntil != 0 {
+		s += fmt.Sprintf("  *BAN for %3d min", (p.BanUntil-now)/60)
+	} else if p.IsBanned() {
+		s += "  *BAN subnet"
 	} else {
 		s += fmt.Sprintf("  Seen %3d min ago", (now-p.Time)/60)
 	}
@@ -195,7 +217,7 @@ func GetBestPeers(limit uint, isConnected func(*PeerAddr)bool) (res manyPeers) {
 	tmp := make(manyPeers, 0)
 	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 		ad := NewPeer(v)
-		if ad.Banned==0 && sys.ValidIp4(ad.Ip4[:]) && !sys.IsIPBlocked(ad.Ip4[:]) {
+		if !ad.IsBanned() && ad.Routable() {
 			if isConnected==nil || !isConnected(ad) {
 				tmp = append(tmp, ad)
 			}
@@ -222,14 +244,13 @@ func initSeeds(seeds []string, port uint16) {
 		if er == nil {
 			for j := range ad {
 				ip := net.ParseIP(ad[j])
-				if ip != nil && len(ip)==16 {
+				if ip != nil {
 					p := NewEmptyPeer()
 					p.Time = uint32(time.Now().Unix())
 					p.Services = 1
-					copy(p.Ip6[:], ip[:12])
-					copy(p.Ip4[:], ip[12:16])
+					p.SetIP(ip)
 					p.Port = port
-					p.Save()
+					AddrReceived(p, nil)
 				}
 			}
 		} else {
@@ -239,26 +260,46 @@ func initSeeds(seeds []string, port uint16) {
 }
 
 
+// Opens the peers database, the ban list and the address manager - without seeding.
+// InitPeers calls it; alone it is useful for tests.
+func OpenPeerDB(dir string) {
+	PeerDB, _ = qdb.NewDB(dir+"peers3", true)
+	loadBanList(dir+"banlist.txt")
+	initAddrMan(dir)
+}
+
+
 // shall be called from the main thread
 func InitPeers(dir string) {
-	PeerDB, _ = qdb.NewDB(dir+"peers3", true)
+	OpenPeerDB(dir)
 
 	if ConnectOnly != "" {
-		x := strings.Index(ConnectOnly, ":")
-		if x == -1 {
-			ConnectOnly = fmt.Sprint(ConnectOnly, ":", DefaultTcpPort)
-		}
-		oa, e := net.ResolveTCPAddr("tcp4", ConnectOnly)
-		if e != nil {
-			println(e.Error())
-			os.Exit(1)
+		if _, _, e := net.SplitHostPort(ConnectOnly); e != nil {
+			ConnectOnly = net.JoinHostPort(strings.Trim(ConnectOnly, "[]"), fmt.Sprint(DefaultTcpPort()))
 		}
 		proxyPeer = NewEmptyPeer()
 		proxyPeer.Services = Services
-		copy(proxyPeer.Ip4[:], oa.IP[0:4])
-		proxyPeer.Port = uint16(oa.Port)
-		fmt.Printf("Connect to bitcoin network via %d.%d.%d.%d:%d\n",
-			oa.IP[0], oa.IP[1], oa.IP[2], oa.IP[3], oa.Port)
+		if host, port, _ := net.SplitHostPort(ConnectOnly); strings.HasSuffix(host, ".onion") {
+			// onion address cannot be resolved - it goes to the proxy as it is
+			v, e := strconv.ParseUint(port, 10, 16)
+			if e == nil {
+				e = proxyPeer.SetHost(host)
+			}
+			if e != nil {
+				println(e.Error())
+				os.Exit(1)
+			}
+			proxyPeer.Port = uint16(v)
+		} else {
+			oa, e := net.ResolveTCPAddr("tcp", ConnectOnly)
+			if e != nil {
+				println(e.Error())
+				os.Exit(1)
+			}
+			proxyPeer.SetIP(oa.IP)
+			proxyPeer.Port = uint16(oa.Port)
+		}
+		fmt.Println("Connect to bitcoin network via", proxyPeer.Ip())
 	} else {
 		go func() {
 			if !Testnet {
@@ -272,14 +313,13 @@ func InitPeers(dir string) {
 			} else {
 				for j := range testnet_seeds {
 					ip := net.ParseIP(testnet_seeds[j])
-					if ip != nil && len(ip)==16 {
+					if ip != nil {
 						p := NewEmptyPeer()
 						p.Time = uint32(time.Now().Unix())
 						p.Services = 1
-						copy(p.Ip6[:], ip[:12])
-						copy(p.Ip4[:], ip[12:16])
+						p.SetIP(ip)
 						p.Port = 18333
-						p.Save()
+						AddrReceived(p, nil)
 					}
 				}
 				initSeeds([]string{
@@ -0,0 +1,88 @@
+// Package sha3 implements SHA3-256 (FIPS 202), as used by Tor v3 onion address checksums.
+package sha3
+
+import (
+	"encoding/binary"
+)
+
+const rate = 136 // SHA3-256 block size in bytes
+
+var rc = [24]uint64{
+	0x0000000000000001, 0x0000000000008082, 0x800000000000808a, 0x8000000080008000,
+	0x000000000000808b, 0x0000000080000001, 0x8000000080008081, 0x8000000000008009,
+	0x000000000000008a, 0x0000000000000088, 0x0000000080008009, 0x000000008000000a,
+	0x000000008000808b, 0x800000000000008b, 0x8000000000008089, 0x8000000000008003,
+	0x8000000000008002, 0x8000000000000080, 0x000000000000800a, 0x800000008000000a,
+	0x8000000080008081, 0x8000000000008080, 0x0000000080000001, 0x8000000080008008,
+}
+
+var rotc = [24]uint{1, 3, 6, 10, 15, 21, 28, 36, 45, 55, 2, 14, 27, 41, 56, 8, 25, 43, 62, 18, 39, 61, 20, 44}
+
+var piln = [24]int{10, 7, 11, 17, 18, 3, 5, 16, 8, 21, 24, 4, 15, 23, 19, 13, 12, 2, 20, 14, 22, 9, 6, 1}
+
+func rotl(x uint64, b uint) uint64 {
+	return (x << b) | (x >> (64 - b))
+}
+
+func keccakf(st *[25]uint64) {
+	var bc [5]uint64
+	for r := 0; r < 24; r++ {
+		// theta
+		for i := 0; i < 5; i++ {
+			bc[i] = st[i] ^ st[i+5] ^ st[i+10] ^ st[i+15] ^ st[i+20]
+		}
+		for i := 0; i < 5; i++ {
+			t := bc[(i+4)%5] ^ rotl(bc[(i+1)%5], 1)
+			for j := 0; j < 25; j += 5 {
+				st[j+i] ^= t
+			}
+		}
+
+		// rho & pi
+		t := st[1]
+		for i := 0; i < 24; i++ {
+			j := piln[i]
+			bc[0] = st[j]
+			st[j] = rotl(t, rotc[i])
+			t = bc[0]
+		}
+
+		// chi
+		for j := 0; j < 25; j += 5 {
+			for i := 0; i < 5; i++ {
+				bc[i] = st[j+i]
+			}
+			for i := 0; i < 5; i++ {
+				st[j+i] ^= (^bc[(i+1)%5]) & bc[(i+2)%5]
+			}
+		}
+
+		// iota
+		st[0] ^= rc[r]
+	}
+}
+
+func absorb(st *[25]uint64, blk []byte) {
+	for i := 0; i < rate/8; i++ {
+		st[i] ^= binary.LittleEndian.Uint64(blk[8*i:])
+	}
+	keccakf(st)
+}
+
+// Sum256 returns SHA3-256 of the given data
+func Sum256(p []byte) (res [32]byte) {
+	var st [25]uint64
+	var last [rate]byte
+	for len(p) >= rate {
+		absorb(&st, p[:rate])
+		p = p[rate:]
+	}
+	copy(last[:], p)
+	last[len(p)] ^= 0x06
+	last[rate-1] ^= 0x80
+	absorb(&st, last[:])
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint64(res[8*i:], st[i])
+	}
+	return
+}
@@ -0,0 +1,36 @@
+package sha3
+
+import (
+	"testing"
+	"encoding/hex"
+)
+
+// Test vectors are from FIPS 202 examples
+var vectors = []struct {
+	in string
+	out string
+}{
+	{"", "a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a"},
+	{"abc", "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"},
+	{"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq",
+		"41c0dba2a9d6240849100376a8235e2c82e1b9998a999e21db32dd97496d3376"},
+}
+
+func TestSum256(t *testing.T) {
+	for i, v := range vectors {
+		res := Sum256([]byte(v.in))
+		if hex.EncodeToString(res[:]) != v.out {
+			t.Error(i, "mismatch", hex.EncodeToString(res[:]))
+		}
+	}
+
+	// message longer than one block
+	var long [200]byte
+	for i := range long {
+		long[i] = 0xa3
+	}
+	res := Sum256(long[:])
+	if hex.EncodeToString(res[:]) != "79f38adec5c20307a98ef76e8324afbfd46cfd81b22e3973c65fa1bd9de31787" {
+		t.Error("long message mismatch", hex.EncodeToString(res[:]))
+	}
+}
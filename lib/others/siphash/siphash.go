@@ -0,0 +1,61 @@
+// Package siphash implements SipHash-2-4, as used by BIP152 for short transaction IDs
+// and by BIP158 block filters.
+package siphash
+
+import (
+	"encoding/binary"
+)
+
+func rotl(x uint64, b uint) uint64 {
+	return (x << b) | (x >> (64 - b))
+}
+
+func round(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = rotl(v1, 13)
+	v1 ^= v0
+	v0 = rotl(v0, 32)
+	v2 += v3
+	v3 = rotl(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = rotl(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = rotl(v1, 17)
+	v1 ^= v2
+	v2 = rotl(v2, 32)
+	return v0, v1, v2, v3
+}
+
+// Hash returns SipHash-2-4 of the given data, for the 128-bit key (k0, k1)
+func Hash(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	b := uint64(len(p)) << 56
+	for len(p) >= 8 {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		v0, v1, v2, v3 = round(v0, v1, v2, v3)
+		v0, v1, v2, v3 = round(v0, v1, v2, v3)
+		v0 ^= m
+		p = p[8:]
+	}
+	for i := range p {
+		b |= uint64(p[i]) << (8 * uint(i))
+	}
+
+	v3 ^= b
+	v0, v1, v2, v3 = round(v0, v1, v2, v3)
+	v0, v1, v2, v3 = round(v0, v1, v2, v3)
+	v0 ^= b
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = round(v0, v1, v2, v3)
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,35 @@
+package siphash
+
+import (
+	"testing"
+	"encoding/binary"
+)
+
+// Test vectors are from the reference implementation (key: 00 01 02 ... 0f)
+var vectors = []struct {
+	inlen int
+	out uint64
+}{
+	{0, 0x726fdb47dd0e0e31},
+	{1, 0x74f839c593dc67fd},
+	{8, 0x93f5f5799a932462},
+	{15, 0xa129ca6149be45e5},
+}
+
+func TestHash(t *testing.T) {
+	var key [16]byte
+	var msg [64]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+	for _, v := range vectors {
+		if res := Hash(k0, k1, msg[:v.inlen]); res != v.out {
+			t.Errorf("Hash of %d bytes: got %016x, expected %016x", v.inlen, res, v.out)
+		}
+	}
+}
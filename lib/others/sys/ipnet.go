@@ -1,6 +1,7 @@
 package sys
 
 import (
+	"net"
 )
 
 
@@ -25,6 +26,30 @@ func ValidIp4(ip []byte) bool {
 }
 
 
-func IsIPBlocked(ip4 []byte) bool {
+// Discard any IPv4 or IPv6 address that is not publicly routable
+func ValidIp(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ValidIp4(ip4)
+	}
+	if len(ip)!=net.IPv6len || ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() {
+		return false
+	}
+
+	// RFC4193 (unique local)
+	if ip[0]&0xfe==0xfc {
+		return false
+	}
+
+	// RFC3849 (documentation)
+	if ip[0]==0x20 && ip[1]==0x01 && ip[2]==0x0d && ip[3]==0xb8 {
+		return false
+	}
+
+	return true
+}
+
+
+func IsIPBlocked(ip []byte) bool {
 	return false
 }
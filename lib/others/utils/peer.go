@@ -9,12 +9,16 @@ import (
 type OnePeer struct {
 	btc.NetAddr
 	Time uint32  // When seen last time
-	Banned uint32 // time when this address baned or zero if never
+	BanUntil uint32 // time when the ban of this address expires or zero if not banned
+	Tried bool // we have successfully connected to this peer (it is in the "tried" table)
+	Source uint32 // network group hash of the peer that has told us about this address
 }
 
 
 var crctab = crc64.MakeTable(crc64.ISO)
 
+const OldBanTime = 24*3600 // records from older versions keep the time of the ban - assume it was for so long
+
 
 /*
 Serialized peer record (all values are LSB unless specified otherwise):
@@ -23,7 +27,12 @@ Serialized peer record (all values are LSB unless specified otherwise):
  [12:24] - IPv6 (network order)
  [24:28] - IPv4 (network order)
  [28:30] - TCP port (big endian)
- [30:34] - OPTIONAL: if present, unix timestamp of when the peer was banned
+ [30:34] - OPTIONAL: if present, unix timestamp of when the peer's ban expires (see the flags)
+ [34] - OPTIONAL: if present, BIP155 network ID of a non-IP address (IPv6 and IPv4 fields are zero then)
+ [35] - flags: bit 0 set if the peer is in the "tried" table,
+        bit 1 set if [30:34] is the ban expiry (older records have there the time of the ban)
+ [36:40] - hash of the network group of the peer we learned this address from
+ [40:] - the non-IP address (e.g. 32 bytes of TorV3 public key)
 */
 
 
@@ -38,17 +47,38 @@ func NewPeer(v []byte) (p *OnePeer) {
 	copy(p.Ip6[:], v[12:24])
 	copy(p.Ip4[:], v[24:28])
 	p.Port = binary.BigEndian.Uint16(v[28:30])
+	var ban uint32
 	if len(v)>=34 {
-		p.Banned = binary.LittleEndian.Uint32(v[30:34])
+		ban = binary.LittleEndian.Uint32(v[30:34])
+	}
+	if len(v)>=40 {
+		p.NetID = v[34]
+		p.Tried = (v[35]&1) != 0
+		p.Source = binary.LittleEndian.Uint32(v[36:40])
+		if p.NetID != 0 {
+			p.Addr = append([]byte{}, v[40:]...)
+		}
+	}
+	if len(v)>=40 && (v[35]&2) != 0 {
+		p.BanUntil = ban
+	} else if ban != 0 {
+		p.BanUntil = ban + OldBanTime
 	}
 	return
 }
 
 
 func (p *OnePeer) Bytes() (res []byte) {
-	if p.Banned != 0 {
-		res = make([]byte, 34)
-		binary.LittleEndian.PutUint32(res[30:34], p.Banned)
+	if p.NetID != 0 || p.Tried || p.Source != 0 || p.BanUntil != 0 {
+		res = make([]byte, 40+len(p.Addr))
+		binary.LittleEndian.PutUint32(res[30:34], p.BanUntil)
+		res[34] = p.NetID
+		if p.Tried {
+			res[35] = 1
+		}
+		res[35] |= 2 // [30:34] is the ban expiry
+		binary.LittleEndian.PutUint32(res[36:40], p.Source)
+		copy(res[40:], p.Addr)
 	} else {
 		res = make([]byte, 30)
 	}
@@ -66,5 +96,9 @@ func (p *OnePeer) UniqID() (uint64) {
 	h.Write(p.Ip6[:])
 	h.Write(p.Ip4[:])
 	h.Write([]byte{byte(p.Port>>8),byte(p.Port)})
+	if p.NetID != 0 {
+		h.Write([]byte{p.NetID})
+		h.Write(p.Addr)
+	}
 	return h.Sum64()
 }
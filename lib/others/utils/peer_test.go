@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestPeerRecord(t *testing.T) {
+	ip4 := new(OnePeer)
+	ip4.Time, ip4.Services, ip4.Port = 1500000000, 0x409, 8333
+	ip4.Ip6 = [12]byte{10: 0xff, 11: 0xff}
+	ip4.Ip4 = [4]byte{8, 8, 4, 4}
+
+	banned := *ip4
+	banned.BanUntil = 1600000000
+
+	tried := *ip4
+	tried.Tried, tried.Source = true, 0x12345678
+
+	tor := new(OnePeer)
+	tor.Time, tor.Port = 1500000000, 9333
+	tor.NetID, tor.Addr = btc.NET_TORV3, bytes.Repeat([]byte{0xab}, 32)
+
+	var tv = []struct {
+		p *OnePeer
+		size int
+	} {
+		{ip4, 30},
+		{&banned, 40},
+		{&tried, 40},
+		{tor, 40+32},
+	}
+	ids := make(map[uint64]bool)
+	for i := range tv {
+		b := tv[i].p.Bytes()
+		if len(b) != tv[i].size {
+			t.Error(i, "Bad record size", len(b))
+		}
+		p := NewPeer(b)
+		if p.Time != tv[i].p.Time || p.Services != tv[i].p.Services || p.Ip6 != tv[i].p.Ip6 || p.Ip4 != tv[i].p.Ip4 ||
+			p.Port != tv[i].p.Port || p.BanUntil != tv[i].p.BanUntil || p.Tried != tv[i].p.Tried ||
+			p.Source != tv[i].p.Source || p.NetID != tv[i].p.NetID || !bytes.Equal(p.Addr, tv[i].p.Addr) {
+			t.Error(i, "Record changed", p, tv[i].p)
+		}
+		if !bytes.Equal(p.Bytes(), b) {
+			t.Error(i, "Serialization not stable")
+		}
+		ids[p.UniqID()] = true
+	}
+	// the address manager's fields and the ban are not part of the ID
+	if len(ids) != 2 {
+		t.Error("Bad number of unique IDs", len(ids))
+	}
+
+	// the fields are at the documented offsets
+	b := tor.Bytes()
+	if b[34] != btc.NET_TORV3 || !bytes.Equal(b[40:], tor.Addr) {
+		t.Error("Bad non-IP address fields")
+	}
+	b = tried.Bytes()
+	if b[35] != 1|2 || !bytes.Equal(b[36:40], []byte{0x78, 0x56, 0x34, 0x12}) || !bytes.Equal(b[24:30], []byte{8, 8, 4, 4, 0x20, 0x8d}) {
+		t.Error("Bad IP, port or address manager fields")
+	}
+
+	// records from older versions keep the time of the ban
+	b = banned.Bytes()
+	b[35] = 0
+	if p := NewPeer(b); p.BanUntil != banned.BanUntil+OldBanTime {
+		t.Error("Bad ban expiry of 40 bytes record", p.BanUntil)
+	}
+	if p := NewPeer(b[:34]); p.BanUntil != banned.BanUntil+OldBanTime || p.Tried || p.Source != 0 {
+		t.Error("Bad 34 bytes record", p)
+	}
+	if p := NewPeer(b[:30]); p.BanUntil != 0 || p.Port != 8333 {
+		t.Error("Bad 30 bytes record", p)
+	}
+
+	if NewPeer(make([]byte, 29)) != nil {
+		t.Error("Too short record accepted")
+	}
+}
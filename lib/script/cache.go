@@ -0,0 +1,87 @@
+package script
+
+import (
+	"sync"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+/*
+  Cache of successfully verified input scripts.
+  Inputs verified while taking a tx to the memory pool do not need to be
+  verified again when the tx arrives in a block.
+*/
+
+// CacheMaxEntries limits the number of the cached inputs (0 disables the cache)
+var CacheMaxEntries = 250000
+
+var (
+	cache_mutex sync.Mutex
+	cache_map = make(map[[32]byte] bool)
+	cache_salt [32]byte
+)
+
+
+func init() {
+	rand.Read(cache_salt[:])
+}
+
+
+// The key is salted, so nobody could make us evict particular entries
+func cacheKey(pkScr []byte, i int, tx *btc.Tx, ver_flags uint32) (key [32]byte) {
+	var tmp [8]byte
+	sha := sha256.New()
+	sha.Write(cache_salt[:])
+	sha.Write(tx.Hash.Hash[:])
+	binary.LittleEndian.PutUint32(tmp[0:4], uint32(i))
+	binary.LittleEndian.PutUint32(tmp[4:8], ver_flags)
+	sha.Write(tmp[:])
+	sha.Write(pkScr)
+	copy(key[:], sha.Sum(nil))
+	return
+}
+
+
+// CacheAdd records that the given input has been verified OK with the given flags
+func CacheAdd(pkScr []byte, i int, tx *btc.Tx, ver_flags uint32) {
+	if CacheMaxEntries <= 0 {
+		return
+	}
+	key := cacheKey(pkScr, i, tx, ver_flags)
+	cache_mutex.Lock()
+	for len(cache_map) >= CacheMaxEntries {
+		for k := range cache_map {
+			delete(cache_map, k) // Go's map iteration order is random enough
+			break
+		}
+	}
+	cache_map[key] = true
+	cache_mutex.Unlock()
+}
+
+
+// CacheHas returns true if the input has been verified OK with the same flags.
+// If erase is true, the entry gets removed (use it when the tx is being mined).
+func CacheHas(pkScr []byte, i int, tx *btc.Tx, ver_flags uint32, erase bool) (res bool) {
+	if CacheMaxEntries <= 0 {
+		return
+	}
+	key := cacheKey(pkScr, i, tx, ver_flags)
+	cache_mutex.Lock()
+	if res = cache_map[key]; res && erase {
+		delete(cache_map, key)
+	}
+	cache_mutex.Unlock()
+	return
+}
+
+
+// CacheLen returns the number of the cached inputs
+func CacheLen() (res int) {
+	cache_mutex.Lock()
+	res = len(cache_map)
+	cache_mutex.Unlock()
+	return
+}
@@ -0,0 +1,43 @@
+package script
+
+import (
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+
+func TestCache(t *testing.T) {
+	tx := &btc.Tx{TxIn:[]*btc.TxIn{{}, {}}}
+	tx.Hash = btc.NewSha2Hash([]byte("test tx"))
+	pk := []byte{0x51}
+
+	if CacheHas(pk, 0, tx, VER_P2SH, false) {
+		t.Error("Found in empty cache")
+	}
+	CacheAdd(pk, 0, tx, VER_P2SH)
+	if !CacheHas(pk, 0, tx, VER_P2SH, false) {
+		t.Error("Not found")
+	}
+	if CacheHas(pk, 1, tx, VER_P2SH, false) {
+		t.Error("Found different input")
+	}
+	if CacheHas(pk, 0, tx, VER_P2SH|VER_DERSIG, false) {
+		t.Error("Found with different flags")
+	}
+	if CacheHas([]byte{0x52}, 0, tx, VER_P2SH, false) {
+		t.Error("Found with different pkScript")
+	}
+	if !CacheHas(pk, 0, tx, VER_P2SH, true) || CacheHas(pk, 0, tx, VER_P2SH, false) {
+		t.Error("Erase failed")
+	}
+
+	max := CacheMaxEntries
+	CacheMaxEntries = 10
+	for i := 0; i < 100; i++ {
+		CacheAdd(pk, i, tx, 0)
+	}
+	if CacheLen() != 10 {
+		t.Error("Cache not bounded", CacheLen())
+	}
+	CacheMaxEntries = max
+}
@@ -111,7 +111,7 @@ func execute_test_tx(t *testing.T, tv *testvector) bool {
 		t.Error(er.Error())
 		return false
 	}
-	tx, _ := btc.NewTx(rd)
+	tx, _, _ := btc.NewTx(rd)
 	if tx==nil {
 		t.Error("Canot decode tx")
 		return false
@@ -254,7 +254,7 @@ func TestSighash(t *testing.T) {
 	for i := range arr {
 		if len(arr[i])==5 {
 			tmp, _ := hex.DecodeString(arr[i][0].(string))
-			tx, _ := btc.NewTx(tmp)
+			tx, _, _ := btc.NewTx(tmp)
 			if tx == nil {
 				t.Error("Cannot decode tx from text number", i)
 				continue
@@ -0,0 +1,258 @@
+package secp256k1
+
+import (
+	"crypto/rand"
+)
+
+/*
+ElligatorSwift encoding of public keys, as used by BIP324.
+A key is encoded as two 32 bytes field elements (u, t) that look like
+random data. Only X coordinate of the point is encoded.
+
+The arithmetic is done on Field (fixed size limbs, exponentiation based Inv
+and Sqrt), same as the rest of the package, so there is no math/big here.
+The code still branches on which of the candidates is valid, but only the
+public data goes through it: X of the public key and the random (u, t).
+Mind that EllSwiftXonlyECDH uses Multiply (ECmult), which is not constant
+time with respect to the private key.
+*/
+
+var (
+	ell_c0 Field // sqrt(-3)
+	ell_7 Field
+)
+
+func init() {
+	ell_c0.SetHex("0a2d2ba93507f1df233770c2a797962cc61f6d15da14ecd47d8d27ae1cd5f852")
+	ell_7.SetInt(7)
+}
+
+
+// All the fe_ functions expect normalized arguments and return normalized results
+func fe_int(a uint32) (r Field) {
+	r.SetInt(a)
+	return
+}
+
+func fe_mul(a, b *Field) (r Field) {
+	a.Mul(&r, b)
+	r.Normalize()
+	return
+}
+
+func fe_add(a, b *Field) (r Field) {
+	r = *a
+	r.SetAdd(b)
+	r.Normalize()
+	return
+}
+
+func fe_neg(a *Field) (r Field) {
+	a.Negate(&r, 1)
+	r.Normalize()
+	return
+}
+
+func fe_sub(a, b *Field) (r Field) {
+	b.Negate(&r, 1)
+	r.SetAdd(a)
+	r.Normalize()
+	return
+}
+
+func fe_div(a, b *Field) (r Field) {
+	var inv Field
+	b.Inv(&inv)
+	a.Mul(&r, &inv)
+	r.Normalize()
+	return
+}
+
+// ok is false if a is not a square
+func fe_sqrt(a *Field) (r Field, ok bool) {
+	a.Sqrt(&r)
+	r.Normalize()
+	sq := fe_mul(&r, &r)
+	ok = sq.Equals(a)
+	return
+}
+
+// x^3 + 7
+func fe_curve(x *Field) Field {
+	x2 := fe_mul(x, x)
+	x3 := fe_mul(&x2, x)
+	return fe_add(&x3, &ell_7)
+}
+
+func fe_valid_x(x *Field) bool {
+	c := fe_curve(x)
+	_, ok := fe_sqrt(&c)
+	return ok
+}
+
+
+// Decodes field elements (u, t) to X coordinate of a point on the curve
+func xswiftec(u, t Field) Field {
+	u.Normalize()
+	t.Normalize()
+	if u.IsZero() {
+		u.SetInt(1)
+	}
+	if t.IsZero() {
+		t.SetInt(1)
+	}
+	gu := fe_curve(&u)
+	t2 := fe_mul(&t, &t)
+	if tmp := fe_add(&gu, &t2); tmp.IsZero() {
+		t = fe_add(&t, &t)
+		t2 = fe_mul(&t, &t)
+	}
+	tt := fe_add(&t, &t)
+	num := fe_sub(&gu, &t2)
+	X := fe_div(&num, &tt)
+	num = fe_add(&X, &t)
+	den := fe_mul(&ell_c0, &u)
+	Y := fe_div(&num, &den)
+	YY := fe_mul(&Y, &Y)
+	four := fe_int(4)
+	YY = fe_mul(&four, &YY)
+	if x := fe_add(&u, &YY); fe_valid_x(&x) {
+		return x
+	}
+	two := fe_int(2)
+	XY := fe_div(&X, &Y)
+	nXY := fe_neg(&XY)
+	num = fe_sub(&nXY, &u)
+	if x := fe_div(&num, &two); fe_valid_x(&x) {
+		return x
+	}
+	num = fe_sub(&XY, &u)
+	return fe_div(&num, &two)
+}
+
+
+// Finds t such that xswiftec(u, t) = x. There are up to 8 solutions selected by c.
+// ok is false if there is no solution for the given c.
+func xswiftec_inv(x, u Field, c int) (t Field, ok bool) {
+	var v, s Field
+	x.Normalize()
+	u.Normalize()
+	if (c&2) == 0 {
+		nx := fe_neg(&x)
+		if tmp := fe_sub(&nx, &u); fe_valid_x(&tmp) {
+			return
+		}
+		v = x
+		gu := fe_curve(&u)
+		num := fe_neg(&gu)
+		uu := fe_mul(&u, &u)
+		uv := fe_mul(&u, &v)
+		vv := fe_mul(&v, &v)
+		den := fe_add(&uu, &uv)
+		den = fe_add(&den, &vv)
+		s = fe_div(&num, &den)
+	} else {
+		s = fe_sub(&x, &u)
+		if s.IsZero() {
+			return
+		}
+		gu := fe_curve(&u)
+		four, three := fe_int(4), fe_int(3)
+		a := fe_mul(&four, &gu)
+		uu := fe_mul(&u, &u)
+		b := fe_mul(&three, &s)
+		b = fe_mul(&b, &uu)
+		a = fe_add(&a, &b)
+		ns := fe_neg(&s)
+		r := fe_mul(&ns, &a)
+		if r, ok = fe_sqrt(&r); !ok {
+			return
+		}
+		if (c&1) != 0 && r.IsZero() {
+			ok = false
+			return
+		}
+		two := fe_int(2)
+		num := fe_div(&r, &s)
+		num = fe_sub(&num, &u)
+		v = fe_div(&num, &two)
+	}
+	var w Field
+	if w, ok = fe_sqrt(&s); !ok {
+		return
+	}
+	if (c&4) != 0 {
+		w = fe_neg(&w)
+	}
+	var k Field // u * (1 -/+ sqrt(-3)) / 2
+	one, two := fe_int(1), fe_int(2)
+	if (c&1) == 0 {
+		k = fe_sub(&one, &ell_c0)
+	} else {
+		k = fe_add(&one, &ell_c0)
+		w = fe_neg(&w)
+	}
+	k = fe_mul(&u, &k)
+	k = fe_div(&k, &two)
+	k = fe_add(&k, &v)
+	k = fe_mul(&w, &k)
+	t = fe_neg(&k)
+	return
+}
+
+
+// EllSwiftDecode returns X coordinate (32 bytes) of the point encoded in 64 bytes
+func EllSwiftDecode(enc []byte) []byte {
+	var u, t Field
+	res := make([]byte, 32)
+	u.SetB32(enc[:32])
+	t.SetB32(enc[32:64])
+	x := xswiftec(u, t)
+	x.GetB32(res)
+	return res
+}
+
+
+// EllSwiftEncode returns a random 64 bytes encoding of the given X coordinate
+func EllSwiftEncode(xb []byte) (res []byte) {
+	var rnd [33]byte
+	var x, u Field
+	x.SetB32(xb)
+	x.Normalize()
+	for {
+		rand.Read(rnd[:])
+		u.SetB32(rnd[:32])
+		u.Normalize()
+		if u.IsZero() {
+			continue
+		}
+		t, ok := xswiftec_inv(x, u, int(rnd[32]&7))
+		if !ok {
+			continue
+		}
+		if dec := xswiftec(u, t); !dec.Equals(&x) {
+			continue
+		}
+		res = make([]byte, 64)
+		u.GetB32(res[:32])
+		t.GetB32(res[32:])
+		return
+	}
+}
+
+
+// EllSwiftCreate returns ElligatorSwift encoding of the public key for the given private key
+func EllSwiftCreate(priv []byte) []byte {
+	var pub [33]byte
+	BaseMultiply(priv, pub[:])
+	return EllSwiftEncode(pub[1:])
+}
+
+
+// EllSwiftXonlyECDH returns X coordinate of priv times the point encoded in enc
+func EllSwiftXonlyECDH(enc, priv []byte) []byte {
+	var out [33]byte
+	pub := append([]byte{0x02}, EllSwiftDecode(enc)...)
+	Multiply(pub, priv, out[:])
+	return out[1:]
+}
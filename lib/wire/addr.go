@@ -0,0 +1,82 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Entry of "addr" and "addrv2" messages
+type Addr struct {
+	Time uint32
+	btc.NetAddr
+}
+
+
+// EncodeAddr returns the payload of "addrv2" (BIP155) message if v2 is true, or of "addr" otherwise.
+// Non-IP addresses are skipped in the old format.
+func EncodeAddr(addrs []*Addr, v2 bool) []byte {
+	var cnt uint64
+	buf := new(bytes.Buffer)
+	for _, a := range addrs {
+		if v2 {
+			binary.Write(buf, binary.LittleEndian, a.Time)
+			buf.Write(a.NetAddr.BytesV2())
+			cnt++
+		} else if a.IsIP() {
+			binary.Write(buf, binary.LittleEndian, a.Time)
+			buf.Write(a.NetAddr.Bytes())
+			cnt++
+		}
+	}
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, cnt)
+	b.Write(buf.Bytes())
+	return b.Bytes()
+}
+
+
+// ParseAddr decodes the payload of "addr" message
+func ParseAddr(pl []byte) (addrs []*Addr, e error) {
+	var cnt int
+	var buf [30]byte
+	b := bytes.NewReader(pl)
+	if cnt, e = readCount(b, MaxAddrCount); e != nil {
+		return
+	}
+	for i := 0; i < cnt; i++ {
+		if e = readFull(b, buf[:]); e != nil {
+			return
+		}
+		a := new(Addr)
+		a.Time = binary.LittleEndian.Uint32(buf[0:4])
+		a.NetAddr = *btc.NewNetAddr(buf[4:30])
+		addrs = append(addrs, a)
+	}
+	return
+}
+
+
+// ParseAddrV2 decodes the payload of "addrv2" message (BIP155).
+// Addresses from networks that we do not know are also returned (with NetID set).
+func ParseAddrV2(pl []byte) (addrs []*Addr, e error) {
+	var cnt int
+	var na *btc.NetAddr
+	b := bytes.NewReader(pl)
+	if cnt, e = readCount(b, MaxAddrCount); e != nil {
+		return
+	}
+	for i := 0; i < cnt; i++ {
+		a := new(Addr)
+		if e = binary.Read(b, binary.LittleEndian, &a.Time); e != nil {
+			e = ErrTooShort
+			return
+		}
+		if na, e = btc.ReadNetAddrV2(b); e != nil {
+			return
+		}
+		a.NetAddr = *na
+		addrs = append(addrs, a)
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Inventory types
+const (
+	MSG_TX = 1
+	MSG_BLOCK = 2
+	MSG_FILTERED_BLOCK = 3 // BIP37
+	MSG_CMPCT_BLOCK = 4 // BIP152 - used in getdata to request cmpctblock
+	MSG_DANDELION_TX = 5 // BIP156 - tx in the stem phase
+	MSG_WITNESS_FLAG = 0x40000000
+)
+
+// Entry of "inv", "getdata" and "notfound" messages
+type InvVect struct {
+	Type uint32
+	Hash [32]byte
+}
+
+
+// EncodeInv returns the payload of "inv", "getdata" or "notfound" message
+func EncodeInv(invs []InvVect) []byte {
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint64(len(invs)))
+	for i := range invs {
+		binary.Write(b, binary.LittleEndian, invs[i].Type)
+		b.Write(invs[i].Hash[:])
+	}
+	return b.Bytes()
+}
+
+
+// ParseInv decodes the payload of "inv", "getdata" or "notfound" message
+func ParseInv(pl []byte) (invs []InvVect, e error) {
+	var cnt int
+	b := bytes.NewReader(pl)
+	if cnt, e = readCount(b, MaxInvCount); e != nil {
+		return
+	}
+	if b.Len() < 36*cnt {
+		e = ErrTooShort
+		return
+	}
+	if b.Len() > 36*cnt {
+		e = ErrTrailing
+		return
+	}
+	invs = make([]InvVect, cnt)
+	for i := range invs {
+		binary.Read(b, binary.LittleEndian, &invs[i].Type)
+		b.Read(invs[i].Hash[:])
+	}
+	return
+}
+
+
+// Payload of "getblocks" and "getheaders" messages
+type MsgLocator struct {
+	Version uint32
+	Hashes []*btc.Uint256
+	Stop *btc.Uint256 // nil means no limit
+}
+
+
+func (l *MsgLocator) Bytes() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, l.Version)
+	btc.WriteVlen(b, uint64(len(l.Hashes)))
+	for _, h := range l.Hashes {
+		b.Write(h.Hash[:])
+	}
+	if l.Stop != nil {
+		b.Write(l.Stop.Hash[:])
+	} else {
+		b.Write(make([]byte, 32))
+	}
+	return b.Bytes()
+}
+
+
+// ParseLocator decodes the payload of "getblocks" or "getheaders" message
+func ParseLocator(pl []byte) (l *MsgLocator, e error) {
+	var cnt int
+	var h [32]byte
+	b := bytes.NewReader(pl)
+	l = new(MsgLocator)
+	if e = binary.Read(b, binary.LittleEndian, &l.Version); e != nil {
+		e = ErrTooShort
+		return
+	}
+	if cnt, e = readCount(b, MaxLocators); e != nil {
+		return
+	}
+	if b.Len() < 32*cnt + 32 {
+		e = ErrTooShort
+		return
+	}
+	l.Hashes = make([]*btc.Uint256, cnt)
+	for i := range l.Hashes {
+		b.Read(h[:])
+		l.Hashes[i] = btc.NewUint256(h[:])
+	}
+	b.Read(h[:])
+	l.Stop = btc.NewUint256(h[:])
+	return
+}
+
+
+// EncodeHeaders returns the payload of "headers" message (each header is 80 bytes)
+func EncodeHeaders(hdrs [][]byte) []byte {
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint64(len(hdrs)))
+	for _, h := range hdrs {
+		b.Write(h[:80])
+		b.WriteByte(0) // txn_count is always zero
+	}
+	return b.Bytes()
+}
+
+
+// ParseHeaders decodes the payload of "headers" message, returning the 80 bytes headers
+func ParseHeaders(pl []byte) (hdrs [][]byte, e error) {
+	var cnt int
+	b := bytes.NewReader(pl)
+	if cnt, e = readCount(b, MaxHeadersCount); e != nil {
+		return
+	}
+	if b.Len() < 81*cnt {
+		e = ErrTooShort
+		return
+	}
+	hdrs = make([][]byte, cnt)
+	for i := range hdrs {
+		hdr := make([]byte, 81)
+		b.Read(hdr)
+		if hdr[80] != 0 {
+			e = ErrTxnCount
+			return
+		}
+		hdrs[i] = hdr[:80]
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Reject codes (BIP61)
+const (
+	REJECT_MALFORMED = 0x01
+	REJECT_INVALID = 0x10
+	REJECT_OBSOLETE = 0x11
+	REJECT_DUPLICATE = 0x12
+	REJECT_NONSTANDARD = 0x40
+	REJECT_DUST = 0x41
+	REJECT_INSUFFICIENTFEE = 0x42
+	REJECT_CHECKPOINT = 0x43
+)
+
+
+// EncodePing returns the payload of "ping" or "pong" message (BIP31)
+func EncodePing(nonce uint64) []byte {
+	pl := make([]byte, 8)
+	binary.LittleEndian.PutUint64(pl, nonce)
+	return pl
+}
+
+
+// ParsePing decodes the payload of "ping" or "pong" message
+func ParsePing(pl []byte) (nonce uint64, e error) {
+	if len(pl) < 8 {
+		e = ErrTooShort
+		return
+	}
+	if len(pl) > 8 {
+		e = ErrTrailing
+		return
+	}
+	nonce = binary.LittleEndian.Uint64(pl)
+	return
+}
+
+
+// EncodeFeeFilter returns the payload of "feefilter" message (BIP133), fee rate in satoshis per 1000 bytes
+func EncodeFeeFilter(spkb uint64) []byte {
+	return EncodePing(spkb)
+}
+
+
+// ParseFeeFilter decodes the payload of "feefilter" message
+func ParseFeeFilter(pl []byte) (spkb uint64, e error) {
+	return ParsePing(pl)
+}
+
+
+// The "reject" message (BIP61)
+type MsgReject struct {
+	Message string // command of the rejected message
+	Code byte
+	Reason string
+	Data []byte // hash of the rejected tx or block (if any)
+}
+
+
+func (r *MsgReject) Bytes() []byte {
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint64(len(r.Message)))
+	b.Write([]byte(r.Message))
+	b.WriteByte(r.Code)
+	reason := r.Reason
+	if len(reason) > MaxRejectLen {
+		reason = reason[:MaxRejectLen]
+	}
+	btc.WriteVlen(b, uint64(len(reason)))
+	b.Write([]byte(reason))
+	b.Write(r.Data)
+	return b.Bytes()
+}
+
+
+// ParseReject decodes the payload of "reject" message
+func ParseReject(pl []byte) (r *MsgReject, e error) {
+	var le int
+	b := bytes.NewReader(pl)
+	r = new(MsgReject)
+	if le, e = readCount(b, 12); e != nil {
+		return
+	}
+	s := make([]byte, le)
+	if e = readFull(b, s); e != nil {
+		return
+	}
+	r.Message = string(s)
+	if r.Code, e = b.ReadByte(); e != nil {
+		e = ErrTooShort
+		return
+	}
+	if le, e = readCount(b, MaxRejectLen); e != nil {
+		return
+	}
+	s = make([]byte, le)
+	if e = readFull(b, s); e != nil {
+		return
+	}
+	r.Reason = string(s)
+	if b.Len() > 0 {
+		r.Data = make([]byte, b.Len())
+		b.Read(r.Data)
+	}
+	return
+}
+
+
+// ParseTx decodes the payload of "tx" message. It sets the hash and the size of the transaction.
+func ParseTx(pl []byte) (tx *btc.Tx, e error) {
+	var le int
+	if tx, le, e = btc.NewTx(pl); e != nil {
+		return
+	}
+	if le != len(pl) {
+		tx, e = nil, ErrTrailing
+		return
+	}
+	tx.Hash = btc.NewSha2Hash(pl)
+	tx.Size = uint32(le)
+	return
+}
+
+
+// ParseBlock decodes the payload of "block" message
+func ParseBlock(pl []byte) (*btc.Block, error) {
+	if uint32(len(pl)) > MaxMsgSize("block") {
+		return nil, ErrTooBig
+	}
+	return btc.NewBlock(pl)
+}
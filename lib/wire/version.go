@@ -0,0 +1,77 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// The "version" message
+type MsgVersion struct {
+	Version uint32
+	Services uint64
+	Timestamp uint64
+	AddrRecv [26]byte // services(8) + ip(16) + port(2)
+	AddrFrom [26]byte
+	Nonce [8]byte
+	UserAgent string
+	Height uint32
+	Relay bool // if false, the peer does not want to be notified about transactions (BIP37)
+	HasRelay bool // set by the parser if the relay flag was present
+}
+
+
+func (v *MsgVersion) Bytes() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, v.Version)
+	binary.Write(b, binary.LittleEndian, v.Services)
+	binary.Write(b, binary.LittleEndian, v.Timestamp)
+	b.Write(v.AddrRecv[:])
+	b.Write(v.AddrFrom[:])
+	b.Write(v.Nonce[:])
+	btc.WriteVlen(b, uint64(len(v.UserAgent)))
+	b.Write([]byte(v.UserAgent))
+	binary.Write(b, binary.LittleEndian, v.Height)
+	if !v.Relay {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+
+// ParseVersion decodes the "version" message. Fields after the nonce are optional.
+func ParseVersion(pl []byte) (v *MsgVersion, e error) {
+	if len(pl) < 80 /*Up to, includiong, the nonce */ {
+		e = ErrTooShort
+		return
+	}
+	v = new(MsgVersion)
+	v.Version = binary.LittleEndian.Uint32(pl[0:4])
+	v.Services = binary.LittleEndian.Uint64(pl[4:12])
+	v.Timestamp = binary.LittleEndian.Uint64(pl[12:20])
+	copy(v.AddrRecv[:], pl[20:46])
+	copy(v.AddrFrom[:], pl[46:72])
+	copy(v.Nonce[:], pl[72:80])
+	v.Relay = true
+	if len(pl) == 80 {
+		return
+	}
+
+	b := bytes.NewReader(pl[80:])
+	le, e := readCount(b, MaxUserAgentLen)
+	if e != nil {
+		return
+	}
+	ua := make([]byte, le)
+	if e = readFull(b, ua); e != nil {
+		return
+	}
+	v.UserAgent = string(ua)
+	if binary.Read(b, binary.LittleEndian, &v.Height) != nil {
+		return
+	}
+	if rel, er := b.ReadByte(); er == nil {
+		v.Relay, v.HasRelay = rel != 0, true
+	}
+	return
+}
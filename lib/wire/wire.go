@@ -0,0 +1,141 @@
+/*
+Package wire implements encoding and decoding of the bitcoin P2P protocol messages.
+It is shared by the client and the downloader, so protocol changes only need to be done here.
+*/
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+const (
+	HeaderLen = 24 // magic(4) + command(12) + length(4) + checksum(4)
+
+	MaxInvCount = 50000 // max number of entries in inv, getdata and notfound
+	MaxHeadersCount = 2000 // max number of headers in one message
+	MaxLocators = 500 // max number of locator hashes we accept in getblocks and getheaders
+	MaxAddrCount = 1000 // max number of addresses in addr and addrv2
+	MaxUserAgentLen = 256
+	MaxRejectLen = 111 // max length of the reject reason
+)
+
+var (
+	ErrBadMagic = errors.New("Bad magic")
+	ErrTooBig = errors.New("Message too big")
+	ErrChecksum = errors.New("Checksum mismatch")
+	ErrTooShort = errors.New("Payload too short")
+	ErrTrailing = errors.New("Unexpected data at the end of payload")
+	ErrTooMany = errors.New("Too many entries")
+	ErrTxnCount = errors.New("Unexpected txn_count in headers")
+)
+
+
+// MaxMsgSize returns the maximum payload size that we accept for the given command
+func MaxMsgSize(cmd string) uint32 {
+	switch cmd {
+		case "inv": return 3+MaxInvCount*36 // the spec says "max 50000 entries"
+		case "tx": return 100e3 // max tx size 100KB
+		case "addr": return 3+MaxAddrCount*30 // max 1000 addrs
+		case "addrv2": return 3+MaxAddrCount*(4+9+1+3+btc.MAX_ADDRV2_SIZE+2)
+		case "block": return 1e6 // max block size 1MB
+		case "cmpctblock": return 1e6
+		case "getblocktxn": return 32+9+1e6 // one index per byte of block at most
+		case "blocktxn": return 1e6
+		case "filterload": return 9+btc.MAX_BLOOM_FILTER_SIZE+9
+		case "filteradd": return 3+btc.MAX_SCRIPT_ELEMENT_SIZE
+		case "getblocks": return 4+3+MaxLocators*32+32 // we allow up to 500 locator hashes
+		case "getdata": return 3+MaxInvCount*36 // the spec says "max 50000 entries"
+		case "notfound": return 3+MaxInvCount*36
+		case "headers": return 3+MaxInvCount*36 // the spec says "max 50000 entries"
+		case "getheaders": return 4+3+MaxLocators*32+32 // we allow up to 500 locator hashes
+		default: return 1024 // Any other type of block: 1KB payload limit
+	}
+}
+
+
+// Header of a (v1) network message
+type Header struct {
+	Cmd string
+	Len uint32
+	Checksum [4]byte
+}
+
+
+// MsgHeader returns the 24 bytes header of a (v1) message with the given payload
+func MsgHeader(magic [4]byte, cmd string, pl []byte) []byte {
+	hdr := make([]byte, HeaderLen)
+	copy(hdr[0:4], magic[:])
+	copy(hdr[4:16], cmd)
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(len(pl)))
+	sh := btc.Sha2Sum(pl)
+	copy(hdr[20:24], sh[:4])
+	return hdr
+}
+
+
+// Encode returns the complete (v1) message, ready to be sent
+func Encode(magic [4]byte, cmd string, pl []byte) []byte {
+	return append(MsgHeader(magic, cmd, pl), pl...)
+}
+
+
+// ParseHeader decodes the message header, checking the magic and the payload size limit.
+// On ErrTooBig the header is also returned.
+func ParseHeader(magic [4]byte, hdr []byte) (h *Header, e error) {
+	if len(hdr) < HeaderLen {
+		e = ErrTooShort
+		return
+	}
+	if !bytes.Equal(hdr[:4], magic[:]) {
+		e = ErrBadMagic
+		return
+	}
+	h = new(Header)
+	h.Cmd = strings.TrimRight(string(hdr[4:16]), "\000")
+	h.Len = binary.LittleEndian.Uint32(hdr[16:20])
+	copy(h.Checksum[:], hdr[20:24])
+	if h.Len > MaxMsgSize(h.Cmd) {
+		e = ErrTooBig
+	}
+	return
+}
+
+
+// Verify checks the payload against the checksum from the header
+func (h *Header) Verify(pl []byte) error {
+	sh := btc.Sha2Sum(pl)
+	if !bytes.Equal(h.Checksum[:], sh[:4]) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+
+// Reads the count of the entries that follow, making sure there is not more than max of them
+func readCount(b *bytes.Reader, max uint64) (cnt int, e error) {
+	var c uint64
+	if c, e = btc.ReadVLen(b); e != nil {
+		if e == btc.ErrTooBig {
+			e = ErrTooMany
+		}
+		return
+	}
+	if c > max {
+		e = ErrTooMany
+		return
+	}
+	cnt = int(c)
+	return
+}
+
+
+func readFull(b *bytes.Reader, buf []byte) (e error) {
+	if n, _ := b.Read(buf); n != len(buf) {
+		e = ErrTooShort
+	}
+	return
+}
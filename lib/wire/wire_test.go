@@ -0,0 +1,123 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+var magic = [4]byte{0xf9, 0xbe, 0xb4, 0xd9}
+
+func TestFraming(t *testing.T) {
+	msg := Encode(magic, "verack", nil)
+	if len(msg) != HeaderLen {
+		t.Fatal("Bad length", len(msg))
+	}
+	h, e := ParseHeader(magic, msg)
+	if e != nil || h.Cmd != "verack" || h.Len != 0 {
+		t.Fatal("ParseHeader failed", e)
+	}
+	if h.Verify(nil) != nil {
+		t.Error("Checksum failed")
+	}
+	if h.Verify([]byte{1}) != ErrChecksum {
+		t.Error("Bad checksum accepted")
+	}
+	if _, e = ParseHeader([4]byte{1, 2, 3, 4}, msg); e != ErrBadMagic {
+		t.Error("Bad magic accepted")
+	}
+	if _, e = ParseHeader(magic, MsgHeader(magic, "ping", make([]byte, 1025))); e != ErrTooBig {
+		t.Error("Too big message accepted")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	v := &MsgVersion{Version: 70015, Services: 9, Timestamp: 1234, UserAgent: "/Gocoin:1.0/", Height: 500000}
+	v.Nonce[3] = 7
+	v2, e := ParseVersion(v.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if v2.Relay || !v2.HasRelay {
+		t.Error("Relay flag mismatch")
+	}
+	v2.Relay, v2.HasRelay = v.Relay, v.HasRelay
+	if *v2 != *v {
+		t.Error("Version mismatch", v2)
+	}
+	if _, e = ParseVersion(make([]byte, 79)); e != ErrTooShort {
+		t.Error("Short version accepted")
+	}
+}
+
+func TestInv(t *testing.T) {
+	invs := []InvVect{{Type: MSG_TX}, {Type: MSG_BLOCK}}
+	invs[1].Hash[5] = 5
+	res, e := ParseInv(EncodeInv(invs))
+	if e != nil || len(res) != 2 || res[0] != invs[0] || res[1] != invs[1] {
+		t.Error("Inv mismatch", e)
+	}
+	pl := EncodeInv(invs)
+	if _, e = ParseInv(pl[:len(pl)-1]); e != ErrTooShort {
+		t.Error("Short inv accepted")
+	}
+	if _, e = ParseInv(append(pl, 0)); e != ErrTrailing {
+		t.Error("Long inv accepted")
+	}
+	if _, e = ParseInv([]byte{0xfe, 0xff, 0xff, 0xff, 0xff}); e != ErrTooMany {
+		t.Error("Huge inv accepted")
+	}
+}
+
+func TestLocator(t *testing.T) {
+	l := &MsgLocator{Version: 70015, Hashes: []*btc.Uint256{btc.NewSha2Hash([]byte{1}), btc.NewSha2Hash([]byte{2})}}
+	l2, e := ParseLocator(l.Bytes())
+	if e != nil || l2.Version != l.Version || len(l2.Hashes) != 2 || !l2.Hashes[1].Equal(l.Hashes[1]) ||
+		!l2.Stop.Equal(new(btc.Uint256)) {
+		t.Error("Locator mismatch", e)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	hdrs := [][]byte{bytes.Repeat([]byte{1}, 80), bytes.Repeat([]byte{2}, 80)}
+	pl := EncodeHeaders(hdrs)
+	res, e := ParseHeaders(pl)
+	if e != nil || len(res) != 2 || !bytes.Equal(res[1], hdrs[1]) {
+		t.Error("Headers mismatch", e)
+	}
+	pl[len(pl)-1] = 1
+	if _, e = ParseHeaders(pl); e != ErrTxnCount {
+		t.Error("Bad txn_count accepted")
+	}
+}
+
+func TestAddr(t *testing.T) {
+	a := &Addr{Time: 1e9}
+	a.SetIP([]byte{1, 2, 3, 4})
+	a.Port = 8333
+	res, e := ParseAddr(EncodeAddr([]*Addr{a}, false))
+	if e != nil || len(res) != 1 || res[0].Time != a.Time || res[0].String() != "1.2.3.4:8333" {
+		t.Error("Addr mismatch", e)
+	}
+	res, e = ParseAddrV2(EncodeAddr([]*Addr{a}, true))
+	if e != nil || len(res) != 1 || res[0].Time != a.Time || res[0].String() != "1.2.3.4:8333" {
+		t.Error("AddrV2 mismatch", e)
+	}
+}
+
+func TestReject(t *testing.T) {
+	r := &MsgReject{Message: "tx", Code: REJECT_DUST, Reason: "dust", Data: make([]byte, 32)}
+	r2, e := ParseReject(r.Bytes())
+	if e != nil || r2.Message != r.Message || r2.Code != r.Code || r2.Reason != r.Reason || !bytes.Equal(r2.Data, r.Data) {
+		t.Error("Reject mismatch", e)
+	}
+	if n, e := ParsePing(EncodePing(0x1122334455667788)); e != nil || n != 0x1122334455667788 {
+		t.Error("Ping mismatch", e)
+	}
+	if n, e := ParseFeeFilter(EncodeFeeFilter(1000)); e != nil || n != 1000 {
+		t.Error("FeeFilter mismatch", e)
+	}
+	if _, e := ParseFeeFilter([]byte{1, 2, 3}); e != ErrTooShort {
+		t.Error("Short feefilter accepted")
+	}
+}
@@ -50,7 +50,7 @@ func main() {
 	cnt := 0
 	db.Browse(func(k qdb.KeyType, v []byte) uint32 {
 		np := utils.NewPeer(v)
-		if !sys.ValidIp4(np.Ip4[:]) {
+		if !sys.ValidIp(np.IP()) {
 			return 0
 		}
 		if cnt < len(tmp) {
@@ -63,8 +63,6 @@ func main() {
 	sort.Sort(tmp[:cnt])
 	for cnt=0; cnt<len(tmp)&&cnt<2500; cnt++ {
 		ad := tmp[cnt]
-		fmt.Printf("%3d) %16s   %5d  - seen %5d min ago\n", cnt+1,
-			fmt.Sprintf("%d.%d.%d.%d", ad.Ip4[0], ad.Ip4[1], ad.Ip4[2], ad.Ip4[3]),
-			ad.Port, (time.Now().Unix() - int64(ad.Time))/60)
+		fmt.Printf("%3d) %16s   %5d  - seen %5d min ago\n", cnt+1, ad.Host(), ad.Port, (time.Now().Unix() - int64(ad.Time))/60)
 	}
 }
@@ -23,9 +23,10 @@ func raw_tx_from_file(fn string) *btc.Tx {
 		fmt.Println("hex.DecodeString failed - assume binary transaction file")
 		dat = d
 	}
-	tx, txle := btc.NewTx(dat)
-
-	if tx != nil && txle != len(dat) {
+	tx, txle, er := btc.NewTx(dat)
+	if er != nil {
+		fmt.Println("Raw transaction is broken:", er.Error())
+	} else if txle != len(dat) {
 		fmt.Println("WARNING: Raw transaction length mismatch", txle, len(dat))
 	}
 
@@ -16,7 +16,7 @@ var (
 	waltype uint = 3
 	type2sec string
 	uncompressed bool = false
-	fee string = "0.00001"
+	fee string // empty - use balance/feerate.txt (if present) or DefaultFee
 	apply2bal bool = true
 	secret_seed []byte
 	litecoin bool = false
@@ -139,7 +139,7 @@ func parse_config() {
 	flag.UintVar(&waltype, "type", waltype, "Type of deterministic wallet (1 to 4)")
 	flag.StringVar(&type2sec, "t2sec", type2sec, "Enforce using this secret for Type-2 wallet (hex encoded)")
 	flag.BoolVar(&uncompressed, "u", uncompressed, "Use uncompressed public keys (not advised)")
-	flag.StringVar(&fee, "fee", fee, "Specify transaction fee to be used")
+	flag.StringVar(&fee, "fee", fee, "Specify transaction fee to be used (default: from balance/feerate.txt or "+DefaultFee+")")
 	flag.BoolVar(&apply2bal, "a", apply2bal, "Apply changes to the balance folder (does not work with -raw)")
 	flag.BoolVar(&litecoin, "ltc", litecoin, "Litecoin mode")
 	flag.IntVar(&sequence, "seq", int(time.Now().Unix()), "Use given RBF sequence number (-1 or -2 for final)")
@@ -12,6 +12,7 @@ import (
 var (
 	PassSeedFilename = ".secret"
 	RawKeysFilename = ".others"
+	DefaultFee = "0.00001"
 )
 
 var (
@@ -87,8 +88,17 @@ func main() {
 
 	flag.Parse()
 
+	if fee=="" {
+		// fee not specified - try the fee rate estimated by the client
+		if feeSPB = load_feerate(); feeSPB==0 {
+			fee = DefaultFee
+		}
+	}
+
 	// convert string fee to uint64
-	if val, e := btc.StringToSatoshis(fee); e != nil {
+	if feeSPB > 0 {
+		// the fee will be calculated in send_request()
+	} else if val, e := btc.StringToSatoshis(fee); e != nil {
 		println("Incorrect fee value", fee)
 		os.Exit(1)
 	} else {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"fmt"
 	"bufio"
 	"strings"
 	"github.com/piotrnar/gocoin/lib/btc"
@@ -42,10 +43,6 @@ func parse_spend() {
 			println("Incorrect amount: ", tmp[1], er.Error())
 			cleanExit(1)
 		}
-		if *subfee {
-			am -= curFee
-		}
-
 		sendTo = append(sendTo, oneSendTo{addr:a, amount:am})
 		spendBtc += am
 	}
@@ -95,14 +92,46 @@ func parse_batch() {
 	}
 }
 
+// returns fee for a tx spending spendBtc to the given number of outputs, at feeSPB
+func estimate_fee(outcnt int) (fee uint64) {
+	var btcsofar uint64
+	var incnt int
+	for i := range unspentOuts {
+		if unspentOuts[i].key == nil {
+			continue
+		}
+		btcsofar += getUO(&unspentOuts[i].TxPrevOut).Value
+		incnt++
+		// about 148 bytes per input, 34 per output (plus the change) and 10 for the rest
+		fee = uint64(feeSPB * float64(10 + 148*incnt + 34*(outcnt+1)))
+		if !*useallinputs && ( btcsofar >= spendBtc + fee ) {
+			break
+		}
+	}
+	return
+}
+
 // returns true if spend operation has been requested
 func send_request() bool {
-	feeBtc = curFee
 	if *send!="" {
 		parse_spend()
 	}
+	subfeecnt := len(sendTo) // the fee is only substracted from the "-send" outputs
 	if *batch!="" {
 		parse_batch()
 	}
+	if feeSPB > 0 {
+		curFee = estimate_fee(len(sendTo))
+		if len(sendTo)>0 {
+			fmt.Println("Using fee", btc.UintToBtc(curFee), "BTC for", feeSPB, "SPB from balance/feerate.txt")
+		}
+	}
+	feeBtc = curFee
+	if *subfee {
+		for i:=0; i<subfeecnt; i++ {
+			sendTo[i].amount -= curFee
+			spendBtc -= curFee
+		}
+	}
 	return len(sendTo)>0
 }
@@ -142,8 +142,10 @@ func raw_tx_from_file(fn string) *btc.Tx {
 		fmt.Println("Cannot fetch raw transaction data")
 		return nil
 	}
-	tx, txle := btc.NewTx(dat)
-	if tx != nil {
+	tx, txle, er := btc.NewTx(dat)
+	if er != nil {
+		fmt.Println("ERROR: Raw transaction is broken:", er.Error())
+	} else {
 		tx.Hash = btc.NewSha2Hash(dat)
 		if txle != len(dat) {
 			fmt.Println("WARNING: Raw transaction length mismatch", txle, len(dat))
@@ -163,7 +165,7 @@ func tx_from_balance(txid *btc.Uint256, error_is_fatal bool) (tx *btc.Tx) {
 		var th [32]byte
 		btc.ShaHash(buf, th[:])
 		if txid.Hash==th {
-			tx, _ = btc.NewTx(buf)
+			tx, _, _ = btc.NewTx(buf)
 			if error_is_fatal && tx == nil {
 				println("Transaction is corrupt:", txid.String())
 				cleanExit(1)
@@ -100,6 +100,16 @@ func load_balance() error {
 }
 
 
+// returns fee rate (SPB) from balance/feerate.txt or zero if it cannot be read
+func load_feerate() (spb float64) {
+	d, e := ioutil.ReadFile("balance/feerate.txt")
+	if e == nil {
+		spb, _ = strconv.ParseFloat(strings.Trim(string(d), " \n\r\t"), 64)
+	}
+	return
+}
+
+
 func show_balance() {
 	var totBtc, msBtc, knownInputs, unknownInputs, multisigInputs uint64
 	for i := range unspentOuts {
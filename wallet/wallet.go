@@ -18,6 +18,7 @@ var (
 	// set in make_wallet():
 	keys []*btc.PrivateAddr
 	curFee uint64
+	feeSPB float64 // if not zero, curFee is calculated from the estimated tx size
 )
 
 